@@ -0,0 +1,388 @@
+// Package client is a Go client for the forum's JSON API (/api/v1).
+//
+// Authenticate either with a personal API token from the account settings:
+//
+//	c, err := client.New("https://forum.example.com")
+//	c.SetToken("forum_pat_...")
+//
+// or by logging in with an email and password, which keeps a browser-style
+// session:
+//
+//	err = c.Login(ctx, "me@example.com", "secret")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// apiPath is the API prefix the client talks to
+const apiPath = "/api/v1"
+
+// Login errors
+var (
+	ErrLoginFailed         = errors.New("login failed: wrong email or password, or the account is locked")
+	ErrTwoFactorRequired   = errors.New("this account uses two-factor authentication; use an API token instead")
+	errUnexpectedLoginPage = errors.New("login failed: unexpected response from the server")
+)
+
+// Client talks to one forum. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	token     string
+	csrfToken string // CSRF token of the login session
+}
+
+// New creates a client for the forum at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid forum URL %q", baseURL)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{baseURL: u, httpClient: &http.Client{Jar: jar}}, nil
+}
+
+// SetToken authenticates every request with a personal API token
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// SetHTTPClient replaces the HTTP client, e.g. to set a timeout. Its cookie
+// jar, if any, holds the login session.
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// Login logs in with an email and password like the login form does.
+// Accounts with two-factor authentication must use an API token.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	if c.httpClient.Jar == nil {
+		return fmt.Errorf("logging in needs an HTTP client with a cookie jar")
+	}
+
+	// Visiting the form gives the visitor CSRF cookie the login must echo
+	loginURL := c.baseURL.String() + "/login"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, loginURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var csrf string
+	for _, cookie := range c.httpClient.Jar.Cookies(c.baseURL) {
+		if cookie.Name == "csrf_token" {
+			csrf = cookie.Value
+		}
+	}
+	if csrf == "" {
+		return errUnexpectedLoginPage
+	}
+
+	form := url.Values{"email": {email}, "password": {password}, "csrf_token": {csrf}}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, loginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Look at the redirect instead of following it
+	noRedirect := *c.httpClient
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err = noRedirect.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// The form was shown again with an error
+		return ErrLoginFailed
+	case resp.StatusCode != http.StatusSeeOther:
+		return errUnexpectedLoginPage
+	case resp.Header.Get("Location") == "/login/2fa":
+		return ErrTwoFactorRequired
+	}
+
+	// Any authenticated API call hands out the session's CSRF token
+	_, err = c.Me(ctx)
+	return err
+}
+
+// ListPosts lists and searches posts, newest first unless opt.Oldest
+func (c *Client) ListPosts(ctx context.Context, opt ListOptions) (*PostList, error) {
+	query := pageQuery(opt.Page, opt.PerPage)
+	if opt.Query != "" {
+		query.Set("q", opt.Query)
+	}
+	if opt.Category != "" {
+		query.Set("category", opt.Category)
+	}
+	if opt.AuthorID > 0 {
+		query.Set("author", strconv.FormatInt(opt.AuthorID, 10))
+	}
+	if opt.Oldest {
+		query.Set("order", "oldest")
+	}
+
+	var list PostList
+	if err := c.do(ctx, http.MethodGet, "/posts", query, nil, &list.Posts, &list.Page); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetPost returns a post
+func (c *Client) GetPost(ctx context.Context, id int64) (*Post, error) {
+	var post Post
+	if err := c.do(ctx, http.MethodGet, postPath(id), nil, nil, &post, nil); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// CreatePost creates a post and returns it
+func (c *Client) CreatePost(ctx context.Context, p NewPost) (*Post, error) {
+	var post Post
+	if err := c.do(ctx, http.MethodPost, "/posts", nil, p, &post, nil); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// UpdatePost edits one of your posts and returns it
+func (c *Client) UpdatePost(ctx context.Context, id int64, update PostUpdate) (*Post, error) {
+	var post Post
+	if err := c.do(ctx, http.MethodPatch, postPath(id), nil, update, &post, nil); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// DeletePost deletes one of your posts
+func (c *Client) DeletePost(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, postPath(id), nil, nil, nil, nil)
+}
+
+// ReactToPost likes or dislikes a post, or removes your reaction with NoReaction
+func (c *Client) ReactToPost(ctx context.Context, id int64, reaction Reaction) (*Post, error) {
+	var post Post
+	if err := c.do(ctx, http.MethodPut, postPath(id)+"/reaction", nil, reactionBody(reaction), &post, nil); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// ListComments returns one page of a post's comments, oldest first
+func (c *Client) ListComments(ctx context.Context, postID int64, page, perPage int) (*CommentList, error) {
+	var list CommentList
+	if err := c.do(ctx, http.MethodGet, postPath(postID)+"/comments", pageQuery(page, perPage), nil, &list.Comments, &list.Page); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetComment returns a comment
+func (c *Client) GetComment(ctx context.Context, id int64) (*Comment, error) {
+	var comment Comment
+	if err := c.do(ctx, http.MethodGet, commentPath(id), nil, nil, &comment, nil); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// CreateComment comments on a post and returns the comment
+func (c *Client) CreateComment(ctx context.Context, postID int64, content string) (*Comment, error) {
+	var comment Comment
+	if err := c.do(ctx, http.MethodPost, postPath(postID)+"/comments", nil, commentBody{content}, &comment, nil); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// UpdateComment edits one of your comments and returns it
+func (c *Client) UpdateComment(ctx context.Context, id int64, content string) (*Comment, error) {
+	var comment Comment
+	if err := c.do(ctx, http.MethodPatch, commentPath(id), nil, commentBody{content}, &comment, nil); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// DeleteComment deletes one of your comments
+func (c *Client) DeleteComment(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, commentPath(id), nil, nil, nil, nil)
+}
+
+// ReactToComment likes or dislikes a comment, or removes your reaction with NoReaction
+func (c *Client) ReactToComment(ctx context.Context, id int64, reaction Reaction) (*Comment, error) {
+	var comment Comment
+	if err := c.do(ctx, http.MethodPut, commentPath(id)+"/reaction", nil, reactionBody(reaction), &comment, nil); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// Categories lists all categories
+func (c *Client) Categories(ctx context.Context) ([]Category, error) {
+	var categories []Category
+	if err := c.do(ctx, http.MethodGet, "/categories", nil, nil, &categories, nil); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// User returns a user's public profile
+func (c *Client) User(ctx context.Context, id int64) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodGet, "/users/"+strconv.FormatInt(id, 10), nil, nil, &user, nil); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Me returns the authenticated user's account
+func (c *Client) Me(ctx context.Context) (*Account, error) {
+	var account Account
+	if err := c.do(ctx, http.MethodGet, "/me", nil, nil, &account, nil); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+type commentBody struct {
+	Content string `json:"content"`
+}
+
+type reactionRequest struct {
+	Reaction Reaction `json:"reaction"`
+}
+
+func reactionBody(r Reaction) reactionRequest {
+	return reactionRequest{Reaction: r}
+}
+
+func postPath(id int64) string {
+	return "/posts/" + strconv.FormatInt(id, 10)
+}
+
+func commentPath(id int64) string {
+	return "/comments/" + strconv.FormatInt(id, 10)
+}
+
+func pageQuery(page, perPage int) url.Values {
+	query := url.Values{}
+	if page > 0 {
+		query.Set("page", strconv.Itoa(page))
+	}
+	if perPage > 0 {
+		query.Set("per_page", strconv.Itoa(perPage))
+	}
+	return query
+}
+
+// do sends an API request. The response's data is decoded into data and, for
+// lists, its pagination into meta.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, data any, meta *Page) error {
+	u := c.baseURL.String() + apiPath + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	c.mu.Lock()
+	token, csrf := c.token, c.csrfToken
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if csrf != "" && method != http.MethodGet {
+		req.Header.Set("X-CSRF-Token", csrf)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if csrf := resp.Header.Get("X-CSRF-Token"); csrf != "" {
+		c.mu.Lock()
+		c.csrfToken = csrf
+		c.mu.Unlock()
+	}
+
+	if resp.StatusCode >= 400 {
+		return decodeError(resp)
+	}
+	if resp.StatusCode == http.StatusNoContent || data == nil {
+		return nil
+	}
+
+	envelope := struct {
+		Data any   `json:"data"`
+		Meta *Page `json:"meta"`
+	}{Data: data, Meta: meta}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("forum API: invalid response: %w", err)
+	}
+	return nil
+}
+
+// decodeError reads the API's error envelope, falling back to the HTTP status
+// for errors from outside the API such as a proxy
+func decodeError(resp *http.Response) error {
+	var envelope struct {
+		Error *Error `json:"error"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(raw, &envelope) == nil && envelope.Error != nil {
+		return envelope.Error
+	}
+	return &Error{
+		Status:  resp.StatusCode,
+		Code:    "http_error",
+		Message: http.StatusText(resp.StatusCode),
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// Author is the user who wrote a post or comment
+type Author struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// Post mirrors features.PostWithDetails as the API returns it
+type Post struct {
+	ID         int64      `json:"id"`
+	Title      string     `json:"title"`
+	Content    string     `json:"content"`
+	Categories []string   `json:"categories"`
+	Author     Author     `json:"author"`
+	Likes      int        `json:"likes"`
+	Dislikes   int        `json:"dislikes"`
+	Comments   int        `json:"comments"`
+	MyReaction Reaction   `json:"my_reaction,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"` // nil if never edited
+}
+
+// Comment mirrors features.CommentWithDetails as the API returns it
+type Comment struct {
+	ID         int64      `json:"id"`
+	PostID     int64      `json:"post_id"`
+	Content    string     `json:"content"`
+	Author     Author     `json:"author"`
+	Likes      int        `json:"likes"`
+	Dislikes   int        `json:"dislikes"`
+	MyReaction Reaction   `json:"my_reaction,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"` // nil if never edited
+}
+
+// Category is a post category
+type Category struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// User is a user's public profile
+type User struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Posts     int       `json:"posts"`
+	Comments  int       `json:"comments"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Account is the authenticated user's own account
+type Account struct {
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+}
+
+// Page describes where a list page sits in the full result
+type Page struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// PostList is one page of posts
+type PostList struct {
+	Posts []Post `json:"posts"`
+	Page  Page   `json:"page"`
+}
+
+// CommentList is one page of comments
+type CommentList struct {
+	Comments []Comment `json:"comments"`
+	Page     Page      `json:"page"`
+}
+
+// Reaction is a like or dislike; NoReaction removes it
+type Reaction string
+
+// Reactions
+const (
+	Like       Reaction = "like"
+	Dislike    Reaction = "dislike"
+	NoReaction Reaction = "none"
+)
+
+// ParseReaction reads "like", "dislike" or "none"
+func ParseReaction(s string) (Reaction, error) {
+	switch r := Reaction(s); r {
+	case Like, Dislike, NoReaction:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown reaction %q, use like, dislike or none", s)
+}
+
+// ListOptions filters and pages a post listing. Zero values use the server defaults.
+type ListOptions struct {
+	Page     int
+	PerPage  int
+	Query    string // Search titles and content
+	Category string
+	AuthorID int64
+	Oldest   bool // Oldest first instead of newest first
+}
+
+// NewPost is a post to create
+type NewPost struct {
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// PostUpdate edits a post. Nil fields keep their value.
+type PostUpdate struct {
+	Title      *string   `json:"title,omitempty"`
+	Content    *string   `json:"content,omitempty"`
+	Categories *[]string `json:"categories,omitempty"`
+}
+
+// Error is an error answered by the API
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"` // e.g. "not_found", "forbidden", "insufficient_scope"
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("forum API: %s (%d %s)", e.Message, e.Status, e.Code)
+}
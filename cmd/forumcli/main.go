@@ -0,0 +1,405 @@
+// Command forumcli reads and writes the forum from a terminal through its JSON API.
+//
+// Usage:
+//
+//	forumcli [-server URL] [-token TOKEN] [-json] <command> [arguments]
+//
+// Authenticate with a personal API token (-token or FORUM_TOKEN), or with
+// FORUM_EMAIL and FORUM_PASSWORD. Reading works without either.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"forum/client"
+)
+
+const usage = `Usage: forumcli [flags] <command> [arguments]
+
+Commands:
+  posts [-q text] [-category name] [-author id] [-page n] [-per-page n] [-oldest]
+                                     List posts
+  search <text>                      Search posts
+  show <post-id> [-page n]           Show a post and its comments
+  post -title title [-categories a,b] <content | ->
+                                     Create a post; "-" reads the content from stdin
+  comment <post-id> <content | ->    Comment on a post
+  react post|comment <id> like|dislike|none
+                                     React to a post or comment
+  delete post|comment <id>           Delete your post or comment
+  categories                         List categories
+  user <id>                          Show a user's profile
+  me                                 Show your account
+
+Flags:
+`
+
+// cli holds the global settings of one run
+type cli struct {
+	client *client.Client
+	json   bool
+	out    io.Writer
+	in     io.Reader
+}
+
+func main() {
+	flags := flag.NewFlagSet("forumcli", flag.ExitOnError)
+	server := flags.String("server", envOrDefault("FORUM_URL", "http://localhost:8080"), "forum URL (FORUM_URL)")
+	token := flags.String("token", os.Getenv("FORUM_TOKEN"), "personal API token (FORUM_TOKEN)")
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	timeout := flags.Duration("timeout", 30*time.Second, "request timeout")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c, err := client.New(*server)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if *token != "" {
+		c.SetToken(*token)
+	} else if email := os.Getenv("FORUM_EMAIL"); email != "" {
+		if err := c.Login(ctx, email, os.Getenv("FORUM_PASSWORD")); err != nil {
+			fatal(err)
+		}
+	}
+
+	app := &cli{client: c, json: *asJSON, out: os.Stdout, in: os.Stdin}
+	if err := app.run(ctx, flags.Arg(0), flags.Args()[1:]); err != nil {
+		fatal(err)
+	}
+}
+
+// run executes one command
+func (app *cli) run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "posts":
+		return app.posts(ctx, args)
+	case "search":
+		if len(args) == 0 {
+			return errors.New("usage: search <text>")
+		}
+		return app.posts(ctx, []string{"-q", strings.Join(args, " ")})
+	case "show":
+		return app.show(ctx, args)
+	case "post":
+		return app.post(ctx, args)
+	case "comment":
+		return app.comment(ctx, args)
+	case "react":
+		return app.react(ctx, args)
+	case "delete":
+		return app.delete(ctx, args)
+	case "categories":
+		categories, err := app.client.Categories(ctx)
+		if err != nil {
+			return err
+		}
+		if app.json {
+			return app.printJSON(categories)
+		}
+		for _, category := range categories {
+			fmt.Fprintln(app.out, category.Name)
+		}
+		return nil
+	case "user":
+		if len(args) != 1 {
+			return errors.New("usage: user <id>")
+		}
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		user, err := app.client.User(ctx, id)
+		if err != nil {
+			return err
+		}
+		if app.json {
+			return app.printJSON(user)
+		}
+		fmt.Fprintf(app.out, "%s (#%d), joined %s: %d posts, %d comments\n",
+			user.Username, user.ID, user.CreatedAt.Format("Jan 2, 2006"), user.Posts, user.Comments)
+		return nil
+	case "me":
+		account, err := app.client.Me(ctx)
+		if err != nil {
+			return err
+		}
+		if app.json {
+			return app.printJSON(account)
+		}
+		fmt.Fprintf(app.out, "%s (#%d) <%s>, role %s\n", account.Username, account.ID, account.Email, account.Role)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, run forumcli -h for help", command)
+}
+
+func (app *cli) posts(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("posts", flag.ContinueOnError)
+	var opt client.ListOptions
+	flags.StringVar(&opt.Query, "q", "", "search titles and content")
+	flags.StringVar(&opt.Category, "category", "", "only this category")
+	flags.Int64Var(&opt.AuthorID, "author", 0, "only posts by this user id")
+	flags.IntVar(&opt.Page, "page", 1, "page number")
+	flags.IntVar(&opt.PerPage, "per-page", 20, "posts per page")
+	flags.BoolVar(&opt.Oldest, "oldest", false, "oldest first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	list, err := app.client.ListPosts(ctx, opt)
+	if err != nil {
+		return err
+	}
+	if app.json {
+		return app.printJSON(list)
+	}
+
+	tw := tabwriter.NewWriter(app.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tAUTHOR\tLIKES\tDISLIKES\tCOMMENTS\tCREATED")
+	for _, p := range list.Posts {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			p.ID, p.Title, p.Author.Username, p.Likes, p.Dislikes, p.Comments, p.CreatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	tw.Flush()
+	fmt.Fprintf(app.out, "page %d of %d, %d posts\n", list.Page.Page, max(list.Page.TotalPages, 1), list.Page.Total)
+	return nil
+}
+
+func (app *cli) show(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: show <post-id> [-page n]")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	page := flags.Int("page", 1, "page of comments")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	post, err := app.client.GetPost(ctx, id)
+	if err != nil {
+		return err
+	}
+	comments, err := app.client.ListComments(ctx, id, *page, 0)
+	if err != nil {
+		return err
+	}
+	if app.json {
+		return app.printJSON(struct {
+			Post     *client.Post        `json:"post"`
+			Comments *client.CommentList `json:"comments"`
+		}{post, comments})
+	}
+
+	fmt.Fprintf(app.out, "#%d %s\n", post.ID, post.Title)
+	fmt.Fprintf(app.out, "by %s on %s", post.Author.Username, post.CreatedAt.Local().Format("2006-01-02 15:04"))
+	if len(post.Categories) > 0 {
+		fmt.Fprintf(app.out, " in %s", strings.Join(post.Categories, ", "))
+	}
+	fmt.Fprintf(app.out, " | %d likes, %d dislikes%s\n\n%s\n", post.Likes, post.Dislikes, reactionNote(post.MyReaction), post.Content)
+
+	if comments.Page.Total > 0 {
+		fmt.Fprintf(app.out, "\n%d comments (page %d of %d)\n", comments.Page.Total, comments.Page.Page, comments.Page.TotalPages)
+	}
+	for _, comment := range comments.Comments {
+		fmt.Fprintf(app.out, "\n  [%d] %s, %s | %d likes, %d dislikes%s\n  %s\n",
+			comment.ID, comment.Author.Username, comment.CreatedAt.Local().Format("2006-01-02 15:04"),
+			comment.Likes, comment.Dislikes, reactionNote(comment.MyReaction),
+			strings.ReplaceAll(comment.Content, "\n", "\n  "))
+	}
+	return nil
+}
+
+func (app *cli) post(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("post", flag.ContinueOnError)
+	title := flags.String("title", "", "post title")
+	categories := flags.String("categories", "", "comma-separated categories")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *title == "" || flags.NArg() == 0 {
+		return errors.New("usage: post -title title [-categories a,b] <content | ->")
+	}
+	content, err := app.content(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	newPost := client.NewPost{Title: *title, Content: content}
+	for _, category := range strings.Split(*categories, ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			newPost.Categories = append(newPost.Categories, category)
+		}
+	}
+
+	post, err := app.client.CreatePost(ctx, newPost)
+	if err != nil {
+		return err
+	}
+	if app.json {
+		return app.printJSON(post)
+	}
+	fmt.Fprintf(app.out, "Created post #%d\n", post.ID)
+	return nil
+}
+
+func (app *cli) comment(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: comment <post-id> <content | ->")
+	}
+	postID, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	content, err := app.content(args[1:])
+	if err != nil {
+		return err
+	}
+
+	comment, err := app.client.CreateComment(ctx, postID, content)
+	if err != nil {
+		return err
+	}
+	if app.json {
+		return app.printJSON(comment)
+	}
+	fmt.Fprintf(app.out, "Created comment #%d on post #%d\n", comment.ID, comment.PostID)
+	return nil
+}
+
+func (app *cli) react(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: react post|comment <id> like|dislike|none")
+	}
+	id, err := parseID(args[1])
+	if err != nil {
+		return err
+	}
+	reaction, err := client.ParseReaction(args[2])
+	if err != nil {
+		return err
+	}
+
+	var result any
+	var likes, dislikes int
+	switch args[0] {
+	case "post":
+		post, err := app.client.ReactToPost(ctx, id, reaction)
+		if err != nil {
+			return err
+		}
+		result, likes, dislikes = post, post.Likes, post.Dislikes
+	case "comment":
+		comment, err := app.client.ReactToComment(ctx, id, reaction)
+		if err != nil {
+			return err
+		}
+		result, likes, dislikes = comment, comment.Likes, comment.Dislikes
+	default:
+		return errors.New("usage: react post|comment <id> like|dislike|none")
+	}
+
+	if app.json {
+		return app.printJSON(result)
+	}
+	fmt.Fprintf(app.out, "%s #%d now has %d likes and %d dislikes\n", args[0], id, likes, dislikes)
+	return nil
+}
+
+func (app *cli) delete(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: delete post|comment <id>")
+	}
+	id, err := parseID(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "post":
+		err = app.client.DeletePost(ctx, id)
+	case "comment":
+		err = app.client.DeleteComment(ctx, id)
+	default:
+		return errors.New("usage: delete post|comment <id>")
+	}
+	if err != nil {
+		return err
+	}
+	if !app.json {
+		fmt.Fprintf(app.out, "Deleted %s #%d\n", args[0], id)
+	}
+	return nil
+}
+
+// content joins the arguments, or reads stdin for "-"
+func (app *cli) content(args []string) (string, error) {
+	if len(args) == 1 && args[0] == "-" {
+		raw, err := io.ReadAll(app.in)
+		if err != nil {
+			return "", err
+		}
+		return string(raw), nil
+	}
+	return strings.Join(args, " "), nil
+}
+
+func (app *cli) printJSON(v any) error {
+	encoder := json.NewEncoder(app.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func reactionNote(r client.Reaction) string {
+	switch r {
+	case client.Like:
+		return " (you liked this)"
+	case client.Dislike:
+		return " (you disliked this)"
+	}
+	return ""
+}
+
+func parseID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid id %q", s)
+	}
+	return id, nil
+}
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "forumcli:", err)
+	os.Exit(1)
+}
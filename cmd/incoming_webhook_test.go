@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/auth"
+	"forum/internal/database"
+	"forum/internal/webhooks"
+)
+
+// createIncomingWebhook adds an incoming webhook that posts to General and
+// returns it with its token
+func createIncomingWebhook(t *testing.T, db *database.DB, rateLimit int) (*webhooks.IncomingWebhook, string) {
+	t.Helper()
+	adminID := createUser(t, db, "admin")
+	botID, err := auth.NewAuthService(db.DB).BotUser("ci-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var categoryID int64
+	if err := db.QueryRow("SELECT id FROM categories WHERE name = 'General'").Scan(&categoryID); err != nil {
+		t.Fatal(err)
+	}
+	hook, token, err := webhooks.NewIncomingService(db.DB).CreateIncoming(context.Background(), "CI", botID, categoryID, rateLimit, adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook, token
+}
+
+// incomingResponse is the JSON an incoming webhook answers with
+type incomingResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	PostID    int64  `json:"post_id"`
+	CommentID int64  `json:"comment_id"`
+}
+
+// postIncoming sends a message to an incoming webhook
+func postIncoming(t *testing.T, serverURL, token, body string) (*http.Response, incomingResponse) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, serverURL+webhooks.IncomingPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result incomingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("response is not JSON: %v", err)
+	}
+	return resp, result
+}
+
+func TestIncomingWebhookMessages(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	_, token := createIncomingWebhook(t, db, 100)
+
+	resp, first := postIncoming(t, serverURL, token, `{"title": "Build #1 failed", "content": "Details", "key": "build-1"}`)
+	if resp.StatusCode != http.StatusOK || !first.OK || first.PostID == 0 || first.CommentID != 0 {
+		t.Fatalf("first message = %d %+v, want a post", resp.StatusCode, first)
+	}
+	resp, second := postIncoming(t, serverURL, token, `{"content": "Fixed", "key": "build-1"}`)
+	if resp.StatusCode != http.StatusOK || second.PostID != first.PostID || second.CommentID == 0 {
+		t.Fatalf("message with the same key = %d %+v, want a comment on post %d", resp.StatusCode, second, first.PostID)
+	}
+
+	var posts, comments int
+	db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&posts)
+	db.QueryRow("SELECT COUNT(*) FROM comments WHERE post_id = ?", first.PostID).Scan(&comments)
+	if posts != 1 || comments != 1 {
+		t.Errorf("%d posts and %d comments, want 1 of each", posts, comments)
+	}
+
+	resp, result := postIncoming(t, serverURL, token, `{"content": "A new key needs a title", "key": "build-2"}`)
+	if resp.StatusCode != http.StatusBadRequest || result.OK || result.Error == "" {
+		t.Errorf("message without a title = %d %+v, want 400", resp.StatusCode, result)
+	}
+	resp, result = postIncoming(t, serverURL, "forum_whin_not-a-token", `{"title": "T", "content": "C"}`)
+	if resp.StatusCode != http.StatusUnauthorized || result.OK {
+		t.Errorf("message with a wrong token = %d %+v, want 401", resp.StatusCode, result)
+	}
+}
+
+func TestIncomingWebhookTokenRotation(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	hook, oldToken := createIncomingWebhook(t, db, 100)
+
+	newToken, err := webhooks.NewIncomingService(db.DB).RotateIncoming(context.Background(), hook.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if resp, result := postIncoming(t, serverURL, token, `{"title": "T", "content": "C"}`); resp.StatusCode != http.StatusOK {
+			t.Errorf("message during the grace period = %d %+v", resp.StatusCode, result)
+		}
+	}
+
+	if _, err := db.Exec("UPDATE incoming_webhooks SET previous_expires_at = ?", time.Now().UTC().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, result := postIncoming(t, serverURL, oldToken, `{"title": "T", "content": "C"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("message with the old token after the grace period = %d %+v, want 401", resp.StatusCode, result)
+	}
+	if resp, result := postIncoming(t, serverURL, newToken, `{"title": "T", "content": "C"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("message with the new token = %d %+v", resp.StatusCode, result)
+	}
+}
+
+func TestIncomingWebhookRateLimit(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	_, token := createIncomingWebhook(t, db, 2)
+
+	for i := 1; i <= 2; i++ {
+		if resp, result := postIncoming(t, serverURL, token, `{"title": "T", "content": "C"}`); resp.StatusCode != http.StatusOK {
+			t.Fatalf("message %d = %d %+v", i, resp.StatusCode, result)
+		}
+	}
+
+	resp, result := postIncoming(t, serverURL, token, `{"title": "T", "content": "C"}`)
+	if resp.StatusCode != http.StatusTooManyRequests || result.OK || result.Error == "" {
+		t.Fatalf("message over the limit = %d %+v, want 429", resp.StatusCode, result)
+	}
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 3600 {
+		t.Errorf("Retry-After = %q, want 1 to 3600 seconds", resp.Header.Get("Retry-After"))
+	}
+
+	var posts int
+	db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&posts)
+	if posts != 2 {
+		t.Errorf("%d posts were created, want 2", posts)
+	}
+}
@@ -1,15 +1,30 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"forum/internal/attachments"
 	"forum/internal/auth"
+	"forum/internal/avatars"
 	"forum/internal/database"
+	"forum/internal/digest"
+	"forum/internal/events"
+	"forum/internal/features"
+	"forum/internal/feeds"
 	"forum/internal/handlers"
+	"forum/internal/mailer"
+	"forum/internal/oidc"
+	"forum/internal/storage"
+	"forum/internal/webhooks"
 )
 
 func main() {
@@ -25,8 +40,44 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
+	srv := newServer(db)
+	for _, job := range srv.jobs {
+		go job()
+	}
+
+	// Start server
+	log.Println("Server starting on :8080")
+	log.Fatal(http.ListenAndServe(":8080", srv.handler))
+}
+
+// server is the forum's HTTP handler and the jobs that run beside it
+type server struct {
+	handler http.Handler
+	jobs    []func()
+}
+
+// newServer sets up the services and routes on an initialized database,
+// configured from the environment. The jobs are not started.
+func newServer(db *database.DB) *server {
+	var jobs []func()
+
 	// Create template functions for better date formatting
 	funcMap := template.FuncMap{
+		"csrfField": auth.CSRFField,
+		// Unread count for the notification bell in the navigation bar
+		"unreadNotifications": func(userID int64) int {
+			count, err := features.CountUnreadNotifications(context.Background(), db.DB, userID)
+			if err != nil {
+				log.Printf("Failed to count notifications: %v", err)
+			}
+			return count
+		},
+		// Link to a user's public profile; usernames may contain characters such as / or ?
+		"profileURL": func(username string) string {
+			return "/user/" + url.PathEscape(username)
+		},
+		// Uploaded avatar or identicon of a user, at least size pixels wide
+		"avatarURL": avatars.URL,
 		"formatDate": func(t time.Time) string {
 			return t.Format("Jan 2, 2006 at 3:04 PM")
 		},
@@ -50,52 +101,368 @@ func main() {
 
 	// Load HTML templates with custom functions
 	templates := template.New("").Funcs(funcMap)
-	templates, err = templates.ParseFiles(
+	templates, err := templates.ParseFiles(
 		"web/templates/layout.html",
 		"web/templates/index.html",
 		"web/templates/login.html",
+		"web/templates/login_2fa.html",
+		"web/templates/login_oidc_username.html",
+		"web/templates/login_proxy.html",
 		"web/templates/register.html",
+		"web/templates/forgot_password.html",
+		"web/templates/reset_password.html",
+		"web/templates/verify_email.html",
 		"web/templates/create_post.html",
 		"web/templates/post_detail.html",
 		"web/templates/error.html",
+		"web/templates/admin_lockouts.html",
+		"web/templates/admin_users.html",
+		"web/templates/admin_security.html",
+		"web/templates/admin_webhooks.html",
+		"web/templates/admin_webhook.html",
+		"web/templates/admin_incoming_webhook.html",
+		"web/templates/settings_account.html",
+		"web/templates/settings_devices.html",
+		"web/templates/settings_2fa.html",
+		"web/templates/settings_passkeys.html",
+		"web/templates/settings_tokens.html",
+		"web/templates/settings_reauthenticate.html",
+		"web/templates/notifications.html",
+		"web/templates/user_profile.html",
+		"web/templates/digest_unsubscribe.html",
 	)
 	if err != nil {
 		log.Fatal("Failed to load templates:", err)
 	}
 
+	// Initialize mailer
+	mail, err := newMailer()
+	if err != nil {
+		log.Fatal("Failed to configure mailer:", err)
+	}
+
 	// Initialize services
 	authService := auth.NewAuthService(db.DB)
+	authService.SetMailer(mail)
+	if baseURL := os.Getenv("FORUM_BASE_URL"); baseURL != "" {
+		authService.SetBaseURL(baseURL)
+	}
+	providers, err := newOIDCProviders(authService.BaseURL() + "/login/oidc/callback")
+	if err != nil {
+		log.Fatal("Failed to configure login providers:", err)
+	}
+	authService.SetOIDCProviders(providers)
+	if required, ok := os.LookupEnv("FORUM_VERIFY_REQUIRED_FOR"); ok {
+		// Comma-separated actions (post, comment, react) that need a verified email
+		policy := auth.DefaultVerificationPolicy()
+		policy.RequiredFor = nil
+		for _, action := range strings.Split(required, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				policy.RequiredFor = append(policy.RequiredFor, action)
+			}
+		}
+		authService.SetVerificationPolicy(policy)
+	}
 	sessionService := auth.NewSessionService(db.DB)
+	sessionService.SetMailer(mail)
 	authMiddleware := auth.NewMiddleware(sessionService)
 
+	// Reverse proxies whose X-Forwarded-For is believed for login lockouts,
+	// rate limits and session details (comma-separated CIDRs)
+	trustedProxies, err := auth.ParseTrustedProxies(os.Getenv("FORUM_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Failed to configure trusted proxies:", err)
+	}
+
+	// Optionally trust an authenticating reverse proxy (comma-separated CIDRs)
+	var proxyAuth *auth.ProxyAuth
+	if trusted := os.Getenv("FORUM_PROXY_AUTH_TRUSTED"); trusted != "" {
+		networks, err := auth.ParseTrustedProxies(trusted)
+		if err != nil {
+			log.Fatal("Failed to configure proxy authentication:", err)
+		}
+		trustedProxies = append(trustedProxies, networks...)
+		proxyAuth, err = auth.NewProxyAuth(db.DB, auth.ProxyAuthConfig{
+			UserHeader:     envOrDefault("FORUM_PROXY_AUTH_USER_HEADER", "X-Forwarded-User"),
+			EmailHeader:    envOrDefault("FORUM_PROXY_AUTH_EMAIL_HEADER", "X-Forwarded-Email"),
+			TrustedProxies: networks,
+		})
+		if err != nil {
+			log.Fatal("Failed to configure proxy authentication:", err)
+		}
+		authMiddleware.SetProxyAuth(proxyAuth)
+		log.Printf("Proxy authentication enabled for %s", trusted)
+	}
+	auth.SetTrustedProxies(trustedProxies)
+
+	// Promote the configured administrators (comma-separated emails)
+	for _, email := range strings.Split(os.Getenv("FORUM_ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email == "" {
+			continue
+		}
+		if err := authService.GrantAdmin(email); err != nil {
+			log.Printf("Could not grant admin role to %s: %v", email, err)
+		}
+	}
+
+	// Webhooks are delivered in the background, with retries, from a queue
+	// stored in the database
+	webhookService := webhooks.NewService(db.DB)
+	webhookService.SetBaseURL(authService.BaseURL())
+	authService.SetRegistrationHook(webhookService.UserRegistered)
+	if proxyAuth != nil {
+		proxyAuth.SetRegistrationHook(webhookService.UserRegistered)
+	}
+	jobs = append(jobs, webhookService.Run)
+
+	// Incoming webhooks let external systems post as a bot account
+	incomingService := webhooks.NewIncomingService(db.DB)
+	incomingService.SetBaseURL(authService.BaseURL())
+
+	// Email digests are sent in the background to members who opted in
+	digests, err := digest.NewService(db.DB, mail, "web/templates/email/digest.html", "web/templates/email/digest.txt")
+	if err != nil {
+		log.Fatal("Failed to configure email digests:", err)
+	}
+	digests.SetBaseURL(authService.BaseURL())
+	digestInterval, err := time.ParseDuration(envOrDefault("FORUM_DIGEST_CHECK_INTERVAL", "1h"))
+	if err != nil || digestInterval <= 0 {
+		log.Fatal("FORUM_DIGEST_CHECK_INTERVAL must be a positive duration such as 30m")
+	}
+	jobs = append(jobs, func() {
+		for range time.Tick(digestInterval) {
+			if err := digests.SendDue(context.Background()); err != nil {
+				log.Printf("Sending digests failed: %v", err)
+			}
+		}
+	})
+
+	// Files attached to posts and comments are kept on disk in FORUM_UPLOAD_DIR
+	uploadStore, err := storage.NewDiskStore(envOrDefault("FORUM_UPLOAD_DIR", "uploads"))
+	if err != nil {
+		log.Fatal("Failed to configure uploads:", err)
+	}
+	uploads := attachments.NewService(db.DB, uploadStore)
+	maxUploadMB, err := strconv.Atoi(envOrDefault("FORUM_UPLOAD_MAX_MB", strconv.Itoa(attachments.DefaultMaxSize>>20)))
+	if err != nil || maxUploadMB < 1 {
+		log.Fatal("FORUM_UPLOAD_MAX_MB must be a positive number")
+	}
+	maxUploadFiles, err := strconv.Atoi(envOrDefault("FORUM_UPLOAD_MAX_FILES", strconv.Itoa(attachments.DefaultMaxFiles)))
+	if err != nil || maxUploadFiles < 0 {
+		log.Fatal("FORUM_UPLOAD_MAX_FILES must be zero or a positive number")
+	}
+	uploads.SetLimits(int64(maxUploadMB)<<20, maxUploadFiles)
+	avatarService := avatars.NewService(db.DB, uploadStore)
+
+	// Live updates keep the last 100 events of every topic for reconnecting
+	// browsers and cap the open streams per IP address
+	maxStreams, err := strconv.Atoi(envOrDefault("FORUM_LIVE_MAX_STREAMS_PER_IP", "10"))
+	if err != nil || maxStreams < 1 {
+		log.Fatal("FORUM_LIVE_MAX_STREAMS_PER_IP must be a positive number")
+	}
+	broker := events.NewBroker(100, maxStreams)
+
+	// Periodically remove expired sessions, stale login attempts, spent tokens
+	// old read notifications, finished webhook deliveries and files no post
+	// or comment uses any more
+	jobs = append(jobs, func() {
+		for range time.Tick(time.Hour) {
+			if err := db.CleanExpiredSessions(); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanOldLoginAttempts(24 * time.Hour); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanPasswordResets(); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanEmailVerifications(); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanLoginChallenges(24 * time.Hour); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanPasskeyChallenges(); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanOAuthStates(); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanNotifications(90 * 24 * time.Hour); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if err := db.CleanWebhookDeliveries(30 * 24 * time.Hour); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if _, err := uploads.Cleanup(context.Background()); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			if _, err := avatarService.Cleanup(context.Background()); err != nil {
+				log.Printf("Cleanup failed: %v", err)
+			}
+			broker.Prune(time.Hour)
+		}
+	})
+
 	// Initialize error handler
 	errorLogger := log.New(log.Writer(), "[ERROR] ", log.LstdFlags|log.Lshortfile)
 	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+	csrfProtection := auth.NewCSRFProtection(sessionService, errorHandler)
+	csrfProtection.Exempt("/digest/unsubscribe") // Signed link, also posted by mail clients
+	csrfProtection.Exempt(webhooks.IncomingPath) // Authenticated by the hook's token
+	twoFactor := auth.NewTwoFactorEnforcement(authService, authMiddleware)
 
 	// Initialize handlers
 	authHandlers := handlers.NewAuthHandlers(authService, sessionService, templates)
-	forumHandlers := handlers.NewForumHandlers(db.DB, authService, sessionService, templates)
+	forumHandlers := handlers.NewForumHandlers(db.DB, authService, sessionService, templates, broker, webhookService, uploads)
 	filterHandlers := handlers.NewFilterHandlers(db.DB, sessionService, templates)
+	adminHandlers := handlers.NewAdminHandlers(db.DB, authService, webhookService, incomingService, templates)
+	incomingHandlers := handlers.NewIncomingWebhookHandlers(db.DB, incomingService, broker, webhookService)
+	feedService := feeds.NewService(db.DB)
+	feedService.SetBaseURL(authService.BaseURL())
+	feedHandlers := handlers.NewFeedHandlers(feedService, templates)
+	attachmentHandlers := handlers.NewAttachmentHandlers(uploads, templates)
+	avatarHandlers := handlers.NewAvatarHandlers(avatarService, templates)
+	settingsHandlers := handlers.NewSettingsHandlers(authService, sessionService, templates, avatarService)
+	profileHandlers := handlers.NewProfileHandlers(db.DB, authService, templates)
+	liveHandlers := handlers.NewLiveHandlers(broker)
+	notificationHandlers := handlers.NewNotificationHandlers(db.DB, authService, digests, templates)
 
 	// Create a custom mux to handle 404 errors
 	mux := http.NewServeMux()
 
 	// Routes
-	mux.HandleFunc("/", authMiddleware.OptionalAuth(forumHandlers.HomeHandler))
-	mux.HandleFunc("/login", authHandlers.LoginHandler)
-	mux.HandleFunc("/register", authHandlers.RegisterHandler)
+	mux.HandleFunc("/", authMiddleware.OptionalAuthOrToken(auth.ScopeRead, forumHandlers.HomeHandler))
+	singleSignOn := authMiddleware.OptionalAuth(authHandlers.SingleSignOnHandler)
+	if proxyAuth != nil {
+		// The proxy logs users in, so the local login forms are turned off
+		for _, path := range []string{
+			"/login", "/login/2fa", "/login/passkey/begin", "/login/passkey/finish",
+			"/login/oidc", "/login/oidc/callback", "/login/oidc/username",
+			"/register", "/forgot-password", "/reset-password",
+		} {
+			mux.HandleFunc(path, singleSignOn)
+		}
+	} else {
+		mux.HandleFunc("/login", authHandlers.LoginHandler)
+		mux.HandleFunc("/login/2fa", authHandlers.LoginTwoFactorHandler)
+		mux.HandleFunc("/login/passkey/begin", authHandlers.PasskeyLoginBeginHandler)
+		mux.HandleFunc("/login/passkey/finish", authHandlers.PasskeyLoginFinishHandler)
+		mux.HandleFunc("/login/oidc", authHandlers.OIDCLoginHandler)
+		mux.HandleFunc("/login/oidc/callback", authHandlers.OIDCCallbackHandler)
+		mux.HandleFunc("/login/oidc/username", authHandlers.OIDCUsernameHandler)
+		mux.HandleFunc("/register", authHandlers.RegisterHandler)
+		mux.HandleFunc("/forgot-password", authHandlers.ForgotPasswordHandler)
+		mux.HandleFunc("/reset-password", authHandlers.ResetPasswordHandler)
+	}
 	mux.HandleFunc("/logout", authHandlers.LogoutHandler)
+	mux.HandleFunc("/verify-email", authMiddleware.OptionalAuth(authHandlers.VerifyEmailHandler))
+	mux.HandleFunc("/verify-email/resend", authMiddleware.RequireAuth(authHandlers.ResendVerificationHandler))
 
 	// Protected routes
-	mux.HandleFunc("/create-post", authMiddleware.RequireAuth(forumHandlers.CreatePostPageHandler))
-	mux.HandleFunc("/add-comment", authMiddleware.RequireAuth(forumHandlers.AddCommentHandler))
-	mux.HandleFunc("/delete-post", authMiddleware.RequireAuth(forumHandlers.DeletePostHandler))
-	mux.HandleFunc("/delete-comment", authMiddleware.RequireAuth(forumHandlers.DeleteCommentHandler))
-	mux.HandleFunc("/my-posts", authMiddleware.RequireAuth(filterHandlers.MyPostsHandler))
-	mux.HandleFunc("/liked-posts", authMiddleware.RequireAuth(filterHandlers.LikedPostsHandler))
-	mux.HandleFunc("/post/", authMiddleware.OptionalAuth(forumHandlers.PostDetailHandler))
-	mux.HandleFunc("/like-post", authMiddleware.RequireAuth(forumHandlers.LikePostHandler))
-	mux.HandleFunc("/like-comment", authMiddleware.RequireAuth(forumHandlers.LikeCommentHandler))
+	mux.HandleFunc("/create-post", authMiddleware.RequireAuthOrToken(auth.ScopeWrite, forumHandlers.CreatePostPageHandler))
+	mux.HandleFunc("/add-comment", authMiddleware.RequireAuthOrToken(auth.ScopeWrite, forumHandlers.AddCommentHandler))
+	mux.HandleFunc("/preview", authMiddleware.RequireAuth(forumHandlers.PreviewHandler))
+	mux.HandleFunc("/delete-post", authMiddleware.RequireAuthOrToken(auth.ScopeWrite, forumHandlers.DeletePostHandler))
+	mux.HandleFunc("/delete-comment", authMiddleware.RequireAuthOrToken(auth.ScopeWrite, forumHandlers.DeleteCommentHandler))
+	mux.HandleFunc("/my-posts", authMiddleware.RequireAuthOrToken(auth.ScopeRead, filterHandlers.MyPostsHandler))
+	mux.HandleFunc("/liked-posts", authMiddleware.RequireAuthOrToken(auth.ScopeRead, filterHandlers.LikedPostsHandler))
+	mux.HandleFunc("/post/", authMiddleware.OptionalAuthOrToken(auth.ScopeRead, forumHandlers.PostDetailHandler))
+	mux.HandleFunc("/like-post", authMiddleware.RequireAuthOrToken(auth.ScopeReact, forumHandlers.LikePostHandler))
+	mux.HandleFunc("/like-comment", authMiddleware.RequireAuthOrToken(auth.ScopeReact, forumHandlers.LikeCommentHandler))
+	mux.HandleFunc("/watch-post", authMiddleware.RequireAuth(forumHandlers.WatchPostHandler))
+	mux.HandleFunc("GET /user/{username}", authMiddleware.OptionalAuthOrToken(auth.ScopeRead, profileHandlers.UserProfileHandler))
+
+	// Notifications
+	mux.HandleFunc("/notifications", authMiddleware.RequireAuth(notificationHandlers.NotificationsHandler))
+	mux.HandleFunc("/notifications/read", authMiddleware.RequireAuth(notificationHandlers.MarkReadHandler))
+	mux.HandleFunc("/notifications/read-all", authMiddleware.RequireAuth(notificationHandlers.MarkAllReadHandler))
+	mux.HandleFunc("/notifications/preferences", authMiddleware.RequireAuth(notificationHandlers.PreferencesHandler))
+	mux.HandleFunc("/notifications/digest", authMiddleware.RequireAuth(notificationHandlers.DigestHandler))
+	mux.HandleFunc("/digest/unsubscribe", authMiddleware.OptionalAuth(notificationHandlers.DigestUnsubscribeHandler))
+
+	// Live updates (Server-Sent Events)
+	mux.HandleFunc("GET /events", liveHandlers.FeedEventsHandler)
+	mux.HandleFunc("GET /post/{id}/events", liveHandlers.PostEventsHandler)
+
+	// Account settings
+	mux.HandleFunc("/settings", authMiddleware.RequireAuth(settingsHandlers.AccountHandler))
+	mux.HandleFunc("/settings/username", authMiddleware.RequireAuth(settingsHandlers.ChangeUsernameHandler))
+	mux.HandleFunc("/settings/profile", authMiddleware.RequireAuth(settingsHandlers.UpdateProfileHandler))
+	mux.HandleFunc("/settings/avatar", authMiddleware.RequireAuth(settingsHandlers.AvatarHandler))
+	mux.HandleFunc("/settings/devices", authMiddleware.RequireAuth(settingsHandlers.DevicesHandler))
+	mux.HandleFunc("/settings/devices/revoke", authMiddleware.RequireAuth(settingsHandlers.RevokeDeviceHandler))
+	mux.HandleFunc("/settings/devices/revoke-others", authMiddleware.RequireAuth(settingsHandlers.RevokeOtherDevicesHandler))
+	mux.HandleFunc("/settings/devices/notifications", authMiddleware.RequireAuth(settingsHandlers.DeviceNotificationsHandler))
+	mux.HandleFunc("/settings/2fa", authMiddleware.RequireAuth(settingsHandlers.TwoFactorHandler))
+	mux.HandleFunc("/settings/2fa/setup", authMiddleware.RequireAuth(settingsHandlers.TwoFactorSetupHandler))
+	mux.HandleFunc("/settings/2fa/confirm", authMiddleware.RequireAuth(settingsHandlers.TwoFactorConfirmHandler))
+	mux.HandleFunc("/settings/tokens", authMiddleware.RequireAuth(settingsHandlers.APITokensHandler))
+	mux.HandleFunc("/settings/tokens/create", authMiddleware.RequireAuth(settingsHandlers.CreateAPITokenHandler))
+	mux.HandleFunc("/settings/tokens/revoke", authMiddleware.RequireAuth(settingsHandlers.RevokeAPITokenHandler))
+	if proxyAuth != nil {
+		// The proxy's sign-on also owns the account's email and credentials,
+		// so the forms that change them are turned off. 2FA enrolment stays
+		// for staff who are required to use it.
+		settingsHandlers.SetSingleSignOn()
+		for _, path := range []string{
+			"/settings/email", "/settings/password", "/settings/delete",
+			"/settings/2fa/disable", "/settings/2fa/recovery-codes",
+			"/settings/passkeys", "/settings/passkeys/begin", "/settings/passkeys/finish", "/settings/passkeys/delete",
+			"/settings/reauthenticate",
+		} {
+			mux.HandleFunc(path, singleSignOn)
+		}
+	} else {
+		mux.HandleFunc("/settings/email", authMiddleware.RequireAuth(settingsHandlers.ChangeEmailHandler))
+		mux.HandleFunc("/settings/password", authMiddleware.RequireAuth(settingsHandlers.ChangePasswordHandler))
+		mux.HandleFunc("/settings/delete", authMiddleware.RequireAuth(settingsHandlers.DeleteAccountHandler))
+		mux.HandleFunc("/settings/2fa/disable", authMiddleware.RequireAuth(settingsHandlers.TwoFactorDisableHandler))
+		mux.HandleFunc("/settings/2fa/recovery-codes", authMiddleware.RequireAuth(settingsHandlers.RecoveryCodesHandler))
+		mux.HandleFunc("/settings/passkeys", authMiddleware.RequireAuth(settingsHandlers.PasskeysHandler))
+		mux.HandleFunc("/settings/passkeys/begin", authMiddleware.RequireAuth(settingsHandlers.PasskeyRegisterBeginHandler))
+		mux.HandleFunc("/settings/passkeys/finish", authMiddleware.RequireAuth(settingsHandlers.PasskeyRegisterFinishHandler))
+		mux.HandleFunc("/settings/passkeys/delete", authMiddleware.RequireAuth(settingsHandlers.DeletePasskeyHandler))
+		mux.HandleFunc("/settings/reauthenticate", authMiddleware.RequireAuth(settingsHandlers.ReauthenticateHandler))
+	}
+
+	// Admin routes
+	mux.HandleFunc("/admin/lockouts", authMiddleware.RequireAdmin(adminHandlers.LockoutsHandler))
+	mux.HandleFunc("/admin/unlock", authMiddleware.RequireAdmin(adminHandlers.UnlockHandler))
+	mux.HandleFunc("/admin/users", authMiddleware.RequireAdmin(adminHandlers.UsersHandler))
+	mux.HandleFunc("/admin/set-role", authMiddleware.RequireAdmin(adminHandlers.SetRoleHandler))
+	mux.HandleFunc("/admin/security", authMiddleware.RequireAdmin(adminHandlers.SecurityHandler))
+	mux.HandleFunc("/admin/security/2fa", authMiddleware.RequireAdmin(adminHandlers.SetTwoFactorPolicyHandler))
+	mux.HandleFunc("/admin/webhooks", authMiddleware.RequireAdmin(adminHandlers.WebhooksHandler))
+	mux.HandleFunc("/admin/webhooks/view", authMiddleware.RequireAdmin(adminHandlers.WebhookHandler))
+	mux.HandleFunc("/admin/webhooks/create", authMiddleware.RequireAdmin(adminHandlers.CreateWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/update", authMiddleware.RequireAdmin(adminHandlers.UpdateWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/test", authMiddleware.RequireAdmin(adminHandlers.TestWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/toggle", authMiddleware.RequireAdmin(adminHandlers.ToggleWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/retry", authMiddleware.RequireAdmin(adminHandlers.RetryWebhookDeliveryHandler))
+	mux.HandleFunc("/admin/webhooks/delete", authMiddleware.RequireAdmin(adminHandlers.DeleteWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/incoming", authMiddleware.RequireAdmin(adminHandlers.IncomingWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/incoming/create", authMiddleware.RequireAdmin(adminHandlers.CreateIncomingWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/incoming/update", authMiddleware.RequireAdmin(adminHandlers.UpdateIncomingWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/incoming/rotate", authMiddleware.RequireAdmin(adminHandlers.RotateIncomingWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/incoming/toggle", authMiddleware.RequireAdmin(adminHandlers.ToggleIncomingWebhookHandler))
+	mux.HandleFunc("/admin/webhooks/incoming/delete", authMiddleware.RequireAdmin(adminHandlers.DeleteIncomingWebhookHandler))
+
+	// Atom and RSS feeds
+	mux.HandleFunc(feeds.AtomPath, feedHandlers.AtomHandler)
+	mux.HandleFunc(feeds.RSSPath, feedHandlers.RSSHandler)
+
+	// Uploaded files
+	mux.HandleFunc("GET "+attachments.Prefix+"{hash}/{name}", attachmentHandlers.FileHandler)
+	mux.HandleFunc("GET "+attachments.ThumbnailPrefix+"{hash}", attachmentHandlers.ThumbnailHandler)
+	mux.HandleFunc("GET "+avatars.Prefix+"{hash}/{size}", avatarHandlers.AvatarHandler)
+	mux.HandleFunc("GET "+avatars.IdenticonPrefix+"{id}/{size}", avatarHandlers.IdenticonHandler)
+
+	// Incoming webhooks
+	mux.HandleFunc(webhooks.IncomingPath, incomingHandlers.ReceiveHandler)
+
+	// JSON API
+	mux.Handle(handlers.APIPrefix+"/", handlers.NewAPIHandlers(db.DB, authService, authMiddleware, broker, webhookService, uploads))
 
 	// Static files
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("web/static/"))))
@@ -103,7 +470,7 @@ func main() {
 	// Create a wrapper that handles 404 errors
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if the path matches any registered routes
-		if r.URL.Path != "/" && !routeExists(r.URL.Path) && !isStaticFile(r.URL.Path) && !isPostDetail(r.URL.Path) {
+		if r.URL.Path != "/" && !routeExists(r.URL.Path) && !isStaticFile(r.URL.Path) && !isPostDetail(r.URL.Path) && !isAPI(r.URL.Path) && !isAttachment(r.URL.Path) && !isAvatar(r.URL.Path) && !isUserProfile(r.URL.EscapedPath()) {
 			errorHandler.Handle404(w, r)
 			return
 		}
@@ -112,17 +479,118 @@ func main() {
 		mux.ServeHTTP(w, r)
 	})
 
-	// Start server
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	return &server{
+		handler: limitBody(csrfProtection.Protect(twoFactor.Enforce(handler)), max(uploads.MaxRequestSize(), avatars.MaxSize+1<<20), errorHandler),
+		jobs:    jobs,
+	}
+}
+
+// newMailer configures email delivery from the environment. FORUM_MAIL_TRANSPORT
+// selects "log" (default), "file" (writes .eml files to FORUM_MAIL_DIR) or "smtp".
+func newMailer() (mailer.Mailer, error) {
+	from := os.Getenv("FORUM_MAIL_FROM")
+	if from == "" {
+		from = "Forum <no-reply@localhost>"
+	}
+
+	switch transport := os.Getenv("FORUM_MAIL_TRANSPORT"); transport {
+	case "", "log":
+		return mailer.NewLogMailer(log.New(log.Writer(), "[MAIL] ", log.LstdFlags)), nil
+	case "file":
+		dir := os.Getenv("FORUM_MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return mailer.NewFileMailer(dir, from)
+	case "smtp":
+		port := 0
+		if p := os.Getenv("FORUM_SMTP_PORT"); p != "" {
+			var err error
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("invalid FORUM_SMTP_PORT %q", p)
+			}
+		}
+		return mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Host:     os.Getenv("FORUM_SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("FORUM_SMTP_USERNAME"),
+			Password: os.Getenv("FORUM_SMTP_PASSWORD"),
+			From:     from,
+		})
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", transport)
+	}
+}
+
+// envOrDefault returns an environment variable, or fallback when it is unset or empty
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// newOIDCProviders configures OpenID Connect login from the environment.
+// FORUM_OIDC_PROVIDERS lists provider names (e.g. "google,gitlab"); each is
+// configured with FORUM_OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and
+// optionally _DISPLAY_NAME and _SCOPES.
+func newOIDCProviders(redirectURL string) ([]*oidc.Provider, error) {
+	var providers []*oidc.Provider
+	for _, name := range strings.Split(os.Getenv("FORUM_OIDC_PROVIDERS"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		for _, c := range name {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return nil, fmt.Errorf("invalid provider name %q", name)
+			}
+		}
+
+		prefix := "FORUM_OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider, err := oidc.NewProvider(oidc.Config{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " ")),
+			RedirectURL:  redirectURL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
 }
 
 // routeExists checks if a route is registered
 func routeExists(path string) bool {
 	validRoutes := []string{
-		"/", "/login", "/register", "/logout",
-		"/create-post", "/add-comment", "/delete-post", "/delete-comment",
-		"/my-posts", "/liked-posts", "/like-post", "/like-comment",
+		"/", "/login", "/login/2fa", "/register", "/logout", "/forgot-password", "/reset-password",
+		"/login/passkey/begin", "/login/passkey/finish",
+		"/login/oidc", "/login/oidc/callback", "/login/oidc/username",
+		"/verify-email", "/verify-email/resend",
+		"/create-post", "/preview", "/add-comment", "/delete-post", "/delete-comment",
+		"/my-posts", "/liked-posts", "/like-post", "/like-comment", "/events", "/watch-post",
+		"/notifications", "/notifications/read", "/notifications/read-all", "/notifications/preferences",
+		"/notifications/digest", "/digest/unsubscribe",
+		"/admin/lockouts", "/admin/unlock", "/admin/users", "/admin/set-role",
+		"/admin/security", "/admin/security/2fa",
+		"/admin/webhooks", "/admin/webhooks/view", "/admin/webhooks/create", "/admin/webhooks/update",
+		"/admin/webhooks/test", "/admin/webhooks/toggle", "/admin/webhooks/retry", "/admin/webhooks/delete",
+		"/admin/webhooks/incoming", "/admin/webhooks/incoming/create", "/admin/webhooks/incoming/update",
+		"/admin/webhooks/incoming/rotate", "/admin/webhooks/incoming/toggle", "/admin/webhooks/incoming/delete",
+		webhooks.IncomingPath, feeds.AtomPath, feeds.RSSPath,
+		"/settings", "/settings/username", "/settings/email", "/settings/password", "/settings/delete",
+		"/settings/profile", "/settings/avatar",
+		"/settings/devices", "/settings/devices/revoke", "/settings/devices/revoke-others",
+		"/settings/devices/notifications",
+		"/settings/2fa", "/settings/2fa/setup", "/settings/2fa/confirm", "/settings/2fa/disable",
+		"/settings/2fa/recovery-codes",
+		"/settings/passkeys", "/settings/passkeys/begin", "/settings/passkeys/finish", "/settings/passkeys/delete",
+		"/settings/reauthenticate",
+		"/settings/tokens", "/settings/tokens/create", "/settings/tokens/revoke",
 	}
 
 	for _, route := range validRoutes {
@@ -138,6 +606,57 @@ func isStaticFile(path string) bool {
 	return len(path) > 8 && path[:8] == "/static/"
 }
 
+// isAPI checks if the path belongs to the JSON API, which answers its own 404s
+func isAPI(path string) bool {
+	return strings.HasPrefix(path, handlers.APIPrefix+"/")
+}
+
+// isAttachment checks if the path is for an uploaded file or thumbnail,
+// /attachments/{hash}/{name} or /attachments/thumb/{hash}
+func isAttachment(path string) bool {
+	rest, ok := strings.CutPrefix(path, attachments.Prefix)
+	if !ok {
+		return false
+	}
+	hash, name, ok := strings.Cut(rest, "/")
+	return ok && hash != "" && name != "" && !strings.Contains(name, "/")
+}
+
+// limitBody refuses request bodies larger than limit. Forms with files can be
+// up to the upload limits; the CSRF check reads the form before any handler,
+// so the limit is enforced here rather than per route.
+func limitBody(next http.Handler, limit int64, errorHandler *auth.HTTPErrorHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			errorHandler.Handle413(w, r, fmt.Sprintf("Uploads are limited to %d MB in total. Please attach fewer or smaller files.", limit>>20))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAvatar checks if the path is for an avatar, /avatars/{hash}/{size} or
+// /avatars/identicon/{id}/{size}
+func isAvatar(path string) bool {
+	rest, ok := strings.CutPrefix(path, avatars.Prefix)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) == 3 && parts[0] == "identicon" {
+		parts = parts[1:]
+	}
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// isUserProfile checks if the escaped path is for a profile page,
+// /user/{username}. A / in the username is escaped, so there is one segment.
+func isUserProfile(escapedPath string) bool {
+	username, ok := strings.CutPrefix(escapedPath, "/user/")
+	return ok && username != "" && !strings.Contains(username, "/")
+}
+
 // isPostDetail checks if the path is for a post detail page
 func isPostDetail(path string) bool {
 	return len(path) > 6 && path[:6] == "/post/"
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"forum/client"
+	"forum/internal/auth"
+	"forum/internal/database"
+)
+
+// newTestServer runs the forum on a fresh database and returns its URL and
+// the database
+func newTestServer(t *testing.T) (string, *database.DB) {
+	t.Helper()
+
+	// Templates, static files and migrations are read relative to the
+	// repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	dir := t.TempDir()
+	t.Setenv("FORUM_UPLOAD_DIR", filepath.Join(dir, "uploads"))
+	config := database.DefaultConfig()
+	config.DSN = filepath.Join(dir, "forum.db")
+	db, err := database.NewDB(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newServer(db).handler)
+	t.Cleanup(server.Close)
+	return server.URL, db
+}
+
+// createUser registers a user with a verified email and returns their ID
+func createUser(t *testing.T, db *database.DB, username string) int64 {
+	t.Helper()
+	email := username + "@example.com"
+	if err := auth.NewAuthService(db.DB).RegisterUser(email, username, "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	if err := db.QueryRow("UPDATE users SET email_verified = 1 WHERE email = ? RETURNING id", email).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// newClient returns a client for the server, authenticated with token if set
+func newClient(t *testing.T, serverURL, token string) *client.Client {
+	t.Helper()
+	c, err := client.New(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetToken(token)
+	return c
+}
+
+// wantAPIError checks that err is the API error envelope with status and code
+func wantAPIError(t *testing.T, err error, status int, code string) {
+	t.Helper()
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("error = %v, want the API's %d %s", err, status, code)
+	}
+	if apiErr.Status != status || apiErr.Code != code || apiErr.Message == "" {
+		t.Errorf("error = %+v, want %d %s", *apiErr, status, code)
+	}
+}
+
+func TestClient(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	userID := createUser(t, db, "alice")
+	token, err := auth.NewSessionService(db.DB).CreateAPIToken(userID, "test", []string{auth.ScopeRead, auth.ScopeWrite, auth.ScopeReact}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, serverURL, token)
+	ctx := context.Background()
+
+	me, err := c.Me(ctx)
+	if err != nil {
+		t.Fatalf("Me() = %v", err)
+	}
+	if me.ID != userID || me.Username != "alice" || !me.EmailVerified {
+		t.Errorf("Me() = %+v", *me)
+	}
+
+	post, err := c.CreatePost(ctx, client.NewPost{
+		Title:      "Hello from the client",
+		Content:    "Posted through the JSON API",
+		Categories: []string{"General"},
+	})
+	if err != nil {
+		t.Fatalf("CreatePost() = %v", err)
+	}
+	if post.Title != "Hello from the client" || post.Author.ID != userID || len(post.Categories) != 1 || post.Categories[0] != "General" {
+		t.Errorf("CreatePost() = %+v", *post)
+	}
+	if _, err := c.CreatePost(ctx, client.NewPost{Title: "Another post", Content: "Something else"}); err != nil {
+		t.Fatalf("CreatePost() = %v", err)
+	}
+
+	list, err := c.ListPosts(ctx, client.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListPosts() = %v", err)
+	}
+	if len(list.Posts) != 2 || list.Page.Total != 2 || list.Posts[1].ID != post.ID {
+		t.Errorf("ListPosts() = %+v, want both posts, newest first", *list)
+	}
+	list, err = c.ListPosts(ctx, client.ListOptions{PerPage: 1, Page: 2})
+	if err != nil {
+		t.Fatalf("ListPosts() = %v", err)
+	}
+	if len(list.Posts) != 1 || list.Page.TotalPages != 2 || list.Posts[0].ID != post.ID {
+		t.Errorf("second page = %+v", *list)
+	}
+
+	list, err = c.ListPosts(ctx, client.ListOptions{Query: "json api"})
+	if err != nil {
+		t.Fatalf("search = %v", err)
+	}
+	if len(list.Posts) != 1 || list.Posts[0].ID != post.ID {
+		t.Errorf("search = %+v, want the first post", *list)
+	}
+	list, err = c.ListPosts(ctx, client.ListOptions{Query: "nothing like this"})
+	if err != nil {
+		t.Fatalf("search = %v", err)
+	}
+	if len(list.Posts) != 0 || list.Page.Total != 0 {
+		t.Errorf("search = %+v, want no posts", *list)
+	}
+
+	comment, err := c.CreateComment(ctx, post.ID, "First comment")
+	if err != nil {
+		t.Fatalf("CreateComment() = %v", err)
+	}
+	if comment.PostID != post.ID || comment.Content != "First comment" || comment.Author.ID != userID {
+		t.Errorf("CreateComment() = %+v", *comment)
+	}
+	comments, err := c.ListComments(ctx, post.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListComments() = %v", err)
+	}
+	if len(comments.Comments) != 1 || comments.Comments[0].ID != comment.ID {
+		t.Errorf("ListComments() = %+v", *comments)
+	}
+
+	reacted, err := c.ReactToPost(ctx, post.ID, client.Like)
+	if err != nil {
+		t.Fatalf("ReactToPost() = %v", err)
+	}
+	if reacted.Likes != 1 || reacted.MyReaction != client.Like {
+		t.Errorf("after liking, post = %+v", *reacted)
+	}
+	reacted, err = c.ReactToPost(ctx, post.ID, client.NoReaction)
+	if err != nil {
+		t.Fatalf("ReactToPost() = %v", err)
+	}
+	if reacted.Likes != 0 || reacted.Dislikes != 0 {
+		t.Errorf("after removing the reaction, post = %+v", *reacted)
+	}
+	reactedComment, err := c.ReactToComment(ctx, comment.ID, client.Dislike)
+	if err != nil {
+		t.Fatalf("ReactToComment() = %v", err)
+	}
+	if reactedComment.Dislikes != 1 || reactedComment.MyReaction != client.Dislike {
+		t.Errorf("after disliking, comment = %+v", *reactedComment)
+	}
+
+	post, err = c.GetPost(ctx, post.ID)
+	if err != nil {
+		t.Fatalf("GetPost() = %v", err)
+	}
+	if post.Comments != 1 {
+		t.Errorf("GetPost() = %+v, want one comment", *post)
+	}
+}
+
+func TestClientLogin(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	createUser(t, db, "bob")
+	c := newClient(t, serverURL, "")
+	ctx := context.Background()
+
+	if err := c.Login(ctx, "bob@example.com", "wrong"); err != client.ErrLoginFailed {
+		t.Errorf("Login() with a wrong password = %v, want %v", err, client.ErrLoginFailed)
+	}
+	if err := c.Login(ctx, "bob@example.com", "secret1"); err != nil {
+		t.Fatalf("Login() = %v", err)
+	}
+
+	// The session's CSRF token is sent with writes
+	post, err := c.CreatePost(ctx, client.NewPost{Title: "Session post", Content: "Posted after logging in"})
+	if err != nil {
+		t.Fatalf("CreatePost() = %v", err)
+	}
+	if post.Author.Username != "bob" {
+		t.Errorf("CreatePost() = %+v", *post)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	userID := createUser(t, db, "carol")
+	readOnly, err := auth.NewSessionService(db.DB).CreateAPIToken(userID, "read only", []string{auth.ScopeRead}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	anonymous := newClient(t, serverURL, "")
+	if _, err := anonymous.ListPosts(ctx, client.ListOptions{}); err != nil {
+		t.Errorf("ListPosts() without a token = %v", err)
+	}
+	_, err = anonymous.Me(ctx)
+	wantAPIError(t, err, http.StatusUnauthorized, "unauthenticated")
+	// Writes with neither a token nor a session stop at the CSRF check
+	_, err = anonymous.CreatePost(ctx, client.NewPost{Title: "Anonymous", Content: "Not allowed"})
+	wantAPIError(t, err, http.StatusForbidden, "csrf_failed")
+
+	_, err = newClient(t, serverURL, "forum_pat_not-a-real-token").Me(ctx)
+	wantAPIError(t, err, http.StatusUnauthorized, "invalid_token")
+
+	c := newClient(t, serverURL, readOnly)
+	_, err = c.CreatePost(ctx, client.NewPost{Title: "Read only", Content: "Not allowed"})
+	wantAPIError(t, err, http.StatusForbidden, "insufficient_scope")
+
+	_, err = c.GetPost(ctx, 999)
+	wantAPIError(t, err, http.StatusNotFound, "not_found")
+	_, err = c.GetComment(ctx, 999)
+	wantAPIError(t, err, http.StatusNotFound, "not_found")
+	_, err = c.User(ctx, 999)
+	wantAPIError(t, err, http.StatusNotFound, "not_found")
+}
+
+func TestMeForDeletedAccount(t *testing.T) {
+	serverURL, db := newTestServer(t)
+	userID := createUser(t, db, "dave")
+	token, err := auth.NewSessionService(db.DB).CreateAPIToken(userID, "script", []string{auth.ScopeRead}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting an account removes its tokens; remove only the user, as if
+	// the account went away while a request with its token was under way
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "DELETE FROM users WHERE id = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newClient(t, serverURL, token).Me(ctx)
+	wantAPIError(t, err, http.StatusUnauthorized, "invalid_token")
+}
@@ -0,0 +1,80 @@
+// Command webhookecho receives forum webhooks and prints them, for trying out
+// webhooks locally.
+//
+// Usage:
+//
+//	webhookecho [-addr :9090] [-secret whsec_...] [-fail n]
+//
+// Add http://localhost:9090/ as a webhook in the admin panel. With -secret,
+// deliveries with a bad signature are refused with 401. -fail n answers the
+// first n deliveries with 500 to watch the forum retry them.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"forum/internal/webhooks"
+)
+
+func main() {
+	addr := flag.String("addr", ":9090", "address to listen on")
+	secret := flag.String("secret", "", "webhook secret to verify signatures with")
+	fail := flag.Int("fail", 0, "answer this many deliveries with 500 first")
+	flag.Parse()
+
+	var mu sync.Mutex
+	failures := *fail
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		signature := "not checked"
+		if *secret != "" {
+			if err := webhooks.Verify(*secret, r.Header, body, 5*time.Minute); err != nil {
+				log.Printf("%s delivery %s: %v", r.Header.Get(webhooks.HeaderEvent), r.Header.Get(webhooks.HeaderDelivery), err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			signature = "valid"
+		}
+
+		mu.Lock()
+		failing := failures > 0
+		if failing {
+			failures--
+		}
+		mu.Unlock()
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") != nil {
+			pretty.Reset()
+			pretty.Write(body)
+		}
+		log.Printf("%s delivery %s (signature %s)\n%s",
+			r.Header.Get(webhooks.HeaderEvent), r.Header.Get(webhooks.HeaderDelivery), signature, pretty.String())
+
+		if failing {
+			http.Error(w, "failing on purpose", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	log.Printf("Listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
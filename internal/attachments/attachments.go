@@ -0,0 +1,370 @@
+// Package attachments stores files uploaded with posts and comments.
+//
+// Files are content-addressed: each distinct file is stored once as a blob
+// named after its SHA-256 hash, and every upload of it is an attachment row
+// pointing at that blob. Images have their metadata stripped and get a
+// thumbnail. Blobs that no attachment uses any more are removed by Cleanup.
+package attachments
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"forum/internal/storage"
+)
+
+// Default upload limits
+const (
+	DefaultMaxSize  = 8 << 20 // Bytes per file
+	DefaultMaxFiles = 5       // Files per post or comment
+)
+
+// Errors for rejected uploads. Their messages are shown to the uploader.
+var (
+	ErrNotFound    = errors.New("attachment not found")
+	ErrTooMany     = errors.New("too many files")
+	ErrTooLarge    = errors.New("file is too large")
+	ErrType        = errors.New("file type is not allowed; upload JPEG, PNG or GIF images, PDF, ZIP or plain text files")
+	ErrBadImage    = errors.New("image could not be read")
+	ErrHugeImage   = errors.New("image dimensions are too large")
+	ErrEmptyUpload = errors.New("file is empty")
+)
+
+// Attachment is a file attached to a post or comment
+type Attachment struct {
+	ID           int64
+	PostID       int64
+	CommentID    int64 // Zero for files attached to the post itself
+	UploaderID   int64
+	Hash         string
+	Filename     string
+	ContentType  string
+	Size         int64
+	Width        int // Images only
+	Height       int
+	HasThumbnail bool
+	CreatedAt    time.Time
+}
+
+// URL is where the file is served
+func (a Attachment) URL() string {
+	return FileURL(a.Hash, a.Filename)
+}
+
+// ThumbnailURL is where the image's thumbnail is served. Images small enough
+// to have no thumbnail are served in full.
+func (a Attachment) ThumbnailURL() string {
+	if !a.HasThumbnail {
+		return a.URL()
+	}
+	return ThumbnailPrefix + a.Hash
+}
+
+// IsImage reports whether the file is shown inline as a picture
+func (a Attachment) IsImage() bool {
+	return IsImageType(a.ContentType)
+}
+
+// EmbeddedIn reports whether content already shows the file inline, so it
+// need not be listed again below it
+func (a Attachment) EmbeddedIn(content string) bool {
+	return strings.Contains(content, Prefix+a.Hash+"/")
+}
+
+// NotEmbedded returns the attachments that content does not show inline
+func NotEmbedded(list []Attachment, content string) []Attachment {
+	var rest []Attachment
+	for _, a := range list {
+		if !a.EmbeddedIn(content) {
+			rest = append(rest, a)
+		}
+	}
+	return rest
+}
+
+// Prefix and ThumbnailPrefix start the URLs files and thumbnails are served at
+const (
+	Prefix          = "/attachments/"
+	ThumbnailPrefix = "/attachments/thumb/"
+)
+
+// FileURL is the URL of a blob, ending in the name it is downloaded as
+func FileURL(hash, filename string) string {
+	return Prefix + hash + "/" + url.PathEscape(filename)
+}
+
+// Service stores and lists attachments
+type Service struct {
+	db       *sql.DB
+	store    storage.Store
+	maxSize  int64
+	maxFiles int
+
+	// mu keeps Cleanup from deleting a blob that an upload is about to reuse
+	mu sync.Mutex
+}
+
+// NewService creates an attachment service that keeps files in store
+func NewService(db *sql.DB, store storage.Store) *Service {
+	return &Service{db: db, store: store, maxSize: DefaultMaxSize, maxFiles: DefaultMaxFiles}
+}
+
+// SetLimits changes the largest file size and the number of files per post
+// or comment
+func (s *Service) SetLimits(maxSize int64, maxFiles int) {
+	s.maxSize = maxSize
+	s.maxFiles = maxFiles
+}
+
+// MaxFiles is the number of files allowed per post or comment
+func (s *Service) MaxFiles() int {
+	return s.maxFiles
+}
+
+// MaxSize is the largest file size allowed, in bytes
+func (s *Service) MaxSize() int64 {
+	return s.maxSize
+}
+
+// MaxRequestSize is the largest form body that can carry the allowed files
+func (s *Service) MaxRequestSize() int64 {
+	return s.maxSize*int64(s.maxFiles) + 1<<20
+}
+
+// Save stores prepared uploads and attaches them to a post, or to a comment
+// when commentID is not zero. Files already stored are not written again.
+func (s *Service) Save(ctx context.Context, uploads []*Upload, uploaderID, postID, commentID int64) error {
+	if len(uploads) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range uploads {
+		var exists bool
+		err := s.db.QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM attachment_blobs WHERE hash = ?)", u.Hash).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := s.store.Put(ctx, u.Hash, u.data); err != nil {
+			return err
+		}
+		if u.thumbnail != nil {
+			if err := s.store.Put(ctx, thumbnailKey(u.Hash), u.thumbnail); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, u := range uploads {
+		_, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO attachment_blobs(hash, content_type, size, width, height, has_thumbnail, created_at)
+			VALUES(?,?,?,?,?,?,?)`,
+			u.Hash, u.ContentType, len(u.data), u.width, u.height, u.thumbnail != nil, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO attachments(blob_hash, uploader_id, post_id, comment_id, filename, created_at)
+			VALUES(?,?,?,?,?,?)`,
+			u.Hash, uploaderID, postID, nullID(commentID), u.Filename, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const attachmentColumns = `
+	a.id, a.post_id, COALESCE(a.comment_id, 0), a.uploader_id, a.blob_hash, a.filename,
+	b.content_type, b.size, b.width, b.height, b.has_thumbnail, a.created_at`
+
+func scanAttachments(rows *sql.Rows) ([]Attachment, error) {
+	defer rows.Close()
+	var list []Attachment
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.PostID, &a.CommentID, &a.UploaderID, &a.Hash, &a.Filename,
+			&a.ContentType, &a.Size, &a.Width, &a.Height, &a.HasThumbnail, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// ListForPost returns the files attached to a post itself, oldest first
+func (s *Service) ListForPost(ctx context.Context, postID int64) ([]Attachment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT`+attachmentColumns+`
+		FROM attachments a JOIN attachment_blobs b ON b.hash = a.blob_hash
+		WHERE a.post_id = ? AND a.comment_id IS NULL
+		ORDER BY a.id`, postID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+// ListForComments returns the files attached to a post's comments, by comment ID
+func (s *Service) ListForComments(ctx context.Context, postID int64) (map[int64][]Attachment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT`+attachmentColumns+`
+		FROM attachments a JOIN attachment_blobs b ON b.hash = a.blob_hash
+		WHERE a.post_id = ? AND a.comment_id IS NOT NULL
+		ORDER BY a.id`, postID)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	byComment := make(map[int64][]Attachment)
+	for _, a := range list {
+		byComment[a.CommentID] = append(byComment[a.CommentID], a)
+	}
+	return byComment, nil
+}
+
+// BlobInfo describes a stored file for serving it
+type BlobInfo struct {
+	ContentType string
+	Size        int64
+	CreatedAt   time.Time
+}
+
+// Open returns a stored file, or its thumbnail, by hash
+func (s *Service) Open(ctx context.Context, hash string, thumbnail bool) (storage.Blob, *BlobInfo, error) {
+	if !validHash(hash) {
+		return nil, nil, ErrNotFound
+	}
+	var info BlobInfo
+	var hasThumbnail bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT content_type, size, has_thumbnail, created_at FROM attachment_blobs WHERE hash = ?", hash).
+		Scan(&info.ContentType, &info.Size, &hasThumbnail, &info.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	key := hash
+	if thumbnail && hasThumbnail {
+		key = thumbnailKey(hash)
+		info.ContentType = thumbnailType(info.ContentType)
+	}
+	blob, err := s.store.Open(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	info.Size = blob.Size()
+	return blob, &info, nil
+}
+
+// Cleanup deletes stored files that no attachment uses any more, such as the
+// files of deleted posts and comments. It returns how many were removed.
+func (s *Service) Cleanup(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT hash, has_thumbnail FROM attachment_blobs b
+		WHERE NOT EXISTS (SELECT 1 FROM attachments a WHERE a.blob_hash = b.hash)`)
+	if err != nil {
+		return 0, err
+	}
+	type orphan struct {
+		hash      string
+		thumbnail bool
+	}
+	var orphans []orphan
+	for rows.Next() {
+		var o orphan
+		if err := rows.Scan(&o.hash, &o.thumbnail); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, o := range orphans {
+		if err := s.store.Delete(ctx, o.hash); err != nil {
+			return removed, fmt.Errorf("failed to delete blob %s: %w", o.hash, err)
+		}
+		if o.thumbnail {
+			if err := s.store.Delete(ctx, thumbnailKey(o.hash)); err != nil {
+				return removed, fmt.Errorf("failed to delete thumbnail %s: %w", o.hash, err)
+			}
+		}
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM attachment_blobs WHERE hash = ?", o.hash); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// CleanupAfterDelete removes the files a deletion left unused, logging
+// rather than failing the request that deleted them
+func (s *Service) CleanupAfterDelete(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	if _, err := s.Cleanup(ctx); err != nil {
+		log.Printf("Failed to clean up attachments: %v", err)
+	}
+}
+
+func thumbnailKey(hash string) string {
+	return hash + ".thumb"
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+func nullID(id int64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
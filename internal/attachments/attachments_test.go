@@ -0,0 +1,150 @@
+package attachments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"image/color"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"forum/internal/database"
+	"forum/internal/storage"
+)
+
+// newTestService returns a service storing files in a temporary directory,
+// the directory, the database and the ID of a user
+func newTestService(t *testing.T) (*Service, string, *sql.DB, int64) {
+	t.Helper()
+
+	// InitializeDatabase reads the migrations relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("..", "..")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := database.NewDB(&database.Config{
+		DSN:          filepath.Join(t.TempDir(), "forum.db"),
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	var userID int64
+	err = db.QueryRow(
+		"INSERT INTO users (username, email, password_hash) VALUES ('alice', 'alice@example.com', '!') RETURNING id",
+	).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	store, err := storage.NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(db.DB, store), dir, db.DB, userID
+}
+
+// storedFiles counts the files in the upload directory
+func storedFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSameFileStoredOnce(t *testing.T) {
+	s, dir, db, userID := newTestService(t)
+	ctx := context.Background()
+
+	// Large enough to get a thumbnail, which is stored and removed with it
+	data := pngOf(t, 960, 480, color.RGBA{R: 255, A: 255})
+
+	var posts []int64
+	for i, filename := range []string{"first.png", "second.png"} {
+		var postID int64
+		err := db.QueryRow("INSERT INTO posts (author_id, title, content) VALUES (?, ?, 'Content') RETURNING id",
+			userID, filename).Scan(&postID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := Prepare(filename, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Save(ctx, []*Upload{u}, userID, postID, 0); err != nil {
+			t.Fatalf("upload %d: %v", i+1, err)
+		}
+		posts = append(posts, postID)
+	}
+
+	var blobs, rows int
+	db.QueryRow("SELECT COUNT(*) FROM attachment_blobs").Scan(&blobs)
+	db.QueryRow("SELECT COUNT(*) FROM attachments").Scan(&rows)
+	if blobs != 1 || rows != 2 {
+		t.Fatalf("%d blobs and %d attachments, want 1 blob used twice", blobs, rows)
+	}
+	if n := storedFiles(t, dir); n != 2 {
+		t.Fatalf("%d files stored, want the image and its thumbnail", n)
+	}
+
+	list, err := s.ListForPost(ctx, posts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Filename != "second.png" || !list[0].HasThumbnail {
+		t.Fatalf("second post lists %+v", list)
+	}
+	hash := list[0].Hash
+
+	// The blob stays while a post still uses it
+	if _, err := db.Exec("DELETE FROM posts WHERE id = ?", posts[0]); err != nil {
+		t.Fatal(err)
+	}
+	s.CleanupAfterDelete(ctx)
+	blob, _, err := s.Open(ctx, hash, false)
+	if err != nil {
+		t.Fatalf("file of the remaining post: %v", err)
+	}
+	blob.Close()
+	if n := storedFiles(t, dir); n != 2 {
+		t.Errorf("%d files stored after deleting one post, want 2", n)
+	}
+
+	// and goes with the last one
+	if _, err := db.Exec("DELETE FROM posts WHERE id = ?", posts[1]); err != nil {
+		t.Fatal(err)
+	}
+	s.CleanupAfterDelete(ctx)
+	if _, _, err := s.Open(ctx, hash, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("file after deleting both posts: %v, want ErrNotFound", err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM attachment_blobs").Scan(&blobs)
+	if blobs != 0 {
+		t.Errorf("%d blobs left", blobs)
+	}
+	if n := storedFiles(t, dir); n != 0 {
+		t.Errorf("%d files left on disk", n)
+	}
+}
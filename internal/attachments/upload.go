@@ -0,0 +1,228 @@
+package attachments
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"forum/internal/imaging"
+)
+
+// ThumbnailSize is the largest width or height of image thumbnails
+const ThumbnailSize = 480
+
+// allowedTypes are the sniffed content types that may be uploaded
+var allowedTypes = map[string]bool{
+	"image/jpeg":                true,
+	"image/png":                 true,
+	"image/gif":                 true,
+	"application/pdf":           true,
+	"application/zip":           true,
+	"text/plain; charset=utf-8": true,
+}
+
+// IsImageType reports whether files of a content type are shown as pictures
+func IsImageType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/")
+}
+
+// thumbnailType is the format of an image's thumbnail. PNG keeps the
+// transparency of PNG and GIF images.
+func thumbnailType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// Upload is a checked file, ready to be saved
+type Upload struct {
+	Filename    string
+	ContentType string
+	Hash        string
+
+	data          []byte
+	width, height int
+	thumbnail     []byte
+}
+
+// URL is where the file will be served once saved
+func (u *Upload) URL() string {
+	return FileURL(u.Hash, u.Filename)
+}
+
+// FromRequest checks the files of a multipart form field. The type of each
+// file is sniffed from its content rather than trusted from the browser, and
+// images are cleaned and get a thumbnail. Errors name the offending file.
+func (s *Service) FromRequest(r *http.Request, field string) ([]*Upload, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			if errors.Is(err, http.ErrNotMultipart) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	var headers []*multipart.FileHeader
+	for _, h := range r.MultipartForm.File[field] {
+		// Browsers send an empty part when no file was chosen
+		if h.Filename != "" || h.Size > 0 {
+			headers = append(headers, h)
+		}
+	}
+	if len(headers) > s.maxFiles {
+		return nil, fmt.Errorf("%w: attach at most %d", ErrTooMany, s.maxFiles)
+	}
+
+	var uploads []*Upload
+	for _, h := range headers {
+		u, err := s.prepareFile(h)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cleanFilename(h.Filename), err)
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+func (s *Service) prepareFile(h *multipart.FileHeader) (*Upload, error) {
+	if h.Size > s.maxSize {
+		return nil, fmt.Errorf("%w (the limit is %d MB)", ErrTooLarge, s.maxSize>>20)
+	}
+	f, err := h.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, s.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxSize {
+		return nil, fmt.Errorf("%w (the limit is %d MB)", ErrTooLarge, s.maxSize>>20)
+	}
+	return Prepare(h.Filename, data)
+}
+
+// Prepare checks and cleans a single file
+func Prepare(filename string, data []byte) (*Upload, error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyUpload
+	}
+	contentType := http.DetectContentType(data)
+	if !allowedTypes[contentType] || (contentType == "text/plain; charset=utf-8" && looksLikeMarkup(data)) {
+		return nil, ErrType
+	}
+	u := &Upload{Filename: cleanFilename(filename), ContentType: contentType}
+
+	if IsImageType(contentType) {
+		if err := u.prepareImage(data); err != nil {
+			return nil, err
+		}
+	} else {
+		u.data = data
+	}
+	u.Hash = hashOf(u.data)
+	return u, nil
+}
+
+// looksLikeMarkup reports whether text starts with a tag, a comment or an
+// XML declaration. Content sniffing calls SVG without a declaration plain
+// text, so this keeps SVG and HTML from being uploaded under another name.
+func looksLikeMarkup(data []byte) bool {
+	text := bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")), " \t\r\n\f")
+	if len(text) < 2 || text[0] != '<' {
+		return false
+	}
+	c := text[1]
+	return c == '!' || c == '?' || c == '/' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// prepareImage strips metadata, records the size and makes a thumbnail of
+// images too large to show in full
+func (u *Upload) prepareImage(data []byte) error {
+	cleaned, err := imaging.StripMetadata(data, u.ContentType)
+	if err != nil {
+		return ErrBadImage
+	}
+	u.data = cleaned
+
+	u.width, u.height, err = imaging.Size(cleaned)
+	if err != nil {
+		return ErrBadImage
+	}
+	if u.width*u.height > imaging.MaxPixels {
+		return ErrHugeImage
+	}
+	if u.width <= ThumbnailSize && u.height <= ThumbnailSize {
+		return nil
+	}
+
+	img, _, err := imaging.Decode(cleaned)
+	if err != nil {
+		if errors.Is(err, imaging.ErrTooLarge) {
+			return ErrHugeImage
+		}
+		return ErrBadImage
+	}
+	width, height := imaging.Fit(u.width, u.height, ThumbnailSize)
+	thumb := imaging.Resize(img, width, height)
+	if thumbnailType(u.ContentType) == "image/jpeg" {
+		u.thumbnail, err = imaging.EncodeJPEG(thumb)
+	} else {
+		u.thumbnail, err = imaging.EncodePNG(thumb)
+	}
+	return err
+}
+
+// Embed replaces references like ![diagram](attachment:diagram.png) in
+// Markdown with the URLs of the uploaded files, so they show inline
+func Embed(content string, uploads []*Upload) string {
+	// Longer names first, so "a.png" cannot replace part of "a.png.txt"
+	sorted := append([]*Upload(nil), uploads...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i].Filename) > len(sorted[j].Filename)
+	})
+	for _, u := range sorted {
+		content = strings.ReplaceAll(content, "attachment:"+u.Filename, u.URL())
+	}
+	return content
+}
+
+// cleanFilename keeps the last element of a path without control characters
+// or quotes. Long names are shortened to 100 bytes, keeping the extension.
+func cleanFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' || r == '/' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if len(name) > 100 {
+		ext := path.Ext(name)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)
+		for len(stem)+len(ext) > 100 {
+			_, size := utf8.DecodeLastRuneInString(stem)
+			stem = stem[:len(stem)-size]
+		}
+		name = stem + ext
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
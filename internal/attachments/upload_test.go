@@ -0,0 +1,91 @@
+package attachments
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// pngOf encodes a plain image of the given size and colour
+func pngOf(t *testing.T, width, height int, c color.RGBA) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPrepareRejectsDisguisedFiles(t *testing.T) {
+	tests := []struct {
+		name, filename, data string
+	}{
+		{"SVG", "logo.png", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`},
+		{"SVG with XML declaration", "logo.png", `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`},
+		{"HTML", "photo.png", `<!DOCTYPE html><html><body onload="alert(1)"></body></html>`},
+		{"HTML fragment", "photo.jpg", "  <script>alert(document.cookie)</script>"},
+		{"SVG with byte order mark", "logo.gif", "\xEF\xBB\xBF\n<svg xmlns=\"http://www.w3.org/2000/svg\"/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Prepare(tt.filename, []byte(tt.data)); !errors.Is(err, ErrType) {
+				t.Errorf("Prepare = %v, want ErrType", err)
+			}
+		})
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	if _, err := Prepare("empty.txt", nil); !errors.Is(err, ErrEmptyUpload) {
+		t.Errorf("empty file: %v, want ErrEmptyUpload", err)
+	}
+
+	// The PNG signature followed by garbage sniffs as PNG but cannot be read
+	if _, err := Prepare("broken.png", []byte("\x89PNG\r\n\x1a\nnot really")); !errors.Is(err, ErrBadImage) {
+		t.Errorf("broken image: %v, want ErrBadImage", err)
+	}
+
+	// The type comes from the content, not the name
+	u, err := Prepare("notes.png", []byte("Just some notes, with a < b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("text named .png has type %q", u.ContentType)
+	}
+
+	small, err := Prepare("../../small.png", pngOf(t, 40, 20, color.RGBA{G: 255, A: 255}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.Filename != "small.png" || small.ContentType != "image/png" {
+		t.Errorf("small image = %q %q", small.Filename, small.ContentType)
+	}
+	if small.width != 40 || small.height != 20 || small.thumbnail != nil {
+		t.Errorf("small image is %dx%d with a thumbnail: %v", small.width, small.height, small.thumbnail != nil)
+	}
+
+	large, err := Prepare("large.png", pngOf(t, 960, 240, color.RGBA{B: 255, A: 255}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if large.thumbnail == nil {
+		t.Fatal("large image has no thumbnail")
+	}
+	thumb, err := png.DecodeConfig(bytes.NewReader(large.thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Width != ThumbnailSize || thumb.Height != ThumbnailSize/4 {
+		t.Errorf("thumbnail is %dx%d, want %dx%d", thumb.Width, thumb.Height, ThumbnailSize, ThumbnailSize/4)
+	}
+}
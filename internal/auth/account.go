@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"forum/internal/mailer"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UsernameChangeCooldown is how long a user has to wait between username changes
+const UsernameChangeCooldown = 30 * 24 * time.Hour
+
+// MaxBioLength is the longest bio a user can put on their profile, in characters
+const MaxBioLength = 500
+
+// Placeholder account that owns the posts and comments of anonymized deleted accounts
+const (
+	deletedUsername = "[deleted]"
+	deletedEmail    = "deleted@invalid"
+)
+
+// lockedPassword is stored for accounts nobody may log in as, such as the
+// placeholder and bot accounts. Unlike unusablePassword it never gives way to
+// a password: logins, password checks and password resets all refuse it.
+const lockedPassword = "*"
+
+// ErrNoPassword is returned when a password is checked for an account that
+// has none, such as one created through a provider or proxy. Such accounts
+// confirm it is them with Reauthenticated instead.
+var ErrNoPassword = errors.New("your account has no password, please confirm it is you another way")
+
+// Reauthentication is the proof a user gives before a sensitive change to
+// their account: their current password, or, for accounts without one, a
+// session that recently logged in again with a provider or second factor.
+type Reauthentication struct {
+	Password        string
+	Reauthenticated bool
+}
+
+// validateUsername checks the rules every username has to follow
+func validateUsername(username string) error {
+	if strings.TrimSpace(username) == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if strings.Contains(username, " ") {
+		return fmt.Errorf("username cannot contain spaces")
+	}
+	if strings.EqualFold(username, deletedUsername) {
+		return fmt.Errorf("username already taken")
+	}
+	return nil
+}
+
+// VerifyPassword checks a user's current password. It returns ErrNoPassword
+// for accounts created through a provider or proxy that never set one.
+func (a *AuthService) VerifyPassword(userID int64, password string) error {
+	var hashedPassword string
+	err := a.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&hashedPassword)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+	if hashedPassword == lockedPassword {
+		return fmt.Errorf("current password is incorrect")
+	}
+	if hashedPassword == unusablePassword {
+		return ErrNoPassword
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		return fmt.Errorf("current password is incorrect")
+	}
+	return nil
+}
+
+// Reauthenticate checks the proof a user gave before a sensitive change. A
+// recent reauthentication only counts for accounts without a password;
+// everyone else has to enter theirs.
+func (a *AuthService) Reauthenticate(userID int64, proof Reauthentication) error {
+	err := a.VerifyPassword(userID, proof.Password)
+	if errors.Is(err, ErrNoPassword) && proof.Reauthenticated {
+		return nil
+	}
+	return err
+}
+
+// ChangePassword replaces a user's password after checking the current one,
+// or sets a first password for an account that has none.
+// Callers should revoke the user's other sessions and rotate the current one.
+func (a *AuthService) ChangePassword(userID int64, proof Reauthentication, newPassword string) error {
+	if err := a.Reauthenticate(userID, proof); err != nil {
+		return err
+	}
+	if len(newPassword) < 6 {
+		return fmt.Errorf("password must be at least 6 characters long")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if _, err := a.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	a.notifyPasswordChanged(userID)
+	return nil
+}
+
+// notifyPasswordChanged tells the account owner their password was changed
+func (a *AuthService) notifyPasswordChanged(userID int64) {
+	var username, address string
+	if err := a.db.QueryRow("SELECT username, email FROM users WHERE id = ?", userID).Scan(&username, &address); err != nil {
+		return
+	}
+	if a.mailer == nil {
+		return
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+The password of your forum account was just changed, and every other
+device was signed out.
+
+If you did not do this, reset your password right away:
+%s/forgot-password
+`, username, a.baseURL)
+
+	err := a.mailer.Send(mailer.Message{
+		To:      address,
+		Subject: "Your forum password was changed",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("Failed to send password change notification to %s: %v", address, err)
+	}
+}
+
+// NextUsernameChange returns when the user may change their username again;
+// the zero time means right away
+func (a *AuthService) NextUsernameChange(userID int64) (time.Time, error) {
+	var changedAt sql.NullTime
+	err := a.db.QueryRow("SELECT username_changed_at FROM users WHERE id = ?", userID).Scan(&changedAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to load user: %w", err)
+	}
+	if !changedAt.Valid {
+		return time.Time{}, nil
+	}
+
+	next := changedAt.Time.Add(UsernameChangeCooldown)
+	if time.Now().After(next) {
+		return time.Time{}, nil
+	}
+	return next, nil
+}
+
+// ChangeUsername renames a user, at most once per UsernameChangeCooldown
+func (a *AuthService) ChangeUsername(userID int64, newUsername string) error {
+	newUsername = strings.TrimSpace(newUsername)
+	if err := validateUsername(newUsername); err != nil {
+		return err
+	}
+
+	next, err := a.NextUsernameChange(userID)
+	if err != nil {
+		return err
+	}
+	if !next.IsZero() {
+		return fmt.Errorf("you can change your username again on %s", next.Format("Jan 2, 2006"))
+	}
+
+	var exists bool
+	err = a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? AND id != ?)", newUsername, userID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check username availability: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("username already taken")
+	}
+
+	_, err = a.db.Exec(
+		"UPDATE users SET username = ?, username_changed_at = ? WHERE id = ?",
+		newUsername, time.Now().UTC(), userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to change username: %w", err)
+	}
+	return nil
+}
+
+// Profile is what a user can edit about their public profile page
+type Profile struct {
+	Bio            string
+	ShowLikedPosts bool
+}
+
+// GetProfile returns the editable part of a user's public profile
+func (a *AuthService) GetProfile(userID int64) (*Profile, error) {
+	var p Profile
+	err := a.db.QueryRow("SELECT bio, show_liked_posts FROM users WHERE id = ?", userID).Scan(&p.Bio, &p.ShowLikedPosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load profile: %w", err)
+	}
+	return &p, nil
+}
+
+// UpdateProfile changes a user's bio and whether their profile lists the posts they liked
+func (a *AuthService) UpdateProfile(userID int64, p Profile) error {
+	bio := strings.TrimSpace(strings.ReplaceAll(p.Bio, "\r\n", "\n"))
+	if utf8.RuneCountInString(bio) > MaxBioLength {
+		return fmt.Errorf("bio cannot be longer than %d characters", MaxBioLength)
+	}
+
+	_, err := a.db.Exec("UPDATE users SET bio = ?, show_liked_posts = ? WHERE id = ?", bio, p.ShowLikedPosts, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+	return nil
+}
+
+// deletedUserID returns the placeholder account, creating it on first use
+func deletedUserID(tx *sql.Tx) (int64, error) {
+	_, err := tx.Exec(
+		"INSERT OR IGNORE INTO users (username, email, password_hash, email_verified) VALUES (?, ?, ?, 1)",
+		deletedUsername, deletedEmail, lockedPassword,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create placeholder account: %w", err)
+	}
+
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE email = ?", deletedEmail).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to load placeholder account: %w", err)
+	}
+	return id, nil
+}
+
+// DeleteAccount deletes a user after checking it is them. With anonymize,
+// their posts and comments are kept and attributed to "[deleted]"; otherwise
+// they are deleted along with the account (including replies to their posts).
+func (a *AuthService) DeleteAccount(userID int64, proof Reauthentication, anonymize bool) error {
+	if err := a.Reauthenticate(userID, proof); err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if anonymize {
+		placeholderID, err := deletedUserID(tx)
+		if err != nil {
+			return err
+		}
+		if placeholderID == userID {
+			return fmt.Errorf("this account cannot be deleted")
+		}
+		if _, err := tx.Exec("UPDATE posts SET author_id = ? WHERE author_id = ?", placeholderID, userID); err != nil {
+			return fmt.Errorf("failed to anonymize posts: %w", err)
+		}
+		if _, err := tx.Exec("UPDATE comments SET author_id = ? WHERE author_id = ?", placeholderID, userID); err != nil {
+			return fmt.Errorf("failed to anonymize comments: %w", err)
+		}
+	}
+
+	// Sessions, reactions and tokens go with the account (ON DELETE CASCADE)
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// createPasswordlessUser adds a user the way provider and proxy logins do
+func createPasswordlessUser(t *testing.T, db *sql.DB, username string) int64 {
+	t.Helper()
+	result, err := db.Exec(
+		"INSERT INTO users (username, email, password_hash, email_verified) VALUES (?, ?, ?, 1)",
+		username, username+"@example.com", unusablePassword,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestVerifyPassword(t *testing.T) {
+	a, _ := newTestAuthService(t)
+	if err := a.RegisterUser("alice@example.com", "alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	userID, err := a.AuthenticateUser("alice@example.com", "secret1", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.VerifyPassword(userID, "secret1"); err != nil {
+		t.Errorf("VerifyPassword(correct) = %v", err)
+	}
+	for _, password := range []string{"", "wrong", "!"} {
+		if err := a.VerifyPassword(userID, password); err == nil {
+			t.Errorf("VerifyPassword(%q) succeeded", password)
+		}
+	}
+	user, err := a.GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.HasPassword {
+		t.Error("HasPassword = false for a user who registered with a password")
+	}
+}
+
+func TestPasswordlessAccount(t *testing.T) {
+	a, db := newTestAuthService(t)
+	userID := createPasswordlessUser(t, db, "oidcuser")
+
+	user, err := a.GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.HasPassword {
+		t.Error("HasPassword = true for a provider account")
+	}
+	for _, password := range []string{"", "!"} {
+		if err := a.VerifyPassword(userID, password); !errors.Is(err, ErrNoPassword) {
+			t.Errorf("VerifyPassword(%q) = %v, want %v", password, err, ErrNoPassword)
+		}
+	}
+	if _, err := a.AuthenticateUser(user.Email, "!", "192.0.2.1"); err == nil {
+		t.Error("logged in with the unusable password")
+	}
+
+	// Setting a first password needs the user to have confirmed it is them
+	if err := a.ChangePassword(userID, Reauthentication{}, "secret1"); !errors.Is(err, ErrNoPassword) {
+		t.Fatalf("ChangePassword() without reauthenticating = %v, want %v", err, ErrNoPassword)
+	}
+	if err := a.ChangePassword(userID, Reauthentication{Reauthenticated: true}, "secret1"); err != nil {
+		t.Fatalf("ChangePassword() = %v", err)
+	}
+
+	// From then on the password is required, reauthenticated or not
+	if err := a.VerifyPassword(userID, ""); err == nil || errors.Is(err, ErrNoPassword) {
+		t.Errorf("VerifyPassword(\"\") after a password was set = %v", err)
+	}
+	if err := a.Reauthenticate(userID, Reauthentication{Reauthenticated: true}); err == nil {
+		t.Error("Reauthenticate() accepted a reauthenticated session without the password")
+	}
+	if err := a.VerifyPassword(userID, "secret1"); err != nil {
+		t.Errorf("VerifyPassword(new password) = %v", err)
+	}
+}
+
+func TestDeletePasswordlessAccount(t *testing.T) {
+	a, db := newTestAuthService(t)
+	userID := createPasswordlessUser(t, db, "proxyuser")
+
+	if err := a.DeleteAccount(userID, Reauthentication{}, true); !errors.Is(err, ErrNoPassword) {
+		t.Fatalf("DeleteAccount() without reauthenticating = %v, want %v", err, ErrNoPassword)
+	}
+	if _, err := a.GetUserByID(userID); err != nil {
+		t.Fatalf("account was deleted: %v", err)
+	}
+
+	if err := a.DeleteAccount(userID, Reauthentication{Reauthenticated: true}, true); err != nil {
+		t.Fatalf("DeleteAccount() = %v", err)
+	}
+	if _, err := a.GetUserByID(userID); err == nil {
+		t.Error("account still exists")
+	}
+}
+
+// enableTwoFactor turns on 2FA for a user and returns their recovery codes
+func enableTwoFactor(t *testing.T, a *AuthService, userID int64) []string {
+	t.Helper()
+	secret, _, err := a.BeginTOTPEnrollment(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := a.ConfirmTOTPEnrollment(userID, totpCode(key, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment() = %v", err)
+	}
+	return codes
+}
+
+func TestDisableTwoFactorWithoutPassword(t *testing.T) {
+	a, db := newTestAuthService(t)
+	userID := createPasswordlessUser(t, db, "oidcuser")
+	codes := enableTwoFactor(t, a, userID)
+
+	// The second factor is still checked when there is no password
+	if err := a.DisableTwoFactor(userID, "", "000000"); err == nil {
+		t.Error("DisableTwoFactor() succeeded with a wrong code")
+	}
+	if err := a.DisableTwoFactor(userID, "", codes[0]); err != nil {
+		t.Fatalf("DisableTwoFactor() = %v", err)
+	}
+	if enabled, err := a.TwoFactorEnabled(userID); err != nil || enabled {
+		t.Errorf("TwoFactorEnabled() = %v, %v, want false", enabled, err)
+	}
+}
+
+func TestConfirmSecondFactor(t *testing.T) {
+	a, db := newTestAuthService(t)
+	userID := createPasswordlessUser(t, db, "oidcuser")
+
+	if err := a.ConfirmSecondFactor(userID, "000000"); err == nil {
+		t.Error("ConfirmSecondFactor() succeeded without 2FA")
+	}
+	codes := enableTwoFactor(t, a, userID)
+
+	if err := a.ConfirmSecondFactor(userID, codes[0]); err != nil {
+		t.Fatalf("ConfirmSecondFactor(recovery code) = %v", err)
+	}
+	if err := a.ConfirmSecondFactor(userID, codes[0]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("ConfirmSecondFactor(used recovery code) = %v, want %v", err, ErrInvalidTwoFactorCode)
+	}
+
+	// Wrong codes are throttled like those entered while logging in
+	for i := 1; i < a.lockout.AccountThreshold; i++ {
+		if err := a.ConfirmSecondFactor(userID, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Fatalf("wrong code %d = %v, want %v", i, err, ErrInvalidTwoFactorCode)
+		}
+	}
+	if err := a.ConfirmSecondFactor(userID, codes[1]); !errors.Is(err, ErrLoginThrottled) {
+		t.Errorf("ConfirmSecondFactor() after %d wrong codes = %v, want %v", a.lockout.AccountThreshold, err, ErrLoginThrottled)
+	}
+	if _, err := a.CreateLoginChallenge(userID, false); !errors.Is(err, ErrLoginThrottled) {
+		t.Errorf("CreateLoginChallenge() after wrong codes = %v, want %v", err, ErrLoginThrottled)
+	}
+}
+
+func TestReauthenticatedSession(t *testing.T) {
+	a, db := newTestAuthService(t)
+	userID := createPasswordlessUser(t, db, "oidcuser")
+	sessions := NewSessionService(db)
+
+	token, err := sessions.CreateSession(userID, httptest.NewRequest("POST", "/login", nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/settings", nil)
+	r.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+
+	if sessions.Reauthenticated(r) {
+		t.Error("Reauthenticated() = true for a new session")
+	}
+	if err := sessions.MarkReauthenticated(r); err != nil {
+		t.Fatalf("MarkReauthenticated() = %v", err)
+	}
+	if !sessions.Reauthenticated(r) {
+		t.Error("Reauthenticated() = false right after MarkReauthenticated()")
+	}
+	if err := a.Reauthenticate(userID, Reauthentication{Reauthenticated: sessions.Reauthenticated(r)}); err != nil {
+		t.Errorf("Reauthenticate() = %v", err)
+	}
+
+	if _, err := db.Exec("UPDATE sessions SET reauthenticated_at = ?", time.Now().UTC().Add(-ReauthenticationWindow)); err != nil {
+		t.Fatal(err)
+	}
+	if sessions.Reauthenticated(r) {
+		t.Error("Reauthenticated() = true after the window")
+	}
+
+	other := httptest.NewRequest("GET", "/settings", nil)
+	other.AddCookie(&http.Cookie{Name: "session_token", Value: "not-a-session"})
+	if err := sessions.MarkReauthenticated(other); err == nil {
+		t.Error("MarkReauthenticated() succeeded without a valid session")
+	}
+}
+
+func TestLockedAccounts(t *testing.T) {
+	a, db := newTestAuthService(t)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholderID, err := deletedUserID(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	botID, err := a.BotUser("deploybot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userID := range []int64{placeholderID, botID} {
+		user, err := a.GetUserByID(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.HasPassword {
+			t.Errorf("HasPassword = true for %s", user.Username)
+		}
+		for _, password := range []string{"", "*", "!"} {
+			if err := a.VerifyPassword(userID, password); err == nil {
+				t.Errorf("VerifyPassword(%q) succeeded for %s", password, user.Username)
+			}
+			if _, err := a.AuthenticateUser(user.Email, password, "192.0.2.1"); err == nil {
+				t.Errorf("logged in as %s with %q", user.Username, password)
+			}
+		}
+		if err := a.RequestPasswordReset(user.Email); err != nil {
+			t.Errorf("RequestPasswordReset(%s) = %v", user.Email, err)
+		}
+	}
+
+	var resets int
+	if err := db.QueryRow("SELECT COUNT(*) FROM password_resets").Scan(&resets); err != nil {
+		t.Fatal(err)
+	}
+	if resets != 0 {
+		t.Errorf("%d password resets were issued for locked accounts", resets)
+	}
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// API token scopes
+const (
+	ScopeRead  = "read"  // Read posts and comments
+	ScopeWrite = "write" // Create and delete posts and comments
+	ScopeReact = "react" // Like and dislike
+)
+
+// Scopes lists every API token scope in display order
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeReact}
+
+const (
+	// apiTokenPrefix marks forum tokens so secret scanners can find leaked ones
+	apiTokenPrefix        = "forum_pat_"
+	maxAPITokensPerUser   = 20
+	maxAPITokenNameLength = 50
+)
+
+// ErrInvalidAPIToken is returned for unknown, expired or revoked tokens
+var ErrInvalidAPIToken = errors.New("invalid or expired API token")
+
+// APIToken is a personal access token as shown in the account settings
+type APIToken struct {
+	ID         int64
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // Zero if the token never expires
+	LastUsedAt time.Time // Zero if never used
+	LastUsedIP string
+}
+
+// Expired reports whether the token can no longer be used
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+// HasScope reports whether the token grants the scope
+func (t APIToken) HasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIToken mints a personal access token and returns it. Only its hash
+// is stored, so it cannot be shown again. A zero lifetime never expires.
+func (s *SessionService) CreateAPIToken(userID int64, name string, scopes []string, lifetime time.Duration) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("token name cannot be empty")
+	}
+	if utf8.RuneCountInString(name) > maxAPITokenNameLength {
+		return "", fmt.Errorf("token name must be at most %d characters", maxAPITokenNameLength)
+	}
+
+	// Scopes are stored once each, in display order, however they were asked for
+	for _, scope := range scopes {
+		if !hasScope(Scopes, scope) {
+			return "", fmt.Errorf("unknown token scope %q", scope)
+		}
+	}
+	var granted []string
+	for _, scope := range Scopes {
+		if hasScope(scopes, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	if len(granted) == 0 {
+		return "", fmt.Errorf("select at least one scope")
+	}
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return "", fmt.Errorf("failed to count tokens: %w", err)
+	}
+	if count >= maxAPITokensPerUser {
+		return "", fmt.Errorf("you can have at most %d API tokens", maxAPITokensPerUser)
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + secret
+
+	now := time.Now().UTC()
+	var expiresAt sql.NullTime
+	if lifetime > 0 {
+		expiresAt = sql.NullTime{Time: now.Add(lifetime), Valid: true}
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, name, hashToken(token), strings.Join(granted, ","), expiresAt, now,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token: %w", err)
+	}
+	return token, nil
+}
+
+// ListAPITokens returns the user's tokens, newest first
+func (s *SessionService) ListAPITokens(userID int64) ([]APIToken, error) {
+	rows, err := s.db.Query(
+		"SELECT id, name, scopes, created_at, expires_at, last_used_at, last_used_ip FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+		var expiresAt, lastUsed sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &expiresAt, &lastUsed, &t.LastUsedIP); err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			t.ExpiresAt = expiresAt.Time
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = lastUsed.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken deletes one of the user's tokens
+func (s *SessionService) RevokeAPIToken(userID, tokenID int64) error {
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("token not found")
+	}
+	return nil
+}
+
+// AuthenticateAPIToken returns the user and scopes of a valid token and
+// records its use
+func (s *SessionService) AuthenticateAPIToken(token, ip string) (int64, []string, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return 0, nil, ErrInvalidAPIToken
+	}
+
+	var id, userID int64
+	var scopes string
+	var expiresAt, lastUsed sql.NullTime
+	err := s.db.QueryRow(
+		"SELECT id, user_id, scopes, expires_at, last_used_at FROM api_tokens WHERE token_hash = ?",
+		hashToken(token),
+	).Scan(&id, &userID, &scopes, &expiresAt, &lastUsed)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil, ErrInvalidAPIToken
+		}
+		return 0, nil, fmt.Errorf("failed to load token: %w", err)
+	}
+	if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+		return 0, nil, ErrInvalidAPIToken
+	}
+
+	now := time.Now().UTC()
+	if !lastUsed.Valid || now.Sub(lastUsed.Time) >= lastSeenResolution {
+		s.db.Exec("UPDATE api_tokens SET last_used_at = ?, last_used_ip = ? WHERE id = ?", now, ip, id)
+	}
+	return userID, strings.Split(scopes, ","), nil
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header, or ""
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
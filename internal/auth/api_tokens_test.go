@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateAPITokenScopes(t *testing.T) {
+	_, db := newTestAuthService(t)
+	sessions := NewSessionService(db)
+	userID := createPasswordlessUser(t, db, "alice")
+
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    string // Stored scopes, or the start of the error
+		wantErr bool
+	}{
+		{"one scope", []string{ScopeRead}, "read", false},
+		{"repeated scope", []string{ScopeRead, ScopeRead}, "read", false},
+		{"display order", []string{ScopeReact, ScopeRead, ScopeWrite, ScopeRead}, "read,write,react", false},
+		{"unknown scope", []string{ScopeRead, "admin"}, `unknown token scope "admin"`, true},
+		{"no scopes", nil, "select at least one scope", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := sessions.CreateAPIToken(userID, tt.name, tt.scopes, time.Hour)
+			if tt.wantErr {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+					t.Errorf("CreateAPIToken(%q) = %v, want %s", tt.scopes, err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateAPIToken(%q) = %v", tt.scopes, err)
+			}
+
+			id, scopes, err := sessions.AuthenticateAPIToken(token, "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != userID || strings.Join(scopes, ",") != tt.want {
+				t.Errorf("token of user %d has scopes %q, want user %d with %s", id, scopes, userID, tt.want)
+			}
+		})
+	}
+}
@@ -2,21 +2,72 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/mail"
-	"strings"
+	"time"
+
+	"forum/internal/mailer"
+	"forum/internal/oidc"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// User roles
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 // AuthService handles user authentication
 type AuthService struct {
-	db *sql.DB
+	db      *sql.DB
+	lockout LockoutConfig
+	mailer  mailer.Mailer
+	baseURL string // Public URL of the forum, used in emailed links
+
+	verification  VerificationPolicy
+	oidcProviders []*oidc.Provider
+	onRegister    RegistrationHook
 }
 
+// RegistrationHook is called after a new account is created. method is
+// "password", "proxy", "bot" or the name of the OIDC provider the user signed
+// up with.
+type RegistrationHook func(userID int64, method string)
+
 // NewAuthService creates a new authentication service
 func NewAuthService(db *sql.DB) *AuthService {
-	return &AuthService{db: db}
+	return &AuthService{
+		db:           db,
+		lockout:      DefaultLockoutConfig(),
+		baseURL:      "http://localhost:8080",
+		verification: DefaultVerificationPolicy(),
+	}
+}
+
+// SetMailer sets the mailer used to notify users about their account
+func (a *AuthService) SetMailer(m mailer.Mailer) {
+	a.mailer = m
+}
+
+// SetRegistrationHook sets a function to call after each new account
+func (a *AuthService) SetRegistrationHook(hook RegistrationHook) {
+	a.onRegister = hook
+}
+
+// registered runs the registration hook, if there is one
+func (a *AuthService) registered(userID int64, method string) {
+	if a.onRegister != nil {
+		a.onRegister(userID, method)
+	}
+}
+
+// SetLockoutConfig overrides the login throttling configuration
+func (a *AuthService) SetLockoutConfig(config LockoutConfig) {
+	a.lockout = config
 }
 
 // RegisterUser creates a new user account
@@ -27,11 +78,8 @@ func (a *AuthService) RegisterUser(email, username, password string) error {
 	}
 
 	// Validate input
-	if strings.TrimSpace(username) == "" {
-		return fmt.Errorf("username cannot be empty")
-	}
-	if strings.Contains(username, " ") {
-		return fmt.Errorf("username cannot contain spaces")
+	if err := validateUsername(username); err != nil {
+		return err
 	}
 	if len(password) < 6 {
 		return fmt.Errorf("password must be at least 6 characters long")
@@ -62,8 +110,8 @@ func (a *AuthService) RegisterUser(email, username, password string) error {
 		return fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	// Insert user
-	_, err = a.db.Exec(
+	// Insert user; the account stays unverified until the emailed link is opened
+	result, err := a.db.Exec(
 		"INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)",
 		username, email, string(hashedPassword),
 	)
@@ -71,11 +119,28 @@ func (a *AuthService) RegisterUser(email, username, password string) error {
 		return fmt.Errorf("failed to create user: %w", err)
 	}
 
+	// A failed email does not undo the registration; the user can ask for another one
+	if userID, err := result.LastInsertId(); err == nil {
+		if err := a.sendVerification(userID, username, email); err != nil {
+			log.Printf("Could not send verification email to %s: %v", email, err)
+		}
+		a.registered(userID, "password")
+	}
+
 	return nil
 }
 
-// AuthenticateUser validates user credentials and returns user ID
-func (a *AuthService) AuthenticateUser(email, password string) (int64, error) {
+// AuthenticateUser validates user credentials and returns user ID.
+// Failed attempts are tracked per email and per client IP; repeated failures
+// cause exponential backoff and then a temporary lockout (ErrLoginThrottled).
+func (a *AuthService) AuthenticateUser(email, password, ip string) (int64, error) {
+	now := time.Now().UTC()
+	attemptEmail := normalizeLoginEmail(email)
+
+	if err := a.checkLoginAllowed(attemptEmail, ip, now); err != nil {
+		return 0, err
+	}
+
 	var userID int64
 	var hashedPassword string
 
@@ -86,31 +151,114 @@ func (a *AuthService) AuthenticateUser(email, password string) (int64, error) {
 
 	if err != nil {
 		if err == sql.ErrNoRows {
+			if err := a.recordLoginFailure(attemptEmail, ip, now); err != nil {
+				return 0, err
+			}
 			return 0, fmt.Errorf("invalid email or password")
 		}
 		return 0, fmt.Errorf("failed to authenticate user: %w", err)
 	}
 
 	// Check password
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	if hashedPassword == lockedPassword {
+		err = bcrypt.ErrMismatchedHashAndPassword
+	} else {
+		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	}
 	if err != nil {
+		if err := a.recordLoginFailure(attemptEmail, ip, now); err != nil {
+			return 0, err
+		}
 		return 0, fmt.Errorf("invalid email or password")
 	}
 
+	if err := a.recordLoginAttempt(attemptEmail, ip, true, now); err != nil {
+		return 0, err
+	}
+
 	return userID, nil
 }
 
+// GrantAdmin gives the admin role to the user with the given email
+func (a *AuthService) GrantAdmin(email string) error {
+	var userID int64
+	var role string
+	err := a.db.QueryRow("SELECT id, role FROM users WHERE email = ?", email).Scan(&userID, &role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user not found")
+		}
+		return fmt.Errorf("failed to grant admin role: %w", err)
+	}
+	if role == RoleAdmin {
+		return nil
+	}
+	return a.SetUserRole(userID, RoleAdmin)
+}
+
+// SetUserRole changes a user's role. Privilege changes invalidate all of the
+// user's sessions, so they have to log in again and get fresh tokens.
+func (a *AuthService) SetUserRole(userID int64, role string) error {
+	if role != RoleUser && role != RoleModerator && role != RoleAdmin {
+		return fmt.Errorf("invalid role")
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET role = ? WHERE id = ? AND role != ?", role, userID, role)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// Unknown user or role unchanged
+		return nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListUsers returns all users ordered by username
+func (a *AuthService) ListUsers() ([]User, error) {
+	rows, err := a.db.Query("SELECT id, username, email, role, email_verified, created_at FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// ErrUserNotFound is returned for user IDs that have no account, such as
+// that of an account deleted while one of its sessions was in use
+var ErrUserNotFound = errors.New("user not found")
+
 // GetUserByID retrieves user information by ID
 func (a *AuthService) GetUserByID(userID int64) (*User, error) {
 	var user User
 	err := a.db.QueryRow(
-		"SELECT id, username, email, created_at FROM users WHERE id = ?",
-		userID,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+		"SELECT id, username, email, role, email_verified, created_at, password_hash NOT IN (?, ?) FROM users WHERE id = ?",
+		unusablePassword, lockedPassword, userID,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &user.CreatedAt, &user.HasPassword)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -120,8 +268,16 @@ func (a *AuthService) GetUserByID(userID int64) (*User, error) {
 
 // User represents a user in the system
 type User struct {
-	ID        int64  `json:"id"`
-	Username  string `json:"username"`
-	Email     string `json:"email"`
-	CreatedAt string `json:"created_at"`
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"email_verified"`
+	CreatedAt     string `json:"created_at"`
+	HasPassword   bool   `json:"-"` // False for accounts created through a provider or proxy
+}
+
+// IsAdmin reports whether the user has the admin role
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
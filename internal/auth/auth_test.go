@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"forum/internal/database"
+)
+
+// newTestAuthService returns an AuthService on a fresh database
+func newTestAuthService(t *testing.T) (*AuthService, *sql.DB) {
+	t.Helper()
+
+	// InitializeDatabase reads the migrations relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("..", "..")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := database.NewDB(&database.Config{
+		DSN:          filepath.Join(t.TempDir(), "forum.db"),
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	return NewAuthService(db.DB), db.DB
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// botEmailDomain is used for the email address of bot accounts. The .invalid
+// top-level domain never resolves, so no mail, such as a password reset
+// link, can reach anyone.
+const botEmailDomain = "bots.invalid"
+
+// BotUser returns the account used by integrations that post under the given
+// username. An existing account with that username is used as it is;
+// otherwise a bot account is created that has no password and cannot log in.
+func (a *AuthService) BotUser(username string) (int64, error) {
+	username = strings.TrimSpace(username)
+	if err := validateUsername(username); err != nil {
+		return 0, err
+	}
+
+	var userID int64
+	err := a.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	result, err := a.db.Exec(
+		"INSERT INTO users (username, email, password_hash, email_verified) VALUES (?, ?, ?, 1)",
+		username, strings.ToLower(username)+"@"+botEmailDomain, lockedPassword,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create bot account: %w", err)
+	}
+	if userID, err = result.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("failed to create bot account: %w", err)
+	}
+	a.registered(userID, "bot")
+	return userID, nil
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For header is
+// believed. It is set once at startup, before the server accepts requests.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the networks of the reverse proxies in front of the
+// forum. Requests from them are attributed to the client address they forward.
+func SetTrustedProxies(networks []*net.IPNet) {
+	trustedProxies = networks
+}
+
+// ClientIP returns the IP address of the client that sent the request. Behind
+// a trusted proxy this is the last address in X-Forwarded-For that was not
+// added by one of the trusted proxies; otherwise it is the connection's peer.
+func ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// Each proxy appends the address it received the request from, so the
+	// header is read from the right; addresses left of the first untrusted
+	// one could have been made up by the client
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteIP returns the address of the connection's peer, which may be a proxy
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isTrustedProxy(address string) bool {
+	return inNetworks(address, trustedProxies)
+}
+
+// inNetworks reports whether an IP address is in any of the networks
+func inNetworks(address string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
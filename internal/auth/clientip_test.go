@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	networks, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTrustedProxies(networks)
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"untrusted peer cannot forward", "203.0.113.5:4000", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed hops left of the client are ignored", "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.2:4000", []string{"198.51.100.7, 192.168.1.1, 10.0.0.9"}, "198.51.100.7"},
+		{"repeated headers", "10.0.0.2:4000", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"garbage stops the walk", "10.0.0.2:4000", []string{"198.51.100.7, nonsense"}, "10.0.0.2"},
+		{"trusted proxy without header", "10.0.0.2:4000", nil, "10.0.0.2"},
+		{"IPv6 client", "[2001:db8::1]:4000", nil, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// CSRF token transport names
+const (
+	CSRFFieldName  = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+	csrfCookieName = "csrf_token"
+)
+
+// CSRFProtection issues CSRF tokens and verifies them on state-changing requests.
+// Logged-in users get the token stored with their session; anonymous visitors
+// (login and registration forms) get a random token in a cookie instead.
+type CSRFProtection struct {
+	sessionService *SessionService
+	errorHandler   *HTTPErrorHandler
+	exempt         map[string]bool
+}
+
+// NewCSRFProtection creates a new CSRF protection middleware
+func NewCSRFProtection(sessionService *SessionService, errorHandler *HTTPErrorHandler) *CSRFProtection {
+	return &CSRFProtection{
+		sessionService: sessionService,
+		errorHandler:   errorHandler,
+		exempt:         map[string]bool{},
+	}
+}
+
+// Exempt skips the check for paths whose requests prove themselves another
+// way, such as signed links posted by mail clients
+func (c *CSRFProtection) Exempt(paths ...string) {
+	for _, path := range paths {
+		c.exempt[path] = true
+	}
+}
+
+// Protect makes the request's CSRF token available to handlers and rejects
+// unsafe requests that do not carry it
+func (c *CSRFProtection) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := c.tokenFor(w, r)
+
+		// Browsers cannot attach an Authorization header to a cross-site
+		// request, so token-only requests need no CSRF token. Any session
+		// cookie still does, and token requests never use cookies anyway.
+		if !isSafeMethod(r.Method) && !bearerOnly(r) && !c.exempt[r.URL.Path] {
+			submitted := r.Header.Get(CSRFHeaderName)
+			if submitted == "" {
+				submitted = r.PostFormValue(CSRFFieldName)
+			}
+			if submitted == "" || token.value == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(token.value)) != 1 {
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					// API clients get the API's error envelope instead of a page
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(`{"error":{"status":403,"code":"csrf_failed","message":"missing or invalid X-CSRF-Token header"}}` + "\n"))
+					return
+				}
+				c.errorHandler.Handle403(w, r, "Your form has expired or was submitted from another site. Please go back, reload the page and try again.")
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), "csrfToken", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// csrfToken is a request's CSRF token. Anonymous visitors without a token
+// cookie get one only when a page asks for it, so feeds, files and API
+// responses do not set cookies on clients that never submit forms.
+type csrfToken struct {
+	value string
+	w     http.ResponseWriter
+}
+
+// get returns the token, creating the anonymous visitor cookie on first use.
+// It must be called before the response headers are written.
+func (t *csrfToken) get() string {
+	if t.value != "" || t.w == nil {
+		return t.value
+	}
+	value, err := randomToken(32)
+	if err != nil {
+		// Forms then fail the check and the visitor can try again
+		return ""
+	}
+	http.SetCookie(t.w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	t.value, t.w = value, nil
+	return t.value
+}
+
+// tokenFor returns the CSRF token of the request's session, or of the anonymous
+// visitor cookie (created when first used) when there is no valid session
+func (c *CSRFProtection) tokenFor(w http.ResponseWriter, r *http.Request) *csrfToken {
+	if cookie, err := r.Cookie("session_token"); err == nil {
+		if token, err := c.sessionService.CSRFToken(cookie.Value); err == nil {
+			return &csrfToken{value: token}
+		}
+	}
+
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return &csrfToken{value: cookie.Value}
+	}
+	return &csrfToken{w: w}
+}
+
+// bearerOnly reports whether the request authenticates with an API token and
+// carries no session cookie
+func bearerOnly(r *http.Request) bool {
+	if BearerToken(r) == "" {
+		return false
+	}
+	_, err := r.Cookie("session_token")
+	return err != nil
+}
+
+// isSafeMethod reports whether the method must not change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFToken returns the CSRF token for the current request. For anonymous
+// visitors the first call sets the token cookie, so it must come before the
+// response is written.
+func CSRFToken(r *http.Request) string {
+	token, ok := r.Context().Value("csrfToken").(*csrfToken)
+	if !ok {
+		return ""
+	}
+	return token.get()
+}
+
+// CSRFField renders the hidden form field carrying a CSRF token
+func CSRFField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + CSRFFieldName + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
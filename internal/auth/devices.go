@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"forum/internal/mailer"
+)
+
+// lastSeenResolution limits how often a session's last-seen time is written
+const lastSeenResolution = time.Minute
+
+// DeviceSession describes one of a user's active sessions
+type DeviceSession struct {
+	ID         int64
+	Device     string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	Current    bool
+}
+
+// ListUserSessions returns the active sessions of a user, most recently used first.
+// The session identified by currentToken is flagged as the current one.
+func (s *SessionService) ListUserSessions(userID int64, currentToken string) ([]DeviceSession, error) {
+	rows, err := s.db.Query(`
+		SELECT id, token, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY COALESCE(last_seen_at, created_at) DESC`,
+		userID, time.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	currentHash := hashToken(currentToken)
+	defer rows.Close()
+
+	var sessions []DeviceSession
+	for rows.Next() {
+		var ds DeviceSession
+		var token string
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&ds.ID, &token, &ds.UserAgent, &ds.IPAddress, &ds.CreatedAt, &lastSeen, &ds.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		ds.LastSeenAt = ds.CreatedAt
+		if lastSeen.Valid {
+			ds.LastSeenAt = lastSeen.Time
+		}
+		ds.Device = DescribeUserAgent(ds.UserAgent)
+		ds.Current = token == currentHash
+		sessions = append(sessions, ds)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes one of the user's sessions
+func (s *SessionService) RevokeSession(userID, sessionID int64) error {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
+
+// RevokeOtherSessions deletes every session of the user except the current one
+func (s *SessionService) RevokeOtherSessions(userID int64, currentToken string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ? AND token != ?", userID, hashToken(currentToken))
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// NewDeviceNotifications reports whether the user wants an email on logins from new devices
+func (s *SessionService) NewDeviceNotifications(userID int64) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("SELECT notify_new_device FROM users WHERE id = ?", userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to load notification setting: %w", err)
+	}
+	return enabled, nil
+}
+
+// SetNewDeviceNotifications turns new device login emails on or off for a user
+func (s *SessionService) SetNewDeviceNotifications(userID int64, enabled bool) error {
+	_, err := s.db.Exec("UPDATE users SET notify_new_device = ? WHERE id = ?", enabled, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update notification setting: %w", err)
+	}
+	return nil
+}
+
+// touchSession records that a session was just used
+func (s *SessionService) touchSession(token string) {
+	now := time.Now().UTC()
+	s.db.Exec(
+		"UPDATE sessions SET last_seen_at = ? WHERE token = ? AND (last_seen_at IS NULL OR last_seen_at < ?)",
+		now, hashToken(token), now.Add(-lastSeenResolution),
+	)
+}
+
+// rememberDevice records the device a user logged in from and, if the user
+// asked for it, emails them when the device has not been seen before
+func (s *SessionService) rememberDevice(userID int64, userAgent, ip string, now time.Time) {
+	sum := sha256.Sum256([]byte(userAgent))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	result, err := s.db.Exec(`
+		INSERT INTO known_devices (user_id, fingerprint, first_seen_at, last_seen_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, fingerprint) DO NOTHING`,
+		userID, fingerprint, now, now,
+	)
+	if err != nil {
+		log.Printf("Failed to record device for user %d: %v", userID, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// Known device
+		s.db.Exec("UPDATE known_devices SET last_seen_at = ? WHERE user_id = ? AND fingerprint = ?", now, userID, fingerprint)
+		return
+	}
+
+	var username, email string
+	var notify, firstDevice bool
+	err = s.db.QueryRow(`
+		SELECT username, email, notify_new_device,
+			(SELECT COUNT(1) FROM known_devices WHERE user_id = users.id) = 1
+		FROM users WHERE id = ?`,
+		userID,
+	).Scan(&username, &email, &notify, &firstDevice)
+	if err != nil || !notify || firstDevice {
+		return
+	}
+
+	if s.mailer == nil {
+		log.Printf("New device login for user %d (no mailer configured)", userID)
+		return
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Your forum account was just signed in to from a new device:
+
+  Device:     %s
+  IP address: %s
+  Time:       %s
+
+If this was you, there is nothing to do. If not, sign out that device from
+"Your devices" in your account settings and change your password.
+`, username, DescribeUserAgent(userAgent), ip, now.Format("Jan 2, 2006 at 3:04 PM MST"))
+
+	err = s.mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "New sign-in to your forum account",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("Failed to send new device notification to %s: %v", email, err)
+	}
+}
+
+// DescribeUserAgent turns a User-Agent header into a short "Browser on OS" label
+func DescribeUserAgent(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		return "curl"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		os = "iOS"
+	case strings.Contains(ua, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
@@ -25,6 +25,14 @@ func (h *HTTPErrorHandler) Handle404(w http.ResponseWriter, r *http.Request) {
 	h.handleError(w, r, http.StatusNotFound, "Page Not Found", "The page you are looking for does not exist.")
 }
 
+// Handle403 handles 403 Forbidden errors
+func (h *HTTPErrorHandler) Handle403(w http.ResponseWriter, r *http.Request, message string) {
+	if message == "" {
+		message = "You do not have permission to perform this action."
+	}
+	h.handleError(w, r, http.StatusForbidden, "Forbidden", message)
+}
+
 // Handle500 handles 500 Internal Server Error
 func (h *HTTPErrorHandler) Handle500(w http.ResponseWriter, r *http.Request, err error) {
 	if h.logger != nil {
@@ -41,8 +49,18 @@ func (h *HTTPErrorHandler) Handle400(w http.ResponseWriter, r *http.Request, mes
 	h.handleError(w, r, http.StatusBadRequest, "Bad Request", message)
 }
 
+// Handle413 handles 413 Request Entity Too Large errors
+func (h *HTTPErrorHandler) Handle413(w http.ResponseWriter, r *http.Request, message string) {
+	if message == "" {
+		message = "The request is too large."
+	}
+	h.handleError(w, r, http.StatusRequestEntityTooLarge, "Request Too Large", message)
+}
+
 // handleError is the core error handling function
 func (h *HTTPErrorHandler) handleError(w http.ResponseWriter, r *http.Request, statusCode int, title, message string) {
+	// Read before the status is written, since it may set the token cookie
+	csrfToken := CSRFToken(r)
 	w.WriteHeader(statusCode)
 
 	// Try to render the error template
@@ -54,6 +72,7 @@ func (h *HTTPErrorHandler) handleError(w http.ResponseWriter, r *http.Request, s
 			Message    string
 			BackURL    string
 			User       interface{} // Add User field for layout compatibility
+			CSRFToken  string
 		}{
 			Title:      title,
 			StatusCode: statusCode,
@@ -61,6 +80,7 @@ func (h *HTTPErrorHandler) handleError(w http.ResponseWriter, r *http.Request, s
 			Message:    message,
 			BackURL:    "/", // Default back URL
 			User:       nil, // No user for error pages
+			CSRFToken:  csrfToken,
 		}
 
 		// Set appropriate back URL based on the error
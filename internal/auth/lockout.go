@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"forum/internal/mailer"
+)
+
+// ErrLoginThrottled is returned while an email or IP address is backing off or locked out.
+// It is returned for unknown emails too, so it does not reveal which accounts exist.
+var ErrLoginThrottled = errors.New("too many failed login attempts, please try again later")
+
+// Lockout scopes
+const (
+	LockoutScopeEmail = "email"
+	LockoutScopeIP    = "ip"
+)
+
+// LockoutConfig controls how failed logins are throttled
+type LockoutConfig struct {
+	Window           time.Duration // Failures older than this are forgotten
+	BackoffThreshold int           // Failures allowed before delays kick in
+	BaseDelay        time.Duration // Delay after the first throttled failure, doubled after each one
+	MaxDelay         time.Duration // Upper bound for the backoff delay
+	AccountThreshold int           // Failures per email before it is locked out
+	IPThreshold      int           // Failures per IP address before it is locked out
+	LockoutDuration  time.Duration // How long a lockout lasts
+}
+
+// DefaultLockoutConfig returns the default login throttling configuration
+func DefaultLockoutConfig() LockoutConfig {
+	return LockoutConfig{
+		Window:           15 * time.Minute,
+		BackoffThreshold: 3,
+		BaseDelay:        2 * time.Second,
+		MaxDelay:         time.Minute,
+		AccountThreshold: 10,
+		IPThreshold:      50,
+		LockoutDuration:  30 * time.Minute,
+	}
+}
+
+// Lockout represents an active login lockout
+type Lockout struct {
+	ID          int64
+	Scope       string
+	Subject     string
+	LockedUntil time.Time
+	CreatedAt   time.Time
+}
+
+// normalizeLoginEmail returns the key used to track attempts for an email
+func normalizeLoginEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginAllowed returns ErrLoginThrottled if the email or IP is locked out or still backing off
+func (a *AuthService) checkLoginAllowed(email, ip string, now time.Time) error {
+	var locked bool
+	err := a.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM login_lockouts
+			WHERE ((scope = ? AND subject = ?) OR (scope = ? AND subject = ?)) AND locked_until > ?
+		)`,
+		LockoutScopeEmail, email, LockoutScopeIP, ip, now,
+	).Scan(&locked)
+	if err != nil {
+		return fmt.Errorf("failed to check login lockout: %w", err)
+	}
+	if locked {
+		return ErrLoginThrottled
+	}
+
+	failures, lastFailure, err := a.recentEmailFailures(email, now)
+	if err != nil {
+		return err
+	}
+	if failures >= a.lockout.BackoffThreshold && now.Sub(lastFailure) < a.backoffDelay(failures) {
+		return ErrLoginThrottled
+	}
+
+	return nil
+}
+
+// backoffDelay returns how long to wait after the given number of consecutive failures
+func (a *AuthService) backoffDelay(failures int) time.Duration {
+	delay := a.lockout.BaseDelay
+	for i := a.lockout.BackoffThreshold; i < failures; i++ {
+		delay *= 2
+		if delay >= a.lockout.MaxDelay {
+			return a.lockout.MaxDelay
+		}
+	}
+	return delay
+}
+
+// recentEmailFailures counts failures for an email since its last successful login
+// (within the window) and returns the time of the most recent one
+func (a *AuthService) recentEmailFailures(email string, now time.Time) (int, time.Time, error) {
+	since := now.Add(-a.lockout.Window)
+
+	var lastSuccess time.Time
+	err := a.db.QueryRow(
+		"SELECT created_at FROM login_attempts WHERE email = ? AND success = 1 ORDER BY created_at DESC LIMIT 1",
+		email,
+	).Scan(&lastSuccess)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, time.Time{}, fmt.Errorf("failed to load last successful login: %w", err)
+	}
+	if lastSuccess.After(since) {
+		since = lastSuccess
+	}
+
+	var count int
+	err = a.db.QueryRow(
+		"SELECT COUNT(1) FROM login_attempts WHERE email = ? AND success = 0 AND created_at > ?",
+		email, since,
+	).Scan(&count)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to count failed logins: %w", err)
+	}
+	if count == 0 {
+		return 0, time.Time{}, nil
+	}
+
+	var lastFailure time.Time
+	err = a.db.QueryRow(
+		"SELECT created_at FROM login_attempts WHERE email = ? AND success = 0 ORDER BY created_at DESC LIMIT 1",
+		email,
+	).Scan(&lastFailure)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to load last failed login: %w", err)
+	}
+
+	return count, lastFailure, nil
+}
+
+// recordLoginAttempt stores the outcome of a login attempt
+func (a *AuthService) recordLoginAttempt(email, ip string, success bool, now time.Time) error {
+	_, err := a.db.Exec(
+		"INSERT INTO login_attempts (email, ip_address, success, created_at) VALUES (?, ?, ?, ?)",
+		email, ip, success, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record login attempt: %w", err)
+	}
+	return nil
+}
+
+// recordLoginFailure stores a failed login and locks the email or IP out once a threshold is reached
+func (a *AuthService) recordLoginFailure(email, ip string, now time.Time) error {
+	if err := a.recordLoginAttempt(email, ip, false, now); err != nil {
+		return err
+	}
+
+	emailFailures, _, err := a.recentEmailFailures(email, now)
+	if err != nil {
+		return err
+	}
+	if emailFailures >= a.lockout.AccountThreshold {
+		if err := a.lock(LockoutScopeEmail, email, now); err != nil {
+			return err
+		}
+		a.notifyLockout(email, ip, emailFailures, now.Add(a.lockout.LockoutDuration))
+	}
+
+	var ipFailures int
+	err = a.db.QueryRow(
+		"SELECT COUNT(1) FROM login_attempts WHERE ip_address = ? AND success = 0 AND created_at > ?",
+		ip, now.Add(-a.lockout.Window),
+	).Scan(&ipFailures)
+	if err != nil {
+		return fmt.Errorf("failed to count failed logins: %w", err)
+	}
+	if ipFailures >= a.lockout.IPThreshold {
+		if err := a.lock(LockoutScopeIP, ip, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lock creates or extends a lockout
+func (a *AuthService) lock(scope, subject string, now time.Time) error {
+	_, err := a.db.Exec(`
+		INSERT INTO login_lockouts (scope, subject, locked_until, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(scope, subject) DO UPDATE SET locked_until = excluded.locked_until, created_at = excluded.created_at`,
+		scope, subject, now.Add(a.lockout.LockoutDuration), now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to lock out %s: %w", scope, err)
+	}
+	return nil
+}
+
+// notifyLockout tells the account owner (if the email belongs to an account) that it was locked
+func (a *AuthService) notifyLockout(email, ip string, failures int, until time.Time) {
+	var username, address string
+	err := a.db.QueryRow(
+		"SELECT username, email FROM users WHERE LOWER(email) = ?",
+		email,
+	).Scan(&username, &address)
+	if err != nil {
+		// No account for this email, nobody to notify
+		return
+	}
+
+	if a.mailer == nil {
+		log.Printf("Login lockout for %s (no mailer configured)", address)
+		return
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+We temporarily locked sign-in to your forum account after %d failed login attempts.
+The most recent attempt came from %s.
+
+You can try again after %s. If these attempts were not made by you,
+we recommend choosing a stronger password once you are back in.
+`, username, failures, ip, until.Format("Jan 2, 2006 at 3:04 PM MST"))
+
+	err = a.mailer.Send(mailer.Message{
+		To:      address,
+		Subject: "Your forum account was temporarily locked",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("Failed to send lockout notification to %s: %v", address, err)
+	}
+}
+
+// ListActiveLockouts returns all lockouts that have not expired yet
+func (a *AuthService) ListActiveLockouts() ([]Lockout, error) {
+	rows, err := a.db.Query(`
+		SELECT id, scope, subject, locked_until, created_at
+		FROM login_lockouts
+		WHERE locked_until > ?
+		ORDER BY locked_until DESC`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list lockouts: %w", err)
+	}
+	defer rows.Close()
+
+	var lockouts []Lockout
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.ID, &l.Scope, &l.Subject, &l.LockedUntil, &l.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan lockout: %w", err)
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// Unlock lifts a lockout and forgets the failures that caused it
+func (a *AuthService) Unlock(lockoutID int64) error {
+	var scope, subject string
+	err := a.db.QueryRow("SELECT scope, subject FROM login_lockouts WHERE id = ?", lockoutID).Scan(&scope, &subject)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("lockout not found")
+		}
+		return fmt.Errorf("failed to load lockout: %w", err)
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM login_lockouts WHERE id = ?", lockoutID); err != nil {
+		return fmt.Errorf("failed to delete lockout: %w", err)
+	}
+
+	column := "email"
+	if scope == LockoutScopeIP {
+		column = "ip_address"
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE "+column+" = ? AND success = 0", subject); err != nil {
+		return fmt.Errorf("failed to clear failed logins: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -2,12 +2,15 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strings"
 )
 
 // Middleware provides authentication middleware
 type Middleware struct {
 	sessionService *SessionService
+	proxyAuth      *ProxyAuth
 }
 
 // NewMiddleware creates a new authentication middleware
@@ -15,10 +18,29 @@ func NewMiddleware(sessionService *SessionService) *Middleware {
 	return &Middleware{sessionService: sessionService}
 }
 
+// SetProxyAuth switches to authentication by a trusted reverse proxy. Session
+// cookies are then ignored and the proxy's headers decide who is logged in.
+func (m *Middleware) SetProxyAuth(proxyAuth *ProxyAuth) {
+	m.proxyAuth = proxyAuth
+}
+
+// currentUserID returns the user making the request
+func (m *Middleware) currentUserID(r *http.Request) (int64, bool) {
+	if m.proxyAuth != nil {
+		return m.proxyAuth.GetCurrentUserID(r)
+	}
+	return m.sessionService.GetCurrentUserID(r)
+}
+
 // RequireAuth middleware that requires user to be authenticated
 func (m *Middleware) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, authenticated := m.sessionService.GetCurrentUserID(r)
+		if BearerToken(r) != "" {
+			http.Error(w, "API tokens cannot be used here", http.StatusForbidden)
+			return
+		}
+
+		userID, authenticated := m.currentUserID(r)
 		if !authenticated {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
@@ -39,11 +61,147 @@ func GetUserFromContext(r *http.Request) (int64, bool) {
 // OptionalAuth middleware that adds user info to context if authenticated
 func (m *Middleware) OptionalAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, authenticated := m.sessionService.GetCurrentUserID(r)
-		if authenticated {
+		// Requests carrying an API token never fall back to cookies
+		userID, authenticated := m.currentUserID(r)
+		if authenticated && BearerToken(r) == "" {
 			ctx := context.WithValue(r.Context(), "userID", userID)
 			r = r.WithContext(ctx)
 		}
 		next.ServeHTTP(w, r)
 	}
 }
+
+// RequireAuthOrToken is RequireAuth for routes bots and scripts may use: it
+// also accepts an "Authorization: Bearer" API token granting the scope
+func (m *Middleware) RequireAuthOrToken(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if BearerToken(r) == "" {
+			m.RequireAuth(next)(w, r)
+			return
+		}
+
+		userID, ok := m.authenticateToken(w, r, scope)
+		if !ok {
+			return
+		}
+		ctx := context.WithValue(r.Context(), "userID", userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// OptionalAuthOrToken is OptionalAuth that also accepts an API token granting
+// the scope. A bad token is rejected rather than treated as anonymous.
+func (m *Middleware) OptionalAuthOrToken(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if BearerToken(r) == "" {
+			m.OptionalAuth(next)(w, r)
+			return
+		}
+
+		userID, ok := m.authenticateToken(w, r, scope)
+		if !ok {
+			return
+		}
+		ctx := context.WithValue(r.Context(), "userID", userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// ErrInsufficientScope is returned for API tokens that lack the scope a request needs
+var ErrInsufficientScope = errors.New("this API token does not have the required scope")
+
+// Authenticate returns the user making the request without writing a
+// response, for handlers that answer errors themselves. An API token must
+// grant the scope; otherwise the session or proxy decides. The bool is false
+// for anonymous requests.
+func (m *Middleware) Authenticate(r *http.Request, scope string) (int64, bool, error) {
+	token := BearerToken(r)
+	if token == "" {
+		userID, ok := m.currentUserID(r)
+		return userID, ok, nil
+	}
+
+	userID, scopes, err := m.sessionService.AuthenticateAPIToken(token, ClientIP(r))
+	if err != nil {
+		return 0, false, ErrInvalidAPIToken
+	}
+	if !hasScope(scopes, scope) {
+		return 0, false, ErrInsufficientScope
+	}
+	return userID, true, nil
+}
+
+// authenticateToken checks the request's API token and scope, answering with
+// an RFC 6750 error when they do not check out
+func (m *Middleware) authenticateToken(w http.ResponseWriter, r *http.Request, scope string) (int64, bool) {
+	userID, _, err := m.Authenticate(r, scope)
+	switch {
+	case errors.Is(err, ErrInsufficientScope):
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		http.Error(w, "this API token does not have the "+scope+" scope", http.StatusForbidden)
+		return 0, false
+	case err != nil:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, ErrInvalidAPIToken.Error(), http.StatusUnauthorized)
+		return 0, false
+	}
+	return userID, true
+}
+
+// RequireAdmin middleware that requires the user to be an administrator
+func (m *Middleware) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return m.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := GetUserFromContext(r)
+
+		var role string
+		err := m.sessionService.db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+		if err != nil || role != RoleAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TwoFactorEnforcement sends staff who must use 2FA but have not set it up to
+// the 2FA settings page until they do
+type TwoFactorEnforcement struct {
+	authService *AuthService
+	middleware  *Middleware
+}
+
+// NewTwoFactorEnforcement creates the 2FA enrolment enforcement. Users are
+// recognized the way middleware does, so it also covers proxy logins.
+func NewTwoFactorEnforcement(authService *AuthService, middleware *Middleware) *TwoFactorEnforcement {
+	return &TwoFactorEnforcement{authService: authService, middleware: middleware}
+}
+
+// twoFactorExempt reports whether a path stays reachable while enrolment is pending
+func twoFactorExempt(path string) bool {
+	return path == "/logout" || path == "/settings/2fa" ||
+		strings.HasPrefix(path, "/settings/2fa/") || strings.HasPrefix(path, "/static/")
+}
+
+// Enforce wraps a handler with the enrolment check
+func (e *TwoFactorEnforcement) Enforce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if twoFactorExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID, authenticated := e.middleware.currentUserID(r)
+		if !authenticated {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if needed, err := e.authService.NeedsTwoFactorEnrollment(userID); err == nil && needed {
+			http.Redirect(w, r, "/settings/2fa?required=true", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTwoFactorEnforcementBehindProxy(t *testing.T) {
+	a, db := newTestAuthService(t)
+	networks, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAuth, err := NewProxyAuth(db, ProxyAuthConfig{
+		UserHeader:     "X-Forwarded-User",
+		EmailHeader:    "X-Forwarded-Email",
+		TrustedProxies: networks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := NewMiddleware(NewSessionService(db))
+	middleware.SetProxyAuth(proxyAuth)
+	enforce := NewTwoFactorEnforcement(a, middleware).Enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(user, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "10.0.0.2:4000"
+		r.Header.Set("X-Forwarded-User", user)
+		r.Header.Set("X-Forwarded-Email", user+"@example.com")
+		w := httptest.NewRecorder()
+		enforce.ServeHTTP(w, r)
+		return w
+	}
+
+	// Seen once so the proxy creates the accounts
+	request("mod", "/")
+	request("member", "/")
+	if _, err := db.Exec("UPDATE users SET role = ? WHERE username = 'mod'", RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetTwoFactorRequiredForStaff(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := request("mod", "/"); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/settings/2fa?required=true" {
+		t.Errorf("staff without 2FA got %d %q, want a redirect to the 2FA settings", w.Code, w.Header().Get("Location"))
+	}
+	if w := request("mod", "/settings/2fa/setup"); w.Code != http.StatusOK {
+		t.Errorf("staff could not reach 2FA enrolment: %d", w.Code)
+	}
+	if w := request("member", "/"); w.Code != http.StatusOK {
+		t.Errorf("member got %d, want 200", w.Code)
+	}
+}
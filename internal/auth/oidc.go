@@ -0,0 +1,473 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"forum/internal/oidc"
+)
+
+const (
+	oauthStateTTL     = 10 * time.Minute
+	oauthSignupTTL    = 30 * time.Minute
+	oauthStateCookie  = "oauth_state"
+	oauthSignupCookie = "oauth_signup"
+	oauthCookiePath   = "/login/oidc"
+)
+
+// unusablePassword is stored for accounts created through a provider. It is
+// not a bcrypt hash, so no password matches it until the user sets one in
+// their settings or with the password reset flow.
+const unusablePassword = "!"
+
+// ErrOIDCLoginFailed is returned when a provider login cannot be completed
+var ErrOIDCLoginFailed = errors.New("logging in with that provider failed, please try again")
+
+// OIDCProvider is a provider login option
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+}
+
+// OIDCLoginResult tells the caller what to do after a provider login
+type OIDCLoginResult struct {
+	UserID          int64  // Set when the login matched an account
+	SignupToken     string // Set when the user has no account yet and must pick a username
+	Reauthenticated bool   // Set when a logged in user confirmed it is them; no new session is needed
+	ReturnTo        string // Where to send a reauthenticated user back to
+}
+
+// OIDCSignup is a first provider login waiting for a username
+type OIDCSignup struct {
+	Provider          string // Display name of the provider
+	Email             string
+	SuggestedUsername string
+}
+
+// SetOIDCProviders configures the OpenID Connect providers users can log in with
+func (a *AuthService) SetOIDCProviders(providers []*oidc.Provider) {
+	a.oidcProviders = providers
+}
+
+// OIDCProviders returns the configured providers, in configuration order
+func (a *AuthService) OIDCProviders() []OIDCProvider {
+	list := make([]OIDCProvider, 0, len(a.oidcProviders))
+	for _, p := range a.oidcProviders {
+		list = append(list, OIDCProvider{Name: p.Name(), DisplayName: p.DisplayName()})
+	}
+	return list
+}
+
+// oidcProvider returns the provider with the given name, or nil
+func (a *AuthService) oidcProvider(name string) *oidc.Provider {
+	for _, p := range a.oidcProviders {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// LinkedOIDCProviders returns the configured providers the user has logged in
+// with, in configuration order
+func (a *AuthService) LinkedOIDCProviders(userID int64) ([]OIDCProvider, error) {
+	rows, err := a.db.Query("SELECT provider FROM oauth_identities WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load linked accounts: %w", err)
+	}
+	defer rows.Close()
+
+	linked := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan linked account: %w", err)
+		}
+		linked[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var list []OIDCProvider
+	for _, p := range a.OIDCProviders() {
+		if linked[p.Name] {
+			list = append(list, p)
+		}
+	}
+	return list, nil
+}
+
+// BeginOIDCLogin starts a login with a provider and returns the state to keep
+// in the browser and the provider URL to send the user to
+func (a *AuthService) BeginOIDCLogin(ctx context.Context, providerName string) (state, authURL string, err error) {
+	return a.beginOIDC(ctx, providerName, 0, "")
+}
+
+// BeginOIDCReauthentication starts a round trip to a provider the user has
+// logged in with before, so a user without a password can confirm it is
+// them. FinishOIDCLogin sends them back to returnTo afterwards.
+func (a *AuthService) BeginOIDCReauthentication(ctx context.Context, userID int64, providerName, returnTo string) (state, authURL string, err error) {
+	var linked bool
+	err = a.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM oauth_identities WHERE user_id = ? AND provider = ?)",
+		userID, providerName,
+	).Scan(&linked)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load linked accounts: %w", err)
+	}
+	if !linked {
+		return "", "", fmt.Errorf("you have not logged in with that provider")
+	}
+	return a.beginOIDC(ctx, providerName, userID, returnTo)
+}
+
+// beginOIDC stores the state of a provider round trip; userID is set when a
+// logged in user is reauthenticating
+func (a *AuthService) beginOIDC(ctx context.Context, providerName string, userID int64, returnTo string) (state, authURL string, err error) {
+	provider := a.oidcProvider(providerName)
+	if provider == nil {
+		return "", "", fmt.Errorf("unknown login provider")
+	}
+
+	req, err := oidc.NewAuthRequest()
+	if err != nil {
+		return "", "", err
+	}
+	authURL, err = provider.AuthCodeURL(ctx, req)
+	if err != nil {
+		log.Printf("Could not start %s login: %v", providerName, err)
+		return "", "", ErrOIDCLoginFailed
+	}
+
+	now := time.Now().UTC()
+	var reauthUserID sql.NullInt64
+	if userID != 0 {
+		reauthUserID = sql.NullInt64{Int64: userID, Valid: true}
+	}
+	_, err = a.db.Exec(
+		"INSERT INTO oauth_states (state_hash, provider, nonce, code_verifier, user_id, return_to, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		hashToken(req.State), providerName, req.Nonce, req.CodeVerifier, reauthUserID, returnTo, now.Add(oauthStateTTL), now,
+	)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store login state: %w", err)
+	}
+	return req.State, authURL, nil
+}
+
+// FinishOIDCLogin handles the provider's redirect back to the forum. The
+// state must match the one kept in the browser so a login started elsewhere
+// cannot be completed here. Known identities log in directly; new ones are
+// linked to the account with the same verified email, or become a signup.
+// A reauthentication only accepts an identity already linked to the user.
+func (a *AuthService) FinishOIDCLogin(ctx context.Context, browserState, state, code string) (*OIDCLoginResult, error) {
+	expired := fmt.Errorf("your login attempt has expired, please try again")
+	if browserState == "" || subtle.ConstantTimeCompare([]byte(browserState), []byte(state)) != 1 {
+		return nil, expired
+	}
+
+	var stateID int64
+	var req oidc.AuthRequest
+	var providerName string
+	var reauthUserID sql.NullInt64
+	var returnTo sql.NullString
+	var expiresAt time.Time
+	err := a.db.QueryRow(
+		"SELECT id, provider, nonce, code_verifier, user_id, return_to, expires_at FROM oauth_states WHERE state_hash = ?",
+		hashToken(state),
+	).Scan(&stateID, &providerName, &req.Nonce, &req.CodeVerifier, &reauthUserID, &returnTo, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, expired
+		}
+		return nil, fmt.Errorf("failed to load login state: %w", err)
+	}
+	if _, err := a.db.Exec("DELETE FROM oauth_states WHERE id = ?", stateID); err != nil {
+		return nil, fmt.Errorf("failed to use login state: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return nil, expired
+	}
+	req.State = state
+
+	provider := a.oidcProvider(providerName)
+	if provider == nil {
+		return nil, fmt.Errorf("unknown login provider")
+	}
+	claims, err := provider.Exchange(ctx, code, req)
+	if err != nil {
+		log.Printf("%s login rejected: %v", providerName, err)
+		return nil, ErrOIDCLoginFailed
+	}
+
+	// Returning user
+	var userID int64
+	err = a.db.QueryRow(
+		"SELECT user_id FROM oauth_identities WHERE provider = ? AND subject = ?",
+		providerName, claims.Subject,
+	).Scan(&userID)
+	if reauthUserID.Valid {
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to load identity: %w", err)
+		}
+		if err == sql.ErrNoRows || userID != reauthUserID.Int64 {
+			return nil, fmt.Errorf("that %s account is not linked to yours", provider.DisplayName())
+		}
+		return &OIDCLoginResult{UserID: userID, Reauthenticated: true, ReturnTo: returnTo.String}, nil
+	}
+	if err == nil {
+		_, err = a.db.Exec(
+			"UPDATE oauth_identities SET email = ?, last_login_at = ? WHERE provider = ? AND subject = ?",
+			claims.Email, time.Now().UTC(), providerName, claims.Subject,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update identity: %w", err)
+		}
+		return &OIDCLoginResult{UserID: userID}, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+
+	if claims.Email == "" {
+		return nil, fmt.Errorf("%s did not share your email address with the forum", provider.DisplayName())
+	}
+
+	// Existing account with the same email: only link when both sides have
+	// verified the address, otherwise whoever controls one side could take
+	// over the other
+	var existingID int64
+	var existingVerified bool
+	err = a.db.QueryRow(
+		"SELECT id, email_verified FROM users WHERE LOWER(email) = LOWER(?)",
+		claims.Email,
+	).Scan(&existingID, &existingVerified)
+	switch {
+	case err == nil:
+		if !claims.EmailVerified || !existingVerified {
+			return nil, fmt.Errorf("an account with this email already exists, please log in with your password")
+		}
+		if err := a.linkIdentity(a.db, existingID, providerName, claims); err != nil {
+			return nil, err
+		}
+		return &OIDCLoginResult{UserID: existingID}, nil
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("failed to look up account: %w", err)
+	}
+
+	// New user: remember the identity until they pick a username
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	_, err = a.db.Exec(
+		`INSERT INTO oauth_signups (token_hash, provider, subject, email, email_verified, suggested_username, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), providerName, claims.Subject, claims.Email, claims.EmailVerified,
+		a.suggestUsername(claims), now.Add(oauthSignupTTL), now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store signup: %w", err)
+	}
+	return &OIDCLoginResult{SignupToken: token}, nil
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// linkIdentity records that a provider account belongs to a user
+func (a *AuthService) linkIdentity(db execer, userID int64, provider string, claims *oidc.Claims) error {
+	now := time.Now().UTC()
+	_, err := db.Exec(
+		"INSERT INTO oauth_identities (user_id, provider, subject, email, last_login_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, provider, claims.Subject, claims.Email, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to link account: %w", err)
+	}
+	return nil
+}
+
+// suggestUsername proposes a free username from the provider's profile
+func (a *AuthService) suggestUsername(claims *oidc.Claims) string {
+	candidates := []string{claims.PreferredUsername, claims.Name}
+	if at := strings.Index(claims.Email, "@"); at > 0 {
+		candidates = append(candidates, claims.Email[:at])
+	}
+
+	for _, candidate := range candidates {
+		candidate = strings.Join(strings.Fields(candidate), "")
+		if candidate == "" || utf8.RuneCountInString(candidate) > 30 || validateUsername(candidate) != nil {
+			continue
+		}
+		var taken bool
+		err := a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", candidate).Scan(&taken)
+		if err == nil && !taken {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// loadOIDCSignup returns a pending signup
+func (a *AuthService) loadOIDCSignup(token string) (id int64, provider string, claims *oidc.Claims, suggested string, err error) {
+	var expiresAt time.Time
+	claims = &oidc.Claims{}
+	err = a.db.QueryRow(
+		"SELECT id, provider, subject, email, email_verified, suggested_username, expires_at FROM oauth_signups WHERE token_hash = ?",
+		hashToken(token),
+	).Scan(&id, &provider, &claims.Subject, &claims.Email, &claims.EmailVerified, &suggested, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, "", nil, "", fmt.Errorf("your signup has expired, please log in again")
+		}
+		return 0, "", nil, "", fmt.Errorf("failed to load signup: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return 0, "", nil, "", fmt.Errorf("your signup has expired, please log in again")
+	}
+	return id, provider, claims, suggested, nil
+}
+
+// PendingOIDCSignup returns the details of a first provider login
+func (a *AuthService) PendingOIDCSignup(token string) (*OIDCSignup, error) {
+	_, providerName, claims, suggested, err := a.loadOIDCSignup(token)
+	if err != nil {
+		return nil, err
+	}
+
+	signup := &OIDCSignup{Provider: providerName, Email: claims.Email, SuggestedUsername: suggested}
+	if provider := a.oidcProvider(providerName); provider != nil {
+		signup.Provider = provider.DisplayName()
+	}
+	return signup, nil
+}
+
+// CompleteOIDCSignup creates the account of a first provider login with the
+// chosen username and returns the new user's ID
+func (a *AuthService) CompleteOIDCSignup(token, username string) (int64, error) {
+	signupID, providerName, claims, _, err := a.loadOIDCSignup(token)
+	if err != nil {
+		return 0, err
+	}
+
+	username = strings.TrimSpace(username)
+	if err := validateUsername(username); err != nil {
+		return 0, err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check username availability: %w", err)
+	}
+	if exists {
+		return 0, fmt.Errorf("username already taken")
+	}
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER(?))", claims.Email).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check email availability: %w", err)
+	}
+	if exists {
+		return 0, fmt.Errorf("email already registered")
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO users (username, email, password_hash, email_verified) VALUES (?, ?, ?, ?)",
+		username, claims.Email, unusablePassword, claims.EmailVerified,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+	if err := a.linkIdentity(tx, userID, providerName, claims); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM oauth_signups WHERE id = ?", signupID); err != nil {
+		return 0, fmt.Errorf("failed to complete signup: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	// The provider did not vouch for the address, so confirm it like a registration
+	if !claims.EmailVerified {
+		if err := a.sendVerification(userID, username, claims.Email); err != nil {
+			log.Printf("Could not send verification email to %s: %v", claims.Email, err)
+		}
+	}
+	a.registered(userID, providerName)
+	return userID, nil
+}
+
+// SetOAuthStateCookie keeps the state of a provider login in the browser.
+// It must be Lax, not Strict, to come back with the provider's redirect.
+func SetOAuthStateCookie(w http.ResponseWriter, state string) {
+	setOAuthCookie(w, oauthStateCookie, state, oauthStateTTL)
+}
+
+// OAuthStateToken returns the provider login state kept in the browser
+func OAuthStateToken(r *http.Request) string {
+	return cookieValue(r, oauthStateCookie)
+}
+
+// ClearOAuthStateCookie removes the provider login state cookie
+func ClearOAuthStateCookie(w http.ResponseWriter) {
+	setOAuthCookie(w, oauthStateCookie, "", -1)
+}
+
+// SetOAuthSignupCookie keeps a pending signup's token in the browser
+func SetOAuthSignupCookie(w http.ResponseWriter, token string) {
+	setOAuthCookie(w, oauthSignupCookie, token, oauthSignupTTL)
+}
+
+// OAuthSignupToken returns the pending signup token kept in the browser
+func OAuthSignupToken(r *http.Request) string {
+	return cookieValue(r, oauthSignupCookie)
+}
+
+// ClearOAuthSignupCookie removes the pending signup cookie
+func ClearOAuthSignupCookie(w http.ResponseWriter) {
+	setOAuthCookie(w, oauthSignupCookie, "", -1)
+}
+
+func setOAuthCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     oauthCookiePath,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func cookieValue(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
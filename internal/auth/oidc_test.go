@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"forum/internal/oidc"
+	"forum/internal/oidc/oidctest"
+)
+
+// newOIDCTest returns an AuthService that logs in with a test issuer
+func newOIDCTest(t *testing.T) (*AuthService, *oidctest.Issuer) {
+	t.Helper()
+	a, _ := newTestAuthService(t)
+	issuer := oidctest.NewIssuer(t)
+	provider, err := oidc.NewProvider(oidc.Config{
+		Name:         "test",
+		DisplayName:  "Test",
+		Issuer:       issuer.URL,
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  issuer.RedirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetOIDCProviders([]*oidc.Provider{provider})
+	return a, issuer
+}
+
+// oidcLogin logs in at the issuer as the user described by claims
+func oidcLogin(t *testing.T, a *AuthService, issuer *oidctest.Issuer, claims map[string]any) (*OIDCLoginResult, error) {
+	t.Helper()
+	ctx := context.Background()
+	state, authURL, err := a.BeginOIDCLogin(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.Authorize(t, authURL, claims)
+	return a.FinishOIDCLogin(ctx, state, state, code)
+}
+
+func TestOIDCSignupAndReturningLogin(t *testing.T) {
+	a, issuer := newOIDCTest(t)
+	claims := map[string]any{
+		"sub":                "alice-at-test",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+	}
+
+	result, err := oidcLogin(t, a, issuer, claims)
+	if err != nil {
+		t.Fatalf("FinishOIDCLogin() = %v", err)
+	}
+	if result.UserID != 0 || result.SignupToken == "" {
+		t.Fatalf("first login = %+v, want a signup", result)
+	}
+	signup, err := a.PendingOIDCSignup(result.SignupToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OIDCSignup{Provider: "Test", Email: "alice@example.com", SuggestedUsername: "alice"}
+	if *signup != want {
+		t.Errorf("signup = %+v, want %+v", *signup, want)
+	}
+
+	userID, err := a.CompleteOIDCSignup(result.SignupToken, "alice")
+	if err != nil {
+		t.Fatalf("CompleteOIDCSignup() = %v", err)
+	}
+	user, err := a.GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || !user.EmailVerified || user.HasPassword {
+		t.Errorf("new user = %+v", *user)
+	}
+	if _, err := a.CompleteOIDCSignup(result.SignupToken, "alice2"); err == nil {
+		t.Error("a signup could be completed twice")
+	}
+
+	// The identity logs straight in from now on, even with a new email
+	claims["email"] = "alice@new.example.com"
+	result, err = oidcLogin(t, a, issuer, claims)
+	if err != nil {
+		t.Fatalf("returning login = %v", err)
+	}
+	if result.UserID != userID {
+		t.Errorf("returning login = %+v, want user %d", result, userID)
+	}
+}
+
+func TestOIDCSuggestedUsername(t *testing.T) {
+	a, issuer := newOIDCTest(t)
+	if err := a.RegisterUser("taken@example.com", "alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"preferred username", map[string]any{"preferred_username": "bob", "name": "Bob Smith"}, "bob"},
+		{"taken preferred username falls back to the name", map[string]any{"preferred_username": "alice", "name": "Alice Smith"}, "AliceSmith"},
+		{"then to the email address", map[string]any{"preferred_username": "alice", "email": "ally@example.com"}, "ally"},
+		{"reserved names are skipped", map[string]any{"preferred_username": "[deleted]", "email": "carol@example.com"}, "carol"},
+		{"nothing usable", map[string]any{"preferred_username": "alice", "email": "alice@example.com"}, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["sub"] = "subject-" + string(rune('a'+i))
+			if _, ok := tt.claims["email"]; !ok {
+				tt.claims["email"] = tt.claims["sub"].(string) + "@example.com"
+			}
+			result, err := oidcLogin(t, a, issuer, tt.claims)
+			if err != nil {
+				t.Fatalf("FinishOIDCLogin() = %v", err)
+			}
+			signup, err := a.PendingOIDCSignup(result.SignupToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signup.SuggestedUsername != tt.want {
+				t.Errorf("suggested username = %q, want %q", signup.SuggestedUsername, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCSignupUsername(t *testing.T) {
+	a, issuer := newOIDCTest(t)
+	if err := a.RegisterUser("taken@example.com", "alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := oidcLogin(t, a, issuer, map[string]any{"email": "new@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"", "   ", "two words", "alice", "[deleted]"} {
+		if _, err := a.CompleteOIDCSignup(result.SignupToken, username); err == nil {
+			t.Errorf("CompleteOIDCSignup(%q) succeeded", username)
+		}
+	}
+	if _, err := a.CompleteOIDCSignup(result.SignupToken, "newbie"); err != nil {
+		t.Errorf("CompleteOIDCSignup() = %v", err)
+	}
+}
+
+func TestOIDCLinking(t *testing.T) {
+	tests := []struct {
+		name            string
+		accountVerified bool
+		claimVerified   bool
+		link            bool
+	}{
+		{"both verified", true, true, true},
+		{"account not verified", false, true, false},
+		{"provider did not verify", true, false, false},
+		{"neither verified", false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, issuer := newOIDCTest(t)
+			if err := a.RegisterUser("bob@example.com", "bob", "secret1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.db.Exec("UPDATE users SET email_verified = ? WHERE username = 'bob'", tt.accountVerified); err != nil {
+				t.Fatal(err)
+			}
+			var bobID int64
+			if err := a.db.QueryRow("SELECT id FROM users WHERE username = 'bob'").Scan(&bobID); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := oidcLogin(t, a, issuer, map[string]any{
+				"email":          "Bob@Example.com",
+				"email_verified": tt.claimVerified,
+			})
+			if !tt.link {
+				if err == nil || !strings.Contains(err.Error(), "already exists") {
+					t.Errorf("FinishOIDCLogin() = %+v, %v, want a refusal to link", result, err)
+				}
+				var linked bool
+				a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM oauth_identities)").Scan(&linked)
+				if linked {
+					t.Error("the identity was linked")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FinishOIDCLogin() = %v", err)
+			}
+			if result.UserID != bobID {
+				t.Errorf("login = %+v, want user %d", result, bobID)
+			}
+		})
+	}
+}
+
+func TestOIDCReauthentication(t *testing.T) {
+	a, issuer := newOIDCTest(t)
+	ctx := context.Background()
+
+	signup := func(subject, username string) int64 {
+		t.Helper()
+		result, err := oidcLogin(t, a, issuer, map[string]any{
+			"sub":            subject,
+			"email":          username + "@example.com",
+			"email_verified": true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		userID, err := a.CompleteOIDCSignup(result.SignupToken, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userID
+	}
+	aliceID := signup("alice-at-test", "alice")
+	signup("carol-at-test", "carol")
+
+	providers, err := a.LinkedOIDCProviders(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0] != (OIDCProvider{Name: "test", DisplayName: "Test"}) {
+		t.Errorf("LinkedOIDCProviders() = %+v", providers)
+	}
+
+	reauthenticate := func(subject string) (*OIDCLoginResult, error) {
+		t.Helper()
+		state, authURL, err := a.BeginOIDCReauthentication(ctx, aliceID, "test", "/settings/2fa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := issuer.Authorize(t, authURL, map[string]any{"sub": subject, "email": "alice@example.com", "email_verified": true})
+		return a.FinishOIDCLogin(ctx, state, state, code)
+	}
+
+	result, err := reauthenticate("alice-at-test")
+	if err != nil {
+		t.Fatalf("FinishOIDCLogin() = %v", err)
+	}
+	want := OIDCLoginResult{UserID: aliceID, Reauthenticated: true, ReturnTo: "/settings/2fa"}
+	if *result != want {
+		t.Errorf("reauthentication = %+v, want %+v", *result, want)
+	}
+
+	// Only an identity already linked to the user counts; others are neither
+	// logged in, linked nor signed up
+	for _, subject := range []string{"carol-at-test", "someone-new"} {
+		if result, err := reauthenticate(subject); err == nil {
+			t.Errorf("reauthentication as %s = %+v", subject, *result)
+		}
+	}
+	var identities, signups int
+	a.db.QueryRow("SELECT COUNT(*) FROM oauth_identities").Scan(&identities)
+	a.db.QueryRow("SELECT COUNT(*) FROM oauth_signups WHERE subject = 'someone-new'").Scan(&signups)
+	if identities != 2 || signups != 0 {
+		t.Errorf("after refused reauthentications: %d identities, %d signups", identities, signups)
+	}
+
+	if err := a.RegisterUser("bob@example.com", "bob", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	var bobID int64
+	if err := a.db.QueryRow("SELECT id FROM users WHERE username = 'bob'").Scan(&bobID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.BeginOIDCReauthentication(ctx, bobID, "test", "/settings"); err == nil {
+		t.Error("BeginOIDCReauthentication() succeeded for a provider the user never logged in with")
+	}
+}
+
+func TestOIDCLoginState(t *testing.T) {
+	a, issuer := newOIDCTest(t)
+	ctx := context.Background()
+
+	state, authURL, err := a.BeginOIDCLogin(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.Authorize(t, authURL, nil)
+
+	// A login started in another browser cannot be finished in this one
+	if _, err := a.FinishOIDCLogin(ctx, "", state, code); err == nil {
+		t.Error("FinishOIDCLogin() succeeded without the browser's state")
+	}
+	otherState, _, err := a.BeginOIDCLogin(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.FinishOIDCLogin(ctx, otherState, state, code); err == nil {
+		t.Error("FinishOIDCLogin() succeeded with another login's state")
+	}
+
+	if _, _, err := a.BeginOIDCLogin(ctx, "unknown"); err == nil {
+		t.Error("BeginOIDCLogin() succeeded for an unknown provider")
+	}
+}
+
+func TestOIDCLoginRejectsBadTokens(t *testing.T) {
+	a, issuer := newOIDCTest(t)
+	issuer.Token = oidctest.Unsigned
+	if _, err := oidcLogin(t, a, issuer, nil); err != ErrOIDCLoginFailed {
+		t.Errorf("FinishOIDCLogin() with an unsigned token = %v, want %v", err, ErrOIDCLoginFailed)
+	}
+
+	issuer.Token = issuer.SignES256
+	if _, err := oidcLogin(t, a, issuer, map[string]any{"nonce": "from-another-login"}); err != ErrOIDCLoginFailed {
+		t.Errorf("FinishOIDCLogin() with another nonce = %v, want %v", err, ErrOIDCLoginFailed)
+	}
+
+	// The state is used up by a failed login too
+	ctx := context.Background()
+	state, authURL, err := a.BeginOIDCLogin(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Token = oidctest.Unsigned
+	if _, err := a.FinishOIDCLogin(ctx, state, state, issuer.Authorize(t, authURL, nil)); err == nil {
+		t.Fatal("FinishOIDCLogin() succeeded with an unsigned token")
+	}
+	issuer.Token = issuer.SignES256
+	if _, err := a.FinishOIDCLogin(ctx, state, state, issuer.Authorize(t, authURL, nil)); err == nil {
+		t.Error("the state of a failed login could be used again")
+	}
+}
@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"forum/internal/webauthn"
+)
+
+// Passkey ceremonies
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+)
+
+const (
+	passkeyCeremonyCookie = "passkey_ceremony"
+	maxPasskeysPerUser    = 10
+	maxPasskeyNameLength  = 50
+)
+
+// ErrPasskeyLoginFailed is returned for any passkey sign-in that does not check out
+var ErrPasskeyLoginFailed = errors.New("passkey sign-in failed, please try again")
+
+// Passkey is a passkey as shown in the account settings
+type Passkey struct {
+	ID         int64
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // Zero if never used
+}
+
+// relyingParty describes the forum to browsers, derived from its public URL
+func (a *AuthService) relyingParty() webauthn.RelyingParty {
+	rp := webauthn.RelyingParty{ID: "localhost", Name: "Forum", Origin: a.baseURL}
+	if u, err := url.Parse(a.baseURL); err == nil && u.Host != "" {
+		rp.ID = u.Hostname()
+		rp.Origin = u.Scheme + "://" + u.Host
+	}
+	return rp
+}
+
+// userHandle is the opaque user ID stored on authenticators
+func userHandle(userID int64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+// startCeremony stores a new challenge and returns it together with the token
+// that identifies the ceremony to the browser
+func (a *AuthService) startCeremony(ceremony string, userID sql.NullInt64) (string, []byte, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+	_, err = a.db.Exec(
+		"INSERT INTO passkey_challenges (token_hash, user_id, ceremony, challenge, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		hashToken(token), userID, ceremony, challenge, now.Add(webauthn.Timeout), now,
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store passkey challenge: %w", err)
+	}
+	return token, challenge, nil
+}
+
+// finishCeremony consumes a ceremony so its challenge can only be answered once
+func (a *AuthService) finishCeremony(token, ceremony string) (sql.NullInt64, []byte, error) {
+	var id int64
+	var userID sql.NullInt64
+	var challenge []byte
+	var expiresAt time.Time
+
+	expired := fmt.Errorf("the passkey request has expired, please try again")
+	err := a.db.QueryRow(
+		"SELECT id, user_id, challenge, expires_at FROM passkey_challenges WHERE token_hash = ? AND ceremony = ?",
+		hashToken(token), ceremony,
+	).Scan(&id, &userID, &challenge, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return userID, nil, expired
+		}
+		return userID, nil, fmt.Errorf("failed to load passkey challenge: %w", err)
+	}
+
+	// Whoever deletes the row first owns the ceremony
+	result, err := a.db.Exec("DELETE FROM passkey_challenges WHERE id = ?", id)
+	if err != nil {
+		return userID, nil, fmt.Errorf("failed to use passkey challenge: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 || time.Now().After(expiresAt) {
+		return userID, nil, expired
+	}
+	return userID, challenge, nil
+}
+
+// SetPasskeyCeremonyCookie stores a passkey ceremony token in the browser
+func SetPasskeyCeremonyCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyCeremonyCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(webauthn.Timeout.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ClearPasskeyCeremonyCookie removes the passkey ceremony cookie
+func ClearPasskeyCeremonyCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyCeremonyCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// PasskeyCeremonyToken returns the passkey ceremony token of a request, if any
+func PasskeyCeremonyToken(r *http.Request) string {
+	cookie, err := r.Cookie(passkeyCeremonyCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// BeginPasskeyRegistration starts adding a passkey to a user's account and
+// returns the ceremony token and the options for navigator.credentials.create()
+func (a *AuthService) BeginPasskeyRegistration(userID int64) (string, webauthn.CreationOptions, error) {
+	var username string
+	if err := a.db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return "", webauthn.CreationOptions{}, fmt.Errorf("failed to load user: %w", err)
+	}
+
+	rows, err := a.db.Query("SELECT credential_id FROM passkeys WHERE user_id = ?", userID)
+	if err != nil {
+		return "", webauthn.CreationOptions{}, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	// Stop the browser from registering an authenticator twice
+	var exclude [][]byte
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return "", webauthn.CreationOptions{}, fmt.Errorf("failed to scan passkey: %w", err)
+		}
+		if raw, err := base64.RawURLEncoding.DecodeString(id); err == nil {
+			exclude = append(exclude, raw)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", webauthn.CreationOptions{}, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+	if len(exclude) >= maxPasskeysPerUser {
+		return "", webauthn.CreationOptions{}, fmt.Errorf("you can have at most %d passkeys", maxPasskeysPerUser)
+	}
+
+	token, challenge, err := a.startCeremony(ceremonyRegister, sql.NullInt64{Int64: userID, Valid: true})
+	if err != nil {
+		return "", webauthn.CreationOptions{}, err
+	}
+
+	user := webauthn.User{Handle: userHandle(userID), Name: username, DisplayName: username}
+	return token, a.relyingParty().CreationOptions(challenge, user, exclude), nil
+}
+
+// FinishPasskeyRegistration verifies the browser's response and stores the passkey
+func (a *AuthService) FinishPasskeyRegistration(userID int64, token, name string, clientDataJSON, attestationObject []byte) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if utf8.RuneCountInString(name) > maxPasskeyNameLength {
+		return fmt.Errorf("passkey name must be at most %d characters long", maxPasskeyNameLength)
+	}
+
+	owner, challenge, err := a.finishCeremony(token, ceremonyRegister)
+	if err != nil {
+		return err
+	}
+	if !owner.Valid || owner.Int64 != userID {
+		return fmt.Errorf("the passkey request has expired, please try again")
+	}
+
+	credential, err := a.relyingParty().VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		return fmt.Errorf("could not register passkey: %v", err)
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	var exists bool
+	err = a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM passkeys WHERE credential_id = ?)", credentialID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check passkey: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("this passkey is already registered")
+	}
+
+	_, err = a.db.Exec(
+		"INSERT INTO passkeys (user_id, credential_id, public_key, sign_count, name, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, credentialID, credential.PublicKey, credential.SignCount, name, time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store passkey: %w", err)
+	}
+	return nil
+}
+
+// ListPasskeys returns a user's passkeys, oldest first
+func (a *AuthService) ListPasskeys(userID int64) ([]Passkey, error) {
+	rows, err := a.db.Query(
+		"SELECT id, name, created_at, last_used_at FROM passkeys WHERE user_id = ? ORDER BY created_at, id",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var p Passkey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan passkey: %w", err)
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = lastUsed.Time
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// DeletePasskey removes one of a user's passkeys
+func (a *AuthService) DeletePasskey(userID, passkeyID int64) error {
+	result, err := a.db.Exec("DELETE FROM passkeys WHERE id = ? AND user_id = ?", passkeyID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("passkey not found")
+	}
+	return nil
+}
+
+// BeginPasskeyLogin starts a passkey sign-in and returns the ceremony token
+// and the options for navigator.credentials.get()
+func (a *AuthService) BeginPasskeyLogin() (string, webauthn.RequestOptions, error) {
+	token, challenge, err := a.startCeremony(ceremonyLogin, sql.NullInt64{})
+	if err != nil {
+		return "", webauthn.RequestOptions{}, err
+	}
+	return token, a.relyingParty().RequestOptions(challenge), nil
+}
+
+// FinishPasskeyLogin verifies a passkey assertion and returns the user it
+// signs in. Passkeys require user verification, so they stand in for both the
+// password and the second factor.
+func (a *AuthService) FinishPasskeyLogin(token string, assertion webauthn.Assertion) (int64, error) {
+	_, challenge, err := a.finishCeremony(token, ceremonyLogin)
+	if err != nil {
+		return 0, err
+	}
+
+	var passkeyID, userID int64
+	credential := webauthn.Credential{ID: assertion.CredentialID}
+	err = a.db.QueryRow(
+		"SELECT id, user_id, public_key, sign_count FROM passkeys WHERE credential_id = ?",
+		base64.RawURLEncoding.EncodeToString(assertion.CredentialID),
+	).Scan(&passkeyID, &userID, &credential.PublicKey, &credential.SignCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrPasskeyLoginFailed
+		}
+		return 0, fmt.Errorf("failed to load passkey: %w", err)
+	}
+
+	if len(assertion.UserHandle) > 0 && string(assertion.UserHandle) != string(userHandle(userID)) {
+		return 0, ErrPasskeyLoginFailed
+	}
+
+	signCount, err := a.relyingParty().VerifyAssertion(challenge, credential, assertion)
+	if err != nil {
+		log.Printf("Passkey login for user %d rejected: %v", userID, err)
+		return 0, ErrPasskeyLoginFailed
+	}
+
+	_, err = a.db.Exec(
+		"UPDATE passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?",
+		signCount, time.Now().UTC(), passkeyID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update passkey: %w", err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"forum/internal/mailer"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// passwordResetTTL is how long an emailed reset link stays valid
+	passwordResetTTL = time.Hour
+	// passwordResetInterval is the minimum time between two reset emails for an account
+	passwordResetInterval = time.Minute
+)
+
+// SetBaseURL sets the public URL of the forum used in links sent by email
+func (a *AuthService) SetBaseURL(baseURL string) {
+	a.baseURL = strings.TrimRight(baseURL, "/")
+}
+
+// BaseURL returns the public URL of the forum
+func (a *AuthService) BaseURL() string {
+	return a.baseURL
+}
+
+// RequestPasswordReset emails a single-use reset link to the account with the
+// given email. It returns nil when there is no such account so callers cannot
+// be used to find out which emails are registered.
+func (a *AuthService) RequestPasswordReset(email string) error {
+	var userID int64
+	var username, address string
+	err := a.db.QueryRow(
+		"SELECT id, username, email FROM users WHERE LOWER(email) = ? AND password_hash != ?",
+		normalizeLoginEmail(email), lockedPassword,
+	).Scan(&userID, &username, &address)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	now := time.Now().UTC()
+
+	// Don't let the form be used to flood someone's inbox
+	var recent bool
+	err = a.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM password_resets WHERE user_id = ? AND created_at > ?)",
+		userID, now.Add(-passwordResetInterval),
+	).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("failed to check recent resets: %w", err)
+	}
+	if recent {
+		return nil
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the newest link works
+	if _, err := a.db.Exec("DELETE FROM password_resets WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to clear old reset tokens: %w", err)
+	}
+	_, err = a.db.Exec(
+		"INSERT INTO password_resets (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		userID, hashToken(token), now.Add(passwordResetTTL), now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create reset token: %w", err)
+	}
+
+	link := a.baseURL + "/reset-password?token=" + url.QueryEscape(token)
+	if a.mailer == nil {
+		log.Printf("Password reset requested for %s (no mailer configured)", address)
+		return nil
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password of your forum account.
+To choose a new password, open this link within the next hour:
+
+%s
+
+If you did not ask for this, you can ignore this email; your password
+will stay the same.
+`, username, link)
+
+	err = a.mailer.Send(mailer.Message{
+		To:      address,
+		Subject: "Reset your forum password",
+		Body:    body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send reset email: %w", err)
+	}
+	return nil
+}
+
+// ValidatePasswordResetToken checks that a reset token exists, is unused and has not expired
+func (a *AuthService) ValidatePasswordResetToken(token string) error {
+	_, err := a.lookupPasswordReset(a.db, token)
+	return err
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// lookupPasswordReset returns the user a valid reset token belongs to
+func (a *AuthService) lookupPasswordReset(q queryRower, token string) (int64, error) {
+	var userID int64
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+
+	err := q.QueryRow(
+		"SELECT user_id, expires_at, used_at FROM password_resets WHERE token_hash = ?",
+		hashToken(token),
+	).Scan(&userID, &expiresAt, &usedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("this reset link is invalid or has already been used")
+		}
+		return 0, fmt.Errorf("failed to load reset token: %w", err)
+	}
+
+	if usedAt.Valid {
+		return 0, fmt.Errorf("this reset link is invalid or has already been used")
+	}
+	if time.Now().After(expiresAt) {
+		return 0, fmt.Errorf("this reset link has expired")
+	}
+
+	return userID, nil
+}
+
+// ResetPassword sets a new password using a reset token. The token is used up
+// and every session of the user is revoked, so a stolen session cannot outlive
+// the reset.
+func (a *AuthService) ResetPassword(token, newPassword string) error {
+	if len(newPassword) < 6 {
+		return fmt.Errorf("password must be at least 6 characters long")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID, err := a.lookupPasswordReset(tx, token)
+	if err != nil {
+		return err
+	}
+
+	// Mark the token used first; the used_at check makes concurrent resets with
+	// the same token fail instead of both succeeding
+	result, err := tx.Exec(
+		"UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), hashToken(token),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to use reset token: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("this reset link is invalid or has already been used")
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	// The owner proved control of the email, so lift any login lockout and backoff on it
+	var email string
+	if err := tx.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM login_lockouts WHERE scope = ? AND subject = ?", LockoutScopeEmail, normalizeLoginEmail(email)); err != nil {
+		return fmt.Errorf("failed to lift lockout: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE email = ? AND success = 0", normalizeLoginEmail(email)); err != nil {
+		return fmt.Errorf("failed to clear failed logins: %w", err)
+	}
+
+	return tx.Commit()
+}
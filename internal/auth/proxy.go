@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyProvider is the identity provider name of proxy-authenticated users
+const proxyProvider = "proxy"
+
+// ProxyAuthConfig configures authentication by a trusted reverse proxy
+type ProxyAuthConfig struct {
+	UserHeader     string       // Header carrying the user name, e.g. "X-Forwarded-User"
+	EmailHeader    string       // Header carrying the user's email, e.g. "X-Forwarded-Email"
+	TrustedProxies []*net.IPNet // Only requests from these networks may set the headers
+}
+
+// ProxyAuth authenticates users from headers set by an authenticating reverse
+// proxy. The headers are only believed on requests coming from a trusted proxy;
+// the proxy must strip any copies the client sent. Users are created on first
+// sight, so the proxy is the only place accounts are managed.
+type ProxyAuth struct {
+	db         *sql.DB
+	config     ProxyAuthConfig
+	onRegister RegistrationHook
+}
+
+// NewProxyAuth creates the proxy authentication
+func NewProxyAuth(db *sql.DB, config ProxyAuthConfig) (*ProxyAuth, error) {
+	if config.UserHeader == "" || config.EmailHeader == "" {
+		return nil, fmt.Errorf("proxy authentication needs a user and an email header")
+	}
+	if len(config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("proxy authentication needs at least one trusted proxy network")
+	}
+	return &ProxyAuth{db: db, config: config}, nil
+}
+
+// SetRegistrationHook sets a function to call after each account the proxy
+// creates, with the method "proxy"
+func (p *ProxyAuth) SetRegistrationHook(hook RegistrationHook) {
+	p.onRegister = hook
+}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or single IPs
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trusted reports whether the request comes directly from a trusted proxy
+func (p *ProxyAuth) trusted(r *http.Request) bool {
+	return inNetworks(remoteIP(r), p.config.TrustedProxies)
+}
+
+// GetCurrentUserID returns the user the proxy authenticated, creating their
+// account on first sight
+func (p *ProxyAuth) GetCurrentUserID(r *http.Request) (int64, bool) {
+	name := strings.TrimSpace(r.Header.Get(p.config.UserHeader))
+	if name == "" {
+		return 0, false
+	}
+	if !p.trusted(r) {
+		log.Printf("Ignoring %s header from untrusted address %s", p.config.UserHeader, remoteIP(r))
+		return 0, false
+	}
+
+	userID, err := p.userFor(name, strings.TrimSpace(r.Header.Get(p.config.EmailHeader)))
+	if err != nil {
+		log.Printf("Proxy login of %q failed: %v", name, err)
+		return 0, false
+	}
+	return userID, true
+}
+
+// userFor returns the account of a proxy user. Unknown users are linked to the
+// account with the same email, since the proxy vouches for it, or get a new one.
+func (p *ProxyAuth) userFor(name, email string) (int64, error) {
+	now := time.Now().UTC()
+
+	var userID int64
+	err := p.db.QueryRow(
+		"SELECT user_id FROM oauth_identities WHERE provider = ? AND subject = ?",
+		proxyProvider, name,
+	).Scan(&userID)
+	if err == nil {
+		// Record at most one login per hour rather than a write per request
+		_, err = p.db.Exec(
+			"UPDATE oauth_identities SET last_login_at = ? WHERE provider = ? AND subject = ? AND (last_login_at IS NULL OR last_login_at < ?)",
+			now, proxyProvider, name, now.Add(-time.Hour),
+		)
+		if err != nil {
+			log.Printf("Could not record proxy login of %q: %v", name, err)
+		}
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load identity: %w", err)
+	}
+
+	if email == "" {
+		return 0, fmt.Errorf("the proxy did not send an email address")
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created := false
+	err = tx.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER(?)", email).Scan(&userID)
+	switch {
+	case err == sql.ErrNoRows:
+		username, err := freeUsername(tx, name)
+		if err != nil {
+			return 0, err
+		}
+		result, err := tx.Exec(
+			"INSERT INTO users (username, email, password_hash, email_verified) VALUES (?, ?, ?, 1)",
+			username, email, unusablePassword,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create user: %w", err)
+		}
+		if userID, err = result.LastInsertId(); err != nil {
+			return 0, fmt.Errorf("failed to create user: %w", err)
+		}
+		created = true
+		log.Printf("Created account %q for proxy user %q", username, name)
+	case err != nil:
+		return 0, fmt.Errorf("failed to look up account: %w", err)
+	default:
+		// The proxy checked the address, so it counts as verified
+		if _, err := tx.Exec("UPDATE users SET email_verified = 1 WHERE id = ?", userID); err != nil {
+			return 0, fmt.Errorf("failed to update user: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO oauth_identities (user_id, provider, subject, email, last_login_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, proxyProvider, name, email, now, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to link account: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to link account: %w", err)
+	}
+	if created && p.onRegister != nil {
+		p.onRegister(userID, proxyProvider)
+	}
+	return userID, nil
+}
+
+// freeUsername turns a proxy user name into a valid username nobody has taken
+func freeUsername(tx *sql.Tx, name string) (string, error) {
+	base := strings.Join(strings.Fields(name), "")
+	if validateUsername(base) != nil {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 2; i <= 100; i++ {
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", candidate).Scan(&taken); err != nil {
+			return "", fmt.Errorf("failed to check username availability: %w", err)
+		}
+		if !taken {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%d", base, i)
+	}
+	return "", fmt.Errorf("no free username for %q", name)
+}
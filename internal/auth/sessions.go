@@ -6,79 +6,293 @@ import (
 	"net/http"
 	"time"
 
+	"forum/internal/mailer"
+
 	"github.com/google/uuid"
 )
 
+// SessionConfig controls how long sessions live. A session expires once it has
+// been idle for the idle timeout; activity slides that deadline forward, but
+// never past the absolute lifetime counted from login.
+type SessionConfig struct {
+	IdleTimeout         time.Duration
+	AbsoluteLifetime    time.Duration
+	RememberIdleTimeout time.Duration // Idle timeout of "remember me" sessions
+	RememberLifetime    time.Duration // Absolute lifetime of "remember me" sessions
+}
+
+// DefaultSessionConfig returns the default session lifetimes
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		IdleTimeout:         2 * time.Hour,
+		AbsoluteLifetime:    24 * time.Hour,
+		RememberIdleTimeout: 14 * 24 * time.Hour,
+		RememberLifetime:    30 * 24 * time.Hour,
+	}
+}
+
 // SessionService handles user sessions
 type SessionService struct {
-	db *sql.DB
+	db     *sql.DB
+	config SessionConfig
+	mailer mailer.Mailer
 }
 
 // NewSessionService creates a new session service
 func NewSessionService(db *sql.DB) *SessionService {
-	return &SessionService{db: db}
+	return &SessionService{db: db, config: DefaultSessionConfig()}
 }
 
-// CreateSession creates a new session for a user
-func (s *SessionService) CreateSession(userID int64) (string, error) {
+// SetConfig overrides the session lifetimes
+func (s *SessionService) SetConfig(config SessionConfig) {
+	s.config = config
+}
+
+// SetMailer sets the mailer used for new device login notifications
+func (s *SessionService) SetMailer(m mailer.Mailer) {
+	s.mailer = m
+}
+
+// CreateSession creates a new session for a user, recording the device it was
+// created from. Users may have several sessions at once, one per device.
+// Remembered sessions use the longer "remember me" lifetimes. Only a hash of
+// the returned token is stored.
+func (s *SessionService) CreateSession(userID int64, r *http.Request, remember bool) (string, error) {
 	// Generate session token
 	sessionToken := uuid.New().String()
-	expiresAt := time.Now().Add(24 * time.Hour) // 24 hour session
+	now := time.Now()
+	expiresAt := now.Add(s.idleTimeout(remember))
+	absoluteExpiresAt := now.Add(s.absoluteLifetime(remember))
+	userAgent := r.UserAgent()
+	ip := ClientIP(r)
 
-	// Delete any existing sessions for this user (single session per user)
-	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	csrfToken, err := randomToken(32)
 	if err != nil {
-		return "", fmt.Errorf("failed to clean existing sessions: %w", err)
+		return "", err
 	}
 
 	// Insert new session
 	_, err = s.db.Exec(
-		"INSERT INTO sessions (token, user_id, expires_at) VALUES (?, ?, ?)",
-		sessionToken, userID, expiresAt,
+		`INSERT INTO sessions (token, user_id, expires_at, absolute_expires_at, remember, csrf_token, user_agent, ip_address, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(sessionToken), userID, expiresAt, absoluteExpiresAt, remember, csrfToken, userAgent, ip, now.UTC(),
 	)
 	if err != nil {
 		return "", fmt.Errorf("failed to create session: %w", err)
 	}
 
+	s.rememberDevice(userID, userAgent, ip, now.UTC())
+
 	return sessionToken, nil
 }
 
-// ValidateSession checks if a session token is valid and returns user ID
-func (s *SessionService) ValidateSession(token string) (int64, error) {
-	var userID int64
-	var expiresAt time.Time
+// idleTimeout returns the idle timeout for a session
+func (s *SessionService) idleTimeout(remember bool) time.Duration {
+	if remember {
+		return s.config.RememberIdleTimeout
+	}
+	return s.config.IdleTimeout
+}
+
+// absoluteLifetime returns the absolute lifetime for a session
+func (s *SessionService) absoluteLifetime(remember bool) time.Duration {
+	if remember {
+		return s.config.RememberLifetime
+	}
+	return s.config.AbsoluteLifetime
+}
+
+// sessionRecord holds the expiry state of a session
+type sessionRecord struct {
+	userID            int64
+	expiresAt         time.Time
+	absoluteExpiresAt time.Time
+	remember          bool
+}
+
+// loadSession returns a session that is neither idle-expired nor past its absolute lifetime
+func (s *SessionService) loadSession(token string) (*sessionRecord, error) {
+	var rec sessionRecord
+	var createdAt time.Time
+	var absoluteExpiresAt sql.NullTime
 
 	err := s.db.QueryRow(
-		"SELECT user_id, expires_at FROM sessions WHERE token = ?",
-		token,
-	).Scan(&userID, &expiresAt)
+		"SELECT user_id, expires_at, absolute_expires_at, remember, created_at FROM sessions WHERE token = ?",
+		hashToken(token),
+	).Scan(&rec.userID, &rec.expiresAt, &absoluteExpiresAt, &rec.remember, &createdAt)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("invalid session")
+			return nil, fmt.Errorf("invalid session")
 		}
-		return 0, fmt.Errorf("failed to validate session: %w", err)
+		return nil, fmt.Errorf("failed to validate session: %w", err)
+	}
+
+	// Sessions created before absolute lifetimes existed count from their creation
+	rec.absoluteExpiresAt = createdAt.Add(s.absoluteLifetime(rec.remember))
+	if absoluteExpiresAt.Valid {
+		rec.absoluteExpiresAt = absoluteExpiresAt.Time
 	}
 
 	// Check if session has expired
-	if time.Now().After(expiresAt) {
+	now := time.Now()
+	if now.After(rec.expiresAt) || now.After(rec.absoluteExpiresAt) {
 		// Clean up expired session
-		s.db.Exec("DELETE FROM sessions WHERE token = ?", token)
-		return 0, fmt.Errorf("session expired")
+		s.db.Exec("DELETE FROM sessions WHERE token = ?", hashToken(token))
+		return nil, fmt.Errorf("session expired")
 	}
 
-	return userID, nil
+	return &rec, nil
+}
+
+// ValidateSession checks if a session token is valid and returns user ID
+func (s *SessionService) ValidateSession(token string) (int64, error) {
+	rec, err := s.loadSession(token)
+	if err != nil {
+		return 0, err
+	}
+	return rec.userID, nil
+}
+
+// renewSession slides the idle deadline of a session forward once more than
+// half of its idle window has passed, capped at the absolute expiry
+func (s *SessionService) renewSession(token string, rec *sessionRecord) {
+	now := time.Now()
+	idle := s.idleTimeout(rec.remember)
+	if rec.expiresAt.Sub(now) > idle/2 {
+		s.touchSession(token)
+		return
+	}
+
+	expiresAt := now.Add(idle)
+	if expiresAt.After(rec.absoluteExpiresAt) {
+		expiresAt = rec.absoluteExpiresAt
+	}
+	s.db.Exec(
+		"UPDATE sessions SET expires_at = ?, last_seen_at = ? WHERE token = ?",
+		expiresAt, now.UTC(), hashToken(token),
+	)
+}
+
+// CSRFToken returns the CSRF token bound to a valid session, creating one for
+// sessions that predate CSRF protection
+func (s *SessionService) CSRFToken(token string) (string, error) {
+	// Sessions past their idle or absolute lifetime have no token
+	if _, err := s.loadSession(token); err != nil {
+		return "", err
+	}
+
+	var csrfToken sql.NullString
+	err := s.db.QueryRow("SELECT csrf_token FROM sessions WHERE token = ?", hashToken(token)).Scan(&csrfToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("invalid session")
+		}
+		return "", fmt.Errorf("failed to load CSRF token: %w", err)
+	}
+
+	if csrfToken.Valid && csrfToken.String != "" {
+		return csrfToken.String, nil
+	}
+
+	newToken, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.db.Exec("UPDATE sessions SET csrf_token = ? WHERE token = ?", newToken, hashToken(token)); err != nil {
+		return "", fmt.Errorf("failed to store CSRF token: %w", err)
+	}
+
+	return newToken, nil
 }
 
 // DeleteSession removes a session (logout)
 func (s *SessionService) DeleteSession(token string) error {
-	_, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", token)
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", hashToken(token))
 	if err != nil {
 		return fmt.Errorf("failed to delete session: %w", err)
 	}
 	return nil
 }
 
+// RotateSession replaces the token (and CSRF token) of the request's session
+// with fresh ones and updates the cookie, keeping the session itself
+func (s *SessionService) RotateSession(w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return fmt.Errorf("no session")
+	}
+
+	rec, err := s.loadSession(cookie.Value)
+	if err != nil {
+		return err
+	}
+
+	newToken := uuid.New().String()
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE sessions SET token = ?, csrf_token = ? WHERE token = ?",
+		hashToken(newToken), csrfToken, hashToken(cookie.Value),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rotate session: %w", err)
+	}
+
+	s.SetSessionCookie(w, newToken, rec.remember)
+	return nil
+}
+
+// ReauthenticationWindow is how long after logging in again with a provider
+// or second factor a session may make sensitive changes without a password
+const ReauthenticationWindow = 5 * time.Minute
+
+// MarkReauthenticated records that the user of the request's session just
+// proved again that it is them
+func (s *SessionService) MarkReauthenticated(r *http.Request) error {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return fmt.Errorf("no session")
+	}
+	if _, err := s.loadSession(cookie.Value); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("UPDATE sessions SET reauthenticated_at = ? WHERE token = ?", time.Now().UTC(), hashToken(cookie.Value))
+	if err != nil {
+		return fmt.Errorf("failed to record reauthentication: %w", err)
+	}
+	return nil
+}
+
+// Reauthenticated reports whether the request's session was marked with
+// MarkReauthenticated within the ReauthenticationWindow
+func (s *SessionService) Reauthenticated(r *http.Request) bool {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return false
+	}
+
+	var reauthenticatedAt sql.NullTime
+	err = s.db.QueryRow("SELECT reauthenticated_at FROM sessions WHERE token = ?", hashToken(cookie.Value)).Scan(&reauthenticatedAt)
+	if err != nil || !reauthenticatedAt.Valid {
+		return false
+	}
+	return time.Since(reauthenticatedAt.Time) < ReauthenticationWindow
+}
+
+// DeleteUserSessions removes every session of a user, logging them out everywhere
+func (s *SessionService) DeleteUserSessions(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user sessions: %w", err)
+	}
+	return nil
+}
+
 // GetCurrentUserID extracts user ID from session cookie
 func (s *SessionService) GetCurrentUserID(r *http.Request) (int64, bool) {
 	cookie, err := r.Cookie("session_token")
@@ -86,25 +300,30 @@ func (s *SessionService) GetCurrentUserID(r *http.Request) (int64, bool) {
 		return 0, false
 	}
 
-	userID, err := s.ValidateSession(cookie.Value)
+	rec, err := s.loadSession(cookie.Value)
 	if err != nil {
 		return 0, false
 	}
 
-	return userID, true
+	s.renewSession(cookie.Value, rec)
+
+	return rec.userID, true
 }
 
-// SetSessionCookie sets the session cookie in the response
-func (s *SessionService) SetSessionCookie(w http.ResponseWriter, token string) {
+// SetSessionCookie sets the session cookie in the response. Remembered sessions
+// get a persistent cookie; others end when the browser is closed.
+func (s *SessionService) SetSessionCookie(w http.ResponseWriter, token string, remember bool) {
 	cookie := &http.Cookie{
 		Name:     "session_token",
 		Value:    token,
 		Path:     "/",
-		MaxAge:   24 * 60 * 60, // 24 hours
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
 		SameSite: http.SameSiteLaxMode,
 	}
+	if remember {
+		cookie.MaxAge = int(s.config.RememberLifetime.Seconds())
+	}
 	http.SetCookie(w, cookie)
 }
 
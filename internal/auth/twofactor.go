@@ -0,0 +1,520 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// loginChallengeTTL is how long the second login step may take
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts is how many codes may be tried per login challenge
+	loginChallengeAttempts = 5
+	// settingRequireStaff2FA is the site setting that makes 2FA mandatory for staff
+	settingRequireStaff2FA = "require_2fa_for_staff"
+	// totpIssuer names the forum in authenticator apps
+	totpIssuer = "Forum"
+)
+
+// ErrLoginChallengeInvalid is returned when the second login step is missing,
+// expired or has used up its attempts
+var ErrLoginChallengeInvalid = errors.New("your login attempt has expired, please log in again")
+
+// ErrInvalidTwoFactorCode is returned for a wrong authentication or recovery code
+var ErrInvalidTwoFactorCode = errors.New("invalid authentication code")
+
+// TwoFactorStatus describes a user's two-factor authentication setup
+type TwoFactorStatus struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+	Required          bool // The user's role requires 2FA
+}
+
+// TwoFactorEnabled reports whether a user has two-factor authentication turned on
+func (a *AuthService) TwoFactorEnabled(userID int64) (bool, error) {
+	var enabled bool
+	err := a.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to load two-factor status: %w", err)
+	}
+	return enabled, nil
+}
+
+// TwoFactorStatus returns the two-factor setup of a user
+func (a *AuthService) TwoFactorStatus(userID int64) (*TwoFactorStatus, error) {
+	var status TwoFactorStatus
+	var role string
+	err := a.db.QueryRow("SELECT totp_enabled, role FROM users WHERE id = ?", userID).Scan(&status.Enabled, &role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load two-factor status: %w", err)
+	}
+
+	err = a.db.QueryRow(
+		"SELECT COUNT(1) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	).Scan(&status.RecoveryCodesLeft)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+
+	if role == RoleModerator || role == RoleAdmin {
+		status.Required, err = a.TwoFactorRequiredForStaff()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &status, nil
+}
+
+// BeginTOTPEnrollment creates a new secret for a user who does not use 2FA yet
+// and returns it along with the otpauth:// URI to show as a QR code. 2FA is
+// only turned on once ConfirmTOTPEnrollment receives a valid code.
+func (a *AuthService) BeginTOTPEnrollment(userID int64) (secret, uri string, err error) {
+	var username string
+	var enabled bool
+	err = a.db.QueryRow("SELECT username, totp_enabled FROM users WHERE id = ?", userID).Scan(&username, &enabled)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load user: %w", err)
+	}
+	if enabled {
+		return "", "", fmt.Errorf("two-factor authentication is already enabled")
+	}
+
+	secret, err = generateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := a.db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userID); err != nil {
+		return "", "", fmt.Errorf("failed to store secret: %w", err)
+	}
+
+	return secret, totpURI(username, secret), nil
+}
+
+// PendingTOTPEnrollment returns the secret and URI of an enrolment that has
+// not been confirmed yet, or empty strings if there is none
+func (a *AuthService) PendingTOTPEnrollment(userID int64) (secret, uri string, err error) {
+	var username string
+	var stored sql.NullString
+	var enabled bool
+	err = a.db.QueryRow(
+		"SELECT username, totp_secret, totp_enabled FROM users WHERE id = ?",
+		userID,
+	).Scan(&username, &stored, &enabled)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load user: %w", err)
+	}
+	if enabled || !stored.Valid || stored.String == "" {
+		return "", "", nil
+	}
+	return stored.String, totpURI(username, stored.String), nil
+}
+
+// totpURI builds the otpauth:// URI authenticator apps scan
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// ConfirmTOTPEnrollment turns on 2FA once the user proves their app produces
+// valid codes, and returns a fresh set of recovery codes
+func (a *AuthService) ConfirmTOTPEnrollment(userID int64, code string) ([]string, error) {
+	var secret sql.NullString
+	var enabled bool
+	err := a.db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+	if enabled {
+		return nil, fmt.Errorf("two-factor authentication is already enabled")
+	}
+	if !secret.Valid || secret.String == "" {
+		return nil, fmt.Errorf("start the setup again")
+	}
+
+	step, ok := matchTOTP(secret.String, normalizeCode(code), time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	if _, err := a.db.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID); err != nil {
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %w", err)
+	}
+
+	return a.RegenerateRecoveryCodes(userID)
+}
+
+// DisableTwoFactor turns 2FA off after checking the password and a current
+// code. Staff cannot turn it off while it is required for their role.
+func (a *AuthService) DisableTwoFactor(userID int64, password, code string) error {
+	status, err := a.TwoFactorStatus(userID)
+	if err != nil {
+		return err
+	}
+	if !status.Enabled {
+		return fmt.Errorf("two-factor authentication is not enabled")
+	}
+	if status.Required {
+		return fmt.Errorf("two-factor authentication is required for your role")
+	}
+
+	// Accounts without a password are vouched for by the code alone
+	if err := a.VerifyPassword(userID, password); err != nil && !errors.Is(err, ErrNoPassword) {
+		return err
+	}
+	if err := a.ConfirmSecondFactor(userID, code); err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes. The codes are
+// returned once; only their hashes are stored.
+func (a *AuthService) RegenerateRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	now := time.Now().UTC()
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			userID, hashToken(normalizeCode(code)), now,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns a random 50-bit code like "k3f9a-xq2mz"
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))
+	return code[:5] + "-" + code[5:10], nil
+}
+
+// normalizeCode strips the spaces and dashes people type into codes
+func normalizeCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code
+func (a *AuthService) verifySecondFactor(userID int64, code string) error {
+	code = normalizeCode(code)
+
+	var secret sql.NullString
+	var lastStep int64
+	err := a.db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ?", userID).Scan(&secret, &lastStep)
+	if err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+
+	if len(code) == totpDigits && secret.Valid {
+		step, ok := matchTOTP(secret.String, code, time.Now(), lastStep)
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+		// Only one request can claim a step, so a code works exactly once
+		result, err := a.db.Exec(
+			"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+			step, userID, step,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record code use: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	result, err := a.db.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), userID, hashToken(code),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// ConfirmSecondFactor checks an authentication or recovery code of a logged
+// in user, such as one confirming it is them before a sensitive change. Wrong
+// codes count towards the same throttle as those entered while logging in.
+func (a *AuthService) ConfirmSecondFactor(userID int64, code string) error {
+	enabled, err := a.TwoFactorEnabled(userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return fmt.Errorf("two-factor authentication is not enabled")
+	}
+	if err := a.checkTwoFactorFailures(userID); err != nil {
+		return err
+	}
+
+	err = a.verifySecondFactor(userID, code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		a.recordTwoFactorFailure(userID)
+	}
+	return err
+}
+
+// recordTwoFactorFailure counts a wrong code entered outside a login as a
+// used-up login challenge, so checkTwoFactorFailures sees it
+func (a *AuthService) recordTwoFactorFailure(userID int64) {
+	token, err := randomToken(32)
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	a.db.Exec(
+		"INSERT INTO login_challenges (user_id, token_hash, attempts, expires_at, created_at) VALUES (?, ?, 1, ?, ?)",
+		userID, hashToken(token), now, now,
+	)
+}
+
+// CreateLoginChallenge starts the second login step for a user whose password
+// was correct. The returned token identifies the pending login.
+func (a *AuthService) CreateLoginChallenge(userID int64, remember bool) (string, error) {
+	if err := a.checkTwoFactorFailures(userID); err != nil {
+		return "", err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	_, err = a.db.Exec(
+		"INSERT INTO login_challenges (user_id, token_hash, remember, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, hashToken(token), remember, now.Add(loginChallengeTTL), now,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create login challenge: %w", err)
+	}
+	return token, nil
+}
+
+// checkTwoFactorFailures throttles code guessing across login challenges,
+// using the same window and threshold as failed passwords
+func (a *AuthService) checkTwoFactorFailures(userID int64) error {
+	var failures int
+	err := a.db.QueryRow(
+		"SELECT COALESCE(SUM(attempts), 0) FROM login_challenges WHERE user_id = ? AND created_at > ?",
+		userID, time.Now().UTC().Add(-a.lockout.Window),
+	).Scan(&failures)
+	if err != nil {
+		return fmt.Errorf("failed to count failed codes: %w", err)
+	}
+	if failures >= a.lockout.AccountThreshold {
+		return ErrLoginThrottled
+	}
+	return nil
+}
+
+// loginChallengeCookie holds the token of a login waiting for its second factor
+const loginChallengeCookie = "login_challenge"
+
+// SetLoginChallengeCookie stores a login challenge token in the browser
+func SetLoginChallengeCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(loginChallengeTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearLoginChallengeCookie removes the login challenge cookie
+func ClearLoginChallengeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    "",
+		Path:     "/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// LoginChallengeToken returns the login challenge token of a request, if any
+func LoginChallengeToken(r *http.Request) string {
+	cookie, err := r.Cookie(loginChallengeCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// ValidateLoginChallenge checks that a login challenge can still be completed
+func (a *AuthService) ValidateLoginChallenge(token string) error {
+	var attempts int
+	var expiresAt time.Time
+	err := a.db.QueryRow(
+		"SELECT attempts, expires_at FROM login_challenges WHERE token_hash = ?",
+		hashToken(token),
+	).Scan(&attempts, &expiresAt)
+	if err != nil || attempts >= loginChallengeAttempts || time.Now().After(expiresAt) {
+		return ErrLoginChallengeInvalid
+	}
+	return nil
+}
+
+// CompleteLoginChallenge checks the code of the second login step and returns
+// the user to create a session for
+func (a *AuthService) CompleteLoginChallenge(token, code string) (userID int64, remember bool, err error) {
+	var id int64
+	var attempts int
+	var expiresAt time.Time
+	err = a.db.QueryRow(
+		"SELECT id, user_id, remember, attempts, expires_at FROM login_challenges WHERE token_hash = ?",
+		hashToken(token),
+	).Scan(&id, &userID, &remember, &attempts, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, ErrLoginChallengeInvalid
+		}
+		return 0, false, fmt.Errorf("failed to load login challenge: %w", err)
+	}
+	if attempts >= loginChallengeAttempts || time.Now().After(expiresAt) {
+		return 0, false, ErrLoginChallengeInvalid
+	}
+	if err := a.checkTwoFactorFailures(userID); err != nil {
+		return 0, false, err
+	}
+
+	if err := a.verifySecondFactor(userID, code); err != nil {
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			a.db.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?", id)
+		}
+		return 0, false, err
+	}
+
+	// Successful logins clear the user's challenges, and with them the failure count
+	if _, err := a.db.Exec("DELETE FROM login_challenges WHERE user_id = ?", userID); err != nil {
+		return 0, false, fmt.Errorf("failed to complete login challenge: %w", err)
+	}
+	return userID, remember, nil
+}
+
+// TwoFactorRequiredForStaff reports whether moderators and admins must use 2FA
+func (a *AuthService) TwoFactorRequiredForStaff() (bool, error) {
+	var value string
+	err := a.db.QueryRow("SELECT value FROM site_settings WHERE key = ?", settingRequireStaff2FA).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to load setting: %w", err)
+	}
+	return value == "true", nil
+}
+
+// SetTwoFactorRequiredForStaff makes 2FA mandatory (or optional) for moderators and admins
+func (a *AuthService) SetTwoFactorRequiredForStaff(required bool) error {
+	_, err := a.db.Exec(`
+		INSERT INTO site_settings (key, value, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		settingRequireStaff2FA, fmt.Sprint(required), time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save setting: %w", err)
+	}
+	return nil
+}
+
+// NeedsTwoFactorEnrollment reports whether a user has to set up 2FA before
+// using the forum, because it is required for their role
+func (a *AuthService) NeedsTwoFactorEnrollment(userID int64) (bool, error) {
+	var role string
+	var enabled bool
+	err := a.db.QueryRow("SELECT role, totp_enabled FROM users WHERE id = ?", userID).Scan(&role, &enabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to load user: %w", err)
+	}
+	if enabled || (role != RoleModerator && role != RoleAdmin) {
+		return false, nil
+	}
+	return a.TwoFactorRequiredForStaff()
+}
+
+// ListStaffWithoutTwoFactor returns the moderators and admins who have not set up 2FA
+func (a *AuthService) ListStaffWithoutTwoFactor() ([]User, error) {
+	rows, err := a.db.Query(
+		"SELECT id, username, email, role, email_verified, created_at FROM users WHERE role IN (?, ?) AND totp_enabled = 0 ORDER BY username",
+		RoleModerator, RoleAdmin,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
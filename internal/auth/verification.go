@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"forum/internal/mailer"
+)
+
+// Actions that can be restricted until a user has verified their email
+const (
+	ActionPost    = "post"
+	ActionComment = "comment"
+	ActionReact   = "react"
+)
+
+// ErrEmailNotVerified is returned for actions that require a verified email
+var ErrEmailNotVerified = errors.New("please verify your email address first")
+
+// VerificationPolicy controls email verification
+type VerificationPolicy struct {
+	RequiredFor    []string      // Actions unverified users may not perform
+	TokenTTL       time.Duration // How long a verification link stays valid
+	ResendCooldown time.Duration // Minimum time between two verification emails
+}
+
+// DefaultVerificationPolicy returns the default verification policy:
+// unverified users can read and react, but not post or comment
+func DefaultVerificationPolicy() VerificationPolicy {
+	return VerificationPolicy{
+		RequiredFor:    []string{ActionPost, ActionComment},
+		TokenTTL:       24 * time.Hour,
+		ResendCooldown: 2 * time.Minute,
+	}
+}
+
+// requires reports whether the policy restricts an action to verified users
+func (p VerificationPolicy) requires(action string) bool {
+	for _, a := range p.RequiredFor {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// SetVerificationPolicy overrides the email verification policy
+func (a *AuthService) SetVerificationPolicy(policy VerificationPolicy) {
+	a.verification = policy
+}
+
+// CheckVerified returns ErrEmailNotVerified if the policy requires a verified
+// email for the action and the user has not verified theirs
+func (a *AuthService) CheckVerified(userID int64, action string) error {
+	if !a.verification.requires(action) {
+		return nil
+	}
+
+	var verified bool
+	err := a.db.QueryRow("SELECT email_verified FROM users WHERE id = ?", userID).Scan(&verified)
+	if err != nil {
+		return fmt.Errorf("failed to check email verification: %w", err)
+	}
+	if !verified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// sendVerification emails a verification link for address to the user,
+// replacing any link sent before
+func (a *AuthService) sendVerification(userID int64, username, address string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := a.db.Exec("DELETE FROM email_verifications WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to clear old verification tokens: %w", err)
+	}
+	_, err = a.db.Exec(
+		"INSERT INTO email_verifications (user_id, email, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, address, hashToken(token), now.Add(a.verification.TokenTTL), now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create verification token: %w", err)
+	}
+
+	link := a.baseURL + "/verify-email?token=" + url.QueryEscape(token)
+	if a.mailer == nil {
+		log.Printf("Email verification for %s (no mailer configured)", address)
+		return nil
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Please confirm that %s is your email address by opening this link:
+
+%s
+
+If you did not sign up for the forum or change your email there,
+you can ignore this email.
+`, username, address, link)
+
+	err = a.mailer.Send(mailer.Message{
+		To:      address,
+		Subject: "Verify your forum email address",
+		Body:    body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send verification email: %w", err)
+	}
+	return nil
+}
+
+// ResendVerification sends a new verification link for the user's current email
+func (a *AuthService) ResendVerification(userID int64) error {
+	var username, address string
+	var verified bool
+	err := a.db.QueryRow(
+		"SELECT username, email, email_verified FROM users WHERE id = ?",
+		userID,
+	).Scan(&username, &address, &verified)
+	if err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+	if verified {
+		return fmt.Errorf("your email address is already verified")
+	}
+
+	var recent bool
+	err = a.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM email_verifications WHERE user_id = ? AND created_at > ?)",
+		userID, time.Now().UTC().Add(-a.verification.ResendCooldown),
+	).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("failed to check recent verification emails: %w", err)
+	}
+	if recent {
+		return fmt.Errorf("a verification email was sent recently, please wait a few minutes before asking for another")
+	}
+
+	return a.sendVerification(userID, username, address)
+}
+
+// RequestEmailChange starts changing a user's email. The address is only
+// changed once the user opens the verification link sent to the new address.
+func (a *AuthService) RequestEmailChange(userID int64, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if _, err := mail.ParseAddress(newEmail); err != nil {
+		return fmt.Errorf("invalid email format")
+	}
+
+	var username, current string
+	err := a.db.QueryRow("SELECT username, email FROM users WHERE id = ?", userID).Scan(&username, &current)
+	if err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+	if strings.EqualFold(newEmail, current) {
+		return fmt.Errorf("that is already your email address")
+	}
+
+	var exists bool
+	err = a.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER(?))", newEmail).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check email availability: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("email already registered")
+	}
+
+	return a.sendVerification(userID, username, newEmail)
+}
+
+// PendingEmail returns the address waiting for verification, if it differs
+// from the user's current email
+func (a *AuthService) PendingEmail(userID int64) (string, error) {
+	var pending string
+	err := a.db.QueryRow(`
+		SELECT v.email FROM email_verifications v
+		JOIN users u ON u.id = v.user_id
+		WHERE v.user_id = ? AND v.email != u.email AND v.expires_at > ?`,
+		userID, time.Now().UTC(),
+	).Scan(&pending)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to load pending email: %w", err)
+	}
+	return pending, nil
+}
+
+// VerifyEmail marks the address a verification token was sent to as verified,
+// making it the user's email if it was a pending change
+func (a *AuthService) VerifyEmail(token string) error {
+	var userID int64
+	var address string
+	var expiresAt time.Time
+
+	err := a.db.QueryRow(
+		"SELECT user_id, email, expires_at FROM email_verifications WHERE token_hash = ?",
+		hashToken(token),
+	).Scan(&userID, &address, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("this verification link is invalid or has already been used")
+		}
+		return fmt.Errorf("failed to load verification token: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return fmt.Errorf("this verification link has expired")
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The address may have been registered by someone else since the link was sent
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER(?) AND id != ?)", address, userID).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("failed to check email availability: %w", err)
+	}
+	if taken {
+		return fmt.Errorf("email already registered")
+	}
+
+	if _, err := tx.Exec("UPDATE users SET email = ?, email_verified = 1 WHERE id = ?", address, userID); err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to use verification token: %w", err)
+	}
+
+	return tx.Commit()
+}
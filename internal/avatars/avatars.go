@@ -0,0 +1,270 @@
+// Package avatars keeps the pictures members upload for themselves and draws
+// an identicon for everyone else. Uploaded avatars are cropped to a square,
+// stored at each of Sizes under the hash of the upload and served from URLs
+// that include that hash, so the pictures behind a URL never change.
+package avatars
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"forum/internal/imaging"
+	"forum/internal/storage"
+)
+
+// MaxSize is the largest avatar file that can be uploaded
+const MaxSize = 2 << 20
+
+// Sizes are the widths, in pixels, avatars are stored and drawn at
+var Sizes = []int{32, 64, 128}
+
+// URL prefixes of uploaded avatars, /avatars/{hash}/{size}, and of
+// identicons, /avatars/identicon/{user id}/{size}
+const (
+	Prefix          = "/avatars/"
+	IdenticonPrefix = "/avatars/identicon/"
+)
+
+var (
+	ErrNotFound = errors.New("avatar not found")
+	ErrTooLarge = fmt.Errorf("the picture is too large (the limit is %d MB)", MaxSize>>20)
+	ErrType     = errors.New("the picture must be a JPEG, PNG or GIF image")
+	ErrEmpty    = errors.New("please choose a picture")
+)
+
+// Service stores uploaded avatars
+type Service struct {
+	db    *sql.DB
+	store storage.Store
+	mu    sync.Mutex // Keeps Cleanup from deleting an avatar that is being set
+}
+
+// NewService creates an avatar service that keeps pictures in store
+func NewService(db *sql.DB, store storage.Store) *Service {
+	return &Service{db: db, store: store}
+}
+
+// URL returns where a user's avatar is served at the smallest stored size
+// that is at least size pixels wide. hash is the user's uploaded avatar; an
+// empty hash gives their identicon.
+func URL(userID int64, hash string, size int) string {
+	size = fitSize(size)
+	if hash == "" {
+		return IdenticonPrefix + strconv.FormatInt(userID, 10) + "/" + strconv.Itoa(size)
+	}
+	return Prefix + hash + "/" + strconv.Itoa(size)
+}
+
+// fitSize returns the smallest of Sizes that is at least size, or the largest
+func fitSize(size int) int {
+	for _, s := range Sizes {
+		if s >= size {
+			return s
+		}
+	}
+	return Sizes[len(Sizes)-1]
+}
+
+// ParseSize returns the size of an avatar URL, which must be one of Sizes
+func ParseSize(value string) (int, bool) {
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	for _, s := range Sizes {
+		if s == size {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// Current returns the hash of a user's uploaded avatar, or "" if they use
+// their identicon
+func (s *Service) Current(ctx context.Context, userID int64) (string, error) {
+	var hash sql.NullString
+	err := s.db.QueryRowContext(ctx, "SELECT avatar FROM users WHERE id = ?", userID).Scan(&hash)
+	if err != nil {
+		return "", err
+	}
+	return hash.String, nil
+}
+
+// Set makes a picture a user's avatar. The type is sniffed from the content,
+// metadata is dropped (photos are turned upright first), and the middle
+// square of the picture is stored at each of Sizes.
+func (s *Service) Set(ctx context.Context, userID int64, data []byte) error {
+	if len(data) == 0 {
+		return ErrEmpty
+	}
+	if len(data) > MaxSize {
+		return ErrTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return ErrType
+	}
+
+	cleaned, err := imaging.StripMetadata(data, contentType)
+	if err != nil {
+		return ErrType
+	}
+	img, _, err := imaging.Decode(cleaned)
+	if err != nil {
+		if errors.Is(err, imaging.ErrTooLarge) {
+			return ErrTooLarge
+		}
+		return ErrType
+	}
+	square := imaging.Crop(img, centerSquare(img.Bounds()))
+	hash := hashOf(cleaned)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, size := range Sizes {
+		encoded, err := imaging.EncodePNG(imaging.Resize(square, size, size))
+		if err != nil {
+			return fmt.Errorf("failed to encode avatar: %w", err)
+		}
+		if err := s.store.Put(ctx, key(hash, size), encoded); err != nil {
+			return fmt.Errorf("failed to store avatar: %w", err)
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO avatar_blobs (hash) VALUES (?)", hash); err != nil {
+		return fmt.Errorf("failed to save avatar: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET avatar = ? WHERE id = ?", hash, userID); err != nil {
+		return fmt.Errorf("failed to save avatar: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.cleanup(ctx)
+	return nil
+}
+
+// Remove goes back to the user's identicon
+func (s *Service) Remove(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, "UPDATE users SET avatar = NULL WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to remove avatar: %w", err)
+	}
+	s.cleanup(ctx)
+	return nil
+}
+
+// Open returns an uploaded avatar at one of Sizes
+func (s *Service) Open(ctx context.Context, hash string, size int) (storage.Blob, error) {
+	if !validHash(hash) {
+		return nil, ErrNotFound
+	}
+	blob, err := s.store.Open(ctx, key(hash, size))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+// Cleanup deletes stored avatars that no user has any more, such as those of
+// deleted accounts. It returns how many were removed.
+func (s *Service) Cleanup(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeOrphans(ctx)
+}
+
+// cleanup removes orphaned avatars right after a change, logging failures;
+// the periodic Cleanup catches anything left over. s.mu must be held.
+func (s *Service) cleanup(ctx context.Context) {
+	if _, err := s.removeOrphans(ctx); err != nil {
+		log.Printf("Failed to clean up avatars: %v", err)
+	}
+}
+
+func (s *Service) removeOrphans(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT hash FROM avatar_blobs b
+		WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.avatar = b.hash)`)
+	if err != nil {
+		return 0, err
+	}
+	var orphans []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orphans = append(orphans, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, hash := range orphans {
+		for _, size := range Sizes {
+			if err := s.store.Delete(ctx, key(hash, size)); err != nil {
+				return removed, fmt.Errorf("failed to delete avatar %s: %w", hash, err)
+			}
+		}
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM avatar_blobs WHERE hash = ?", hash); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// centerSquare returns the largest square in the middle of r
+func centerSquare(r image.Rectangle) image.Rectangle {
+	side := min(r.Dx(), r.Dy())
+	x := r.Min.X + (r.Dx()-side)/2
+	y := r.Min.Y + (r.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// key is the storage key of an avatar at one size. The suffix keeps avatars
+// apart from attachments when both use the same store.
+func key(hash string, size int) string {
+	return hash + ".avatar-" + strconv.Itoa(size)
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
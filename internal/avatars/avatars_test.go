@@ -0,0 +1,226 @@
+package avatars
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"forum/internal/database"
+	"forum/internal/storage"
+)
+
+// newTestService returns a service storing pictures in a temporary
+// directory, the database and the ID of a user
+func newTestService(t *testing.T) (*Service, *sql.DB, int64) {
+	t.Helper()
+
+	// InitializeDatabase reads the migrations relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("..", "..")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := database.NewDB(&database.Config{
+		DSN:          filepath.Join(t.TempDir(), "forum.db"),
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	var userID int64
+	err = db.QueryRow(
+		"INSERT INTO users (username, email, password_hash) VALUES ('alice', 'alice@example.com', '!') RETURNING id",
+	).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(db.DB, store), db.DB, userID
+}
+
+// banner encodes a 300x200 JPEG that is red in the middle 200 pixels and
+// blue at the sides, so a centred square crop is all red
+func banner(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x < 50 || x >= 250 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// openAvatar reads and decodes a stored avatar
+func openAvatar(t *testing.T, s *Service, hash string, size int) image.Image {
+	t.Helper()
+	blob, err := s.Open(context.Background(), hash, size)
+	if err != nil {
+		t.Fatalf("size %d: %v", size, err)
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("size %d is not a PNG: %v", size, err)
+	}
+	return img
+}
+
+func TestSetStoresEverySize(t *testing.T) {
+	s, _, userID := newTestService(t)
+	ctx := context.Background()
+
+	if err := s.Set(ctx, userID, banner(t)); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.Current(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validHash(hash) {
+		t.Fatalf("current avatar = %q", hash)
+	}
+
+	for _, size := range Sizes {
+		img := openAvatar(t, s, hash, size)
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d is stored as %dx%d", size, b.Dx(), b.Dy())
+		}
+		// The blue sides are cropped away
+		for _, p := range []image.Point{{0, 0}, {size - 1, size / 2}, {size / 2, size - 1}} {
+			r, _, b, _ := img.At(p.X, p.Y).RGBA()
+			if r>>8 < 200 || b>>8 > 60 {
+				t.Errorf("size %d: pixel %v is %v, want red", size, p, img.At(p.X, p.Y))
+			}
+		}
+	}
+	if _, err := s.Open(ctx, hash, 48); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unconfigured size: %v, want ErrNotFound", err)
+	}
+}
+
+func TestSetRejectsBadPictures(t *testing.T) {
+	s, _, userID := newTestService(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrEmpty},
+		{"too large", make([]byte, MaxSize+1), ErrTooLarge},
+		{"SVG", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), ErrType},
+		{"broken PNG", []byte("\x89PNG\r\n\x1a\nnot really"), ErrType},
+	}
+	for _, tt := range tests {
+		if err := s.Set(ctx, userID, tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if hash, err := s.Current(ctx, userID); err != nil || hash != "" {
+		t.Errorf("current avatar = %q, %v; want the identicon", hash, err)
+	}
+}
+
+func TestReplacedAvatarsAreRemoved(t *testing.T) {
+	s, db, userID := newTestService(t)
+	ctx := context.Background()
+
+	if err := s.Set(ctx, userID, banner(t)); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.Current(ctx, userID)
+
+	var square bytes.Buffer
+	png.Encode(&square, image.NewRGBA(image.Rect(0, 0, 64, 64)))
+	if err := s.Set(ctx, userID, square.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.Current(ctx, userID)
+	if second == first {
+		t.Fatal("avatar did not change")
+	}
+	for _, size := range Sizes {
+		if _, err := s.Open(ctx, first, size); !errors.Is(err, ErrNotFound) {
+			t.Errorf("replaced avatar at size %d: %v, want ErrNotFound", size, err)
+		}
+	}
+
+	if err := s.Remove(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, second, Sizes[0]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("removed avatar: %v, want ErrNotFound", err)
+	}
+	var blobs int
+	db.QueryRow("SELECT COUNT(*) FROM avatar_blobs").Scan(&blobs)
+	if blobs != 0 {
+		t.Errorf("%d avatar blobs left", blobs)
+	}
+}
+
+func TestURL(t *testing.T) {
+	hash := hashOf([]byte("picture"))
+	tests := []struct {
+		hash string
+		size int
+		want string
+	}{
+		{"", 16, "/avatars/identicon/5/32"},
+		{"", 64, "/avatars/identicon/5/64"},
+		{"", 65, "/avatars/identicon/5/128"},
+		{hash, 500, "/avatars/" + hash + "/128"},
+	}
+	for _, tt := range tests {
+		if got := URL(5, tt.hash, tt.size); got != tt.want {
+			t.Errorf("URL(5, %q, %d) = %q, want %q", tt.hash, tt.size, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"32", "64", "128"} {
+		if _, ok := ParseSize(value); !ok {
+			t.Errorf("ParseSize(%q) failed", value)
+		}
+	}
+	for _, value := range []string{"", "48", "-32", "1e2"} {
+		if _, ok := ParseSize(value); ok {
+			t.Errorf("ParseSize(%q) succeeded", value)
+		}
+	}
+}
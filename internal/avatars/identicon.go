@@ -0,0 +1,87 @@
+package avatars
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+
+	"forum/internal/imaging"
+)
+
+// identiconBackground is the colour around and between the filled cells
+var identiconBackground = color.RGBA{240, 240, 245, 255}
+
+// Identicon draws a user's identicon as a size by size PNG. It is a 5 by 5
+// grid, mirrored left to right, whose cells and colour come from a hash of
+// the user ID, so a user always gets the same picture.
+func Identicon(userID int64, size int) ([]byte, error) {
+	sum := sha256.Sum256([]byte("identicon:" + strconv.FormatInt(userID, 10)))
+	hue := float64(binary.BigEndian.Uint16(sum[0:2])) / 65536 * 360
+	foreground := hslColor(hue, 0.6, 0.5)
+
+	// Each of the 15 cells of the left half and middle column is on or off
+	var filled [5][5]bool
+	for i := 0; i < 15; i++ {
+		row, col := i/3, i%3
+		on := sum[2+i/8]&(1<<(i%8)) != 0
+		filled[row][col] = on
+		filled[row][4-col] = on
+	}
+
+	// The grid is 5 cells with half a cell of margin on each side, which is
+	// 12 half cells across
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		row, inRow := identiconCell(y, size)
+		for x := 0; x < size; x++ {
+			col, inCol := identiconCell(x, size)
+			c := identiconBackground
+			if inRow && inCol && filled[row][col] {
+				c = foreground
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return imaging.EncodePNG(img)
+}
+
+// identiconCell returns the grid cell a pixel falls in, or false in the margin
+func identiconCell(pixel, size int) (int, bool) {
+	half := pixel * 12 / size
+	if half < 1 || half > 10 {
+		return 0, false
+	}
+	return (half - 1) / 2, true
+}
+
+// hslColor converts a hue in degrees, saturation and lightness to RGB
+func hslColor(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 255,
+	}
+}
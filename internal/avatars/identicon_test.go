@@ -0,0 +1,80 @@
+package avatars
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// decodeIdenticon draws and decodes a user's identicon
+func decodeIdenticon(t *testing.T, userID int64, size int) ([]byte, image.Image) {
+	t.Helper()
+	data, err := Identicon(userID, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, img
+}
+
+// isBackground reports whether a pixel is outside the identicon's cells
+func isBackground(c color.Color) bool {
+	return color.RGBAModel.Convert(c) == identiconBackground
+}
+
+func TestIdenticonIsDeterministic(t *testing.T) {
+	for _, size := range Sizes {
+		first, img := decodeIdenticon(t, 42, size)
+		again, _ := decodeIdenticon(t, 42, size)
+		if !bytes.Equal(first, again) {
+			t.Errorf("size %d: identicon of user 42 changed between calls", size)
+		}
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d: identicon is %dx%d", size, b.Dx(), b.Dy())
+		}
+	}
+
+	seen := make(map[string]int64)
+	for userID := int64(1); userID <= 20; userID++ {
+		data, _ := decodeIdenticon(t, userID, 64)
+		if other, ok := seen[string(data)]; ok {
+			t.Errorf("users %d and %d have the same identicon", other, userID)
+		}
+		seen[string(data)] = userID
+	}
+}
+
+func TestIdenticonIsMirrored(t *testing.T) {
+	const size = 120 // Divisible by 12, so cells are whole pixels
+	_, img := decodeIdenticon(t, 7, size)
+
+	filled := false
+	for y := 0; y < size; y++ {
+		for x := 0; x < size/2; x++ {
+			left, right := img.At(x, y), img.At(size-1-x, y)
+			if left != right {
+				t.Fatalf("pixel %d,%d is %v but its mirror is %v", x, y, left, right)
+			}
+			if !isBackground(left) {
+				filled = true
+			}
+		}
+	}
+	if !filled {
+		t.Error("identicon has no filled cells")
+	}
+
+	// The half cell margin is always background
+	for i := 0; i < size; i++ {
+		for _, p := range []image.Point{{i, 0}, {0, i}, {i, size - 1}, {size - 1, i}} {
+			if !isBackground(img.At(p.X, p.Y)) {
+				t.Fatalf("margin pixel %v is filled", p)
+			}
+		}
+	}
+}
@@ -84,10 +84,153 @@ func (db *DB) InitializeDatabase() error {
 		return fmt.Errorf("failed to execute migrations: %w", err)
 	}
 
+	// Bring databases created by older versions up to date
+	if err := db.addMissingColumns(); err != nil {
+		return err
+	}
+	if err := db.applyDataMigrations(); err != nil {
+		return err
+	}
+
 	log.Println("Database initialized successfully")
 	return nil
 }
 
+// columnMigration describes a column added to a table after its initial release
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+// columnMigrations lists columns that migrations.sql declares in CREATE TABLE but
+// which existing databases may lack. SQLite has no ADD COLUMN IF NOT EXISTS, so
+// each one is checked against PRAGMA table_info before being added.
+var columnMigrations = []columnMigration{
+	{"users", "role", "TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'))"},
+	{"sessions", "csrf_token", "TEXT"},
+	{"sessions", "user_agent", "TEXT"},
+	{"sessions", "ip_address", "TEXT"},
+	{"sessions", "last_seen_at", "DATETIME"},
+	{"sessions", "remember", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "absolute_expires_at", "DATETIME"},
+	{"users", "notify_new_device", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "email_verified", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "username_changed_at", "DATETIME"},
+	{"users", "totp_secret", "TEXT"},
+	{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"posts", "updated_at", "DATETIME"},
+	{"comments", "updated_at", "DATETIME"},
+	{"posts", "content_html", "TEXT"},
+	{"posts", "content_html_version", "INTEGER"},
+	{"comments", "content_html", "TEXT"},
+	{"comments", "content_html_version", "INTEGER"},
+	{"users", "bio", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "show_liked_posts", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "avatar", "TEXT"},
+	{"sessions", "reauthenticated_at", "DATETIME"},
+	{"oauth_states", "user_id", "INTEGER"},
+	{"oauth_states", "return_to", "TEXT"},
+}
+
+// dataMigration is a one-time change to existing data, recorded in schema_migrations
+type dataMigration struct {
+	Name string
+	SQL  string
+}
+
+// dataMigrations run once per database, in order
+var dataMigrations = []dataMigration{
+	// Session tokens used to be stored in plaintext; they are now stored as
+	// SHA-256 hashes, so every legacy session is invalidated.
+	{"0001_invalidate_plaintext_session_tokens", "DELETE FROM sessions"},
+	// Accounts created before email verification existed are trusted as-is
+	{"0002_mark_existing_users_verified", "UPDATE users SET email_verified = 1"},
+	// The placeholder and bot accounts shared the password marker of provider
+	// accounts, which may set a password; they get a marker that never can
+	{"0003_lock_placeholder_and_bot_accounts", "UPDATE users SET password_hash = '*' WHERE password_hash = '!' AND (email = 'deleted@invalid' OR email LIKE '%@bots.invalid')"},
+}
+
+// applyDataMigrations runs the data migrations that have not been applied yet
+func (db *DB) applyDataMigrations() error {
+	for _, m := range dataMigrations {
+		var applied bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE name = ?)", m.Name).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("failed to check migration %s: %w", m.Name, err)
+		}
+		if applied {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to start migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec(m.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)", m.Name, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %w", m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %s: %w", m.Name, err)
+		}
+		log.Printf("Applied migration %s", m.Name)
+	}
+	return nil
+}
+
+// addMissingColumns applies every column migration the database does not have yet
+func (db *DB) addMissingColumns() error {
+	for _, m := range columnMigrations {
+		exists, err := db.columnExists(m.Table, m.Column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.Table, m.Column, m.Definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.Table, m.Column, err)
+		}
+		log.Printf("Added column %s.%s", m.Table, m.Column)
+	}
+	return nil
+}
+
+// columnExists reports whether a table already has the given column
+func (db *DB) columnExists(table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan table info: %w", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 // Close closes the database connection
 func (db *DB) Close() error {
 	if db.DB != nil {
@@ -139,7 +282,118 @@ func (db *DB) CleanExpiredSessions() error {
 	return nil
 }
 
+// CleanOldLoginAttempts removes login attempts and lockouts that no longer affect throttling
+func (db *DB) CleanOldLoginAttempts(olderThan time.Duration) error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	cutoff := time.Now().UTC().Add(-olderThan)
+	if _, err := db.ExecContext(ctx, "DELETE FROM login_attempts WHERE created_at < ?", cutoff); err != nil {
+		return fmt.Errorf("failed to clean login attempts: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM login_lockouts WHERE locked_until < ?", time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to clean login lockouts: %w", err)
+	}
+
+	return nil
+}
+
+// CleanLoginChallenges removes second-step login challenges. They are kept for
+// a while after expiring because failed attempts on them throttle code guessing.
+func (db *DB) CleanLoginChallenges(olderThan time.Duration) error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM login_challenges WHERE created_at < ?", time.Now().UTC().Add(-olderThan))
+	if err != nil {
+		return fmt.Errorf("failed to clean login challenges: %w", err)
+	}
+
+	return nil
+}
+
+// CleanPasskeyChallenges removes abandoned passkey ceremonies
+func (db *DB) CleanPasskeyChallenges() error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM passkey_challenges WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to clean passkey challenges: %w", err)
+	}
+
+	return nil
+}
+
+// CleanOAuthStates removes abandoned OpenID Connect logins and signups
+func (db *DB) CleanOAuthStates() error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, "DELETE FROM oauth_states WHERE expires_at < ?", now); err != nil {
+		return fmt.Errorf("failed to clean oauth states: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM oauth_signups WHERE expires_at < ?", now); err != nil {
+		return fmt.Errorf("failed to clean oauth signups: %w", err)
+	}
+
+	return nil
+}
+
+// CleanEmailVerifications removes expired email verification tokens
+func (db *DB) CleanEmailVerifications() error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM email_verifications WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to clean email verifications: %w", err)
+	}
+
+	return nil
+}
+
+// CleanPasswordResets removes password reset tokens that expired or were used
+func (db *DB) CleanPasswordResets() error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM password_resets WHERE expires_at < ? OR used_at IS NOT NULL", time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to clean password resets: %w", err)
+	}
+
+	return nil
+}
+
 // GetStats returns basic database statistics
 func (db *DB) GetStats() sql.DBStats {
 	return db.DB.Stats()
 }
+
+// CleanNotifications removes read notifications older than olderThan
+func (db *DB) CleanNotifications(olderThan time.Duration) error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	cutoff := time.Now().UTC().Add(-olderThan)
+	if _, err := db.ExecContext(ctx, "DELETE FROM notifications WHERE read_at IS NOT NULL AND updated_at < ?", cutoff); err != nil {
+		return fmt.Errorf("failed to clean notifications: %w", err)
+	}
+
+	return nil
+}
+
+// CleanWebhookDeliveries removes finished webhook deliveries older than olderThan
+func (db *DB) CleanWebhookDeliveries(olderThan time.Duration) error {
+	ctx, cancel := GetContextWithTimeout(10 * time.Second)
+	defer cancel()
+
+	cutoff := time.Now().UTC().Add(-olderThan)
+	if _, err := db.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < ?", cutoff); err != nil {
+		return fmt.Errorf("failed to clean webhook deliveries: %w", err)
+	}
+
+	return nil
+}
@@ -4,12 +4,28 @@
 -- Enable foreign key constraints
 PRAGMA foreign_keys = ON;
 
+-- One-time data migrations that have been applied (see dataMigrations in db.go)
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    name TEXT PRIMARY KEY,
+    applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Users table
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     email TEXT NOT NULL UNIQUE,
     username TEXT NOT NULL UNIQUE,
     password_hash TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin')),
+    notify_new_device INTEGER NOT NULL DEFAULT 0,
+    email_verified INTEGER NOT NULL DEFAULT 0,
+    username_changed_at DATETIME,
+    totp_secret TEXT, -- base32 TOTP secret; set during enrolment, used once totp_enabled
+    totp_enabled INTEGER NOT NULL DEFAULT 0,
+    totp_last_step INTEGER NOT NULL DEFAULT 0, -- last accepted time step, so codes cannot be replayed
+    bio TEXT NOT NULL DEFAULT '', -- shown on the public profile page
+    show_liked_posts INTEGER NOT NULL DEFAULT 0, -- whether the profile lists the posts the user liked
+    avatar TEXT, -- hash of the uploaded avatar in avatar_blobs; NULL shows the generated identicon
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -17,12 +33,29 @@ CREATE TABLE IF NOT EXISTS users (
 CREATE TABLE IF NOT EXISTS sessions (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     user_id INTEGER NOT NULL,
-    token TEXT NOT NULL UNIQUE,
+    token TEXT NOT NULL UNIQUE, -- SHA-256 of the session cookie value, never the value itself
+    csrf_token TEXT,
+    user_agent TEXT,
+    ip_address TEXT,
+    last_seen_at DATETIME,
+    remember INTEGER NOT NULL DEFAULT 0,
     expires_at DATETIME NOT NULL,
+    absolute_expires_at DATETIME,
+    reauthenticated_at DATETIME, -- Last time the user proved it was them without a password
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- Devices (user agents) each user has logged in from, for new device notifications
+CREATE TABLE IF NOT EXISTS known_devices (
+    user_id INTEGER NOT NULL,
+    fingerprint TEXT NOT NULL,
+    first_seen_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, fingerprint),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
 -- Categories table
 CREATE TABLE IF NOT EXISTS categories (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -37,6 +70,9 @@ CREATE TABLE IF NOT EXISTS posts (
     title TEXT NOT NULL,
     content TEXT NOT NULL,
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME, -- NULL until the post is edited
+    content_html TEXT, -- Rendered Markdown; NULL until first shown or after an edit
+    content_html_version INTEGER, -- Renderer version that produced content_html
     FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
@@ -56,6 +92,9 @@ CREATE TABLE IF NOT EXISTS comments (
     author_id INTEGER NOT NULL,
     content TEXT NOT NULL,
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME, -- NULL until the comment is edited
+    content_html TEXT, -- Rendered Markdown; NULL until first shown or after an edit
+    content_html_version INTEGER, -- Renderer version that produced content_html
     FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
     FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE
 );
@@ -80,6 +119,314 @@ CREATE TABLE IF NOT EXISTS comment_likes (
     FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE CASCADE
 );
 
+-- Login attempts for brute-force protection (keyed by the submitted email, not the user,
+-- so unknown addresses are throttled exactly like real ones)
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL,
+    ip_address TEXT NOT NULL,
+    success INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Temporary login lockouts per email or per IP address
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    scope TEXT NOT NULL CHECK (scope IN ('email', 'ip')),
+    subject TEXT NOT NULL,
+    locked_until DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (scope, subject)
+);
+
+-- Single-use password reset tokens; only the SHA-256 of a token is stored
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Email verification tokens; email is the address being verified, which
+-- differs from users.email while an email change is pending
+CREATE TABLE IF NOT EXISTS email_verifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Two-factor recovery codes; only the SHA-256 of a code is stored
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Logins waiting for their second factor
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    remember INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Site-wide settings changed from the admin pages
+CREATE TABLE IF NOT EXISTS site_settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- WebAuthn passkeys; a user can register several
+CREATE TABLE IF NOT EXISTS passkeys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    credential_id TEXT UNIQUE NOT NULL, -- base64url
+    public_key BLOB NOT NULL,           -- COSE_Key
+    sign_count INTEGER NOT NULL DEFAULT 0,
+    name TEXT NOT NULL,
+    last_used_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Passkey registration and login ceremonies in progress
+CREATE TABLE IF NOT EXISTS passkey_challenges (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT UNIQUE NOT NULL,
+    user_id INTEGER, -- Set for registrations, NULL for logins
+    ceremony TEXT NOT NULL CHECK (ceremony IN ('register', 'login')),
+    challenge BLOB NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Accounts at OpenID Connect providers linked to forum users
+CREATE TABLE IF NOT EXISTS oauth_identities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL, -- The user's ID at the provider
+    email TEXT NOT NULL DEFAULT '',
+    last_login_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- OpenID Connect logins waiting for the provider to redirect back
+CREATE TABLE IF NOT EXISTS oauth_states (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    state_hash TEXT UNIQUE NOT NULL,
+    provider TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    user_id INTEGER, -- Set when a logged in user is confirming it is them
+    return_to TEXT,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- First OpenID Connect logins waiting for the user to pick a username
+CREATE TABLE IF NOT EXISTS oauth_signups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT UNIQUE NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL,
+    email_verified INTEGER NOT NULL DEFAULT 0,
+    suggested_username TEXT NOT NULL DEFAULT '',
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Personal API tokens for bots and scripts
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT NOT NULL, -- Comma-separated: read, write, react
+    expires_at DATETIME,  -- NULL for tokens that never expire
+    last_used_at DATETIME,
+    last_used_ip TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,       -- Recipient
+    type TEXT NOT NULL,             -- comment, reply, post_like, comment_like or mention
+    post_id INTEGER NOT NULL,
+    comment_id INTEGER,             -- Latest comment it points at, if any
+    group_key TEXT NOT NULL,        -- Unread notifications with the same type and key are coalesced
+    last_actor_id INTEGER NOT NULL,
+    read_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE SET NULL,
+    FOREIGN KEY (last_actor_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Everyone who contributed to a coalesced notification
+CREATE TABLE IF NOT EXISTS notification_actors (
+    notification_id INTEGER NOT NULL,
+    actor_id INTEGER NOT NULL,
+    PRIMARY KEY (notification_id, actor_id),
+    FOREIGN KEY (notification_id) REFERENCES notifications(id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Notification types a user turned off; types without a row are on
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, type),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Posts a user follows for new comments
+CREATE TABLE IF NOT EXISTS post_watches (
+    user_id INTEGER NOT NULL,
+    post_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, post_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+
+-- Email digest subscriptions; users without a row get no digest
+CREATE TABLE IF NOT EXISTS digest_subscriptions (
+    user_id INTEGER PRIMARY KEY,
+    frequency TEXT NOT NULL CHECK (frequency IN ('daily', 'weekly')),
+    last_sent_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Start of the next digest's period
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Categories whose new posts appear in a user's digest
+CREATE TABLE IF NOT EXISTS category_follows (
+    user_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    PRIMARY KEY (user_id, category_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE CASCADE
+);
+
+-- Outbound webhooks registered by admins
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    secret TEXT NOT NULL,            -- Signs payloads (HMAC-SHA256)
+    events TEXT NOT NULL,            -- Comma-separated event types
+    active BOOLEAN NOT NULL DEFAULT 1,
+    created_by INTEGER,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Delivery queue and log of webhook events
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_attempt_at DATETIME,
+    response_code INTEGER,           -- NULL if no response was received
+    response_body TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+-- Incoming webhooks that let external systems post as a bot account
+CREATE TABLE IF NOT EXISTS incoming_webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,  -- SHA-256 of the secret token in the hook URL
+    previous_token_hash TEXT,         -- Still accepted after a rotation until previous_expires_at
+    previous_expires_at DATETIME,
+    bot_user_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    rate_limit INTEGER NOT NULL DEFAULT 60, -- Requests per hour
+    active BOOLEAN NOT NULL DEFAULT 1,
+    created_by INTEGER,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    FOREIGN KEY (bot_user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Posts created through incoming webhooks, by the key the sender gave them,
+-- so later messages with the same key become comments
+CREATE TABLE IF NOT EXISTS incoming_webhook_posts (
+    webhook_id INTEGER NOT NULL,
+    external_key TEXT NOT NULL,
+    post_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (webhook_id, external_key),
+    FOREIGN KEY (webhook_id) REFERENCES incoming_webhooks(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+
+-- Uploaded files, stored once per distinct content under their SHA-256 hash
+CREATE TABLE IF NOT EXISTS attachment_blobs (
+    hash TEXT PRIMARY KEY,            -- Hex SHA-256 of the stored (metadata-free) file
+    content_type TEXT NOT NULL,       -- Sniffed from the content
+    size INTEGER NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0, -- Images only
+    height INTEGER NOT NULL DEFAULT 0,
+    has_thumbnail BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Uploaded avatars, stored once per distinct picture at each size. Blobs no
+-- user points at are deleted by the avatar cleanup.
+CREATE TABLE IF NOT EXISTS avatar_blobs (
+    hash TEXT PRIMARY KEY, -- Hex SHA-256 of the uploaded (metadata-free) picture
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Files attached to posts and comments. Blobs no row points at are deleted
+-- by the attachment cleanup.
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    blob_hash TEXT NOT NULL,
+    uploader_id INTEGER NOT NULL,
+    post_id INTEGER NOT NULL,
+    comment_id INTEGER, -- NULL for files attached to the post itself
+    filename TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (blob_hash) REFERENCES attachment_blobs(hash),
+    FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE CASCADE
+);
+
 -- Performance indexes
 CREATE INDEX IF NOT EXISTS idx_posts_author_id ON posts(author_id);
 CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts(created_at);
@@ -95,6 +442,31 @@ CREATE INDEX IF NOT EXISTS idx_sessions_token ON sessions(token);
 CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
 CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
 CREATE INDEX IF NOT EXISTS idx_categories_name ON categories(name);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts(email, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts(ip_address, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_lockouts_locked_until ON login_lockouts(locked_until);
+CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id);
+CREATE INDEX IF NOT EXISTS idx_email_verifications_user_id ON email_verifications(user_id);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
+CREATE INDEX IF NOT EXISTS idx_login_challenges_user_id ON login_challenges(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_passkeys_user_id ON passkeys(user_id);
+CREATE INDEX IF NOT EXISTS idx_passkey_challenges_expires_at ON passkey_challenges(expires_at);
+CREATE INDEX IF NOT EXISTS idx_oauth_identities_user_id ON oauth_identities(user_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_states_expires_at ON oauth_states(expires_at);
+CREATE INDEX IF NOT EXISTS idx_oauth_signups_expires_at ON oauth_signups(expires_at);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, updated_at);
+CREATE INDEX IF NOT EXISTS idx_notifications_group ON notifications(user_id, type, group_key);
+CREATE INDEX IF NOT EXISTS idx_notification_actors_actor_id ON notification_actors(actor_id);
+CREATE INDEX IF NOT EXISTS idx_post_watches_post_id ON post_watches(post_id);
+CREATE INDEX IF NOT EXISTS idx_digest_subscriptions_last_sent_at ON digest_subscriptions(frequency, last_sent_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_incoming_webhooks_previous_token_hash ON incoming_webhooks(previous_token_hash);
+CREATE INDEX IF NOT EXISTS idx_incoming_webhook_posts_post_id ON incoming_webhook_posts(post_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_post_id ON attachments(post_id, comment_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_comment_id ON attachments(comment_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_blob_hash ON attachments(blob_hash);
 
 -- Insert some default categories
 INSERT OR IGNORE INTO categories (name) VALUES ('General');
@@ -6,29 +6,57 @@ import (
 
 // User represents a forum user
 type User struct {
-	ID           int64     `db:"id"`
-	Email        string    `db:"email"`
-	Username     string    `db:"username"`
-	PasswordHash string    `db:"password_hash"`
-	CreatedAt    time.Time `db:"created_at"`
+	ID                int64      `db:"id"`
+	Email             string     `db:"email"`
+	Username          string     `db:"username"`
+	PasswordHash      string     `db:"password_hash"`
+	Role              string     `db:"role"` // user, moderator or admin
+	NotifyNewDevice   bool       `db:"notify_new_device"`
+	EmailVerified     bool       `db:"email_verified"`
+	UsernameChangedAt *time.Time `db:"username_changed_at"`
+	TOTPSecret        *string    `db:"totp_secret"`
+	TOTPEnabled       bool       `db:"totp_enabled"`
+	TOTPLastStep      int64      `db:"totp_last_step"`
+	Bio               string     `db:"bio"`
+	ShowLikedPosts    bool       `db:"show_liked_posts"`
+	Avatar            *string    `db:"avatar"` // Hash in avatar_blobs; nil for the identicon
+	CreatedAt         time.Time  `db:"created_at"`
 }
 
 // Session represents a user session for authentication
 type Session struct {
-	ID        int64     `db:"id"`
-	UserID    int64     `db:"user_id"`
-	Token     string    `db:"token"`
-	ExpiresAt time.Time `db:"expires_at"`
-	CreatedAt time.Time `db:"created_at"`
+	ID                int64     `db:"id"`
+	UserID            int64     `db:"user_id"`
+	Token             string    `db:"token"` // SHA-256 of the cookie value
+	CSRFToken         string    `db:"csrf_token"`
+	UserAgent         string    `db:"user_agent"`
+	IPAddress         string    `db:"ip_address"`
+	LastSeenAt        time.Time `db:"last_seen_at"`
+	Remember          bool      `db:"remember"`
+	ExpiresAt         time.Time `db:"expires_at"` // Idle expiry, slides forward with activity
+	AbsoluteExpiresAt time.Time `db:"absolute_expires_at"`
+	CreatedAt         time.Time `db:"created_at"`
+}
+
+// KnownDevice represents a device (user agent) a user has logged in from
+type KnownDevice struct {
+	UserID      int64     `db:"user_id"`
+	Fingerprint string    `db:"fingerprint"`
+	FirstSeenAt time.Time `db:"first_seen_at"`
+	LastSeenAt  time.Time `db:"last_seen_at"`
 }
 
 // Post represents a forum post
 type Post struct {
-	ID        int64     `db:"id"`
-	AuthorID  int64     `db:"author_id"`
-	Title     string    `db:"title"`
-	Content   string    `db:"content"`
-	CreatedAt time.Time `db:"created_at"`
+	ID        int64      `db:"id"`
+	AuthorID  int64      `db:"author_id"`
+	Title     string     `db:"title"`
+	Content   string     `db:"content"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt *time.Time `db:"updated_at"`
+
+	ContentHTML        *string `db:"content_html"`
+	ContentHTMLVersion *int    `db:"content_html_version"`
 }
 
 // Category represents a post category
@@ -46,11 +74,15 @@ type PostCategory struct {
 
 // Comment represents a comment on a post
 type Comment struct {
-	ID        int64     `db:"id"`
-	PostID    int64     `db:"post_id"`
-	AuthorID  int64     `db:"author_id"`
-	Content   string    `db:"content"`
-	CreatedAt time.Time `db:"created_at"`
+	ID        int64      `db:"id"`
+	PostID    int64      `db:"post_id"`
+	AuthorID  int64      `db:"author_id"`
+	Content   string     `db:"content"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt *time.Time `db:"updated_at"`
+
+	ContentHTML        *string `db:"content_html"`
+	ContentHTMLVersion *int    `db:"content_html_version"`
 }
 
 // PostLike represents a like/dislike on a post
@@ -66,3 +98,262 @@ type CommentLike struct {
 	CommentID int64 `db:"comment_id"`
 	Reaction  int   `db:"reaction"` // 1 for like, -1 for dislike
 }
+
+// LoginAttempt records a single login attempt for brute-force tracking
+type LoginAttempt struct {
+	ID        int64     `db:"id"`
+	Email     string    `db:"email"`
+	IPAddress string    `db:"ip_address"`
+	Success   bool      `db:"success"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// LoginLockout represents a temporary lockout of an email or IP address
+type LoginLockout struct {
+	ID          int64     `db:"id"`
+	Scope       string    `db:"scope"` // "email" or "ip"
+	Subject     string    `db:"subject"`
+	LockedUntil time.Time `db:"locked_until"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// PasswordReset is a single-use password reset token
+type PasswordReset struct {
+	ID        int64      `db:"id"`
+	UserID    int64      `db:"user_id"`
+	TokenHash string     `db:"token_hash"` // SHA-256 of the emailed token
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// EmailVerification is a pending verification of a user's (new) email address
+type EmailVerification struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	Email     string    `db:"email"`
+	TokenHash string    `db:"token_hash"` // SHA-256 of the emailed token
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// RecoveryCode is a one-time two-factor recovery code
+type RecoveryCode struct {
+	ID        int64      `db:"id"`
+	UserID    int64      `db:"user_id"`
+	CodeHash  string     `db:"code_hash"` // SHA-256 of the normalized code
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// LoginChallenge is a login waiting for its second factor
+type LoginChallenge struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	TokenHash string    `db:"token_hash"`
+	Remember  bool      `db:"remember"`
+	Attempts  int       `db:"attempts"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Passkey is a WebAuthn credential a user can sign in with
+type Passkey struct {
+	ID           int64      `db:"id"`
+	UserID       int64      `db:"user_id"`
+	CredentialID string     `db:"credential_id"` // base64url
+	PublicKey    []byte     `db:"public_key"`    // COSE_Key
+	SignCount    uint32     `db:"sign_count"`
+	Name         string     `db:"name"`
+	LastUsedAt   *time.Time `db:"last_used_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// PasskeyChallenge is a passkey registration or login ceremony in progress
+type PasskeyChallenge struct {
+	ID        int64     `db:"id"`
+	TokenHash string    `db:"token_hash"`
+	UserID    *int64    `db:"user_id"`
+	Ceremony  string    `db:"ceremony"`
+	Challenge []byte    `db:"challenge"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// OAuthIdentity links an account at an OpenID Connect provider to a user
+type OAuthIdentity struct {
+	ID          int64      `db:"id"`
+	UserID      int64      `db:"user_id"`
+	Provider    string     `db:"provider"`
+	Subject     string     `db:"subject"`
+	Email       string     `db:"email"`
+	LastLoginAt *time.Time `db:"last_login_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+// OAuthState is an OpenID Connect login waiting for the provider's redirect
+type OAuthState struct {
+	ID           int64     `db:"id"`
+	StateHash    string    `db:"state_hash"`
+	Provider     string    `db:"provider"`
+	Nonce        string    `db:"nonce"`
+	CodeVerifier string    `db:"code_verifier"`
+	ExpiresAt    time.Time `db:"expires_at"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// OAuthSignup is a first OpenID Connect login waiting for a username
+type OAuthSignup struct {
+	ID                int64     `db:"id"`
+	TokenHash         string    `db:"token_hash"`
+	Provider          string    `db:"provider"`
+	Subject           string    `db:"subject"`
+	Email             string    `db:"email"`
+	EmailVerified     bool      `db:"email_verified"`
+	SuggestedUsername string    `db:"suggested_username"`
+	ExpiresAt         time.Time `db:"expires_at"`
+	CreatedAt         time.Time `db:"created_at"`
+}
+
+// APIToken is a personal access token used by bots and scripts
+type APIToken struct {
+	ID         int64      `db:"id"`
+	UserID     int64      `db:"user_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	Scopes     string     `db:"scopes"` // Comma-separated
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	LastUsedIP string     `db:"last_used_ip"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+// Notification tells a user about activity on content they own or watch.
+// Unread notifications about the same thing are coalesced into one row.
+type Notification struct {
+	ID          int64      `db:"id"`
+	UserID      int64      `db:"user_id"`
+	Type        string     `db:"type"`
+	PostID      int64      `db:"post_id"`
+	CommentID   *int64     `db:"comment_id"`
+	GroupKey    string     `db:"group_key"`
+	LastActorID int64      `db:"last_actor_id"`
+	ReadAt      *time.Time `db:"read_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+}
+
+// NotificationPreference turns one notification type on or off for a user
+type NotificationPreference struct {
+	UserID  int64  `db:"user_id"`
+	Type    string `db:"type"`
+	Enabled bool   `db:"enabled"`
+}
+
+// PostWatch is a post a user follows for new comments
+type PostWatch struct {
+	UserID    int64     `db:"user_id"`
+	PostID    int64     `db:"post_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// DigestSubscription is a user's choice to get activity digests by email
+type DigestSubscription struct {
+	UserID     int64     `db:"user_id"`
+	Frequency  string    `db:"frequency"` // daily or weekly
+	LastSentAt time.Time `db:"last_sent_at"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// CategoryFollow is a category a user follows in their digest
+type CategoryFollow struct {
+	UserID     int64 `db:"user_id"`
+	CategoryID int64 `db:"category_id"`
+}
+
+// Webhook is an endpoint that receives forum events
+type Webhook struct {
+	ID          int64     `db:"id"`
+	URL         string    `db:"url"`
+	Description string    `db:"description"`
+	Secret      string    `db:"secret"`
+	Events      string    `db:"events"` // Comma-separated
+	Active      bool      `db:"active"`
+	CreatedBy   *int64    `db:"created_by"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// WebhookDelivery is one event queued for, or sent to, a webhook
+type WebhookDelivery struct {
+	ID            int64      `db:"id"`
+	WebhookID     int64      `db:"webhook_id"`
+	Event         string     `db:"event"`
+	Payload       string     `db:"payload"`
+	Status        string     `db:"status"` // pending, delivered or failed
+	Attempts      int        `db:"attempts"`
+	NextAttemptAt time.Time  `db:"next_attempt_at"`
+	LastAttemptAt *time.Time `db:"last_attempt_at"`
+	ResponseCode  *int       `db:"response_code"`
+	ResponseBody  string     `db:"response_body"`
+	Error         string     `db:"error"`
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+// IncomingWebhook lets an external system post as a bot account
+type IncomingWebhook struct {
+	ID                int64      `db:"id"`
+	Name              string     `db:"name"`
+	TokenHash         string     `db:"token_hash"`
+	PreviousTokenHash *string    `db:"previous_token_hash"`
+	PreviousExpiresAt *time.Time `db:"previous_expires_at"`
+	BotUserID         int64      `db:"bot_user_id"`
+	CategoryID        int64      `db:"category_id"`
+	RateLimit         int        `db:"rate_limit"` // Requests per hour
+	Active            bool       `db:"active"`
+	CreatedBy         *int64     `db:"created_by"`
+	CreatedAt         time.Time  `db:"created_at"`
+	LastUsedAt        *time.Time `db:"last_used_at"`
+}
+
+// IncomingWebhookPost maps a sender's key to the post it created
+type IncomingWebhookPost struct {
+	WebhookID   int64     `db:"webhook_id"`
+	ExternalKey string    `db:"external_key"`
+	PostID      int64     `db:"post_id"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// AttachmentBlob is a stored uploaded file, shared by identical uploads
+type AttachmentBlob struct {
+	Hash         string    `db:"hash"`
+	ContentType  string    `db:"content_type"`
+	Size         int64     `db:"size"`
+	Width        int       `db:"width"`
+	Height       int       `db:"height"`
+	HasThumbnail bool      `db:"has_thumbnail"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// Attachment is a file attached to a post or comment
+type Attachment struct {
+	ID         int64     `db:"id"`
+	BlobHash   string    `db:"blob_hash"`
+	UploaderID int64     `db:"uploader_id"`
+	PostID     int64     `db:"post_id"`
+	CommentID  *int64    `db:"comment_id"`
+	Filename   string    `db:"filename"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// AvatarBlob is an uploaded avatar, shared by users who upload the same picture
+type AvatarBlob struct {
+	Hash      string    `db:"hash"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// SiteSetting is a site-wide setting
+type SiteSetting struct {
+	Key       string    `db:"key"`
+	Value     string    `db:"value"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
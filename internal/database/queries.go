@@ -32,14 +32,14 @@ func (db *DB) CreateUser(ctx context.Context, email, username, passwordHash stri
 // GetUserByEmail retrieves a user by their email address
 func (db *DB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-		SELECT id, email, username, password_hash, created_at
+		SELECT id, email, username, password_hash, role, email_verified, created_at
 		FROM users
 		WHERE email = ?
 	`
 
 	var user User
 	err := db.QueryRowContext(ctx, query, email).Scan(
-		&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.CreatedAt,
+		&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.Role, &user.EmailVerified, &user.CreatedAt,
 	)
 
 	if err != nil {
@@ -55,14 +55,14 @@ func (db *DB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 // GetUserByUsername retrieves a user by their username
 func (db *DB) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	query := `
-		SELECT id, email, username, password_hash, created_at
+		SELECT id, email, username, password_hash, role, email_verified, created_at
 		FROM users
 		WHERE username = ?
 	`
 
 	var user User
 	err := db.QueryRowContext(ctx, query, username).Scan(
-		&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.CreatedAt,
+		&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.Role, &user.EmailVerified, &user.CreatedAt,
 	)
 
 	if err != nil {
@@ -78,14 +78,14 @@ func (db *DB) GetUserByUsername(ctx context.Context, username string) (*User, er
 // GetUserByID retrieves a user by their ID
 func (db *DB) GetUserByID(ctx context.Context, userID int64) (*User, error) {
 	query := `
-		SELECT id, email, username, password_hash, created_at
+		SELECT id, email, username, password_hash, role, email_verified, created_at
 		FROM users
 		WHERE id = ?
 	`
 
 	var user User
 	err := db.QueryRowContext(ctx, query, userID).Scan(
-		&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.CreatedAt,
+		&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.Role, &user.EmailVerified, &user.CreatedAt,
 	)
 
 	if err != nil {
@@ -100,14 +100,15 @@ func (db *DB) GetUserByID(ctx context.Context, userID int64) (*User, error) {
 
 // Session CRUD operations
 
-// CreateSession creates a new session for a user
-func (db *DB) CreateSession(ctx context.Context, userID int64, token string, expiresAt time.Time) error {
+// CreateSession creates a new session for a user. tokenHash is the SHA-256 of the
+// session cookie value; the value itself is never stored.
+func (db *DB) CreateSession(ctx context.Context, userID int64, tokenHash string, expiresAt time.Time) error {
 	query := `
 		INSERT INTO sessions (user_id, token, expires_at, created_at)
 		VALUES (?, ?, ?, ?)
 	`
 
-	_, err := db.ExecContext(ctx, query, userID, token, expiresAt, time.Now().UTC())
+	_, err := db.ExecContext(ctx, query, userID, tokenHash, expiresAt, time.Now().UTC())
 	if err != nil {
 		return fmt.Errorf("failed to create session: %w", err)
 	}
@@ -115,8 +116,8 @@ func (db *DB) CreateSession(ctx context.Context, userID int64, token string, exp
 	return nil
 }
 
-// GetSessionByToken retrieves a session by its token
-func (db *DB) GetSessionByToken(ctx context.Context, token string) (*Session, error) {
+// GetSessionByToken retrieves a session by its token hash
+func (db *DB) GetSessionByToken(ctx context.Context, tokenHash string) (*Session, error) {
 	query := `
 		SELECT id, user_id, token, expires_at, created_at
 		FROM sessions
@@ -124,7 +125,7 @@ func (db *DB) GetSessionByToken(ctx context.Context, token string) (*Session, er
 	`
 
 	var session Session
-	err := db.QueryRowContext(ctx, query, token).Scan(
+	err := db.QueryRowContext(ctx, query, tokenHash).Scan(
 		&session.ID, &session.UserID, &session.Token, &session.ExpiresAt, &session.CreatedAt,
 	)
 
@@ -138,11 +139,11 @@ func (db *DB) GetSessionByToken(ctx context.Context, token string) (*Session, er
 	return &session, nil
 }
 
-// DeleteSession deletes a session by its token
-func (db *DB) DeleteSession(ctx context.Context, token string) error {
+// DeleteSession deletes a session by its token hash
+func (db *DB) DeleteSession(ctx context.Context, tokenHash string) error {
 	query := `DELETE FROM sessions WHERE token = ?`
 
-	_, err := db.ExecContext(ctx, query, token)
+	_, err := db.ExecContext(ctx, query, tokenHash)
 	if err != nil {
 		return fmt.Errorf("failed to delete session: %w", err)
 	}
@@ -0,0 +1,143 @@
+package digest
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Digest is the data the email templates render
+type Digest struct {
+	Username       string
+	Frequency      string
+	Since          time.Time
+	Until          time.Time
+	NewPosts       []Post   // New posts in followed categories
+	Threads        []Thread // Threads the user started or follows with new comments
+	TopPosts       []Post   // Most liked new posts
+	ForumURL       string
+	SettingsURL    string
+	UnsubscribeURL string
+}
+
+// Post is a post listed in a digest
+type Post struct {
+	Title    string
+	Author   string
+	URL      string
+	Likes    int
+	Comments int
+}
+
+// Thread is a post with new comments
+type Thread struct {
+	Title    string
+	URL      string
+	Comments int // New comments in the period
+	People   int // Different people who wrote them
+}
+
+// Empty reports whether the digest has nothing to tell
+func (d Digest) Empty() bool {
+	return len(d.NewPosts) == 0 && len(d.Threads) == 0 && len(d.TopPosts) == 0
+}
+
+// build collects a user's activity between r.since and until
+func (s *Service) build(ctx context.Context, r recipient, until time.Time) (*Digest, error) {
+	d := &Digest{
+		Username:       r.username,
+		Frequency:      r.frequency,
+		Since:          r.since,
+		Until:          until,
+		ForumURL:       s.baseURL + "/",
+		SettingsURL:    s.baseURL + "/notifications#digest",
+		UnsubscribeURL: s.UnsubscribeURL(r.userID),
+	}
+
+	var err error
+	if d.NewPosts, err = s.posts(ctx, `
+		SELECT DISTINCT p.id, p.title, u.username,
+			(SELECT COUNT(*) FROM post_likes l WHERE l.post_id = p.id AND l.reaction = 1),
+			(SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id)
+		FROM posts p
+		JOIN users u ON u.id = p.author_id
+		JOIN post_categories pc ON pc.post_id = p.id
+		JOIN category_follows f ON f.category_id = pc.category_id AND f.user_id = ?
+		WHERE p.created_at > ? AND p.created_at <= ? AND p.author_id != ?
+		ORDER BY p.created_at DESC
+		LIMIT ?`, r.userID, r.since, until, r.userID, sectionLimit); err != nil {
+		return nil, err
+	}
+
+	if d.Threads, err = s.threads(ctx, r, until); err != nil {
+		return nil, err
+	}
+
+	if d.TopPosts, err = s.posts(ctx, `
+		SELECT p.id, p.title, u.username,
+			(SELECT COUNT(*) FROM post_likes l WHERE l.post_id = p.id AND l.reaction = 1) AS likes,
+			(SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments
+		FROM posts p
+		JOIN users u ON u.id = p.author_id
+		WHERE p.created_at > ? AND p.created_at <= ?
+		  AND (likes > 0 OR comments > 0)
+		ORDER BY likes DESC, comments DESC, p.created_at DESC
+		LIMIT ?`, r.since, until, topPostsLimit); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (s *Service) posts(ctx context.Context, query string, args ...any) ([]Post, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var id int64
+		var p Post
+		if err := rows.Scan(&id, &p.Title, &p.Author, &p.Likes, &p.Comments); err != nil {
+			return nil, err
+		}
+		p.URL = s.postURL(id)
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// threads returns the user's own and followed posts that others commented on
+func (s *Service) threads(ctx context.Context, r recipient, until time.Time) ([]Thread, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT p.id, p.title, COUNT(c.id), COUNT(DISTINCT c.author_id)
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE (p.author_id = ? OR EXISTS (SELECT 1 FROM post_watches w WHERE w.post_id = p.id AND w.user_id = ?))
+		  AND c.author_id != ? AND c.created_at > ? AND c.created_at <= ?
+		GROUP BY p.id, p.title
+		ORDER BY MAX(c.created_at) DESC
+		LIMIT ?`, r.userID, r.userID, r.userID, r.since, until, sectionLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threads []Thread
+	for rows.Next() {
+		var id int64
+		var t Thread
+		if err := rows.Scan(&id, &t.Title, &t.Comments, &t.People); err != nil {
+			return nil, err
+		}
+		t.URL = s.postURL(id)
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
+
+func (s *Service) postURL(postID int64) string {
+	return s.baseURL + "/post/" + strconv.FormatInt(postID, 10)
+}
@@ -0,0 +1,304 @@
+// Package digest emails members a summary of forum activity since their last
+// digest: new posts in the categories they follow, new comments on their
+// threads and the most liked posts. Members opt in to a daily or weekly digest
+// and can unsubscribe with a signed link that needs no login.
+package digest
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"forum/internal/mailer"
+)
+
+// Digest frequencies
+const (
+	Daily  = "daily"
+	Weekly = "weekly"
+)
+
+// ErrInvalidSignature is returned for unsubscribe links that were not issued
+// by this forum
+var ErrInvalidSignature = errors.New("invalid unsubscribe link")
+
+// ErrUnknownFrequency is returned for frequencies other than Daily and Weekly
+var ErrUnknownFrequency = errors.New("unknown digest frequency")
+
+// signingKeySetting is the site setting holding the key that signs
+// unsubscribe links. It is created on first start.
+const signingKeySetting = "digest_signing_key"
+
+// Digest sections are kept short; the email links to the forum for the rest
+const (
+	sectionLimit  = 10
+	topPostsLimit = 5
+)
+
+// Service builds and sends digests
+type Service struct {
+	db      *sql.DB
+	mailer  mailer.Mailer
+	baseURL string
+	key     []byte
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// NewService creates a digest service rendering emails from the HTML and
+// plain-text templates at htmlPath and textPath
+func NewService(db *sql.DB, mail mailer.Mailer, htmlPath, textPath string) (*Service, error) {
+	html, err := htmltemplate.ParseFiles(htmlPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load digest template: %w", err)
+	}
+	text, err := texttemplate.ParseFiles(textPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load digest template: %w", err)
+	}
+	key, err := loadSigningKey(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Service{
+		db:      db,
+		mailer:  mail,
+		baseURL: "http://localhost:8080",
+		key:     key,
+		html:    html,
+		text:    text,
+	}, nil
+}
+
+// SetBaseURL sets the public URL of the forum used in digest links
+func (s *Service) SetBaseURL(baseURL string) {
+	s.baseURL = strings.TrimRight(baseURL, "/")
+}
+
+// loadSigningKey returns the key for unsubscribe links, creating it if needed
+func loadSigningKey(db *sql.DB) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	// Keep the existing key if another instance created it first
+	_, err := db.Exec(`INSERT OR IGNORE INTO site_settings (key, value, updated_at) VALUES (?, ?, ?)`,
+		signingKeySetting, hex.EncodeToString(key), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store signing key: %w", err)
+	}
+
+	var value string
+	if err := db.QueryRow("SELECT value FROM site_settings WHERE key = ?", signingKeySetting).Scan(&value); err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
+	}
+	return hex.DecodeString(value)
+}
+
+// Subscription is a user's digest settings
+type Subscription struct {
+	Frequency   string  // Daily, Weekly or "" for no digest
+	CategoryIDs []int64 // Categories whose new posts are included
+}
+
+// Follows reports whether the subscription includes a category
+func (sub Subscription) Follows(categoryID int64) bool {
+	for _, id := range sub.CategoryIDs {
+		if id == categoryID {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription returns a user's digest settings
+func (s *Service) Subscription(ctx context.Context, userID int64) (Subscription, error) {
+	var sub Subscription
+	err := s.db.QueryRowContext(ctx, "SELECT frequency FROM digest_subscriptions WHERE user_id = ?", userID).Scan(&sub.Frequency)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT category_id FROM category_follows WHERE user_id = ?", userID)
+	if err != nil {
+		return Subscription{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return Subscription{}, err
+		}
+		sub.CategoryIDs = append(sub.CategoryIDs, id)
+	}
+	return sub, rows.Err()
+}
+
+// Subscribe saves a user's digest settings. The first digest covers the
+// period starting now; changing only the followed categories keeps the
+// schedule.
+func (s *Service) Subscribe(ctx context.Context, userID int64, sub Subscription) error {
+	if sub.Frequency != "" && sub.Frequency != Daily && sub.Frequency != Weekly {
+		return ErrUnknownFrequency
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sub.Frequency == "" {
+		_, err = tx.ExecContext(ctx, "DELETE FROM digest_subscriptions WHERE user_id = ?", userID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO digest_subscriptions (user_id, frequency, last_sent_at) VALUES (?, ?, ?)
+			ON CONFLICT(user_id) DO UPDATE SET frequency = excluded.frequency`,
+			userID, sub.Frequency, time.Now().UTC())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save digest subscription: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM category_follows WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, id := range sub.CategoryIDs {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO category_follows (user_id, category_id)
+			SELECT ?, id FROM categories WHERE id = ?`, userID, id); err != nil {
+			return fmt.Errorf("failed to follow category: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Unsubscribe stops a user's digests. Followed categories are kept in case
+// they subscribe again.
+func (s *Service) Unsubscribe(ctx context.Context, userID int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM digest_subscriptions WHERE user_id = ?", userID)
+	return err
+}
+
+// UnsubscribeURL returns the signed link that unsubscribes a user without logging in
+func (s *Service) UnsubscribeURL(userID int64) string {
+	query := url.Values{"user": {strconv.FormatInt(userID, 10)}, "sig": {s.sign(userID)}}
+	return s.baseURL + "/digest/unsubscribe?" + query.Encode()
+}
+
+// VerifyUnsubscribe checks the signature of an unsubscribe link
+func (s *Service) VerifyUnsubscribe(userID int64, signature string) error {
+	if !hmac.Equal([]byte(signature), []byte(s.sign(userID))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (s *Service) sign(userID int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("unsubscribe:" + strconv.FormatInt(userID, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// recipient is a subscriber whose digest is due
+type recipient struct {
+	userID    int64
+	username  string
+	email     string
+	frequency string
+	since     time.Time
+}
+
+// SendDue sends every digest that is due. A digest that fails is retried on
+// the next run; one that has nothing to report is skipped.
+func (s *Service) SendDue(ctx context.Context) error {
+	now := time.Now().UTC()
+	due, err := s.dueRecipients(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range due {
+		if err := s.send(ctx, r, now); err != nil {
+			log.Printf("Failed to send digest to user %d: %v", r.userID, err)
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, "UPDATE digest_subscriptions SET last_sent_at = ? WHERE user_id = ?", now, r.userID); err != nil {
+			return fmt.Errorf("failed to record digest: %w", err)
+		}
+	}
+	return nil
+}
+
+// dueRecipients returns the verified subscribers whose period has ended
+func (s *Service) dueRecipients(ctx context.Context, now time.Time) ([]recipient, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT s.user_id, u.username, u.email, s.frequency, s.last_sent_at
+		FROM digest_subscriptions s
+		JOIN users u ON u.id = s.user_id
+		WHERE u.email_verified = 1
+		  AND ((s.frequency = 'daily' AND s.last_sent_at <= ?)
+		    OR (s.frequency = 'weekly' AND s.last_sent_at <= ?))`,
+		now.Add(-24*time.Hour), now.Add(-7*24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.userID, &r.username, &r.email, &r.frequency, &r.since); err != nil {
+			return nil, err
+		}
+		due = append(due, r)
+	}
+	return due, rows.Err()
+}
+
+// send builds one user's digest and mails it if there is anything in it
+func (s *Service) send(ctx context.Context, r recipient, until time.Time) error {
+	d, err := s.build(ctx, r, until)
+	if err != nil {
+		return err
+	}
+	if d.Empty() {
+		return nil
+	}
+
+	var text, html bytes.Buffer
+	if err := s.text.Execute(&text, d); err != nil {
+		return fmt.Errorf("failed to render digest: %w", err)
+	}
+	if err := s.html.Execute(&html, d); err != nil {
+		return fmt.Errorf("failed to render digest: %w", err)
+	}
+
+	subject := "Your daily forum digest"
+	if r.frequency == Weekly {
+		subject = "Your weekly forum digest"
+	}
+	return s.mailer.Send(mailer.Message{
+		To:          r.email,
+		Subject:     subject,
+		Body:        text.String(),
+		HTML:        html.String(),
+		Unsubscribe: d.UnsubscribeURL,
+	})
+}
@@ -0,0 +1,210 @@
+// Package events fans out live updates to browsers. Publishers send events to
+// named topics; subscribers get them in order and can resume after a dropped
+// connection from the last event they saw.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTooManySubscriptions is returned when a client already has the maximum
+// number of open subscriptions
+var ErrTooManySubscriptions = errors.New("too many live connections from this client")
+
+// subscriberBuffer is how many events may queue for a subscriber before it is
+// considered stuck and disconnected. It resumes from history on reconnect.
+const subscriberBuffer = 64
+
+// Event is one update sent to a topic's subscribers
+type Event struct {
+	ID   string          // Resumable position, sent as the SSE id
+	Type string          // e.g. "comment.created"
+	Data json.RawMessage // JSON payload
+	seq  uint64
+	at   time.Time
+}
+
+// Broker delivers events in process. Event IDs carry the broker's start time,
+// so IDs from before a restart are recognised and the client told to reload.
+type Broker struct {
+	mu           sync.Mutex
+	boot         string
+	seq          uint64
+	topics       map[string]*topic
+	clients      map[string]int
+	history      int
+	maxPerClient int
+}
+
+type topic struct {
+	history     []Event
+	evicted     uint64 // Highest sequence number dropped from history
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives a topic's events until closed
+type Subscription struct {
+	// C delivers new events. It is closed when the subscriber falls too far
+	// behind; the client should reconnect and resume.
+	C <-chan Event
+	// Missed are the events published since the client's last event ID
+	Missed []Event
+	// Reset means events were missed that can no longer be replayed, so the
+	// client must reload instead of resuming
+	Reset bool
+
+	ch     chan Event
+	broker *Broker
+	topic  string
+	client string
+	once   sync.Once
+}
+
+// NewBroker creates a broker keeping the last history events of every topic
+// and allowing maxPerClient open subscriptions per client
+func NewBroker(history, maxPerClient int) *Broker {
+	return &Broker{
+		boot:         strconv.FormatInt(time.Now().UnixNano(), 36),
+		topics:       map[string]*topic{},
+		clients:      map[string]int{},
+		history:      history,
+		maxPerClient: maxPerClient,
+	}
+}
+
+// Publish sends an event to the topic's subscribers
+func (b *Broker) Publish(topicName, eventType string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", eventType, err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := Event{
+		ID:   b.boot + "-" + strconv.FormatUint(b.seq, 10),
+		Type: eventType,
+		Data: payload,
+		seq:  b.seq,
+		at:   time.Now(),
+	}
+
+	t := b.topic(topicName)
+	t.history = append(t.history, event)
+	if len(t.history) > b.history {
+		t.evicted = t.history[0].seq
+		t.history = t.history[1:]
+	}
+
+	for sub := range t.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			// A stuck connection must not hold up everyone else
+			b.remove(sub)
+		}
+	}
+}
+
+// Subscribe starts receiving a topic's events. lastEventID is the ID of the
+// last event the client saw, from the Last-Event-ID header, or "" for none.
+// client identifies the connection's owner for the per-client limit.
+func (b *Broker) Subscribe(topicName, client, lastEventID string) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.clients[client] >= b.maxPerClient {
+		return nil, ErrTooManySubscriptions
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	sub := &Subscription{C: ch, ch: ch, broker: b, topic: topicName, client: client}
+
+	t := b.topic(topicName)
+	if lastEventID != "" {
+		seq, ok := b.parseID(lastEventID)
+		if !ok || seq < t.evicted {
+			sub.Reset = true
+		} else {
+			for _, event := range t.history {
+				if event.seq > seq {
+					sub.Missed = append(sub.Missed, event)
+				}
+			}
+		}
+	}
+
+	t.subscribers[sub] = struct{}{}
+	b.clients[client]++
+	return sub, nil
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.remove(s)
+}
+
+// Prune forgets the history of topics nobody listens to and that had no
+// events for maxAge
+func (b *Broker) Prune(maxAge time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	for name, t := range b.topics {
+		if len(t.subscribers) > 0 {
+			continue
+		}
+		if len(t.history) == 0 || t.history[len(t.history)-1].at.Before(cutoff) {
+			delete(b.topics, name)
+		}
+	}
+}
+
+// topic returns the named topic, creating it. The caller holds b.mu.
+func (b *Broker) topic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{subscribers: map[*Subscription]struct{}{}}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// remove unregisters a subscription and closes its channel once. The caller
+// holds b.mu.
+func (b *Broker) remove(sub *Subscription) {
+	sub.once.Do(func() {
+		if t, ok := b.topics[sub.topic]; ok {
+			delete(t.subscribers, sub)
+		}
+		if b.clients[sub.client]--; b.clients[sub.client] <= 0 {
+			delete(b.clients, sub.client)
+		}
+		close(sub.ch)
+	})
+}
+
+// parseID returns the sequence number of an event ID from this broker
+func (b *Broker) parseID(id string) (uint64, bool) {
+	boot, seq, ok := strings.Cut(id, "-")
+	if !ok || boot != b.boot {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n > b.seq {
+		return 0, false
+	}
+	return n, true
+}
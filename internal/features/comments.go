@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"html/template"
 	"strings"
 	"time"
 )
@@ -14,6 +15,9 @@ type Comment struct {
 	AuthorID  int64
 	Content   string
 	CreatedAt time.Time
+	UpdatedAt time.Time // Zero if the comment was never edited
+
+	ContentHTML template.HTML // Content rendered as sanitized Markdown
 }
 
 func CreateComment(ctx context.Context, db *sql.DB, postID, authorID int64, content string) (int64, error) {
@@ -38,7 +42,7 @@ func ListCommentsByPostID(ctx context.Context, db *sql.DB, postID int64, limit,
 		offset = 0
 	}
 	rows, err := db.QueryContext(ctx, `
-		SELECT id, post_id, author_id, content, created_at
+		SELECT id, post_id, author_id, content, created_at, updated_at, content_html, content_html_version
 		FROM comments
 		WHERE post_id = ?
 		ORDER BY created_at ASC
@@ -51,14 +55,116 @@ func ListCommentsByPostID(ctx context.Context, db *sql.DB, postID int64, limit,
 	var list []Comment
 	for rows.Next() {
 		var c Comment
-		if err := rows.Scan(&c.ID, &c.PostID, &c.AuthorID, &c.Content, &c.CreatedAt); err != nil {
+		var updatedAt sql.NullTime
+		var html renderCache
+		if err := rows.Scan(&c.ID, &c.PostID, &c.AuthorID, &c.Content, &c.CreatedAt, &updatedAt, &html.content, &html.version); err != nil {
+			return nil, err
+		}
+		if updatedAt.Valid {
+			c.UpdatedAt = updatedAt.Time
+		}
+		c.ContentHTML = html.render(ctx, db, "comments", c.ID, c.Content)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// CountComments returns how many comments a post has
+func CountComments(ctx context.Context, db *sql.DB, postID int64) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM comments WHERE post_id = ?", postID).Scan(&count)
+	return count, err
+}
+
+// AuthoredComment is a comment listed on its author's profile, with the post it is on
+type AuthoredComment struct {
+	Comment
+	PostTitle string
+}
+
+// ListCommentsByAuthor returns one page of a user's comments, newest first
+func ListCommentsByAuthor(ctx context.Context, db *sql.DB, authorID int64, limit, offset int) ([]AuthoredComment, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.post_id, c.author_id, c.content, c.created_at, c.updated_at, c.content_html, c.content_html_version, p.title
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE c.author_id = ?
+		ORDER BY c.created_at DESC
+		LIMIT ? OFFSET ?`, authorID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []AuthoredComment
+	for rows.Next() {
+		var c AuthoredComment
+		var updatedAt sql.NullTime
+		var html renderCache
+		if err := rows.Scan(&c.ID, &c.PostID, &c.AuthorID, &c.Content, &c.CreatedAt, &updatedAt, &html.content, &html.version, &c.PostTitle); err != nil {
 			return nil, err
 		}
+		if updatedAt.Valid {
+			c.UpdatedAt = updatedAt.Time
+		}
+		c.ContentHTML = html.render(ctx, db, "comments", c.ID, c.Content)
 		list = append(list, c)
 	}
 	return list, rows.Err()
 }
 
+// GetCommentByID returns a single comment
+func GetCommentByID(ctx context.Context, db *sql.DB, id int64) (*Comment, error) {
+	var c Comment
+	var updatedAt sql.NullTime
+	var html renderCache
+	err := db.QueryRowContext(ctx, `
+		SELECT id, post_id, author_id, content, created_at, updated_at, content_html, content_html_version
+		FROM comments WHERE id = ?`, id).Scan(&c.ID, &c.PostID, &c.AuthorID, &c.Content, &c.CreatedAt, &updatedAt, &html.content, &html.version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCommentNotFound
+		}
+		return nil, err
+	}
+	if updatedAt.Valid {
+		c.UpdatedAt = updatedAt.Time
+	}
+	c.ContentHTML = html.render(ctx, db, "comments", c.ID, c.Content)
+	return &c, nil
+}
+
+// UpdateComment changes the content of a comment (only by the author)
+func UpdateComment(ctx context.Context, db *sql.DB, commentID, userID int64, content string) error {
+	content = strings.TrimSpace(content)
+	if commentID <= 0 || userID <= 0 || content == "" {
+		return errors.New("invalid comment data")
+	}
+
+	var authorID int64
+	err := db.QueryRowContext(ctx, "SELECT author_id FROM comments WHERE id = ?", commentID).Scan(&authorID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrCommentNotFound
+		}
+		return err
+	}
+	if authorID != userID {
+		return ErrNotAuthor
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE comments SET content = ?, updated_at = ?, content_html = NULL WHERE id = ?",
+		content, time.Now().UTC(), commentID)
+	return err
+}
+
 // DeleteComment deletes a comment (only by the author)
 func DeleteComment(ctx context.Context, db *sql.DB, commentID, userID int64) error {
 	if commentID <= 0 || userID <= 0 {
@@ -77,13 +183,13 @@ func DeleteComment(ctx context.Context, db *sql.DB, commentID, userID int64) err
 	err = tx.QueryRowContext(ctx, "SELECT author_id FROM comments WHERE id = ?", commentID).Scan(&authorID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return errors.New("comment not found")
+			return ErrCommentNotFound
 		}
 		return err
 	}
 
 	if authorID != userID {
-		return errors.New("you can only delete your own comments")
+		return ErrNotAuthor
 	}
 
 	// Delete comment likes first
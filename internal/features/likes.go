@@ -55,8 +55,8 @@ func CountPostReactions(ctx context.Context, db *sql.DB, postID int64) (Reaction
 	var r Reactions
 	row := db.QueryRowContext(ctx, `
 		SELECT
-			SUM(CASE WHEN reaction=1 THEN 1 ELSE 0 END) AS likes,
-			SUM(CASE WHEN reaction=-1 THEN 1 ELSE 0 END) AS dislikes
+			COALESCE(SUM(CASE WHEN reaction=1 THEN 1 ELSE 0 END), 0) AS likes,
+			COALESCE(SUM(CASE WHEN reaction=-1 THEN 1 ELSE 0 END), 0) AS dislikes
 		FROM post_likes WHERE post_id = ?`, postID)
 	if err := row.Scan(&r.Likes, &r.Dislikes); err != nil {
 		return Reactions{}, err
@@ -68,8 +68,8 @@ func CountCommentReactions(ctx context.Context, db *sql.DB, commentID int64) (Re
 	var r Reactions
 	row := db.QueryRowContext(ctx, `
 		SELECT
-			SUM(CASE WHEN reaction=1 THEN 1 ELSE 0 END) AS likes,
-			SUM(CASE WHEN reaction=-1 THEN 1 ELSE 0 END) AS dislikes
+			COALESCE(SUM(CASE WHEN reaction=1 THEN 1 ELSE 0 END), 0) AS likes,
+			COALESCE(SUM(CASE WHEN reaction=-1 THEN 1 ELSE 0 END), 0) AS dislikes
 		FROM comment_likes WHERE comment_id = ?`, commentID)
 	if err := row.Scan(&r.Likes, &r.Dislikes); err != nil {
 		return Reactions{}, err
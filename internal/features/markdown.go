@@ -0,0 +1,32 @@
+package features
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+
+	"forum/internal/markdown"
+)
+
+// renderCache is the rendered HTML stored alongside a post's or comment's content
+type renderCache struct {
+	content sql.NullString
+	version sql.NullInt64
+}
+
+// render returns the cached HTML if the current renderer produced it.
+// Otherwise the content is rendered and the result stored for next time;
+// edits clear the cache, and bumping markdown.Version re-renders everything.
+func (c renderCache) render(ctx context.Context, db *sql.DB, table string, id int64, content string) template.HTML {
+	if c.content.Valid && c.version.Valid && c.version.Int64 == markdown.Version {
+		return template.HTML(c.content.String)
+	}
+
+	rendered := markdown.Render(content)
+	// Matching the content keeps a read that raced with an edit from storing
+	// HTML for the old text. A failed write only means rendering again later.
+	_, _ = db.ExecContext(ctx,
+		"UPDATE "+table+" SET content_html = ?, content_html_version = ? WHERE id = ? AND content = ?",
+		string(rendered), markdown.Version, id, content)
+	return rendered
+}
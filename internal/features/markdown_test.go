@@ -0,0 +1,155 @@
+package features
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"forum/internal/database"
+	"forum/internal/markdown"
+)
+
+// newTestDB returns a fresh database with one user, and that user's ID
+func newTestDB(t *testing.T) (*sql.DB, int64) {
+	t.Helper()
+
+	// InitializeDatabase reads the migrations relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("..", "..")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := database.NewDB(&database.Config{
+		DSN:          filepath.Join(t.TempDir(), "forum.db"),
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	var userID int64
+	err = db.QueryRow(
+		"INSERT INTO users (username, email, password_hash) VALUES ('alice', 'alice@example.com', '!') RETURNING id",
+	).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.DB, userID
+}
+
+// cachedHTML returns the rendered HTML stored for a post or comment
+func cachedHTML(t *testing.T, db *sql.DB, table string, id int64) sql.NullString {
+	t.Helper()
+	var html sql.NullString
+	if err := db.QueryRow("SELECT content_html FROM "+table+" WHERE id = ?", id).Scan(&html); err != nil {
+		t.Fatal(err)
+	}
+	return html
+}
+
+func TestRenderCache(t *testing.T) {
+	ctx := context.Background()
+	db, userID := newTestDB(t)
+
+	postID, err := CreatePost(ctx, db, userID, "Title", "**old post**", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := CreateComment(ctx, db, postID, userID, "**old comment**")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		table  string
+		id     int64
+		load   func() (string, error)
+		edit   func() error
+		before string
+		after  string
+	}{
+		{
+			table: "posts",
+			id:    postID,
+			load: func() (string, error) {
+				p, err := GetPostByID(ctx, db, postID)
+				if err != nil {
+					return "", err
+				}
+				return string(p.ContentHTML), nil
+			},
+			edit:   func() error { return UpdatePost(ctx, db, postID, userID, "Title", "*new post*", nil) },
+			before: "<strong>old post</strong>",
+			after:  "<em>new post</em>",
+		},
+		{
+			table: "comments",
+			id:    commentID,
+			load: func() (string, error) {
+				c, err := GetCommentByID(ctx, db, commentID)
+				if err != nil {
+					return "", err
+				}
+				return string(c.ContentHTML), nil
+			},
+			edit:   func() error { return UpdateComment(ctx, db, commentID, userID, "*new comment*") },
+			before: "<strong>old comment</strong>",
+			after:  "<em>new comment</em>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			html, err := tt.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(html, tt.before) {
+				t.Errorf("HTML = %q, want %q", html, tt.before)
+			}
+			if cached := cachedHTML(t, db, tt.table, tt.id); cached.String != html {
+				t.Errorf("cached HTML = %+v, want %q", cached, html)
+			}
+
+			// The cache is used while it is from the current renderer
+			if _, err := db.Exec("UPDATE "+tt.table+" SET content_html = '<p>from the cache</p>' WHERE id = ?", tt.id); err != nil {
+				t.Fatal(err)
+			}
+			if html, err := tt.load(); err != nil || html != "<p>from the cache</p>" {
+				t.Errorf("HTML = %q, %v, want the cached HTML", html, err)
+			}
+			if _, err := db.Exec("UPDATE "+tt.table+" SET content_html_version = ? WHERE id = ?", markdown.Version-1, tt.id); err != nil {
+				t.Fatal(err)
+			}
+			if html, err := tt.load(); err != nil || !strings.Contains(html, tt.before) {
+				t.Errorf("HTML cached by an older renderer = %q, %v, want it rendered again", html, err)
+			}
+
+			// Editing clears the cache, so the new content is rendered
+			if err := tt.edit(); err != nil {
+				t.Fatal(err)
+			}
+			if cached := cachedHTML(t, db, tt.table, tt.id); cached.Valid {
+				t.Errorf("cached HTML after an edit = %q, want none", cached.String)
+			}
+			html, err = tt.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(html, tt.after) || strings.Contains(html, tt.before) {
+				t.Errorf("HTML after an edit = %q, want %q", html, tt.after)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package features
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification types
+const (
+	NotifyComment     = "comment"      // Someone commented on your post
+	NotifyReply       = "reply"        // Someone commented on a post you watch
+	NotifyPostLike    = "post_like"    // Someone liked your post
+	NotifyCommentLike = "comment_like" // Someone liked your comment
+	NotifyMention     = "mention"      // Someone mentioned your @username
+)
+
+// NotificationType describes a type users can turn on or off
+type NotificationType struct {
+	Type  string
+	Label string
+}
+
+// NotificationTypes lists every notification type in the order shown in preferences
+var NotificationTypes = []NotificationType{
+	{NotifyComment, "Comments on my posts"},
+	{NotifyReply, "New comments on posts I follow"},
+	{NotifyPostLike, "Likes on my posts"},
+	{NotifyCommentLike, "Likes on my comments"},
+	{NotifyMention, "Mentions of my @username"},
+}
+
+// ErrNotificationNotFound is returned for notifications that do not exist or
+// belong to someone else
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// mentionPattern finds @username mentions. Usernames cannot contain spaces;
+// trailing punctuation is trimmed separately.
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@(\S+)`)
+
+// Notification is one entry of a user's notification list. Unread activity
+// on the same target is coalesced, so one entry may stand for many people.
+type Notification struct {
+	ID         int64
+	Type       string
+	PostID     int64
+	PostTitle  string
+	CommentID  int64  // Zero if it is about the post itself
+	ActorName  string // Whoever acted last
+	ActorCount int    // How many different people acted
+	Read       bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Message describes the notification, e.g. "5 people liked your post"
+func (n Notification) Message() string {
+	who := n.ActorName
+	if n.ActorCount > 1 {
+		who = strconv.Itoa(n.ActorCount) + " people"
+	}
+	switch n.Type {
+	case NotifyComment:
+		return who + " commented on your post"
+	case NotifyReply:
+		return who + " commented on a post you follow"
+	case NotifyPostLike:
+		return who + " liked your post"
+	case NotifyCommentLike:
+		return who + " liked your comment on"
+	case NotifyMention:
+		return who + " mentioned you in"
+	}
+	return who + " was active on"
+}
+
+// Link is the page the notification points at
+func (n Notification) Link() string {
+	link := "/post/" + strconv.FormatInt(n.PostID, 10)
+	if n.CommentID > 0 {
+		link += "#comment-" + strconv.FormatInt(n.CommentID, 10)
+	}
+	return link
+}
+
+// NotifyNewPost tells users mentioned in a new post
+func NotifyNewPost(ctx context.Context, db *sql.DB, postID int64) error {
+	post, err := GetPostByID(ctx, db, postID)
+	if err != nil {
+		return err
+	}
+	mentioned, err := mentionedUsers(ctx, db, post.Title+"\n"+post.Content)
+	if err != nil {
+		return err
+	}
+	for _, userID := range mentioned {
+		if err := notify(ctx, db, userID, post.AuthorID, NotifyMention, post.ID, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotifyNewComment tells the post's author, the users mentioned in the comment
+// and everyone watching the post. Each person gets at most one notification
+// per comment. The commenter starts watching the post.
+func NotifyNewComment(ctx context.Context, db *sql.DB, commentID int64) error {
+	comment, err := GetCommentByID(ctx, db, commentID)
+	if err != nil {
+		return err
+	}
+	post, err := GetPostByID(ctx, db, comment.PostID)
+	if err != nil {
+		return err
+	}
+
+	notified := map[int64]bool{comment.AuthorID: true}
+	send := func(userID int64, kind string) error {
+		if notified[userID] {
+			return nil
+		}
+		notified[userID] = true
+		return notify(ctx, db, userID, comment.AuthorID, kind, post.ID, comment.ID)
+	}
+
+	if err := send(post.AuthorID, NotifyComment); err != nil {
+		return err
+	}
+	mentioned, err := mentionedUsers(ctx, db, comment.Content)
+	if err != nil {
+		return err
+	}
+	for _, userID := range mentioned {
+		if err := send(userID, NotifyMention); err != nil {
+			return err
+		}
+	}
+	watchers, err := postWatchers(ctx, db, post.ID)
+	if err != nil {
+		return err
+	}
+	for _, userID := range watchers {
+		if err := send(userID, NotifyReply); err != nil {
+			return err
+		}
+	}
+
+	return WatchPost(ctx, db, comment.AuthorID, post.ID)
+}
+
+// NotifyPostReaction tells a post's author it was liked. Dislikes and removed
+// reactions are not announced.
+func NotifyPostReaction(ctx context.Context, db *sql.DB, actorID, postID int64, reaction int) error {
+	if reaction != 1 {
+		return nil
+	}
+	post, err := GetPostByID(ctx, db, postID)
+	if err != nil {
+		return err
+	}
+	return notify(ctx, db, post.AuthorID, actorID, NotifyPostLike, post.ID, 0)
+}
+
+// NotifyCommentReaction tells a comment's author it was liked
+func NotifyCommentReaction(ctx context.Context, db *sql.DB, actorID, commentID int64, reaction int) error {
+	if reaction != 1 {
+		return nil
+	}
+	comment, err := GetCommentByID(ctx, db, commentID)
+	if err != nil {
+		return err
+	}
+	return notify(ctx, db, comment.AuthorID, actorID, NotifyCommentLike, comment.PostID, comment.ID)
+}
+
+// notify records a notification, folding it into an unread one about the same
+// target if there is one
+func notify(ctx context.Context, db *sql.DB, userID, actorID int64, kind string, postID, commentID int64) error {
+	if userID == actorID {
+		return nil
+	}
+	enabled, err := notificationEnabled(ctx, db, userID, kind)
+	if err != nil || !enabled {
+		return err
+	}
+
+	// Likes on a comment are grouped by comment; everything else by post
+	groupKey := "post:" + strconv.FormatInt(postID, 10)
+	if kind == NotifyCommentLike {
+		groupKey = "comment:" + strconv.FormatInt(commentID, 10)
+	}
+	comment := sql.NullInt64{Int64: commentID, Valid: commentID > 0}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM notifications
+		WHERE user_id = ? AND type = ? AND group_key = ? AND read_at IS NULL`,
+		userID, kind, groupKey).Scan(&id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO notifications (user_id, type, post_id, comment_id, group_key, last_actor_id)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			userID, kind, postID, comment, groupKey, actorID)
+		if err != nil {
+			return fmt.Errorf("failed to create notification: %w", err)
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE notifications
+			SET comment_id = COALESCE(?, comment_id), last_actor_id = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?`, comment, actorID, id)
+		if err != nil {
+			return fmt.Errorf("failed to update notification: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO notification_actors (notification_id, actor_id) VALUES (?, ?)`, id, actorID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mentionedUsers returns the IDs of existing users @mentioned in text
+func mentionedUsers(ctx context.Context, db *sql.DB, text string) ([]int64, error) {
+	seen := map[string]bool{}
+	var ids []int64
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(match[1], ".,;:!?)\"'")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var id int64
+		err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", name).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ListNotifications returns a user's most recent notifications, newest activity first
+func ListNotifications(ctx context.Context, db *sql.DB, userID int64, limit int) ([]Notification, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.id, n.type, n.post_id, p.title, COALESCE(n.comment_id, 0), u.username,
+			(SELECT COUNT(*) FROM notification_actors a WHERE a.notification_id = n.id),
+			n.read_at IS NOT NULL, n.created_at, n.updated_at
+		FROM notifications n
+		JOIN posts p ON p.id = n.post_id
+		JOIN users u ON u.id = n.last_actor_id
+		WHERE n.user_id = ?
+		ORDER BY n.updated_at DESC, n.id DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.PostID, &n.PostTitle, &n.CommentID, &n.ActorName,
+			&n.ActorCount, &n.Read, &n.CreatedAt, &n.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// CountUnreadNotifications returns how many unread notifications a user has
+func CountUnreadNotifications(ctx context.Context, db *sql.DB, userID int64) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationRead marks one of a user's notifications as read
+func MarkNotificationRead(ctx context.Context, db *sql.DB, userID, notificationID int64) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+		WHERE id = ? AND user_id = ?`, notificationID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead marks all of a user's notifications as read
+func MarkAllNotificationsRead(ctx context.Context, db *sql.DB, userID int64) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND read_at IS NULL`, userID)
+	return err
+}
+
+// MarkPostNotificationsRead marks a user's notifications about a post as read,
+// once they have seen it
+func MarkPostNotificationsRead(ctx context.Context, db *sql.DB, userID, postID int64) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND post_id = ? AND read_at IS NULL`, userID, postID)
+	return err
+}
+
+// NotificationPreferences returns which notification types a user has on
+func NotificationPreferences(ctx context.Context, db *sql.DB, userID int64) (map[string]bool, error) {
+	prefs := map[string]bool{}
+	for _, t := range NotificationTypes {
+		prefs[t.Type] = true
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT type, enabled FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var enabled bool
+		if err := rows.Scan(&kind, &enabled); err != nil {
+			return nil, err
+		}
+		prefs[kind] = enabled
+	}
+	return prefs, rows.Err()
+}
+
+// SetNotificationPreferences saves which notification types a user wants.
+// Types missing from enabled are turned off.
+func SetNotificationPreferences(ctx context.Context, db *sql.DB, userID int64, enabled map[string]bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range NotificationTypes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+			ON CONFLICT(user_id, type) DO UPDATE SET enabled = excluded.enabled`,
+			userID, t.Type, enabled[t.Type]); err != nil {
+			return fmt.Errorf("failed to save notification preferences: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func notificationEnabled(ctx context.Context, db *sql.DB, userID int64, kind string) (bool, error) {
+	var enabled bool
+	err := db.QueryRowContext(ctx,
+		"SELECT enabled FROM notification_preferences WHERE user_id = ? AND type = ?", userID, kind).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	return enabled, err
+}
+
+// WatchPost makes a user follow a post's new comments
+func WatchPost(ctx context.Context, db *sql.DB, userID, postID int64) error {
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO post_watches (user_id, post_id) VALUES (?, ?)", userID, postID)
+	return err
+}
+
+// UnwatchPost stops following a post
+func UnwatchPost(ctx context.Context, db *sql.DB, userID, postID int64) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM post_watches WHERE user_id = ? AND post_id = ?", userID, postID)
+	return err
+}
+
+// IsWatchingPost reports whether a user follows a post
+func IsWatchingPost(ctx context.Context, db *sql.DB, userID, postID int64) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM post_watches WHERE user_id = ? AND post_id = ?)", userID, postID).Scan(&exists)
+	return exists, err
+}
+
+func postWatchers(ctx context.Context, db *sql.DB, postID int64) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT user_id FROM post_watches WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -4,17 +4,28 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"html/template"
 	"strings"
 	"time"
 )
 
+// Errors returned for posts and comments that are missing or belong to someone else
+var (
+	ErrPostNotFound    = errors.New("post not found")
+	ErrCommentNotFound = errors.New("comment not found")
+	ErrNotAuthor       = errors.New("you can only change your own posts and comments")
+)
+
 type Post struct {
 	ID         int64
 	AuthorID   int64
 	Title      string
 	Content    string
 	CreatedAt  time.Time
-	Categories []string // أسماء التصنيفات المرتبطة (اختياري للعرض)
+	UpdatedAt  time.Time // Zero if the post was never edited
+	Categories []string  // أسماء التصنيفات المرتبطة (اختياري للعرض)
+
+	ContentHTML template.HTML // Content rendered as sanitized Markdown
 }
 
 func CreatePost(ctx context.Context, db *sql.DB, authorID int64, title, content string, categoryNames []string) (int64, error) {
@@ -55,12 +66,21 @@ func CreatePost(ctx context.Context, db *sql.DB, authorID int64, title, content
 
 func GetPostByID(ctx context.Context, db *sql.DB, id int64) (*Post, error) {
 	row := db.QueryRowContext(ctx, `
-		SELECT p.id, p.author_id, p.title, p.content, p.created_at
+		SELECT p.id, p.author_id, p.title, p.content, p.created_at, p.updated_at, p.content_html, p.content_html_version
 		FROM posts p WHERE p.id = ?`, id)
 	var p Post
-	if err := row.Scan(&p.ID, &p.AuthorID, &p.Title, &p.Content, &p.CreatedAt); err != nil {
+	var updatedAt sql.NullTime
+	var html renderCache
+	if err := row.Scan(&p.ID, &p.AuthorID, &p.Title, &p.Content, &p.CreatedAt, &updatedAt, &html.content, &html.version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPostNotFound
+		}
 		return nil, err
 	}
+	if updatedAt.Valid {
+		p.UpdatedAt = updatedAt.Time
+	}
+	p.ContentHTML = html.render(ctx, db, "posts", p.ID, p.Content)
 
 	// جلب التصنيفات
 	cats, err := listCategoriesForPost(ctx, db, p.ID)
@@ -80,13 +100,12 @@ type ListOptions struct {
 	OrderDesc    bool   // الأحدث أولاً
 }
 
-// ListPosts يدعم الفلاتر المطلوبة: التصنيفات / منشوراتي / المعجب بها
-func ListPosts(ctx context.Context, db *sql.DB, opt ListOptions) ([]Post, error) {
+// postFilter builds the FROM and WHERE clauses shared by ListPosts and CountPosts
+func postFilter(opt ListOptions) (string, []any) {
 	var args []any
 	var sb strings.Builder
 
 	sb.WriteString(`
-	SELECT DISTINCT p.id, p.author_id, p.title, p.content, p.created_at
 	FROM posts p
 	LEFT JOIN post_categories pc ON pc.post_id = p.id
 	LEFT JOIN categories c ON c.id = pc.category_id
@@ -115,6 +134,24 @@ func ListPosts(ctx context.Context, db *sql.DB, opt ListOptions) ([]Post, error)
 	if len(where) > 0 {
 		sb.WriteString(" WHERE " + strings.Join(where, " AND "))
 	}
+	return sb.String(), args
+}
+
+// CountPosts returns how many posts match the filters, ignoring Limit and Offset
+func CountPosts(ctx context.Context, db *sql.DB, opt ListOptions) (int, error) {
+	filter, args := postFilter(opt)
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT p.id) "+filter, args...).Scan(&count)
+	return count, err
+}
+
+// ListPosts يدعم الفلاتر المطلوبة: التصنيفات / منشوراتي / المعجب بها
+func ListPosts(ctx context.Context, db *sql.DB, opt ListOptions) ([]Post, error) {
+	filter, args := postFilter(opt)
+	var sb strings.Builder
+
+	sb.WriteString("SELECT DISTINCT p.id, p.author_id, p.title, p.content, p.created_at, p.updated_at, p.content_html, p.content_html_version ")
+	sb.WriteString(filter)
 
 	if opt.OrderDesc {
 		sb.WriteString(" ORDER BY p.created_at DESC ")
@@ -142,9 +179,15 @@ func ListPosts(ctx context.Context, db *sql.DB, opt ListOptions) ([]Post, error)
 	var list []Post
 	for rows.Next() {
 		var p Post
-		if err := rows.Scan(&p.ID, &p.AuthorID, &p.Title, &p.Content, &p.CreatedAt); err != nil {
+		var updatedAt sql.NullTime
+		var html renderCache
+		if err := rows.Scan(&p.ID, &p.AuthorID, &p.Title, &p.Content, &p.CreatedAt, &updatedAt, &html.content, &html.version); err != nil {
 			return nil, err
 		}
+		if updatedAt.Valid {
+			p.UpdatedAt = updatedAt.Time
+		}
+		p.ContentHTML = html.render(ctx, db, "posts", p.ID, p.Content)
 		if cats, err := listCategoriesForPost(ctx, db, p.ID); err == nil {
 			p.Categories = cats
 		}
@@ -209,6 +252,7 @@ func listCategoriesForPost(ctx context.Context, db *sql.DB, postID int64) ([]str
 type PostWithDetails struct {
 	Post
 	Username      string
+	Avatar        string // Hash of the author's uploaded avatar; empty for their identicon
 	LikesCount    int
 	DislikesCount int
 	CommentsCount int
@@ -220,6 +264,7 @@ type PostWithDetails struct {
 type CommentWithDetails struct {
 	Comment
 	Username      string
+	Avatar        string // Hash of the author's uploaded avatar; empty for their identicon
 	LikesCount    int
 	DislikesCount int
 	UserLiked     bool
@@ -275,124 +320,114 @@ func ListPostsWithDetails(ctx context.Context, db *sql.DB, opt ListOptions, curr
 	if err != nil {
 		return nil, err
 	}
+	return WithDetails(ctx, db, posts, currentUserID), nil
+}
 
+// WithDetails adds the author, counts and the current user's reactions to posts
+// listed by one of the ListPosts wrappers
+func WithDetails(ctx context.Context, db *sql.DB, posts []Post, currentUserID int64) []PostWithDetails {
 	var result []PostWithDetails
 	for _, post := range posts {
-		detail := PostWithDetails{Post: post}
+		result = append(result, postDetails(ctx, db, post, currentUserID))
+	}
+	return result
+}
 
-		// Get username
-		err := db.QueryRowContext(ctx, "SELECT username FROM users WHERE id = ?", post.AuthorID).Scan(&detail.Username)
-		if err != nil {
-			detail.Username = "Unknown"
-		}
+// postDetails adds the author, counts and the current user's reaction to a post
+func postDetails(ctx context.Context, db *sql.DB, post Post, currentUserID int64) PostWithDetails {
+	detail := PostWithDetails{Post: post}
 
-		// Get reaction counts
-		reactions, err := CountPostReactions(ctx, db, post.ID)
-		if err == nil {
-			detail.LikesCount = reactions.Likes
-			detail.DislikesCount = reactions.Dislikes
-		}
+	// Get username and avatar
+	var avatar sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT username, avatar FROM users WHERE id = ?", post.AuthorID).Scan(&detail.Username, &avatar)
+	if err != nil {
+		detail.Username = "Unknown"
+	}
+	detail.Avatar = avatar.String
 
-		// Get comments count
-		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM comments WHERE post_id = ?", post.ID).Scan(&detail.CommentsCount)
-		if err != nil {
-			detail.CommentsCount = 0
-		}
+	// Get reaction counts
+	reactions, err := CountPostReactions(ctx, db, post.ID)
+	if err == nil {
+		detail.LikesCount = reactions.Likes
+		detail.DislikesCount = reactions.Dislikes
+	}
 
-		// Check if current user liked/disliked this post
-		if currentUserID > 0 {
-			var reaction sql.NullInt64
-			err = db.QueryRowContext(ctx, "SELECT reaction FROM post_likes WHERE user_id = ? AND post_id = ?", currentUserID, post.ID).Scan(&reaction)
-			if err == nil && reaction.Valid {
-				if reaction.Int64 == 1 {
-					detail.UserLiked = true
-				} else if reaction.Int64 == -1 {
-					detail.UserDisliked = true
-				}
+	// Get comments count
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM comments WHERE post_id = ?", post.ID).Scan(&detail.CommentsCount)
+	if err != nil {
+		detail.CommentsCount = 0
+	}
+
+	// Check if current user liked/disliked this post
+	if currentUserID > 0 {
+		var reaction sql.NullInt64
+		err = db.QueryRowContext(ctx, "SELECT reaction FROM post_likes WHERE user_id = ? AND post_id = ?", currentUserID, post.ID).Scan(&reaction)
+		if err == nil && reaction.Valid {
+			if reaction.Int64 == 1 {
+				detail.UserLiked = true
+			} else if reaction.Int64 == -1 {
+				detail.UserDisliked = true
 			}
 		}
-
-		result = append(result, detail)
 	}
 
-	return result, nil
+	return detail
 }
 
 // ListCommentsWithDetails returns comments with additional details for display
 func ListCommentsWithDetails(ctx context.Context, db *sql.DB, postID int64, currentUserID int64) ([]CommentWithDetails, error) {
-	comments, err := ListCommentsByPostID(ctx, db, postID, 100, 0)
+	return ListCommentsWithDetailsPage(ctx, db, postID, currentUserID, 100, 0)
+}
+
+// ListCommentsWithDetailsPage returns one page of a post's comments with details
+func ListCommentsWithDetailsPage(ctx context.Context, db *sql.DB, postID, currentUserID int64, limit, offset int) ([]CommentWithDetails, error) {
+	comments, err := ListCommentsByPostID(ctx, db, postID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
 
 	var result []CommentWithDetails
 	for _, comment := range comments {
-		detail := CommentWithDetails{Comment: comment}
-
-		// Get username
-		err := db.QueryRowContext(ctx, "SELECT username FROM users WHERE id = ?", comment.AuthorID).Scan(&detail.Username)
-		if err != nil {
-			detail.Username = "Unknown"
-		}
-
-		// Get reaction counts
-		reactions, err := CountCommentReactions(ctx, db, comment.ID)
-		if err == nil {
-			detail.LikesCount = reactions.Likes
-			detail.DislikesCount = reactions.Dislikes
-		}
-
-		// Check if current user liked/disliked this comment
-		if currentUserID > 0 {
-			var reaction sql.NullInt64
-			err = db.QueryRowContext(ctx, "SELECT reaction FROM comment_likes WHERE user_id = ? AND comment_id = ?", currentUserID, comment.ID).Scan(&reaction)
-			if err == nil && reaction.Valid {
-				if reaction.Int64 == 1 {
-					detail.UserLiked = true
-				} else if reaction.Int64 == -1 {
-					detail.UserDisliked = true
-				}
-			}
-		}
-
-		result = append(result, detail)
+		result = append(result, commentDetails(ctx, db, comment, currentUserID))
 	}
 
 	return result, nil
 }
 
-// GetPostWithDetails returns a single post with all details
-func GetPostWithDetails(ctx context.Context, db *sql.DB, postID int64, currentUserID int64) (*PostWithDetails, error) {
-	post, err := GetPostByID(ctx, db, postID)
+// GetCommentWithDetails returns a single comment with all details
+func GetCommentWithDetails(ctx context.Context, db *sql.DB, commentID, currentUserID int64) (*CommentWithDetails, error) {
+	comment, err := GetCommentByID(ctx, db, commentID)
 	if err != nil {
 		return nil, err
 	}
 
-	detail := PostWithDetails{Post: *post}
+	detail := commentDetails(ctx, db, *comment, currentUserID)
+	return &detail, nil
+}
+
+// commentDetails adds the author, counts and the current user's reaction to a comment
+func commentDetails(ctx context.Context, db *sql.DB, comment Comment, currentUserID int64) CommentWithDetails {
+	detail := CommentWithDetails{Comment: comment}
 
-	// Get username
-	err = db.QueryRowContext(ctx, "SELECT username FROM users WHERE id = ?", post.AuthorID).Scan(&detail.Username)
+	// Get username and avatar
+	var avatar sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT username, avatar FROM users WHERE id = ?", comment.AuthorID).Scan(&detail.Username, &avatar)
 	if err != nil {
 		detail.Username = "Unknown"
 	}
+	detail.Avatar = avatar.String
 
 	// Get reaction counts
-	reactions, err := CountPostReactions(ctx, db, post.ID)
+	reactions, err := CountCommentReactions(ctx, db, comment.ID)
 	if err == nil {
 		detail.LikesCount = reactions.Likes
 		detail.DislikesCount = reactions.Dislikes
 	}
 
-	// Get comments count
-	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM comments WHERE post_id = ?", post.ID).Scan(&detail.CommentsCount)
-	if err != nil {
-		detail.CommentsCount = 0
-	}
-
-	// Check if current user liked/disliked this post
+	// Check if current user liked/disliked this comment
 	if currentUserID > 0 {
 		var reaction sql.NullInt64
-		err = db.QueryRowContext(ctx, "SELECT reaction FROM post_likes WHERE user_id = ? AND post_id = ?", currentUserID, post.ID).Scan(&reaction)
+		err = db.QueryRowContext(ctx, "SELECT reaction FROM comment_likes WHERE user_id = ? AND comment_id = ?", currentUserID, comment.ID).Scan(&reaction)
 		if err == nil && reaction.Valid {
 			if reaction.Int64 == 1 {
 				detail.UserLiked = true
@@ -402,9 +437,66 @@ func GetPostWithDetails(ctx context.Context, db *sql.DB, postID int64, currentUs
 		}
 	}
 
+	return detail
+}
+
+// GetPostWithDetails returns a single post with all details
+func GetPostWithDetails(ctx context.Context, db *sql.DB, postID int64, currentUserID int64) (*PostWithDetails, error) {
+	post, err := GetPostByID(ctx, db, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := postDetails(ctx, db, *post, currentUserID)
 	return &detail, nil
 }
 
+// UpdatePost changes the title and content of a post (only by the author).
+// A nil categoryNames keeps the post's categories; otherwise they are replaced.
+func UpdatePost(ctx context.Context, db *sql.DB, postID, userID int64, title, content string, categoryNames []string) error {
+	title = strings.TrimSpace(title)
+	content = strings.TrimSpace(content)
+	if postID <= 0 || userID <= 0 || title == "" || content == "" {
+		return errors.New("invalid post data")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var authorID int64
+	err = tx.QueryRowContext(ctx, "SELECT author_id FROM posts WHERE id = ?", postID).Scan(&authorID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrPostNotFound
+		}
+		return err
+	}
+	if authorID != userID {
+		return ErrNotAuthor
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE posts SET title = ?, content = ?, updated_at = ?, content_html = NULL WHERE id = ?",
+		title, content, time.Now().UTC(), postID)
+	if err != nil {
+		return err
+	}
+
+	if categoryNames != nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM post_categories WHERE post_id = ?", postID); err != nil {
+			return err
+		}
+		if err := associateCategoriesTx(ctx, tx, postID, categoryNames); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // DeletePost deletes a post and all its associated data (only by the author)
 func DeletePost(ctx context.Context, db *sql.DB, postID, userID int64) error {
 	if postID <= 0 || userID <= 0 {
@@ -423,13 +515,13 @@ func DeletePost(ctx context.Context, db *sql.DB, postID, userID int64) error {
 	err = tx.QueryRowContext(ctx, "SELECT author_id FROM posts WHERE id = ?", postID).Scan(&authorID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return errors.New("post not found")
+			return ErrPostNotFound
 		}
 		return err
 	}
 
 	if authorID != userID {
-		return errors.New("you can only delete your own posts")
+		return ErrNotAuthor
 	}
 
 	// Delete in order: likes, comments, post_categories, then post
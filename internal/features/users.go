@@ -0,0 +1,57 @@
+package features
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrUserNotFound is returned for profiles of users that do not exist
+var ErrUserNotFound = errors.New("user not found")
+
+// UserProfile is the public information about a user
+type UserProfile struct {
+	ID             int64
+	Username       string
+	Bio            string
+	Avatar         string // Hash of the uploaded avatar; empty for the identicon
+	CreatedAt      time.Time
+	PostsCount     int
+	CommentsCount  int
+	Reputation     int  // Likes minus dislikes other users gave the user's posts and comments
+	ShowLikedPosts bool // Whether the profile lists the posts the user liked
+}
+
+// profileQuery selects a UserProfile; callers add the WHERE clause
+const profileQuery = `
+	SELECT u.id, u.username, u.bio, COALESCE(u.avatar, ''), u.created_at, u.show_liked_posts,
+		(SELECT COUNT(*) FROM posts WHERE author_id = u.id),
+		(SELECT COUNT(*) FROM comments WHERE author_id = u.id),
+		(SELECT COALESCE(SUM(pl.reaction), 0) FROM post_likes pl JOIN posts p ON p.id = pl.post_id
+			WHERE p.author_id = u.id AND pl.user_id != u.id) +
+		(SELECT COALESCE(SUM(cl.reaction), 0) FROM comment_likes cl JOIN comments c ON c.id = cl.comment_id
+			WHERE c.author_id = u.id AND cl.user_id != u.id)
+	FROM users u `
+
+// GetUserProfile returns a user's public profile
+func GetUserProfile(ctx context.Context, db *sql.DB, userID int64) (*UserProfile, error) {
+	return scanProfile(db.QueryRowContext(ctx, profileQuery+"WHERE u.id = ?", userID))
+}
+
+// GetUserProfileByUsername returns the public profile of the user with a username
+func GetUserProfileByUsername(ctx context.Context, db *sql.DB, username string) (*UserProfile, error) {
+	return scanProfile(db.QueryRowContext(ctx, profileQuery+"WHERE u.username = ?", username))
+}
+
+func scanProfile(row *sql.Row) (*UserProfile, error) {
+	var p UserProfile
+	err := row.Scan(&p.ID, &p.Username, &p.Bio, &p.Avatar, &p.CreatedAt, &p.ShowLikedPosts, &p.PostsCount, &p.CommentsCount, &p.Reputation)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,186 @@
+package feeds
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// Content types of the two formats
+const (
+	AtomType = "application/atom+xml"
+	RSSType  = "application/rss+xml"
+)
+
+// generator names the software in both formats
+const generator = "Forum"
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title     string      `xml:"title"`
+	Subtitle  string      `xml:"subtitle,omitempty"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Generator string      `xml:"generator"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Link       atomLink       `xml:"link"`
+	Author     atomPerson     `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          rssSelf   `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Generator     string    `xml:"generator"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssSelf struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	Creator     string   `xml:"dc:creator"`
+	Categories  []string `xml:"category"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Atom encodes a feed as Atom 1.0
+func (s *Service) Atom(f *Feed) ([]byte, error) {
+	self := s.selfURL(AtomPath, f.Query)
+	feed := atomFeed{
+		Title:    f.Title,
+		Subtitle: f.Subtitle,
+		ID:       self,
+		Updated:  atomTime(f.Updated),
+		Links: []atomLink{
+			{Rel: "self", Type: AtomType, Href: self},
+			{Rel: "alternate", Type: "text/html", Href: f.Link},
+		},
+		Generator: generator,
+	}
+	for _, e := range f.Entries {
+		entry := atomEntry{
+			Title:     e.Title,
+			ID:        e.ID,
+			Published: atomTime(e.Published),
+			Updated:   atomTime(e.Updated),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: e.ID},
+			Author:    atomPerson{Name: e.Author},
+			Content:   atomContent{Type: "text", Body: e.Content},
+		}
+		for _, c := range e.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: c})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return encode(feed)
+}
+
+// RSS encodes a feed as RSS 2.0
+func (s *Service) RSS(f *Feed) ([]byte, error) {
+	feed := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.Link,
+			Description: f.Subtitle,
+			Self:        rssSelf{Href: s.selfURL(RSSPath, f.Query), Rel: "self", Type: RSSType},
+			Generator:   generator,
+		},
+	}
+	if !f.Updated.IsZero() {
+		feed.Channel.LastBuildDate = rssTime(f.Updated)
+	}
+	for _, e := range f.Entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.ID,
+			GUID:        rssGUID{IsPermaLink: "true", Value: e.ID},
+			Creator:     e.Author,
+			Categories:  e.Categories,
+			PubDate:     rssTime(e.Published),
+			Description: e.Content,
+		})
+	}
+	return encode(feed)
+}
+
+func (s *Service) selfURL(path, query string) string {
+	if query != "" {
+		path += "?" + query
+	}
+	return s.baseURL + path
+}
+
+func encode(v any) ([]byte, error) {
+	body, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
+
+// atomTime formats RFC 3339 times. Atom requires an updated time even for a
+// feed without entries, so the zero time is written as the Unix epoch.
+func atomTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func rssTime(t time.Time) string {
+	return t.UTC().Format(time.RFC1123Z)
+}
@@ -0,0 +1,282 @@
+// Package feeds builds Atom and RSS feeds of the newest posts on the forum, in
+// a category or by an author, and of the newest comments on a post.
+package feeds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"forum/internal/features"
+)
+
+// Paths the feeds are served at. Which feed is returned is chosen with the
+// category, author or post query parameter.
+const (
+	AtomPath = "/feed.atom"
+	RSSPath  = "/feed.rss"
+)
+
+// entryLimit is how many posts or comments a feed holds
+const entryLimit = 30
+
+// ErrNotFound is returned for feeds of categories, authors or posts that do
+// not exist
+var ErrNotFound = errors.New("feed not found")
+
+// Feed is a feed independent of its format
+type Feed struct {
+	Title    string
+	Subtitle string
+	Link     string // Page the feed follows
+	Query    string // Query string selecting this feed, without "?"
+	Updated  time.Time
+	Entries  []Entry
+}
+
+// Entry is a post or comment in a feed
+type Entry struct {
+	ID         string // Permanent URL of the post or comment
+	Title      string
+	Author     string
+	Content    string
+	Categories []string
+	Published  time.Time
+	Updated    time.Time
+}
+
+// Link is a feed autodiscovery link for a page's <head>
+type Link struct {
+	Title string
+	Type  string
+	Href  string
+}
+
+// Service builds feeds from the database
+type Service struct {
+	db      *sql.DB
+	baseURL string
+}
+
+// NewService creates a feed service
+func NewService(db *sql.DB) *Service {
+	return &Service{db: db}
+}
+
+// SetBaseURL sets the public URL of the forum used in feed links
+func (s *Service) SetBaseURL(baseURL string) {
+	s.baseURL = baseURL
+}
+
+// Links returns the Atom and RSS autodiscovery links of a feed. query selects
+// the feed as in Feed.Query; an empty query is the whole site.
+func Links(title, query string) []Link {
+	if query != "" {
+		query = "?" + query
+	}
+	return []Link{
+		{Title: title + " (Atom)", Type: AtomType, Href: AtomPath + query},
+		{Title: title + " (RSS)", Type: RSSType, Href: RSSPath + query},
+	}
+}
+
+// SiteLinks returns the autodiscovery links of the whole site feed
+func SiteLinks() []Link {
+	return Links("Forum", "")
+}
+
+// CategoryLinks returns the autodiscovery links of a category feed
+func CategoryLinks(category string) []Link {
+	return Links("Forum: "+category, categoryQuery(category))
+}
+
+// AuthorLinks returns the autodiscovery links of the feed of an author's posts
+func AuthorLinks(userID int64, username string) []Link {
+	return Links("Posts by "+username, authorQuery(userID))
+}
+
+// CommentLinks returns the autodiscovery links of the feed of a post's comments
+func CommentLinks(postID int64, title string) []Link {
+	return Links("Comments on "+title, postQuery(postID))
+}
+
+// Site returns the newest posts on the forum
+func (s *Service) Site(ctx context.Context) (*Feed, error) {
+	posts, err := features.ListPosts(ctx, s.db, features.ListOptions{Limit: entryLimit, OrderDesc: true})
+	if err != nil {
+		return nil, err
+	}
+	return s.postFeed(ctx, &Feed{
+		Title:    "Forum",
+		Subtitle: "Newest posts",
+		Link:     s.baseURL + "/",
+	}, posts)
+}
+
+// Category returns the newest posts in a category
+func (s *Service) Category(ctx context.Context, name string) (*Feed, error) {
+	err := s.db.QueryRowContext(ctx, "SELECT name FROM categories WHERE name = ?", name).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := features.ListPostsByCategory(ctx, s.db, name, entryLimit, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.postFeed(ctx, &Feed{
+		Title:    "Forum: " + name,
+		Subtitle: "Newest posts in " + name,
+		Link:     s.baseURL + "/?category=" + url.QueryEscape(name),
+		Query:    categoryQuery(name),
+	}, posts)
+}
+
+// Author returns the newest posts by a user
+func (s *Service) Author(ctx context.Context, userID int64) (*Feed, error) {
+	username, err := s.username(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := features.ListPostsByAuthor(ctx, s.db, userID, entryLimit, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.postFeed(ctx, &Feed{
+		Title:    "Posts by " + username,
+		Subtitle: "Newest posts by " + username,
+		Link:     s.baseURL + "/",
+		Query:    authorQuery(userID),
+	}, posts)
+}
+
+// Comments returns the newest comments on a post
+func (s *Service) Comments(ctx context.Context, postID int64) (*Feed, error) {
+	post, err := features.GetPostByID(ctx, s.db, postID)
+	if errors.Is(err, features.ErrPostNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Comments are listed oldest first; skip to the newest ones
+	count, err := features.CountComments(ctx, s.db, postID)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := features.ListCommentsByPostID(ctx, s.db, postID, entryLimit, max(count-entryLimit, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	link := s.postURL(postID)
+	feed := &Feed{
+		Title:    "Comments on " + post.Title,
+		Subtitle: "Newest comments on " + post.Title,
+		Link:     link,
+		Query:    postQuery(postID),
+		// A post without comments was last changed when it was written
+		Updated: latest(post.CreatedAt, post.UpdatedAt),
+	}
+	names := make(map[int64]string)
+	for i := len(comments) - 1; i >= 0; i-- {
+		c := comments[i]
+		author, err := s.cachedUsername(ctx, names, c.AuthorID)
+		if err != nil {
+			return nil, err
+		}
+		feed.add(Entry{
+			ID:        link + "#comment-" + strconv.FormatInt(c.ID, 10),
+			Title:     "Comment by " + author,
+			Author:    author,
+			Content:   c.Content,
+			Published: c.CreatedAt,
+			Updated:   latest(c.CreatedAt, c.UpdatedAt),
+		})
+	}
+	return feed, nil
+}
+
+// postFeed adds posts to a feed as entries
+func (s *Service) postFeed(ctx context.Context, feed *Feed, posts []features.Post) (*Feed, error) {
+	names := make(map[int64]string)
+	for _, p := range posts {
+		author, err := s.cachedUsername(ctx, names, p.AuthorID)
+		if err != nil {
+			return nil, err
+		}
+		categories := append([]string(nil), p.Categories...)
+		sort.Strings(categories)
+		feed.add(Entry{
+			ID:         s.postURL(p.ID),
+			Title:      p.Title,
+			Author:     author,
+			Content:    p.Content,
+			Categories: categories,
+			Published:  p.CreatedAt,
+			Updated:    latest(p.CreatedAt, p.UpdatedAt),
+		})
+	}
+	return feed, nil
+}
+
+// add appends an entry and keeps the feed's updated time at its newest entry
+func (f *Feed) add(e Entry) {
+	f.Entries = append(f.Entries, e)
+	f.Updated = latest(f.Updated, e.Updated)
+}
+
+func (s *Service) postURL(postID int64) string {
+	return s.baseURL + "/post/" + strconv.FormatInt(postID, 10)
+}
+
+func (s *Service) username(ctx context.Context, userID int64) (string, error) {
+	var username string
+	err := s.db.QueryRowContext(ctx, "SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	return username, err
+}
+
+// cachedUsername looks up usernames once per feed, since most feeds have few
+// distinct authors
+func (s *Service) cachedUsername(ctx context.Context, names map[int64]string, userID int64) (string, error) {
+	if name, ok := names[userID]; ok {
+		return name, nil
+	}
+	name, err := s.username(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	names[userID] = name
+	return name, nil
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func categoryQuery(name string) string {
+	return "category=" + url.QueryEscape(name)
+}
+
+func authorQuery(userID int64) string {
+	return "author=" + strconv.FormatInt(userID, 10)
+}
+
+func postQuery(postID int64) string {
+	return "post=" + strconv.FormatInt(postID, 10)
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"forum/internal/auth"
+	"forum/internal/webhooks"
+)
+
+// AdminHandlers handles administration pages
+type AdminHandlers struct {
+	db           *sql.DB
+	authService  *auth.AuthService
+	webhooks     *webhooks.Service
+	incoming     *webhooks.IncomingService
+	templates    *template.Template
+	errorHandler *auth.HTTPErrorHandler
+}
+
+// NewAdminHandlers creates new administration handlers
+func NewAdminHandlers(db *sql.DB, authService *auth.AuthService, hooks *webhooks.Service, incoming *webhooks.IncomingService, templates *template.Template) *AdminHandlers {
+	errorLogger := log.New(os.Stdout, "[ADMIN-ERROR] ", log.LstdFlags|log.Lshortfile)
+	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+
+	return &AdminHandlers{
+		db:           db,
+		authService:  authService,
+		webhooks:     hooks,
+		incoming:     incoming,
+		templates:    templates,
+		errorHandler: errorHandler,
+	}
+}
+
+// LockoutsHandler lists active login lockouts
+func (h *AdminHandlers) LockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	lockouts, err := h.authService.ListActiveLockouts()
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		User      *auth.User
+		Lockouts  []auth.Lockout
+		Success   string
+	}{
+		Title:     "Login Lockouts",
+		CSRFToken: auth.CSRFToken(r),
+		User:      currentUser,
+		Lockouts:  lockouts,
+	}
+
+	if r.URL.Query().Get("unlocked") == "true" {
+		data.Success = "Lockout lifted."
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "admin_lockouts.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+}
+
+// UnlockHandler lifts a login lockout
+func (h *AdminHandlers) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	lockoutID, err := strconv.ParseInt(r.FormValue("lockout_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid lockout ID")
+		return
+	}
+
+	if err := h.authService.Unlock(lockoutID); err != nil {
+		h.errorHandler.Handle400(w, r, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/lockouts?unlocked=true", http.StatusSeeOther)
+}
+
+// UsersHandler lists users and their roles
+func (h *AdminHandlers) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	users, err := h.authService.ListUsers()
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		User      *auth.User
+		Users     []auth.User
+		Roles     []string
+		Success   string
+	}{
+		Title:     "Users",
+		CSRFToken: auth.CSRFToken(r),
+		User:      currentUser,
+		Users:     users,
+		Roles:     []string{auth.RoleUser, auth.RoleModerator, auth.RoleAdmin},
+	}
+
+	if r.URL.Query().Get("updated") == "true" {
+		data.Success = "Role updated. The user has been signed out of all devices."
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "admin_users.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+}
+
+// SetRoleHandler changes a user's role
+func (h *AdminHandlers) SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	targetID, err := strconv.ParseInt(r.FormValue("user_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid user ID")
+		return
+	}
+
+	// Admins cannot demote themselves and lock everyone out of the admin pages
+	userID, _ := auth.GetUserFromContext(r)
+	if targetID == userID {
+		h.errorHandler.Handle400(w, r, "You cannot change your own role")
+		return
+	}
+
+	if err := h.authService.SetUserRole(targetID, r.FormValue("role")); err != nil {
+		h.errorHandler.Handle400(w, r, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users?updated=true", http.StatusSeeOther)
+}
+
+// SecurityHandler shows the two-factor policy for staff and who still has to enrol
+func (h *AdminHandlers) SecurityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	required, err := h.authService.TwoFactorRequiredForStaff()
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	missing, err := h.authService.ListStaffWithoutTwoFactor()
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title           string
+		CSRFToken       string
+		User            *auth.User
+		Require2FA      bool
+		StaffWithout2FA []auth.User
+		Success         string
+	}{
+		Title:           "Security",
+		CSRFToken:       auth.CSRFToken(r),
+		User:            currentUser,
+		Require2FA:      required,
+		StaffWithout2FA: missing,
+	}
+
+	if r.URL.Query().Get("updated") == "true" {
+		data.Success = "Security settings saved."
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "admin_security.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+}
+
+// SetTwoFactorPolicyHandler turns mandatory 2FA for moderators and admins on or off
+func (h *AdminHandlers) SetTwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	if err := h.authService.SetTwoFactorRequiredForStaff(r.FormValue("require_2fa") == "on"); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/security?updated=true", http.StatusSeeOther)
+}
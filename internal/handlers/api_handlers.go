@@ -0,0 +1,768 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/internal/attachments"
+	"forum/internal/auth"
+	"forum/internal/events"
+	"forum/internal/features"
+	"forum/internal/webhooks"
+)
+
+// APIPrefix is the path every JSON API route lives under
+const APIPrefix = "/api/v1"
+
+const (
+	apiDefaultPerPage = 20
+	apiMaxPerPage     = 100
+)
+
+// APIHandlers serves the versioned JSON API. It answers every error, including
+// authentication failures, with the same JSON envelope.
+type APIHandlers struct {
+	db          *sql.DB
+	authService *auth.AuthService
+	middleware  *auth.Middleware
+	mux         *http.ServeMux
+	live        livePublisher
+	notify      notifier
+	webhooks    *webhooks.Service
+	attachments *attachments.Service
+}
+
+// apiRoute is one API endpoint. The route table drives both the router and
+// the OpenAPI document, so the two cannot drift apart.
+type apiRoute struct {
+	method   string
+	path     string // Relative to APIPrefix, with {id} wildcards
+	scope    string // Token scope needed; "" for public metadata
+	auth     bool   // Whether anonymous requests are refused
+	summary  string
+	tag      string
+	body     any // Request body schema, or nil
+	response any // Response schema, or nil for 204
+	list     bool
+	handler  func(w http.ResponseWriter, r *http.Request, userID int64)
+}
+
+// NewAPIHandlers creates the JSON API handlers
+func NewAPIHandlers(db *sql.DB, authService *auth.AuthService, middleware *auth.Middleware, broker *events.Broker, hooks *webhooks.Service, uploads *attachments.Service) *APIHandlers {
+	h := &APIHandlers{
+		db:          db,
+		authService: authService,
+		middleware:  middleware,
+		mux:         http.NewServeMux(),
+		live:        livePublisher{db: db, broker: broker},
+		notify:      notifier{db: db},
+		webhooks:    hooks,
+		attachments: uploads,
+	}
+	for _, route := range h.routes() {
+		h.mux.HandleFunc(route.method+" "+APIPrefix+route.path, h.wrap(route))
+	}
+	h.mux.HandleFunc(APIPrefix+"/", h.notFound)
+	return h
+}
+
+// ServeHTTP routes a request under APIPrefix
+func (h *APIHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *APIHandlers) routes() []apiRoute {
+	return []apiRoute{
+		{method: "GET", path: "/posts", scope: auth.ScopeRead, summary: "List and search posts", tag: "posts", response: apiPost{}, list: true, handler: h.listPosts},
+		{method: "POST", path: "/posts", scope: auth.ScopeWrite, auth: true, summary: "Create a post", tag: "posts", body: apiPostInput{}, response: apiPost{}, handler: h.createPost},
+		{method: "GET", path: "/posts/{id}", scope: auth.ScopeRead, summary: "Get a post", tag: "posts", response: apiPost{}, handler: h.getPost},
+		{method: "PATCH", path: "/posts/{id}", scope: auth.ScopeWrite, auth: true, summary: "Edit your post", tag: "posts", body: apiPostInput{}, response: apiPost{}, handler: h.updatePost},
+		{method: "DELETE", path: "/posts/{id}", scope: auth.ScopeWrite, auth: true, summary: "Delete your post", tag: "posts", handler: h.deletePost},
+		{method: "PUT", path: "/posts/{id}/reaction", scope: auth.ScopeReact, auth: true, summary: "Like or dislike a post", tag: "reactions", body: apiReactionInput{}, response: apiPost{}, handler: h.reactToPost},
+		{method: "DELETE", path: "/posts/{id}/reaction", scope: auth.ScopeReact, auth: true, summary: "Remove your reaction to a post", tag: "reactions", response: apiPost{}, handler: h.reactToPost},
+		{method: "GET", path: "/posts/{id}/comments", scope: auth.ScopeRead, summary: "List the comments of a post", tag: "comments", response: apiComment{}, list: true, handler: h.listComments},
+		{method: "POST", path: "/posts/{id}/comments", scope: auth.ScopeWrite, auth: true, summary: "Comment on a post", tag: "comments", body: apiCommentInput{}, response: apiComment{}, handler: h.createComment},
+		{method: "GET", path: "/comments/{id}", scope: auth.ScopeRead, summary: "Get a comment", tag: "comments", response: apiComment{}, handler: h.getComment},
+		{method: "PATCH", path: "/comments/{id}", scope: auth.ScopeWrite, auth: true, summary: "Edit your comment", tag: "comments", body: apiCommentInput{}, response: apiComment{}, handler: h.updateComment},
+		{method: "DELETE", path: "/comments/{id}", scope: auth.ScopeWrite, auth: true, summary: "Delete your comment", tag: "comments", handler: h.deleteComment},
+		{method: "PUT", path: "/comments/{id}/reaction", scope: auth.ScopeReact, auth: true, summary: "Like or dislike a comment", tag: "reactions", body: apiReactionInput{}, response: apiComment{}, handler: h.reactToComment},
+		{method: "DELETE", path: "/comments/{id}/reaction", scope: auth.ScopeReact, auth: true, summary: "Remove your reaction to a comment", tag: "reactions", response: apiComment{}, handler: h.reactToComment},
+		{method: "GET", path: "/categories", scope: auth.ScopeRead, summary: "List categories", tag: "categories", response: apiCategory{}, list: true, handler: h.listCategories},
+		{method: "GET", path: "/users/{id}", scope: auth.ScopeRead, summary: "Get a user's public profile", tag: "users", response: apiUser{}, handler: h.getUser},
+		{method: "GET", path: "/me", scope: auth.ScopeRead, auth: true, summary: "Get your own account", tag: "users", response: apiMe{}, handler: h.getMe},
+		{method: "GET", path: "/openapi.json", summary: "This OpenAPI document", tag: "meta", handler: h.openAPI},
+	}
+}
+
+// wrap authenticates a request for a route before calling its handler
+func (h *APIHandlers) wrap(route apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userID int64
+		if route.scope != "" {
+			id, ok, err := h.middleware.Authenticate(r, route.scope)
+			switch {
+			case errors.Is(err, auth.ErrInsufficientScope):
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+route.scope+`"`)
+				writeAPIError(w, http.StatusForbidden, "insufficient_scope", "this API token does not have the "+route.scope+" scope")
+				return
+			case err != nil:
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeAPIError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+				return
+			case !ok && route.auth:
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "authentication required")
+				return
+			}
+			userID = id
+			if ok && auth.BearerToken(r) == "" {
+				// Session clients need the token for their next unsafe request
+				w.Header().Set(auth.CSRFHeaderName, auth.CSRFToken(r))
+			}
+		}
+		route.handler(w, r, userID)
+	}
+}
+
+// notFound answers unknown paths, or known paths with the wrong method
+func (h *APIHandlers) notFound(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := h.mux.Handler(probe); pattern != APIPrefix+"/" {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, "not_found", "no such endpoint")
+}
+
+// API resources. Timestamps are RFC 3339 in UTC.
+
+type apiAuthor struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type apiPost struct {
+	ID         int64      `json:"id"`
+	Title      string     `json:"title"`
+	Content    string     `json:"content"`
+	Categories []string   `json:"categories"`
+	Author     apiAuthor  `json:"author"`
+	Likes      int        `json:"likes"`
+	Dislikes   int        `json:"dislikes"`
+	Comments   int        `json:"comments"`
+	MyReaction string     `json:"my_reaction,omitempty" enum:"like,dislike"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+}
+
+type apiComment struct {
+	ID         int64      `json:"id"`
+	PostID     int64      `json:"post_id"`
+	Content    string     `json:"content"`
+	Author     apiAuthor  `json:"author"`
+	Likes      int        `json:"likes"`
+	Dislikes   int        `json:"dislikes"`
+	MyReaction string     `json:"my_reaction,omitempty" enum:"like,dislike"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+}
+
+type apiCategory struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiUser struct {
+	ID         int64     `json:"id"`
+	Username   string    `json:"username"`
+	Bio        string    `json:"bio"`
+	Posts      int       `json:"posts"`
+	Comments   int       `json:"comments"`
+	Reputation int       `json:"reputation"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type apiMe struct {
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+}
+
+// apiPostInput creates or edits a post. When editing, omitted fields keep
+// their value.
+type apiPostInput struct {
+	Title      *string   `json:"title"`
+	Content    *string   `json:"content"`
+	Categories *[]string `json:"categories"`
+}
+
+type apiCommentInput struct {
+	Content string `json:"content"`
+}
+
+type apiReactionInput struct {
+	Reaction string `json:"reaction" enum:"like,dislike,none"`
+}
+
+type apiPage struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Envelopes
+type apiData struct {
+	Data any `json:"data"`
+}
+
+type apiList struct {
+	Data any     `json:"data"`
+	Meta apiPage `json:"meta"`
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorBody{Status: status, Code: code, Message: message}})
+}
+
+// writeAPIFailure maps errors from the features package to responses
+func writeAPIFailure(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, features.ErrPostNotFound), errors.Is(err, features.ErrCommentNotFound), errors.Is(err, features.ErrUserNotFound):
+		writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, features.ErrNotAuthor):
+		writeAPIError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, auth.ErrEmailNotVerified):
+		writeAPIError(w, http.StatusForbidden, "email_not_verified", err.Error())
+	default:
+		log.Printf("API request failed: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+}
+
+// pagination reads ?page and ?per_page
+func pagination(r *http.Request) (page, perPage int, ok bool) {
+	page, perPage = 1, apiDefaultPerPage
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, false
+		}
+		page = n
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxPerPage {
+			return 0, 0, false
+		}
+		perPage = n
+	}
+	return page, perPage, true
+}
+
+func pageMeta(page, perPage, total int) apiPage {
+	return apiPage{Page: page, PerPage: perPage, Total: total, TotalPages: (total + perPage - 1) / perPage}
+}
+
+// pathID reads the {id} wildcard
+func pathID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeAPIError(w, http.StatusNotFound, "not_found", "invalid id")
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeAPIBody reads a JSON body, answering 400 when it is malformed
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := decodeJSON(w, r, v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_body", "request body must be valid JSON")
+		return false
+	}
+	return true
+}
+
+func reactionName(liked, disliked bool) string {
+	switch {
+	case liked:
+		return "like"
+	case disliked:
+		return "dislike"
+	}
+	return ""
+}
+
+func toAPIPost(p features.PostWithDetails) apiPost {
+	categories := p.Categories
+	if categories == nil {
+		categories = []string{}
+	}
+	return apiPost{
+		ID:         p.ID,
+		Title:      p.Title,
+		Content:    p.Content,
+		Categories: categories,
+		Author:     apiAuthor{ID: p.AuthorID, Username: p.Username},
+		Likes:      p.LikesCount,
+		Dislikes:   p.DislikesCount,
+		Comments:   p.CommentsCount,
+		MyReaction: reactionName(p.UserLiked, p.UserDisliked),
+		CreatedAt:  p.CreatedAt.UTC(),
+		UpdatedAt:  optionalTime(p.UpdatedAt),
+	}
+}
+
+func toAPIComment(c features.CommentWithDetails) apiComment {
+	return apiComment{
+		ID:         c.ID,
+		PostID:     c.PostID,
+		Content:    c.Content,
+		Author:     apiAuthor{ID: c.AuthorID, Username: c.Username},
+		Likes:      c.LikesCount,
+		Dislikes:   c.DislikesCount,
+		MyReaction: reactionName(c.UserLiked, c.UserDisliked),
+		CreatedAt:  c.CreatedAt.UTC(),
+		UpdatedAt:  optionalTime(c.UpdatedAt),
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// checkVerified refuses actions the verification policy reserves for verified users
+func (h *APIHandlers) checkVerified(w http.ResponseWriter, userID int64, action string) bool {
+	if err := h.authService.CheckVerified(userID, action); err != nil {
+		writeAPIFailure(w, err)
+		return false
+	}
+	return true
+}
+
+func (h *APIHandlers) listPosts(w http.ResponseWriter, r *http.Request, userID int64) {
+	page, perPage, ok := pagination(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_pagination", "page must be at least 1 and per_page between 1 and 100")
+		return
+	}
+
+	query := r.URL.Query()
+	opt := features.ListOptions{
+		Limit:        perPage,
+		Offset:       (page - 1) * perPage,
+		CategoryName: query.Get("category"),
+		Search:       query.Get("q"),
+		OrderDesc:    query.Get("order") != "oldest",
+	}
+	if v := query.Get("author"); v != "" {
+		authorID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || authorID <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_filter", "author must be a user id")
+			return
+		}
+		opt.AuthorID = authorID
+	}
+
+	total, err := features.CountPosts(r.Context(), h.db, opt)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	posts, err := features.ListPostsWithDetails(r.Context(), h.db, opt, userID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	data := make([]apiPost, 0, len(posts))
+	for _, p := range posts {
+		data = append(data, toAPIPost(p))
+	}
+	writeJSON(w, http.StatusOK, apiList{Data: data, Meta: pageMeta(page, perPage, total)})
+}
+
+// writePost answers with the current state of a post
+func (h *APIHandlers) writePost(w http.ResponseWriter, r *http.Request, status int, postID, userID int64) {
+	post, err := features.GetPostWithDetails(r.Context(), h.db, postID, userID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeJSON(w, status, apiData{Data: toAPIPost(*post)})
+}
+
+func (h *APIHandlers) getPost(w http.ResponseWriter, r *http.Request, userID int64) {
+	postID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	h.writePost(w, r, http.StatusOK, postID, userID)
+}
+
+func (h *APIHandlers) createPost(w http.ResponseWriter, r *http.Request, userID int64) {
+	if !h.checkVerified(w, userID, auth.ActionPost) {
+		return
+	}
+
+	var input apiPostInput
+	if !decodeAPIBody(w, r, &input) {
+		return
+	}
+	if input.Title == nil || strings.TrimSpace(*input.Title) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "post title is required")
+		return
+	}
+	if input.Content == nil || strings.TrimSpace(*input.Content) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "post content is required")
+		return
+	}
+	var categories []string
+	if input.Categories != nil {
+		categories = *input.Categories
+	}
+
+	postID, err := features.CreatePost(r.Context(), h.db, userID, *input.Title, *input.Content, categories)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.postCreated(r.Context(), postID)
+	h.notify.postCreated(r.Context(), postID)
+	h.webhooks.PostCreated(r.Context(), postID)
+	w.Header().Set("Location", APIPrefix+"/posts/"+strconv.FormatInt(postID, 10))
+	h.writePost(w, r, http.StatusCreated, postID, userID)
+}
+
+func (h *APIHandlers) updatePost(w http.ResponseWriter, r *http.Request, userID int64) {
+	postID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	var input apiPostInput
+	if !decodeAPIBody(w, r, &input) {
+		return
+	}
+
+	post, err := features.GetPostByID(r.Context(), h.db, postID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	title, content := post.Title, post.Content
+	if input.Title != nil {
+		title = *input.Title
+	}
+	if input.Content != nil {
+		content = *input.Content
+	}
+	if strings.TrimSpace(title) == "" || strings.TrimSpace(content) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "post title and content cannot be empty")
+		return
+	}
+	var categories []string
+	if input.Categories != nil {
+		categories = append([]string{}, *input.Categories...)
+	}
+
+	if err := features.UpdatePost(r.Context(), h.db, postID, userID, title, content, categories); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.postUpdated(r.Context(), postID)
+	h.webhooks.PostUpdated(r.Context(), postID)
+	h.writePost(w, r, http.StatusOK, postID, userID)
+}
+
+func (h *APIHandlers) deletePost(w http.ResponseWriter, r *http.Request, userID int64) {
+	postID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := features.DeletePost(r.Context(), h.db, postID, userID); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.postDeleted(postID)
+	h.webhooks.PostDeleted(r.Context(), postID, userID)
+	h.attachments.CleanupAfterDelete(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reaction reads the reaction of a PUT body; DELETE removes the reaction
+func reaction(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if r.Method == http.MethodDelete {
+		return 0, true
+	}
+	var input apiReactionInput
+	if !decodeAPIBody(w, r, &input) {
+		return 0, false
+	}
+	switch input.Reaction {
+	case "like":
+		return 1, true
+	case "dislike":
+		return -1, true
+	case "none":
+		return 0, true
+	}
+	writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", `reaction must be "like", "dislike" or "none"`)
+	return 0, false
+}
+
+func (h *APIHandlers) reactToPost(w http.ResponseWriter, r *http.Request, userID int64) {
+	postID, ok := pathID(w, r)
+	if !ok || !h.checkVerified(w, userID, auth.ActionReact) {
+		return
+	}
+	value, ok := reaction(w, r)
+	if !ok {
+		return
+	}
+	if _, err := features.GetPostByID(r.Context(), h.db, postID); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	if err := features.TogglePostReaction(r.Context(), h.db, userID, postID, value); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.postCountsChanged(r.Context(), postID)
+	h.notify.postReacted(r.Context(), userID, postID, value)
+	h.webhooks.PostReactionChanged(r.Context(), userID, postID)
+	h.writePost(w, r, http.StatusOK, postID, userID)
+}
+
+func (h *APIHandlers) listComments(w http.ResponseWriter, r *http.Request, userID int64) {
+	postID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	page, perPage, ok := pagination(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_pagination", "page must be at least 1 and per_page between 1 and 100")
+		return
+	}
+
+	if _, err := features.GetPostByID(r.Context(), h.db, postID); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	total, err := features.CountComments(r.Context(), h.db, postID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	comments, err := features.ListCommentsWithDetailsPage(r.Context(), h.db, postID, userID, perPage, (page-1)*perPage)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	data := make([]apiComment, 0, len(comments))
+	for _, c := range comments {
+		data = append(data, toAPIComment(c))
+	}
+	writeJSON(w, http.StatusOK, apiList{Data: data, Meta: pageMeta(page, perPage, total)})
+}
+
+// writeComment answers with the current state of a comment
+func (h *APIHandlers) writeComment(w http.ResponseWriter, r *http.Request, status int, commentID, userID int64) {
+	comment, err := features.GetCommentWithDetails(r.Context(), h.db, commentID, userID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeJSON(w, status, apiData{Data: toAPIComment(*comment)})
+}
+
+func (h *APIHandlers) getComment(w http.ResponseWriter, r *http.Request, userID int64) {
+	commentID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	h.writeComment(w, r, http.StatusOK, commentID, userID)
+}
+
+func (h *APIHandlers) createComment(w http.ResponseWriter, r *http.Request, userID int64) {
+	postID, ok := pathID(w, r)
+	if !ok || !h.checkVerified(w, userID, auth.ActionComment) {
+		return
+	}
+
+	var input apiCommentInput
+	if !decodeAPIBody(w, r, &input) {
+		return
+	}
+	if strings.TrimSpace(input.Content) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "comment content is required")
+		return
+	}
+	if _, err := features.GetPostByID(r.Context(), h.db, postID); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	commentID, err := features.CreateComment(r.Context(), h.db, postID, userID, input.Content)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.commentCreated(r.Context(), commentID)
+	h.notify.commentCreated(r.Context(), commentID)
+	h.webhooks.CommentCreated(r.Context(), commentID)
+	w.Header().Set("Location", APIPrefix+"/comments/"+strconv.FormatInt(commentID, 10))
+	h.writeComment(w, r, http.StatusCreated, commentID, userID)
+}
+
+func (h *APIHandlers) updateComment(w http.ResponseWriter, r *http.Request, userID int64) {
+	commentID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	var input apiCommentInput
+	if !decodeAPIBody(w, r, &input) {
+		return
+	}
+	if strings.TrimSpace(input.Content) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "comment content is required")
+		return
+	}
+
+	if err := features.UpdateComment(r.Context(), h.db, commentID, userID, input.Content); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.commentUpdated(r.Context(), commentID)
+	h.writeComment(w, r, http.StatusOK, commentID, userID)
+}
+
+func (h *APIHandlers) deleteComment(w http.ResponseWriter, r *http.Request, userID int64) {
+	commentID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	comment, err := features.GetCommentByID(r.Context(), h.db, commentID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	if err := features.DeleteComment(r.Context(), h.db, commentID, userID); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.commentDeleted(r.Context(), comment.PostID, commentID)
+	h.attachments.CleanupAfterDelete(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandlers) reactToComment(w http.ResponseWriter, r *http.Request, userID int64) {
+	commentID, ok := pathID(w, r)
+	if !ok || !h.checkVerified(w, userID, auth.ActionReact) {
+		return
+	}
+	value, ok := reaction(w, r)
+	if !ok {
+		return
+	}
+	if _, err := features.GetCommentByID(r.Context(), h.db, commentID); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	if err := features.ToggleCommentReaction(r.Context(), h.db, userID, commentID, value); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	h.live.commentCountsChanged(r.Context(), commentID)
+	h.notify.commentReacted(r.Context(), userID, commentID, value)
+	h.webhooks.CommentReactionChanged(r.Context(), userID, commentID)
+	h.writeComment(w, r, http.StatusOK, commentID, userID)
+}
+
+func (h *APIHandlers) listCategories(w http.ResponseWriter, r *http.Request, userID int64) {
+	categories, err := features.GetAllCategories(r.Context(), h.db)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	data := make([]apiCategory, 0, len(categories))
+	for _, c := range categories {
+		data = append(data, apiCategory{ID: c.ID, Name: c.Name})
+	}
+	// Categories are few, so they come as a single page
+	writeJSON(w, http.StatusOK, apiList{Data: data, Meta: pageMeta(1, max(len(data), 1), len(data))})
+}
+
+func (h *APIHandlers) getUser(w http.ResponseWriter, r *http.Request, userID int64) {
+	profileID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	profile, err := features.GetUserProfile(r.Context(), h.db, profileID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiData{Data: apiUser{
+		ID:         profile.ID,
+		Username:   profile.Username,
+		Bio:        profile.Bio,
+		Posts:      profile.PostsCount,
+		Comments:   profile.CommentsCount,
+		Reputation: profile.Reputation,
+		CreatedAt:  profile.CreatedAt.UTC(),
+	}})
+}
+
+func (h *APIHandlers) getMe(w http.ResponseWriter, r *http.Request, userID int64) {
+	user, err := h.authService.GetUserByID(userID)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		// The account was deleted after the request was authenticated
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "invalid_token", "the account this token belongs to no longer exists")
+		return
+	}
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiData{Data: apiMe{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	}})
+}
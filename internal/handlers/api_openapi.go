@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPI serves an OpenAPI 3 description of the API, generated from the
+// route table and the response types
+func (h *APIHandlers) openAPI(w http.ResponseWriter, r *http.Request, userID int64) {
+	writeJSON(w, http.StatusOK, h.openAPIDocument())
+}
+
+// openAPIDocument builds the OpenAPI document
+func (h *APIHandlers) openAPIDocument() map[string]any {
+	schemas := map[string]any{}
+	ref := func(v any) map[string]any {
+		return schemaFor(reflect.TypeOf(v), schemas)
+	}
+	pageRef := ref(apiPage{})
+	errorRef := ref(apiError{})
+
+	errorResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content":     map[string]any{"application/json": map[string]any{"schema": errorRef}},
+		}
+	}
+
+	paths := map[string]any{}
+	for _, route := range h.routes() {
+		op := map[string]any{
+			"summary":     route.summary,
+			"tags":        []string{route.tag},
+			"operationId": operationID(route),
+		}
+
+		var params []any
+		if strings.Contains(route.path, "{id}") {
+			params = append(params, map[string]any{
+				"name": "id", "in": "path", "required": true,
+				"schema": map[string]any{"type": "integer", "format": "int64"},
+			})
+		}
+		if route.list && route.path != "/categories" {
+			params = append(params,
+				queryParam("page", "Page number, starting at 1", map[string]any{"type": "integer", "minimum": 1, "default": 1}),
+				queryParam("per_page", "Items per page", map[string]any{"type": "integer", "minimum": 1, "maximum": apiMaxPerPage, "default": apiDefaultPerPage}),
+			)
+		}
+		if route.method == "GET" && route.path == "/posts" {
+			params = append(params,
+				queryParam("q", "Search titles and content", map[string]any{"type": "string"}),
+				queryParam("category", "Only posts in this category", map[string]any{"type": "string"}),
+				queryParam("author", "Only posts by this user id", map[string]any{"type": "integer", "format": "int64"}),
+				queryParam("order", "Sort order", map[string]any{"type": "string", "enum": []string{"newest", "oldest"}, "default": "newest"}),
+			)
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if route.body != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": ref(route.body)}},
+			}
+		}
+
+		responses := map[string]any{}
+		switch {
+		case route.path == "/openapi.json":
+			responses["200"] = map[string]any{
+				"description": "OpenAPI document",
+				"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}},
+			}
+		case route.response == nil:
+			responses["204"] = map[string]any{"description": "Deleted"}
+		default:
+			data := ref(route.response)
+			envelope := map[string]any{
+				"type":       "object",
+				"required":   []string{"data"},
+				"properties": map[string]any{"data": data},
+			}
+			if route.list {
+				envelope["required"] = []string{"data", "meta"}
+				envelope["properties"] = map[string]any{
+					"data": map[string]any{"type": "array", "items": data},
+					"meta": pageRef,
+				}
+			}
+			status, description := "200", "OK"
+			if route.method == "POST" {
+				status, description = "201", "Created"
+			}
+			responses[status] = map[string]any{
+				"description": description,
+				"content":     map[string]any{"application/json": map[string]any{"schema": envelope}},
+			}
+		}
+		if route.body != nil || route.list {
+			responses["400"] = errorResponse("Malformed request")
+		}
+		if route.body != nil {
+			responses["422"] = errorResponse("Invalid values")
+		}
+		if route.scope != "" {
+			responses["401"] = errorResponse("Missing or invalid credentials")
+			responses["403"] = errorResponse("Not allowed, or the token lacks the scope")
+			op["security"] = security(route)
+		} else {
+			op["security"] = []any{}
+		}
+		if strings.Contains(route.path, "{id}") {
+			responses["404"] = errorResponse("Not found")
+		}
+		op["responses"] = responses
+
+		path, _ := paths[route.path].(map[string]any)
+		if path == nil {
+			path = map[string]any{}
+			paths[route.path] = path
+		}
+		path[strings.ToLower(route.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Forum API",
+			"version":     "1.0.0",
+			"description": "JSON API of the forum. Authenticate with a personal API token from the account settings, sent as \"Authorization: Bearer <token>\". Browser sessions work too, but then state-changing requests need the X-CSRF-Token header.",
+		},
+		"servers": []any{map[string]any{"url": APIPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "Personal API token"},
+				"cookieAuth": map[string]any{"type": "apiKey", "in": "cookie", "name": "session_token"},
+			},
+		},
+	}
+}
+
+// security lists how a route may be authenticated; public routes also work anonymously
+func security(route apiRoute) []any {
+	requirements := []any{
+		map[string]any{"bearerAuth": []string{route.scope}},
+		map[string]any{"cookieAuth": []string{}},
+	}
+	if !route.auth {
+		requirements = append(requirements, map[string]any{})
+	}
+	return requirements
+}
+
+func queryParam(name, description string, schema map[string]any) map[string]any {
+	return map[string]any{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+// operationID names an operation after its method and path, e.g. getPostsIdComments
+func operationID(route apiRoute) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(route.method))
+	for _, part := range strings.FieldsFunc(route.path, func(r rune) bool { return r == '/' || r == '.' }) {
+		part = strings.Trim(part, "{}")
+		sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return sb.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the JSON schema of a Go type. Structs are added to schemas
+// under their name without the "api" prefix and referenced.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := map[string]any{}
+		for k, v := range schemaFor(t.Elem(), schemas) {
+			schema[k] = v
+		}
+		if _, isRef := schema["$ref"]; !isRef {
+			schema["nullable"] = true
+		}
+		return schema
+	case t.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() == reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case t.Kind() == reflect.Int:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "api")
+		if _, done := schemas[name]; !done {
+			schemas[name] = map[string]any{} // Placeholder against recursion
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes the JSON object of a struct from its json tags.
+// Fields that are neither pointers nor omitempty are always present.
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		schema := schemaFor(field.Type, schemas)
+		if enum := field.Tag.Get("enum"); enum != "" {
+			schema["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = schema
+
+		if field.Type.Kind() != reflect.Pointer && !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
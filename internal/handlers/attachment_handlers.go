@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+
+	"forum/internal/attachments"
+	"forum/internal/auth"
+)
+
+// attachmentMaxAge lets browsers keep files for a year: a file's URL is its
+// content hash, so the content behind a URL never changes
+const attachmentMaxAge = "public, max-age=31536000, immutable"
+
+// AttachmentHandlers serves uploaded files
+type AttachmentHandlers struct {
+	attachments  *attachments.Service
+	errorHandler *auth.HTTPErrorHandler
+}
+
+// NewAttachmentHandlers creates the attachment handlers
+func NewAttachmentHandlers(uploads *attachments.Service, templates *template.Template) *AttachmentHandlers {
+	errorLogger := log.New(os.Stdout, "[ATTACHMENT-ERROR] ", log.LstdFlags|log.Lshortfile)
+	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+
+	return &AttachmentHandlers{
+		attachments:  uploads,
+		errorHandler: errorHandler,
+	}
+}
+
+// FileHandler serves GET /attachments/{hash}/{name}. The name only sets the
+// download file name.
+func (h *AttachmentHandlers) FileHandler(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, r.PathValue("hash"), r.PathValue("name"), false)
+}
+
+// ThumbnailHandler serves GET /attachments/thumb/{hash}
+func (h *AttachmentHandlers) ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, r.PathValue("hash"), "", true)
+}
+
+func (h *AttachmentHandlers) serve(w http.ResponseWriter, r *http.Request, hash, name string, thumbnail bool) {
+	blob, info, err := h.attachments.Open(r.Context(), hash, thumbnail)
+	if err != nil {
+		if errors.Is(err, attachments.ErrNotFound) {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	defer blob.Close()
+
+	// Uploaded files must never run as part of the site: the type is the
+	// sniffed one, browsers may not guess another, and anything that is not
+	// a picture is downloaded rather than opened
+	header := w.Header()
+	header.Set("Content-Type", info.ContentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; sandbox")
+	header.Set("Cache-Control", attachmentMaxAge)
+	etag := hash
+	if thumbnail {
+		etag += "-thumb"
+	}
+	header.Set("ETag", `"`+etag+`"`)
+
+	disposition := "inline"
+	if !attachments.IsImageType(info.ContentType) {
+		disposition = "attachment"
+	}
+	params := map[string]string{}
+	if name != "" {
+		params["filename"] = name
+	}
+	if value := mime.FormatMediaType(disposition, params); value != "" {
+		header.Set("Content-Disposition", value)
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+
+	http.ServeContent(w, r, "", info.CreatedAt, blob)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"strings"
 
 	"forum/internal/auth"
+	"forum/internal/webauthn"
 )
 
 // AuthHandlers handles authentication-related HTTP requests
@@ -38,15 +40,17 @@ func (h *AuthHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		// Show registration form
 		data := struct {
-			Title    string
-			Error    string
-			Email    string
-			Username string
+			Title     string
+			CSRFToken string
+			Error     string
+			Email     string
+			Username  string
 		}{
-			Title:    "Register",
-			Error:    "",
-			Email:    "",
-			Username: "",
+			Title:     "Register",
+			CSRFToken: auth.CSRFToken(r),
+			Error:     "",
+			Email:     "",
+			Username:  "",
 		}
 
 		if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
@@ -77,15 +81,17 @@ func (h *AuthHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 		if errorMsg != "" {
 			data := struct {
-				Title    string
-				Error    string
-				Email    string
-				Username string
+				Title     string
+				CSRFToken string
+				Error     string
+				Email     string
+				Username  string
 			}{
-				Title:    "Register",
-				Error:    errorMsg,
-				Email:    email,
-				Username: username,
+				Title:     "Register",
+				CSRFToken: auth.CSRFToken(r),
+				Error:     errorMsg,
+				Email:     email,
+				Username:  username,
 			}
 
 			if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
@@ -98,15 +104,17 @@ func (h *AuthHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		err := h.authService.RegisterUser(email, username, password)
 		if err != nil {
 			data := struct {
-				Title    string
-				Error    string
-				Email    string
-				Username string
+				Title     string
+				CSRFToken string
+				Error     string
+				Email     string
+				Username  string
 			}{
-				Title:    "Register",
-				Error:    err.Error(),
-				Email:    email,
-				Username: username,
+				Title:     "Register",
+				CSRFToken: auth.CSRFToken(r),
+				Error:     err.Error(),
+				Email:     email,
+				Username:  username,
 			}
 
 			if err := h.templates.ExecuteTemplate(w, "register.html", data); err != nil {
@@ -130,18 +138,23 @@ func (h *AuthHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		// Show login form
 		data := struct {
 			Title      string
+			CSRFToken  string
 			Error      string
 			Success    string
 			Email      string
+			Remember   bool
 			Registered bool
+			Providers  []auth.OIDCProvider
 		}{
 			Title:      "Login",
+			CSRFToken:  auth.CSRFToken(r),
 			Email:      "",
 			Registered: r.URL.Query().Get("registered") == "true",
+			Providers:  h.authService.OIDCProviders(),
 		}
 
 		if data.Registered {
-			data.Success = "Registration successful! Please log in."
+			data.Success = "Registration successful! We sent you an email to verify your address. Please log in."
 		}
 
 		// Check for logout success message
@@ -149,6 +162,10 @@ func (h *AuthHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 			data.Success = "You have been successfully logged out."
 		}
 
+		if r.URL.Query().Get("reset") == "true" {
+			data.Success = "Your password has been changed. Please log in with your new password."
+		}
+
 		if err := h.templates.ExecuteTemplate(w, "login.html", data); err != nil {
 			h.errorHandler.Handle500(w, r, err)
 			return
@@ -163,6 +180,7 @@ func (h *AuthHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 		email := r.FormValue("email")
 		password := r.FormValue("password")
+		remember := r.FormValue("remember") == "on"
 
 		// Validate required fields with custom messages
 		var errorMsg string
@@ -173,60 +191,365 @@ func (h *AuthHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if errorMsg != "" {
-			data := struct {
-				Title   string
-				Error   string
-				Success string
-				Email   string
-			}{
-				Title:   "Login",
-				Error:   errorMsg,
-				Success: "",
-				Email:   email,
-			}
-
-			if err := h.templates.ExecuteTemplate(w, "login.html", data); err != nil {
-				h.errorHandler.Handle500(w, r, err)
-			}
+			h.renderLoginError(w, r, errorMsg, email, remember)
 			return
 		}
 
 		// Authenticate user
-		userID, err := h.authService.AuthenticateUser(email, password)
+		userID, err := h.authService.AuthenticateUser(email, password, auth.ClientIP(r))
 		if err != nil {
-			data := struct {
-				Title   string
-				Error   string
-				Success string
-				Email   string
-			}{
-				Title:   "Login",
-				Error:   err.Error(),
-				Success: "", // Empty success message for error case
-				Email:   email,
-			}
+			h.renderLoginError(w, r, err.Error(), email, remember)
+			return
+		}
 
-			if err := h.templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		// Accounts with two-factor authentication need a code before getting a session
+		twoFactor, err := h.authService.TwoFactorEnabled(userID)
+		if err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+		if twoFactor {
+			challenge, err := h.authService.CreateLoginChallenge(userID, remember)
+			if err != nil {
+				if errors.Is(err, auth.ErrLoginThrottled) {
+					h.renderLoginError(w, r, err.Error(), email, remember)
+					return
+				}
 				h.errorHandler.Handle500(w, r, err)
+				return
 			}
+			auth.SetLoginChallengeCookie(w, challenge)
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
 			return
 		}
 
-		// Create session
-		sessionToken, err := h.sessionService.CreateSession(userID)
+		h.startSession(w, r, userID, remember)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startSession logs the user in and sends them to the home page
+func (h *AuthHandlers) startSession(w http.ResponseWriter, r *http.Request, userID int64, remember bool) {
+	if err := h.issueSession(w, r, userID, remember); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	// Redirect to home page
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// issueSession creates a session for the user and sets its cookie
+func (h *AuthHandlers) issueSession(w http.ResponseWriter, r *http.Request, userID int64, remember bool) error {
+	// Never carry a previous session over a login; always issue a fresh token
+	if cookie, err := r.Cookie("session_token"); err == nil {
+		h.sessionService.DeleteSession(cookie.Value)
+	}
+
+	// Create session
+	sessionToken, err := h.sessionService.CreateSession(userID, r, remember)
+	if err != nil {
+		return err
+	}
+
+	// Set session cookie
+	h.sessionService.SetSessionCookie(w, sessionToken, remember)
+	return nil
+}
+
+// renderLoginError shows the login form with an error
+func (h *AuthHandlers) renderLoginError(w http.ResponseWriter, r *http.Request, errorMsg, email string, remember bool) {
+	data := struct {
+		Title     string
+		CSRFToken string
+		Error     string
+		Success   string
+		Email     string
+		Remember  bool
+		Providers []auth.OIDCProvider
+	}{
+		Title:     "Login",
+		CSRFToken: auth.CSRFToken(r),
+		Error:     errorMsg,
+		Email:     email,
+		Remember:  remember,
+		Providers: h.authService.OIDCProviders(),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// LoginTwoFactorHandler handles the second login step for accounts with 2FA
+func (h *AuthHandlers) LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	challenge := auth.LoginChallengeToken(r)
+	if err := h.authService.ValidateLoginChallenge(challenge); err != nil {
+		auth.ClearLoginChallengeCookie(w)
+		h.renderLoginError(w, r, err.Error(), "", false)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		Error     string
+	}{
+		Title:     "Two-Factor Authentication",
+		CSRFToken: auth.CSRFToken(r),
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Show the code form
+
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			h.errorHandler.Handle400(w, r, "Invalid form data")
+			return
+		}
+
+		userID, remember, err := h.authService.CompleteLoginChallenge(challenge, r.FormValue("code"))
+		switch {
+		case err == nil:
+			auth.ClearLoginChallengeCookie(w)
+			h.startSession(w, r, userID, remember)
+			return
+		case errors.Is(err, auth.ErrInvalidTwoFactorCode):
+			data.Error = err.Error()
+		case errors.Is(err, auth.ErrLoginChallengeInvalid), errors.Is(err, auth.ErrLoginThrottled):
+			auth.ClearLoginChallengeCookie(w)
+			h.renderLoginError(w, r, err.Error(), "", false)
+			return
+		default:
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "login_2fa.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// PasskeyLoginBeginHandler starts a passkey sign-in and returns the options
+// for navigator.credentials.get()
+func (h *AuthHandlers) PasskeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, options, err := h.authService.BeginPasskeyLogin()
+	if err != nil {
+		log.Printf("Failed to start passkey login: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Something went wrong, please try again")
+		return
+	}
+
+	auth.SetPasskeyCeremonyCookie(w, token)
+	writeJSON(w, http.StatusOK, options)
+}
+
+// PasskeyLoginFinishHandler verifies the passkey assertion and logs the user in
+func (h *AuthHandlers) PasskeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		webauthn.Assertion
+		Remember bool `json:"remember"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid passkey response")
+		return
+	}
+
+	userID, err := h.authService.FinishPasskeyLogin(auth.PasskeyCeremonyToken(r), req.Assertion)
+	auth.ClearPasskeyCeremonyCookie(w)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.issueSession(w, r, userID, req.Remember); err != nil {
+		log.Printf("Failed to create session: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Something went wrong, please try again")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/"})
+}
+
+// OIDCLoginHandler sends the user to an OpenID Connect provider to log in
+func (h *AuthHandlers) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, authURL, err := h.authService.BeginOIDCLogin(r.Context(), r.URL.Query().Get("provider"))
+	if err != nil {
+		h.renderLoginError(w, r, err.Error(), "", false)
+		return
+	}
+
+	auth.SetOAuthStateCookie(w, state)
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+// OIDCCallbackHandler handles the provider's redirect back after logging in
+func (h *AuthHandlers) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	browserState := auth.OAuthStateToken(r)
+	auth.ClearOAuthStateCookie(w)
+
+	// The user cancelled or the provider refused the login
+	if query.Get("error") != "" {
+		h.renderLoginError(w, r, "Login was cancelled.", "", false)
+		return
+	}
+
+	result, err := h.authService.FinishOIDCLogin(r.Context(), browserState, query.Get("state"), query.Get("code"))
+	if err != nil {
+		h.renderLoginError(w, r, err.Error(), "", false)
+		return
+	}
+
+	// A logged in user confirmed it is them: back to the settings they came from
+	if result.Reauthenticated {
+		if userID, ok := h.sessionService.GetCurrentUserID(r); !ok || userID != result.UserID {
+			h.renderLoginError(w, r, "Your session has ended, please log in again.", "", false)
+			return
+		}
+		if err := h.sessionService.MarkReauthenticated(r); err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+		http.Redirect(w, r, result.ReturnTo, http.StatusSeeOther)
+		return
+	}
+
+	// First login with this account: pick a username before continuing
+	if result.SignupToken != "" {
+		auth.SetOAuthSignupCookie(w, result.SignupToken)
+		http.Redirect(w, r, "/login/oidc/username", http.StatusSeeOther)
+		return
+	}
+
+	// The provider does not replace the forum's own second factor
+	twoFactor, err := h.authService.TwoFactorEnabled(result.UserID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	if twoFactor {
+		challenge, err := h.authService.CreateLoginChallenge(result.UserID, false)
 		if err != nil {
+			if errors.Is(err, auth.ErrLoginThrottled) {
+				h.renderLoginError(w, r, err.Error(), "", false)
+				return
+			}
 			h.errorHandler.Handle500(w, r, err)
 			return
 		}
+		auth.SetLoginChallengeCookie(w, challenge)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
 
-		// Set session cookie
-		h.sessionService.SetSessionCookie(w, sessionToken)
+	h.startSession(w, r, result.UserID, false)
+}
 
-		// Redirect to home page
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// OIDCUsernameHandler lets a user logging in with a provider for the first
+// time choose a username and creates their account
+func (h *AuthHandlers) OIDCUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	token := auth.OAuthSignupToken(r)
+	signup, err := h.authService.PendingOIDCSignup(token)
+	if err != nil {
+		auth.ClearOAuthSignupCookie(w)
+		h.renderLoginError(w, r, err.Error(), "", false)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		Error     string
+		Provider  string
+		Email     string
+		Username  string
+	}{
+		Title:     "Choose a Username",
+		CSRFToken: auth.CSRFToken(r),
+		Provider:  signup.Provider,
+		Email:     signup.Email,
+		Username:  signup.SuggestedUsername,
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Show the username form
+
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			h.errorHandler.Handle400(w, r, "Invalid form data")
+			return
+		}
+
+		data.Username = r.FormValue("username")
+		userID, err := h.authService.CompleteOIDCSignup(token, data.Username)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+
+		auth.ClearOAuthSignupCookie(w)
+		h.startSession(w, r, userID, false)
+		return
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "login_oidc_username.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// SingleSignOnHandler replaces the login, registration and password reset
+// pages when a reverse proxy handles authentication
+func (h *AuthHandlers) SingleSignOnHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.GetUserFromContext(r); ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+	}{
+		Title:     "Login",
+		CSRFToken: auth.CSRFToken(r),
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := h.templates.ExecuteTemplate(w, "login_proxy.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
 	}
 }
 
@@ -250,3 +573,164 @@ func (h *AuthHandlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Redirect to login page with success message
 	http.Redirect(w, r, "/login?logout=success", http.StatusSeeOther)
 }
+
+// ForgotPasswordHandler handles both GET (show form) and POST (send reset link)
+func (h *AuthHandlers) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Title     string
+		CSRFToken string
+		Error     string
+		Success   string
+		Email     string
+	}{
+		Title:     "Forgot Password",
+		CSRFToken: auth.CSRFToken(r),
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Show the form
+
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			h.errorHandler.Handle400(w, r, "Invalid form data")
+			return
+		}
+
+		data.Email = r.FormValue("email")
+		if strings.TrimSpace(data.Email) == "" {
+			data.Error = "Email is required"
+			break
+		}
+
+		if err := h.authService.RequestPasswordReset(data.Email); err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+
+		// Same answer whether or not the email is registered
+		data.Success = "If an account exists for that email, we have sent it a link to reset the password."
+		data.Email = ""
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "forgot_password.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// ResetPasswordHandler handles both GET (show form) and POST (set new password)
+func (h *AuthHandlers) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Title     string
+		CSRFToken string
+		Error     string
+		Token     string
+		Invalid   bool
+	}{
+		Title:     "Reset Password",
+		CSRFToken: auth.CSRFToken(r),
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data.Token = r.URL.Query().Get("token")
+		if err := h.authService.ValidatePasswordResetToken(data.Token); err != nil {
+			data.Error = err.Error()
+			data.Invalid = true
+		}
+
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			h.errorHandler.Handle400(w, r, "Invalid form data")
+			return
+		}
+
+		data.Token = r.FormValue("token")
+		password := r.FormValue("password")
+
+		if password != r.FormValue("confirm_password") {
+			data.Error = "Passwords do not match"
+			break
+		}
+
+		if err := h.authService.ResetPassword(data.Token, password); err != nil {
+			data.Error = err.Error()
+			data.Invalid = h.authService.ValidatePasswordResetToken(data.Token) != nil
+			break
+		}
+
+		// All sessions were revoked, including this browser's
+		h.sessionService.ClearSessionCookie(w)
+		http.Redirect(w, r, "/login?reset=true", http.StatusSeeOther)
+		return
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "reset_password.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// renderVerifyEmail shows the result of an email verification action
+func (h *AuthHandlers) renderVerifyEmail(w http.ResponseWriter, r *http.Request, success, errorMsg string) {
+	var currentUser *auth.User
+	if userID, ok := auth.GetUserFromContext(r); ok {
+		currentUser, _ = h.authService.GetUserByID(userID)
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		User      *auth.User
+		Success   string
+		Error     string
+	}{
+		Title:     "Email Verification",
+		CSRFToken: auth.CSRFToken(r),
+		User:      currentUser,
+		Success:   success,
+		Error:     errorMsg,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "verify_email.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// VerifyEmailHandler verifies an email address from an emailed link
+func (h *AuthHandlers) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.authService.VerifyEmail(r.URL.Query().Get("token")); err != nil {
+		h.renderVerifyEmail(w, r, "", err.Error())
+		return
+	}
+
+	h.renderVerifyEmail(w, r, "Your email address has been verified. Thank you!", "")
+}
+
+// ResendVerificationHandler sends the logged-in user a new verification link
+func (h *AuthHandlers) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	if err := h.authService.ResendVerification(userID); err != nil {
+		h.renderVerifyEmail(w, r, "", err.Error())
+		return
+	}
+
+	h.renderVerifyEmail(w, r, "We sent you a new verification link. Please check your inbox.", "")
+}
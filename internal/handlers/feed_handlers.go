@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"forum/internal/auth"
+	"forum/internal/feeds"
+)
+
+// feedMaxAge is how long feed readers and proxies may cache a feed
+const feedMaxAge = "max-age=300"
+
+// FeedHandlers serves Atom and RSS feeds
+type FeedHandlers struct {
+	feeds        *feeds.Service
+	errorHandler *auth.HTTPErrorHandler
+}
+
+// NewFeedHandlers creates the feed handlers
+func NewFeedHandlers(feedService *feeds.Service, templates *template.Template) *FeedHandlers {
+	errorLogger := log.New(os.Stdout, "[FEED-ERROR] ", log.LstdFlags|log.Lshortfile)
+	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+
+	return &FeedHandlers{
+		feeds:        feedService,
+		errorHandler: errorHandler,
+	}
+}
+
+// AtomHandler serves a feed as Atom
+func (h *FeedHandlers) AtomHandler(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, feeds.AtomType, h.feeds.Atom)
+}
+
+// RSSHandler serves a feed as RSS
+func (h *FeedHandlers) RSSHandler(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, feeds.RSSType, h.feeds.RSS)
+}
+
+// serve picks the feed from the category, author or post query parameter and
+// answers conditional requests with 304 Not Modified
+func (h *FeedHandlers) serve(w http.ResponseWriter, r *http.Request, contentType string, encode func(*feeds.Feed) ([]byte, error)) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var feed *feeds.Feed
+	var err error
+	switch {
+	case query.Has("category"):
+		feed, err = h.feeds.Category(r.Context(), query.Get("category"))
+	case query.Has("author"):
+		userID, parseErr := strconv.ParseInt(query.Get("author"), 10, 64)
+		if parseErr != nil {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		feed, err = h.feeds.Author(r.Context(), userID)
+	case query.Has("post"):
+		postID, parseErr := strconv.ParseInt(query.Get("post"), 10, 64)
+		if parseErr != nil {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		feed, err = h.feeds.Comments(r.Context(), postID)
+	default:
+		feed, err = h.feeds.Site(r.Context())
+	}
+	if err != nil {
+		if errors.Is(err, feeds.ErrNotFound) {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	body, err := encode(feed)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	// The ETag also catches deletions and edits that leave the newest
+	// timestamp unchanged, which Last-Modified alone would miss
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Cache-Control", feedMaxAge)
+	http.ServeContent(w, r, "", feed.Updated, bytes.NewReader(body))
+}
@@ -7,6 +7,7 @@ import (
 
 	"forum/internal/auth"
 	"forum/internal/features"
+	"forum/internal/feeds"
 )
 
 type FilterHandlers struct {
@@ -54,17 +55,21 @@ func (h *FilterHandlers) MyPostsHandler(w http.ResponseWriter, r *http.Request)
 
 	data := struct {
 		Title      string
+		CSRFToken  string
 		User       *auth.User
 		Posts      []features.PostWithDetails
 		Categories []features.Category
 		Filter     string
+		Feeds      []feeds.Link
 		Success    string
 	}{
 		Title:      "My Posts",
+		CSRFToken:  auth.CSRFToken(r),
 		User:       currentUser,
 		Posts:      posts,
 		Categories: categories,
 		Filter:     "my-posts",
+		Feeds:      feeds.AuthorLinks(currentUser.ID, currentUser.Username),
 		Success:    "",
 	}
 
@@ -105,17 +110,21 @@ func (h *FilterHandlers) LikedPostsHandler(w http.ResponseWriter, r *http.Reques
 
 	data := struct {
 		Title      string
+		CSRFToken  string
 		User       *auth.User
 		Posts      []features.PostWithDetails
 		Categories []features.Category
 		Filter     string
+		Feeds      []feeds.Link
 		Success    string
 	}{
 		Title:      "Liked Posts",
+		CSRFToken:  auth.CSRFToken(r),
 		User:       currentUser,
 		Posts:      posts,
 		Categories: categories,
 		Filter:     "liked-posts",
+		Feeds:      feeds.SiteLinks(),
 		Success:    "",
 	}
 
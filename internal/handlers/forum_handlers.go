@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
@@ -10,8 +11,13 @@ import (
 	"strconv"
 	"strings"
 
+	"forum/internal/attachments"
 	"forum/internal/auth"
+	"forum/internal/events"
 	"forum/internal/features"
+	"forum/internal/feeds"
+	"forum/internal/markdown"
+	"forum/internal/webhooks"
 )
 
 type ForumHandlers struct {
@@ -20,9 +26,13 @@ type ForumHandlers struct {
 	sessionService *auth.SessionService
 	templates      *template.Template
 	errorHandler   *auth.HTTPErrorHandler
+	live           livePublisher
+	notify         notifier
+	webhooks       *webhooks.Service
+	attachments    *attachments.Service
 }
 
-func NewForumHandlers(db *sql.DB, authService *auth.AuthService, sessionService *auth.SessionService, templates *template.Template) *ForumHandlers {
+func NewForumHandlers(db *sql.DB, authService *auth.AuthService, sessionService *auth.SessionService, templates *template.Template, broker *events.Broker, hooks *webhooks.Service, uploads *attachments.Service) *ForumHandlers {
 	// Create error handler
 	errorLogger := log.New(os.Stdout, "[FORUM-ERROR] ", log.LstdFlags|log.Lshortfile)
 	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
@@ -33,6 +43,10 @@ func NewForumHandlers(db *sql.DB, authService *auth.AuthService, sessionService
 		sessionService: sessionService,
 		templates:      templates,
 		errorHandler:   errorHandler,
+		live:           livePublisher{db: db, broker: broker},
+		notify:         notifier{db: db},
+		webhooks:       hooks,
+		attachments:    uploads,
 	}
 }
 
@@ -41,14 +55,14 @@ func addAnchorToURL(baseURL, anchor string) string {
 	if anchor == "" {
 		return baseURL
 	}
-	
+
 	// Parse the URL to handle existing query parameters
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		// If parsing fails, just append the anchor
 		return baseURL + "#" + anchor
 	}
-	
+
 	u.Fragment = anchor
 	return u.String()
 }
@@ -91,23 +105,33 @@ func (h *ForumHandlers) HomeHandler(w http.ResponseWriter, r *http.Request) {
 
 	data := struct {
 		Title      string
+		CSRFToken  string
 		User       *auth.User
 		Posts      []features.PostWithDetails
 		Categories []features.Category
 		Filter     string
+		Feeds      []feeds.Link
 		Success    string
 	}{
 		Title:      "Forum",
+		CSRFToken:  auth.CSRFToken(r),
 		User:       currentUser,
 		Posts:      posts,
 		Categories: categories,
 		Filter:     category,
+		Feeds:      feeds.SiteLinks(),
+	}
+	if category != "" {
+		data.Feeds = feeds.CategoryLinks(category)
 	}
 
 	// Check for success messages
 	if r.URL.Query().Get("deleted") == "true" {
 		data.Success = "Post deleted successfully."
 	}
+	if r.URL.Query().Get("account_deleted") == "true" {
+		data.Success = "Your account has been deleted."
+	}
 
 	if err := h.templates.ExecuteTemplate(w, "index.html", data); err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
@@ -115,6 +139,16 @@ func (h *ForumHandlers) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleUnverified responds to an action the user may not perform until their
+// email address is verified
+func (h *ForumHandlers) handleUnverified(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, auth.ErrEmailNotVerified) {
+		h.errorHandler.Handle403(w, r, "Please verify your email address first. You can ask for a new verification link on the home page.")
+		return
+	}
+	h.errorHandler.Handle500(w, r, err)
+}
+
 // CreatePostPageHandler shows the create post form
 func (h *ForumHandlers) CreatePostPageHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := auth.GetUserFromContext(r)
@@ -130,37 +164,16 @@ func (h *ForumHandlers) CreatePostPageHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	if r.Method == http.MethodGet {
-		// Get existing categories
-		categories, err := features.GetAllCategories(r.Context(), h.db)
-		if err != nil {
-			categories = []features.Category{} // Empty if error
-		}
-
-		data := struct {
-			Title              string
-			User               *auth.User
-			Error              string
-			PostTitle          string
-			PostContent        string
-			Categories         string
-			ExistingCategories []features.Category
-		}{
-			Title:              "Create Post",
-			User:               currentUser,
-			Error:              "",
-			PostTitle:          "",
-			PostContent:        "",
-			Categories:         "",
-			ExistingCategories: categories,
-		}
-
-		if err := h.templates.ExecuteTemplate(w, "create_post.html", data); err != nil {
-			http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
-		}
+		h.renderCreatePost(w, r, currentUser, "", "", "", "")
 		return
 	}
 
 	if r.Method == http.MethodPost {
+		if err := h.authService.CheckVerified(userID, auth.ActionPost); err != nil {
+			h.handleUnverified(w, r, err)
+			return
+		}
+
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
@@ -207,64 +220,44 @@ func (h *ForumHandlers) CreatePostPageHandler(w http.ResponseWriter, r *http.Req
 			errorMsg = "Post content is required"
 		}
 
-		if errorMsg != "" {
-			// Get existing categories for the error response
-			existingCategories, _ := features.GetAllCategories(r.Context(), h.db)
-
-			data := struct {
-				Title              string
-				User               *auth.User
-				Error              string
-				PostTitle          string
-				PostContent        string
-				Categories         string
-				ExistingCategories []features.Category
-			}{
-				Title:              "Create Post",
-				User:               currentUser,
-				Error:              errorMsg,
-				PostTitle:          title,
-				PostContent:        content,
-				Categories:         categoriesStr,
-				ExistingCategories: existingCategories,
+		// Check the attached files before creating anything
+		var uploads []*attachments.Upload
+		if errorMsg == "" {
+			var err error
+			if uploads, err = h.attachments.FromRequest(r, "attachments"); err != nil {
+				errorMsg = "Could not attach " + err.Error()
 			}
+		}
 
-			if err := h.templates.ExecuteTemplate(w, "create_post.html", data); err != nil {
-				http.Error(w, "Template error", http.StatusInternalServerError)
-			}
+		if errorMsg != "" {
+			h.renderCreatePost(w, r, currentUser, errorMsg, title, content, categoriesStr)
 			return
 		}
 
+		// Files referenced as attachment:name in the text are shown inline
+		body := attachments.Embed(content, uploads)
+
 		// Create post
-		postID, err := features.CreatePost(r.Context(), h.db, userID, title, content, categories)
+		postID, err := features.CreatePost(r.Context(), h.db, userID, title, body, categories)
 		if err != nil {
-			// Get existing categories for the error response
-			existingCategories, _ := features.GetAllCategories(r.Context(), h.db)
-
-			data := struct {
-				Title              string
-				User               *auth.User
-				Error              string
-				PostTitle          string
-				PostContent        string
-				Categories         string
-				ExistingCategories []features.Category
-			}{
-				Title:              "Create Post",
-				User:               currentUser,
-				Error:              "Failed to create post: " + err.Error(),
-				PostTitle:          title,
-				PostContent:        content,
-				Categories:         categoriesStr,
-				ExistingCategories: existingCategories,
-			}
-
-			if err := h.templates.ExecuteTemplate(w, "create_post.html", data); err != nil {
-				http.Error(w, "Template error", http.StatusInternalServerError)
+			h.renderCreatePost(w, r, currentUser, "Failed to create post: "+err.Error(), title, content, categoriesStr)
+			return
+		}
+		if err := h.attachments.Save(r.Context(), uploads, userID, postID, 0); err != nil {
+			// A post without the files it refers to is not what was asked for
+			log.Printf("Failed to save attachments of post %d: %v", postID, err)
+			if err := features.DeletePost(r.Context(), h.db, postID, userID); err != nil {
+				log.Printf("Failed to remove post %d: %v", postID, err)
 			}
+			h.attachments.CleanupAfterDelete(r.Context())
+			h.renderCreatePost(w, r, currentUser, "Failed to save the attached files, please try again", title, content, categoriesStr)
 			return
 		}
 
+		h.live.postCreated(r.Context(), postID)
+		h.notify.postCreated(r.Context(), postID)
+		h.webhooks.PostCreated(r.Context(), postID)
+
 		// Redirect to the new post
 		http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
 		return
@@ -273,6 +266,39 @@ func (h *ForumHandlers) CreatePostPageHandler(w http.ResponseWriter, r *http.Req
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
+// renderCreatePost shows the create post form, keeping what was entered
+func (h *ForumHandlers) renderCreatePost(w http.ResponseWriter, r *http.Request, user *auth.User, errorMsg, title, content, categories string) {
+	existingCategories, _ := features.GetAllCategories(r.Context(), h.db)
+
+	data := struct {
+		Title              string
+		CSRFToken          string
+		User               *auth.User
+		Error              string
+		PostTitle          string
+		PostContent        string
+		Categories         string
+		ExistingCategories []features.Category
+		MaxFiles           int
+		MaxFileMB          int64
+	}{
+		Title:              "Create Post",
+		CSRFToken:          auth.CSRFToken(r),
+		User:               user,
+		Error:              errorMsg,
+		PostTitle:          title,
+		PostContent:        content,
+		Categories:         categories,
+		ExistingCategories: existingCategories,
+		MaxFiles:           h.attachments.MaxFiles(),
+		MaxFileMB:          h.attachments.MaxSize() >> 20,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "create_post.html", data); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+	}
+}
+
 // PostDetailHandler shows a single post with comments
 func (h *ForumHandlers) PostDetailHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract post ID from URL path /post/123
@@ -308,18 +334,60 @@ func (h *ForumHandlers) PostDetailHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	postFiles, err := h.attachments.ListForPost(r.Context(), postID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	commentFiles, err := h.attachments.ListForComments(r.Context(), postID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	// Files shown inline in the text are not listed again below it
+	postFiles = attachments.NotEmbedded(postFiles, post.Content)
+	for _, comment := range comments {
+		commentFiles[comment.ID] = attachments.NotEmbedded(commentFiles[comment.ID], comment.Content)
+	}
+
+	// Seeing the post counts as reading its notifications
+	var watching bool
+	if currentUser != nil {
+		if err := features.MarkPostNotificationsRead(r.Context(), h.db, currentUserID, postID); err != nil {
+			log.Printf("Failed to mark notifications read: %v", err)
+		}
+		if watching, err = features.IsWatchingPost(r.Context(), h.db, currentUserID, postID); err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+	}
+
 	data := struct {
 		Title        string
+		CSRFToken    string
 		User         *auth.User
 		Post         *features.PostWithDetails
 		Comments     []features.CommentWithDetails
+		Attachments  []attachments.Attachment
+		CommentFiles map[int64][]attachments.Attachment
+		MaxFiles     int
+		MaxFileMB    int64
+		Watching     bool
+		Feeds        []feeds.Link
 		Success      string
 		CommentError string
 	}{
 		Title:        post.Title,
+		CSRFToken:    auth.CSRFToken(r),
 		User:         currentUser,
 		Post:         post,
 		Comments:     comments,
+		Attachments:  postFiles,
+		CommentFiles: commentFiles,
+		MaxFiles:     h.attachments.MaxFiles(),
+		MaxFileMB:    h.attachments.MaxSize() >> 20,
+		Watching:     watching,
+		Feeds:        feeds.CommentLinks(post.ID, post.Title),
 		Success:      r.URL.Query().Get("success"),
 		CommentError: r.URL.Query().Get("comment_error"),
 	}
@@ -343,6 +411,11 @@ func (h *ForumHandlers) LikePostHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if err := h.authService.CheckVerified(userID, auth.ActionReact); err != nil {
+		h.handleUnverified(w, r, err)
+		return
+	}
+
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -369,6 +442,20 @@ func (h *ForumHandlers) LikePostHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Failed to update reaction", http.StatusInternalServerError)
 		return
 	}
+	h.live.postCountsChanged(r.Context(), postID)
+	h.notify.postReacted(r.Context(), userID, postID, reaction)
+	h.webhooks.PostReactionChanged(r.Context(), userID, postID)
+
+	// The page's script updates the buttons in place instead of reloading
+	if wantsJSON(r) {
+		post, err := features.GetPostWithDetails(r.Context(), h.db, postID, userID)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "Post not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, reactionState(post.LikesCount, post.DislikesCount, post.UserLiked, post.UserDisliked))
+		return
+	}
 
 	// Get anchor for scroll position
 	anchor := r.FormValue("anchor")
@@ -378,7 +465,7 @@ func (h *ForumHandlers) LikePostHandler(w http.ResponseWriter, r *http.Request)
 	if referer == "" {
 		referer = "/post/" + strconv.FormatInt(postID, 10)
 	}
-	
+
 	// Add anchor using helper function
 	redirectURL := addAnchorToURL(referer, anchor)
 	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
@@ -397,6 +484,11 @@ func (h *ForumHandlers) LikeCommentHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if err := h.authService.CheckVerified(userID, auth.ActionReact); err != nil {
+		h.handleUnverified(w, r, err)
+		return
+	}
+
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -425,6 +517,19 @@ func (h *ForumHandlers) LikeCommentHandler(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "Failed to update reaction", http.StatusInternalServerError)
 		return
 	}
+	h.live.commentCountsChanged(r.Context(), commentID)
+	h.notify.commentReacted(r.Context(), userID, commentID, reaction)
+	h.webhooks.CommentReactionChanged(r.Context(), userID, commentID)
+
+	if wantsJSON(r) {
+		comment, err := features.GetCommentWithDetails(r.Context(), h.db, commentID, userID)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "Comment not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, reactionState(comment.LikesCount, comment.DislikesCount, comment.UserLiked, comment.UserDisliked))
+		return
+	}
 
 	// Get anchor for scroll position
 	anchor := r.FormValue("anchor")
@@ -448,6 +553,11 @@ func (h *ForumHandlers) AddCommentHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if err := h.authService.CheckVerified(userID, auth.ActionComment); err != nil {
+		h.handleUnverified(w, r, err)
+		return
+	}
+
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -466,18 +576,78 @@ func (h *ForumHandlers) AddCommentHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	uploads, err := h.attachments.FromRequest(r, "attachments")
+	if err != nil {
+		message := url.QueryEscape("Could not attach " + err.Error())
+		http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10)+"?comment_error="+message+"#comments-section", http.StatusSeeOther)
+		return
+	}
+
 	// Create the comment
-	commentID, err := features.CreateComment(r.Context(), h.db, postID, userID, content)
+	commentID, err := features.CreateComment(r.Context(), h.db, postID, userID, attachments.Embed(content, uploads))
 	if err != nil {
 		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
 		return
 	}
+	if err := h.attachments.Save(r.Context(), uploads, userID, postID, commentID); err != nil {
+		log.Printf("Failed to save attachments of comment %d: %v", commentID, err)
+		if err := features.DeleteComment(r.Context(), h.db, commentID, userID); err != nil {
+			log.Printf("Failed to remove comment %d: %v", commentID, err)
+		}
+		h.attachments.CleanupAfterDelete(r.Context())
+		http.Error(w, "Failed to save the attached files", http.StatusInternalServerError)
+		return
+	}
+	h.live.commentCreated(r.Context(), commentID)
+	h.notify.commentCreated(r.Context(), commentID)
+	h.webhooks.CommentCreated(r.Context(), commentID)
 
 	// Redirect back to the post with anchor to the new comment
 	redirectURL := "/post/" + strconv.FormatInt(postID, 10) + "#comment-" + strconv.FormatInt(commentID, 10)
 	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 }
 
+// WatchPostHandler follows or unfollows a post's new comments
+func (h *ForumHandlers) WatchPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := auth.GetUserFromContext(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := features.GetPostByID(r.Context(), h.db, postID); err != nil {
+		h.errorHandler.Handle404(w, r)
+		return
+	}
+
+	if r.FormValue("action") == "unwatch" {
+		err = features.UnwatchPost(r.Context(), h.db, userID, postID)
+	} else {
+		err = features.WatchPost(r.Context(), h.db, userID, postID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to update following", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+}
+
 // DeletePostHandler handles post deletion requests
 func (h *ForumHandlers) DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -508,6 +678,9 @@ func (h *ForumHandlers) DeletePostHandler(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Failed to delete post: "+err.Error(), http.StatusForbidden)
 		return
 	}
+	h.live.postDeleted(postID)
+	h.webhooks.PostDeleted(r.Context(), postID, userID)
+	h.attachments.CleanupAfterDelete(r.Context())
 
 	// Redirect to home page with success message
 	http.Redirect(w, r, "/?deleted=true", http.StatusSeeOther)
@@ -544,13 +717,37 @@ func (h *ForumHandlers) DeleteCommentHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Delete the comment
-	err = features.DeleteComment(r.Context(), h.db, commentID, userID)
+	comment, err := features.GetCommentByID(r.Context(), h.db, commentID)
+	if err == nil {
+		err = features.DeleteComment(r.Context(), h.db, commentID, userID)
+	}
 	if err != nil {
 		http.Error(w, "Failed to delete comment: "+err.Error(), http.StatusForbidden)
 		return
 	}
+	h.live.commentDeleted(r.Context(), comment.PostID, commentID)
+	h.attachments.CleanupAfterDelete(r.Context())
 
 	// Redirect back to the post's comments section
 	redirectURL := "/post/" + strconv.FormatInt(postID, 10) + "?comment_deleted=true#comments-section"
 	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 }
+
+// maxPreviewLength limits how much Markdown a preview renders
+const maxPreviewLength = 64 << 10
+
+// PreviewHandler renders the submitted content as Markdown for the live
+// preview on the post form. It answers with {"html": ...}.
+func (h *ForumHandlers) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	content := r.FormValue("content")
+	if len(content) > maxPreviewLength {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "This post is too long to preview")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"html": string(markdown.Render(content))})
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum/internal/auth"
+	"forum/internal/events"
+	"forum/internal/webhooks"
+)
+
+// maxIncomingBody caps the size of a message posted to an incoming webhook
+const maxIncomingBody = 256 << 10
+
+// IncomingWebhookHandlers turns messages from external systems into posts and
+// comments by the bot account of an incoming webhook
+type IncomingWebhookHandlers struct {
+	incoming *webhooks.IncomingService
+	live     livePublisher
+	notify   notifier
+	webhooks *webhooks.Service
+}
+
+// NewIncomingWebhookHandlers creates the incoming webhook handlers
+func NewIncomingWebhookHandlers(db *sql.DB, incoming *webhooks.IncomingService, broker *events.Broker, hooks *webhooks.Service) *IncomingWebhookHandlers {
+	return &IncomingWebhookHandlers{
+		incoming: incoming,
+		live:     livePublisher{db: db, broker: broker},
+		notify:   notifier{db: db},
+		webhooks: hooks,
+	}
+}
+
+// ReceiveHandler accepts a message for an incoming webhook. The hook's token
+// comes in an "Authorization: Bearer" header or, for senders that can only be
+// given a URL, in the token query parameter.
+func (h *IncomingWebhookHandlers) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeIncomingError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	token := auth.BearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	hook, err := h.incoming.Authenticate(r.Context(), token)
+	if err != nil {
+		switch {
+		case errors.Is(err, webhooks.ErrInvalidIncomingToken):
+			writeIncomingError(w, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, webhooks.ErrIncomingPaused):
+			writeIncomingError(w, http.StatusForbidden, err.Error())
+		default:
+			log.Printf("Incoming webhook authentication failed: %v", err)
+			writeIncomingError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		return
+	}
+
+	if ok, wait := h.incoming.Allow(hook); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		writeIncomingError(w, http.StatusTooManyRequests, "rate limit of "+strconv.Itoa(hook.RateLimit)+" requests per hour exceeded")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIncomingBody))
+	if err != nil {
+		writeIncomingError(w, http.StatusRequestEntityTooLarge, "message too large")
+		return
+	}
+	msg, err := webhooks.ParseIncomingMessage(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		writeIncomingError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := h.incoming.Publish(r.Context(), hook, msg)
+	if err != nil {
+		if errors.Is(err, webhooks.ErrInvalidMessage) {
+			writeIncomingError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Incoming webhook %d failed: %v", hook.ID, err)
+		writeIncomingError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	if result.CommentID != 0 {
+		h.live.commentCreated(r.Context(), result.CommentID)
+		h.notify.commentCreated(r.Context(), result.CommentID)
+		h.webhooks.CommentCreated(r.Context(), result.CommentID)
+	} else {
+		h.live.postCreated(r.Context(), result.PostID)
+		h.notify.postCreated(r.Context(), result.PostID)
+		h.webhooks.PostCreated(r.Context(), result.PostID)
+	}
+
+	response := map[string]any{"ok": true, "post_id": result.PostID, "url": result.URL}
+	if result.CommentID != 0 {
+		response["comment_id"] = result.CommentID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// writeIncomingError answers in the shape Slack-compatible senders expect
+func writeIncomingError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{"ok": false, "error": message})
+}
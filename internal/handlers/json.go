@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxJSONBody limits the size of JSON request bodies
+const maxJSONBody = 64 << 10
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// writeJSONError sends {"error": message}, which the browser scripts show to the user
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// decodeJSON reads a JSON request body into v
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody)).Decode(v)
+}
+
+// wantsJSON reports whether a form was submitted by a script asking for JSON
+// instead of a redirect
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// reactionState is the JSON answer to a like or dislike from the page's script
+func reactionState(likes, dislikes int, liked, disliked bool) map[string]any {
+	return map[string]any{
+		"likes":    likes,
+		"dislikes": dislikes,
+		"reaction": reactionName(liked, disliked),
+	}
+}
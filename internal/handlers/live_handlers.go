@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum/internal/auth"
+	"forum/internal/avatars"
+	"forum/internal/events"
+	"forum/internal/features"
+)
+
+// Live topics and event types. The home feed hears about posts; a post's topic
+// about the post and its comments.
+const (
+	feedTopic = "feed"
+
+	eventPostCreated    = "post.created"
+	eventPostUpdated    = "post.updated"
+	eventPostDeleted    = "post.deleted"
+	eventPostCounts     = "post.counts"
+	eventCommentCreated = "comment.created"
+	eventCommentUpdated = "comment.updated"
+	eventCommentDeleted = "comment.deleted"
+	eventCommentCounts  = "comment.counts"
+)
+
+// liveHeartbeat keeps idle streams from being cut by proxies
+const liveHeartbeat = 25 * time.Second
+
+func postTopic(postID int64) string {
+	return "post:" + strconv.FormatInt(postID, 10)
+}
+
+// LiveHandlers streams live updates as Server-Sent Events
+type LiveHandlers struct {
+	broker *events.Broker
+}
+
+// NewLiveHandlers creates the live update handlers
+func NewLiveHandlers(broker *events.Broker) *LiveHandlers {
+	return &LiveHandlers{broker: broker}
+}
+
+// FeedEventsHandler streams new posts and post changes for the home page
+func (h *LiveHandlers) FeedEventsHandler(w http.ResponseWriter, r *http.Request) {
+	h.stream(w, r, feedTopic)
+}
+
+// PostEventsHandler streams changes to a post and its comments
+func (h *LiveHandlers) PostEventsHandler(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || postID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	h.stream(w, r, postTopic(postID))
+}
+
+// stream sends a topic's events until the client goes away. Browsers reconnect
+// by themselves and send Last-Event-ID, so missed events are replayed.
+func (h *LiveHandlers) stream(w http.ResponseWriter, r *http.Request, topic string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, err := h.broker.Subscribe(topic, auth.ClientIP(r), r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		if errors.Is(err, events.ErrTooManySubscriptions) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "Failed to subscribe", http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if sub.Reset {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range sub.Missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				// Fell behind; the browser reconnects and catches up
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
+
+// livePublisher announces changes made through the site or the API. A nil
+// broker turns it into a no-op.
+type livePublisher struct {
+	db     *sql.DB
+	broker *events.Broker
+}
+
+type livePost struct {
+	ID         int64    `json:"id"`
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	HTML       string   `json:"content_html"` // Sanitized, so pages may insert it as markup
+	Categories []string `json:"categories"`
+	Author     string   `json:"author"`
+}
+
+type liveCounts struct {
+	ID       int64 `json:"id"`
+	Likes    int   `json:"likes"`
+	Dislikes int   `json:"dislikes"`
+	Comments *int  `json:"comments,omitempty"` // Posts only
+}
+
+// commentAvatarSize is the avatar size post_detail.html shows next to comments
+const commentAvatarSize = 32
+
+type liveComment struct {
+	ID        int64     `json:"id"`
+	PostID    int64     `json:"post_id"`
+	AuthorID  int64     `json:"author_id"`
+	Author    string    `json:"author"`
+	AvatarURL string    `json:"avatar_url"`
+	Content   string    `json:"content"`
+	HTML      string    `json:"content_html"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type liveDeleted struct {
+	ID int64 `json:"id"`
+}
+
+func (p livePublisher) enabled() bool {
+	return p.broker != nil
+}
+
+// post loads a post for an event, logging rather than failing the request
+func (p livePublisher) post(ctx context.Context, postID int64) (*features.PostWithDetails, bool) {
+	post, err := features.GetPostWithDetails(ctx, p.db, postID, 0)
+	if err != nil {
+		log.Printf("Failed to load post %d for live update: %v", postID, err)
+		return nil, false
+	}
+	return post, true
+}
+
+func toLivePost(post *features.PostWithDetails) livePost {
+	return livePost{ID: post.ID, Title: post.Title, Content: post.Content, HTML: string(post.ContentHTML), Categories: post.Categories, Author: post.Username}
+}
+
+func postCounts(post *features.PostWithDetails) liveCounts {
+	comments := post.CommentsCount
+	return liveCounts{ID: post.ID, Likes: post.LikesCount, Dislikes: post.DislikesCount, Comments: &comments}
+}
+
+func (p livePublisher) postCreated(ctx context.Context, postID int64) {
+	if !p.enabled() {
+		return
+	}
+	if post, ok := p.post(ctx, postID); ok {
+		p.broker.Publish(feedTopic, eventPostCreated, toLivePost(post))
+	}
+}
+
+func (p livePublisher) postUpdated(ctx context.Context, postID int64) {
+	if !p.enabled() {
+		return
+	}
+	if post, ok := p.post(ctx, postID); ok {
+		p.broker.Publish(feedTopic, eventPostUpdated, toLivePost(post))
+		p.broker.Publish(postTopic(postID), eventPostUpdated, toLivePost(post))
+	}
+}
+
+func (p livePublisher) postDeleted(postID int64) {
+	if !p.enabled() {
+		return
+	}
+	p.broker.Publish(feedTopic, eventPostDeleted, liveDeleted{ID: postID})
+	p.broker.Publish(postTopic(postID), eventPostDeleted, liveDeleted{ID: postID})
+}
+
+// postCountsChanged announces new like, dislike and comment counts of a post
+func (p livePublisher) postCountsChanged(ctx context.Context, postID int64) {
+	if !p.enabled() {
+		return
+	}
+	if post, ok := p.post(ctx, postID); ok {
+		p.broker.Publish(feedTopic, eventPostCounts, postCounts(post))
+		p.broker.Publish(postTopic(postID), eventPostCounts, postCounts(post))
+	}
+}
+
+func (p livePublisher) commentCreated(ctx context.Context, commentID int64) {
+	if !p.enabled() {
+		return
+	}
+	comment, err := features.GetCommentWithDetails(ctx, p.db, commentID, 0)
+	if err != nil {
+		log.Printf("Failed to load comment %d for live update: %v", commentID, err)
+		return
+	}
+	p.broker.Publish(postTopic(comment.PostID), eventCommentCreated, liveComment{
+		ID:        comment.ID,
+		PostID:    comment.PostID,
+		AuthorID:  comment.AuthorID,
+		Author:    comment.Username,
+		AvatarURL: avatars.URL(comment.AuthorID, comment.Avatar, commentAvatarSize),
+		Content:   comment.Content,
+		HTML:      string(comment.ContentHTML),
+		CreatedAt: comment.CreatedAt,
+	})
+	p.postCountsChanged(ctx, comment.PostID)
+}
+
+func (p livePublisher) commentUpdated(ctx context.Context, commentID int64) {
+	if !p.enabled() {
+		return
+	}
+	comment, err := features.GetCommentByID(ctx, p.db, commentID)
+	if err != nil {
+		log.Printf("Failed to load comment %d for live update: %v", commentID, err)
+		return
+	}
+	p.broker.Publish(postTopic(comment.PostID), eventCommentUpdated, struct {
+		ID      int64  `json:"id"`
+		Content string `json:"content"`
+		HTML    string `json:"content_html"`
+	}{comment.ID, comment.Content, string(comment.ContentHTML)})
+}
+
+func (p livePublisher) commentDeleted(ctx context.Context, postID, commentID int64) {
+	if !p.enabled() {
+		return
+	}
+	p.broker.Publish(postTopic(postID), eventCommentDeleted, liveDeleted{ID: commentID})
+	p.postCountsChanged(ctx, postID)
+}
+
+// commentCountsChanged announces new like and dislike counts of a comment
+func (p livePublisher) commentCountsChanged(ctx context.Context, commentID int64) {
+	if !p.enabled() {
+		return
+	}
+	comment, err := features.GetCommentWithDetails(ctx, p.db, commentID, 0)
+	if err != nil {
+		log.Printf("Failed to load comment %d for live update: %v", commentID, err)
+		return
+	}
+	p.broker.Publish(postTopic(comment.PostID), eventCommentCounts, liveCounts{
+		ID:       comment.ID,
+		Likes:    comment.LikesCount,
+		Dislikes: comment.DislikesCount,
+	})
+}
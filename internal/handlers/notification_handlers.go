@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"forum/internal/auth"
+	"forum/internal/digest"
+	"forum/internal/features"
+)
+
+// notificationLimit is how many notifications the notifications page shows
+const notificationLimit = 100
+
+// NotificationHandlers shows a user's notifications, notification
+// preferences and email digest settings
+type NotificationHandlers struct {
+	db           *sql.DB
+	authService  *auth.AuthService
+	digests      *digest.Service
+	templates    *template.Template
+	errorHandler *auth.HTTPErrorHandler
+}
+
+// NewNotificationHandlers creates the notification handlers
+func NewNotificationHandlers(db *sql.DB, authService *auth.AuthService, digests *digest.Service, templates *template.Template) *NotificationHandlers {
+	errorLogger := log.New(os.Stdout, "[NOTIFICATION-ERROR] ", log.LstdFlags|log.Lshortfile)
+	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+
+	return &NotificationHandlers{
+		db:           db,
+		authService:  authService,
+		digests:      digests,
+		templates:    templates,
+		errorHandler: errorHandler,
+	}
+}
+
+// NotificationsHandler lists the user's notifications and their preferences
+func (h *NotificationHandlers) NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	notifications, err := features.ListNotifications(r.Context(), h.db, userID, notificationLimit)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	prefs, err := features.NotificationPreferences(r.Context(), h.db, userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	subscription, err := h.digests.Subscription(r.Context(), userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	categories, err := features.GetAllCategories(r.Context(), h.db)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	type preference struct {
+		features.NotificationType
+		Enabled bool
+	}
+	var preferences []preference
+	unread := 0
+	for _, t := range features.NotificationTypes {
+		preferences = append(preferences, preference{t, prefs[t.Type]})
+	}
+	for _, n := range notifications {
+		if !n.Read {
+			unread++
+		}
+	}
+
+	var success string
+	switch r.URL.Query().Get("success") {
+	case "preferences":
+		success = "Notification preferences saved."
+	case "read-all":
+		success = "All notifications marked as read."
+	case "digest":
+		success = "Email digest settings saved."
+	}
+
+	data := struct {
+		Title         string
+		CSRFToken     string
+		User          *auth.User
+		Notifications []features.Notification
+		Unread        int
+		Preferences   []preference
+		Digest        digest.Subscription
+		Categories    []features.Category
+		Success       string
+	}{
+		Title:         "Notifications",
+		CSRFToken:     auth.CSRFToken(r),
+		User:          currentUser,
+		Notifications: notifications,
+		Unread:        unread,
+		Preferences:   preferences,
+		Digest:        subscription,
+		Categories:    categories,
+		Success:       success,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "notifications.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// MarkReadHandler marks one notification as read
+func (h *NotificationHandlers) MarkReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	notificationID, err := strconv.ParseInt(r.FormValue("notification_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid notification")
+		return
+	}
+
+	if err := features.MarkNotificationRead(r.Context(), h.db, userID, notificationID); err != nil {
+		if errors.Is(err, features.ErrNotificationNotFound) {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// MarkAllReadHandler marks all of the user's notifications as read
+func (h *NotificationHandlers) MarkAllReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	if err := features.MarkAllNotificationsRead(r.Context(), h.db, userID); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications?success=read-all", http.StatusSeeOther)
+}
+
+// PreferencesHandler saves which notification types the user wants
+func (h *NotificationHandlers) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	enabled := map[string]bool{}
+	for _, kind := range r.Form["type"] {
+		enabled[kind] = true
+	}
+	if err := features.SetNotificationPreferences(r.Context(), h.db, userID, enabled); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications?success=preferences", http.StatusSeeOther)
+}
+
+// DigestHandler saves the user's email digest frequency and followed categories
+func (h *NotificationHandlers) DigestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	subscription := digest.Subscription{Frequency: r.FormValue("frequency")}
+	for _, value := range r.Form["category"] {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			h.errorHandler.Handle400(w, r, "Invalid category")
+			return
+		}
+		subscription.CategoryIDs = append(subscription.CategoryIDs, id)
+	}
+
+	if err := h.digests.Subscribe(r.Context(), userID, subscription); err != nil {
+		if errors.Is(err, digest.ErrUnknownFrequency) {
+			h.errorHandler.Handle400(w, r, "Please choose daily, weekly or no digest")
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications?success=digest#digest", http.StatusSeeOther)
+}
+
+// DigestUnsubscribeHandler stops a user's digests from the signed link in
+// every digest. It needs no login. Opening the link only asks for
+// confirmation, since mail scanners follow links; the unsubscribe happens on
+// POST, from the confirmation form or from mail clients (RFC 8058 one-click
+// unsubscribe).
+func (h *NotificationHandlers) DigestUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var success, errorMsg string
+	userID, err := strconv.ParseInt(r.URL.Query().Get("user"), 10, 64)
+	if err == nil {
+		err = h.digests.VerifyUnsubscribe(userID, r.URL.Query().Get("sig"))
+	}
+	if err != nil {
+		errorMsg = "This unsubscribe link is invalid. You can change your digest settings after logging in."
+	} else if r.Method == http.MethodPost {
+		if err := h.digests.Unsubscribe(r.Context(), userID); err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+		success = "You have been unsubscribed and will not get any more digest emails."
+	}
+
+	// Mail clients only look at the status
+	if r.Method == http.MethodPost && r.PostFormValue("List-Unsubscribe") == "One-Click" {
+		if errorMsg != "" {
+			http.Error(w, errorMsg, http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var currentUser *auth.User
+	if id, ok := auth.GetUserFromContext(r); ok {
+		currentUser, _ = h.authService.GetUserByID(id)
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		User      *auth.User
+		Confirm   string // Where the confirmation form posts to, with the signed query
+		Success   string
+		Error     string
+	}{
+		Title:     "Email Digest",
+		CSRFToken: auth.CSRFToken(r),
+		User:      currentUser,
+		Success:   success,
+		Error:     errorMsg,
+	}
+	if success == "" && errorMsg == "" {
+		data.Confirm = "/digest/unsubscribe?" + url.Values{
+			"user": {r.URL.Query().Get("user")},
+			"sig":  {r.URL.Query().Get("sig")},
+		}.Encode()
+	}
+
+	if errorMsg != "" {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	if err := h.templates.ExecuteTemplate(w, "digest_unsubscribe.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// notifier records notifications for changes made through the site or the
+// API. Failures are logged; they never fail the request that caused them.
+type notifier struct {
+	db *sql.DB
+}
+
+func (n notifier) postCreated(ctx context.Context, postID int64) {
+	if err := features.NotifyNewPost(ctx, n.db, postID); err != nil {
+		log.Printf("Failed to send notifications for post %d: %v", postID, err)
+	}
+}
+
+func (n notifier) commentCreated(ctx context.Context, commentID int64) {
+	if err := features.NotifyNewComment(ctx, n.db, commentID); err != nil {
+		log.Printf("Failed to send notifications for comment %d: %v", commentID, err)
+	}
+}
+
+func (n notifier) postReacted(ctx context.Context, userID, postID int64, reaction int) {
+	if err := features.NotifyPostReaction(ctx, n.db, userID, postID, reaction); err != nil {
+		log.Printf("Failed to send notifications for post %d: %v", postID, err)
+	}
+}
+
+func (n notifier) commentReacted(ctx context.Context, userID, commentID int64, reaction int) {
+	if err := features.NotifyCommentReaction(ctx, n.db, userID, commentID, reaction); err != nil {
+		log.Printf("Failed to send notifications for comment %d: %v", commentID, err)
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"forum/internal/auth"
+	"forum/internal/features"
+	"forum/internal/feeds"
+)
+
+// profilePerPage is how many posts or comments a profile tab shows per page
+const profilePerPage = 20
+
+// ProfileHandlers handles the public user profile pages
+type ProfileHandlers struct {
+	db           *sql.DB
+	authService  *auth.AuthService
+	templates    *template.Template
+	errorHandler *auth.HTTPErrorHandler
+}
+
+// NewProfileHandlers creates new profile handlers
+func NewProfileHandlers(db *sql.DB, authService *auth.AuthService, templates *template.Template) *ProfileHandlers {
+	errorLogger := log.New(os.Stdout, "[PROFILE-ERROR] ", log.LstdFlags|log.Lshortfile)
+	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+
+	return &ProfileHandlers{
+		db:           db,
+		authService:  authService,
+		templates:    templates,
+		errorHandler: errorHandler,
+	}
+}
+
+// UserProfileHandler shows a user's profile with a tab of their posts, their
+// comments or, if they opted in, the posts they liked
+func (h *ProfileHandlers) UserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, err := features.GetUserProfileByUsername(r.Context(), h.db, r.PathValue("username"))
+	if err != nil {
+		if errors.Is(err, features.ErrUserNotFound) {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	var currentUser *auth.User
+	var currentUserID int64
+	if userID, ok := auth.GetUserFromContext(r); ok {
+		if user, err := h.authService.GetUserByID(userID); err == nil {
+			currentUser = user
+			currentUserID = userID
+		}
+	}
+
+	tab := r.URL.Query().Get("tab")
+	switch tab {
+	case "":
+		tab = "posts"
+	case "posts", "comments":
+	case "liked":
+		if !profile.ShowLikedPosts {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+	default:
+		h.errorHandler.Handle404(w, r)
+		return
+	}
+
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			h.errorHandler.Handle400(w, r, "Invalid page number")
+			return
+		}
+		page = n
+	}
+	offset := (page - 1) * profilePerPage
+
+	var posts []features.PostWithDetails
+	var comments []features.AuthoredComment
+	var total int
+	switch tab {
+	case "posts":
+		total = profile.PostsCount
+		var list []features.Post
+		list, err = features.ListPostsByAuthor(r.Context(), h.db, profile.ID, profilePerPage, offset)
+		posts = features.WithDetails(r.Context(), h.db, list, currentUserID)
+	case "comments":
+		total = profile.CommentsCount
+		comments, err = features.ListCommentsByAuthor(r.Context(), h.db, profile.ID, profilePerPage, offset)
+	case "liked":
+		total, err = features.CountPosts(r.Context(), h.db, features.ListOptions{LikedByUser: profile.ID})
+		if err == nil {
+			var list []features.Post
+			list, err = features.ListPostsLikedByUser(r.Context(), h.db, profile.ID, profilePerPage, offset)
+			posts = features.WithDetails(r.Context(), h.db, list, currentUserID)
+		}
+	}
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		User      *auth.User
+		Profile   *features.UserProfile
+		IsOwner   bool
+		Tab       string
+		Posts     []features.PostWithDetails
+		Comments  []features.AuthoredComment
+		Page      int
+		PrevPage  int // Zero if this is the first page
+		NextPage  int // Zero if this is the last page
+		Feeds     []feeds.Link
+	}{
+		Title:     profile.Username,
+		CSRFToken: auth.CSRFToken(r),
+		User:      currentUser,
+		Profile:   profile,
+		IsOwner:   currentUserID == profile.ID,
+		Tab:       tab,
+		Posts:     posts,
+		Comments:  comments,
+		Page:      page,
+		Feeds:     feeds.AuthorLinks(profile.ID, profile.Username),
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if offset+profilePerPage < total {
+		data.NextPage = page + 1
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "user_profile.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
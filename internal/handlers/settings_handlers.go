@@ -0,0 +1,1019 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"forum/internal/auth"
+	"forum/internal/avatars"
+	"forum/internal/qrcode"
+	"forum/internal/webauthn"
+)
+
+// SettingsHandlers handles the account settings pages
+type SettingsHandlers struct {
+	authService    *auth.AuthService
+	sessionService *auth.SessionService
+	avatars        *avatars.Service
+	templates      *template.Template
+	errorHandler   *auth.HTTPErrorHandler
+	singleSignOn   bool // An authenticating proxy logs users in
+}
+
+// NewSettingsHandlers creates new account settings handlers
+func NewSettingsHandlers(authService *auth.AuthService, sessionService *auth.SessionService, templates *template.Template, avatarService *avatars.Service) *SettingsHandlers {
+	errorLogger := log.New(os.Stdout, "[SETTINGS-ERROR] ", log.LstdFlags|log.Lshortfile)
+	errorHandler := auth.NewHTTPErrorHandler(templates, errorLogger)
+
+	return &SettingsHandlers{
+		authService:    authService,
+		sessionService: sessionService,
+		avatars:        avatarService,
+		templates:      templates,
+		errorHandler:   errorHandler,
+	}
+}
+
+// SetSingleSignOn tells the settings pages that an authenticating proxy logs
+// users in, so there are no passwords or passkeys to manage here
+func (h *SettingsHandlers) SetSingleSignOn() {
+	h.singleSignOn = true
+}
+
+// currentSessionToken returns the session token of the request
+func currentSessionToken(r *http.Request) string {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// reauthentication returns the proof the user gave before a sensitive change
+func (h *SettingsHandlers) reauthentication(r *http.Request, password string) auth.Reauthentication {
+	return auth.Reauthentication{Password: password, Reauthenticated: h.sessionService.Reauthenticated(r)}
+}
+
+// renderAccount shows the account settings page
+func (h *SettingsHandlers) renderAccount(w http.ResponseWriter, r *http.Request, success, errorMsg string) {
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	nextUsernameChange, err := h.authService.NextUsernameChange(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	pendingEmail, err := h.authService.PendingEmail(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	profile, err := h.authService.GetProfile(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	avatar, err := h.avatars.Current(r.Context(), userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title              string
+		CSRFToken          string
+		User               *auth.User
+		SingleSignOn       bool
+		Reauthenticated    bool
+		NextUsernameChange time.Time
+		PendingEmail       string
+		Profile            *auth.Profile
+		MaxBioLength       int
+		Avatar             string
+		MaxAvatarMB        int
+		Success            string
+		Error              string
+	}{
+		Title:              "Account Settings",
+		CSRFToken:          auth.CSRFToken(r),
+		User:               currentUser,
+		SingleSignOn:       h.singleSignOn,
+		Reauthenticated:    h.sessionService.Reauthenticated(r),
+		NextUsernameChange: nextUsernameChange,
+		PendingEmail:       pendingEmail,
+		Profile:            profile,
+		MaxBioLength:       auth.MaxBioLength,
+		Avatar:             avatar,
+		MaxAvatarMB:        avatars.MaxSize >> 20,
+		Success:            success,
+		Error:              errorMsg,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "settings_account.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// AccountHandler shows the account settings page
+func (h *SettingsHandlers) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var success string
+	switch r.URL.Query().Get("success") {
+	case "username":
+		success = "Your username has been changed."
+	case "profile":
+		success = "Your profile has been updated."
+	case "avatar":
+		success = "Your avatar has been changed."
+	case "email":
+		success = "We sent a confirmation link to your new email address. Your email changes once you open it."
+	case "password":
+		success = "Your password has been changed and your other devices were signed out."
+	}
+
+	h.renderAccount(w, r, success, "")
+}
+
+// ChangeUsernameHandler changes the user's username
+func (h *SettingsHandlers) ChangeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	if err := h.authService.ChangeUsername(userID, r.FormValue("username")); err != nil {
+		h.renderAccount(w, r, "", err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/settings?success=username", http.StatusSeeOther)
+}
+
+// UpdateProfileHandler saves the user's bio and liked posts setting
+func (h *SettingsHandlers) UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	profile := auth.Profile{
+		Bio:            r.FormValue("bio"),
+		ShowLikedPosts: r.FormValue("show_liked_posts") == "on",
+	}
+	if err := h.authService.UpdateProfile(userID, profile); err != nil {
+		h.renderAccount(w, r, "", err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/settings?success=profile", http.StatusSeeOther)
+}
+
+// AvatarHandler uploads a new avatar from the "avatar" file of a multipart
+// form, or goes back to the identicon with action=remove
+func (h *SettingsHandlers) AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if r.FormValue("action") == "remove" {
+		if err := h.avatars.Remove(r.Context(), userID); err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/settings?success=avatar", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+			h.renderAccount(w, r, "", avatars.ErrEmpty.Error())
+			return
+		}
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, avatars.MaxSize+1))
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	if err := h.avatars.Set(r.Context(), userID, data); err != nil {
+		if errors.Is(err, avatars.ErrEmpty) || errors.Is(err, avatars.ErrTooLarge) || errors.Is(err, avatars.ErrType) {
+			h.renderAccount(w, r, "", err.Error())
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?success=avatar", http.StatusSeeOther)
+}
+
+// ChangeEmailHandler sends a confirmation link to the user's new email address
+func (h *SettingsHandlers) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	if err := h.authService.Reauthenticate(userID, h.reauthentication(r, r.FormValue("password"))); err != nil {
+		h.renderAccount(w, r, "", err.Error())
+		return
+	}
+
+	if err := h.authService.RequestEmailChange(userID, r.FormValue("email")); err != nil {
+		h.renderAccount(w, r, "", err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/settings?success=email", http.StatusSeeOther)
+}
+
+// ChangePasswordHandler changes the user's password, signing out their other
+// devices and giving the current one a fresh session token
+func (h *SettingsHandlers) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	newPassword := r.FormValue("new_password")
+	if newPassword != r.FormValue("confirm_password") {
+		h.renderAccount(w, r, "", "Passwords do not match")
+		return
+	}
+
+	if err := h.authService.ChangePassword(userID, h.reauthentication(r, r.FormValue("current_password")), newPassword); err != nil {
+		h.renderAccount(w, r, "", err.Error())
+		return
+	}
+
+	if err := h.sessionService.RevokeOtherSessions(userID, currentSessionToken(r)); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	if err := h.sessionService.RotateSession(w, r); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?success=password", http.StatusSeeOther)
+}
+
+// DeleteAccountHandler deletes the user's account
+func (h *SettingsHandlers) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	anonymize := r.FormValue("content") != "delete"
+	if err := h.authService.DeleteAccount(userID, h.reauthentication(r, r.FormValue("password")), anonymize); err != nil {
+		h.renderAccount(w, r, "", err.Error())
+		return
+	}
+
+	h.sessionService.ClearSessionCookie(w)
+	http.Redirect(w, r, "/?account_deleted=true", http.StatusSeeOther)
+}
+
+// DevicesHandler shows the sessions ("devices") the user is logged in on
+func (h *SettingsHandlers) DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	sessions, err := h.sessionService.ListUserSessions(userID, currentSessionToken(r))
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	notify, err := h.sessionService.NewDeviceNotifications(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title           string
+		CSRFToken       string
+		User            *auth.User
+		SingleSignOn    bool
+		Sessions        []auth.DeviceSession
+		NotifyNewDevice bool
+		Success         string
+	}{
+		Title:           "Your Devices",
+		CSRFToken:       auth.CSRFToken(r),
+		User:            currentUser,
+		SingleSignOn:    h.singleSignOn,
+		Sessions:        sessions,
+		NotifyNewDevice: notify,
+	}
+
+	switch r.URL.Query().Get("success") {
+	case "revoked":
+		data.Success = "The device has been signed out."
+	case "revoked-others":
+		data.Success = "All other devices have been signed out."
+	case "notifications":
+		data.Success = "Notification setting saved."
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "settings_devices.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+}
+
+// RevokeDeviceHandler signs out one of the user's sessions
+func (h *SettingsHandlers) RevokeDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	sessionID, err := strconv.ParseInt(r.FormValue("session_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid session ID")
+		return
+	}
+
+	if err := h.sessionService.RevokeSession(userID, sessionID); err != nil {
+		h.errorHandler.Handle400(w, r, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/settings/devices?success=revoked", http.StatusSeeOther)
+}
+
+// RevokeOtherDevicesHandler signs out every session except the current one
+func (h *SettingsHandlers) RevokeOtherDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := h.sessionService.RevokeOtherSessions(userID, currentSessionToken(r)); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/devices?success=revoked-others", http.StatusSeeOther)
+}
+
+// DeviceNotificationsHandler saves the "notify me on new device login" setting
+func (h *SettingsHandlers) DeviceNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	enabled := r.FormValue("notify_new_device") == "on"
+	if err := h.sessionService.SetNewDeviceNotifications(userID, enabled); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/devices?success=notifications", http.StatusSeeOther)
+}
+
+// renderTwoFactor shows the two-factor authentication settings page.
+// recoveryCodes are only passed right after they were generated.
+func (h *SettingsHandlers) renderTwoFactor(w http.ResponseWriter, r *http.Request, success, errorMsg string, recoveryCodes []string) {
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	status, err := h.authService.TwoFactorStatus(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	secret, uri, err := h.authService.PendingTOTPEnrollment(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	// The QR code is rendered here so the secret never leaves the server
+	var qr template.HTML
+	if uri != "" {
+		code, err := qrcode.Encode([]byte(uri))
+		if err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+		qr = template.HTML(code.SVG(4))
+	}
+
+	data := struct {
+		Title           string
+		CSRFToken       string
+		User            *auth.User
+		SingleSignOn    bool
+		Reauthenticated bool
+		Status          *auth.TwoFactorStatus
+		PendingSecret   string
+		QRCode          template.HTML
+		RecoveryCodes   []string
+		Success         string
+		Error           string
+	}{
+		Title:           "Two-Factor Authentication",
+		CSRFToken:       auth.CSRFToken(r),
+		User:            currentUser,
+		SingleSignOn:    h.singleSignOn,
+		Reauthenticated: h.sessionService.Reauthenticated(r),
+		Status:          status,
+		PendingSecret:   secret,
+		QRCode:          qr,
+		RecoveryCodes:   recoveryCodes,
+		Success:         success,
+		Error:           errorMsg,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "settings_2fa.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// TwoFactorHandler shows the two-factor authentication settings page
+func (h *SettingsHandlers) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var success, errorMsg string
+	switch r.URL.Query().Get("success") {
+	case "disabled":
+		success = "Two-factor authentication has been turned off."
+	}
+	if r.URL.Query().Get("required") == "true" {
+		errorMsg = "Your role requires two-factor authentication. Set it up to continue using the forum."
+	}
+
+	h.renderTwoFactor(w, r, success, errorMsg, nil)
+}
+
+// TwoFactorSetupHandler starts enrolling an authenticator app
+func (h *SettingsHandlers) TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if _, _, err := h.authService.BeginTOTPEnrollment(userID); err != nil {
+		h.renderTwoFactor(w, r, "", err.Error(), nil)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+}
+
+// TwoFactorConfirmHandler turns on 2FA once the user enters a code from their app
+func (h *SettingsHandlers) TwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	codes, err := h.authService.ConfirmTOTPEnrollment(userID, r.FormValue("code"))
+	if err != nil {
+		h.renderTwoFactor(w, r, "", err.Error(), nil)
+		return
+	}
+
+	// Behind an authenticating proxy there are no forum sessions to renew
+	if h.singleSignOn {
+		h.renderTwoFactor(w, r, "Two-factor authentication is now on.", "", codes)
+		return
+	}
+
+	// Sessions started before 2FA was on only ever checked the password
+	if err := h.sessionService.RevokeOtherSessions(userID, currentSessionToken(r)); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	if err := h.sessionService.RotateSession(w, r); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	h.renderTwoFactor(w, r, "Two-factor authentication is now on and your other devices were signed out.", "", codes)
+}
+
+// TwoFactorDisableHandler turns 2FA off
+func (h *SettingsHandlers) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	if err := h.authService.DisableTwoFactor(userID, r.FormValue("password"), r.FormValue("code")); err != nil {
+		h.renderTwoFactor(w, r, "", err.Error(), nil)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/2fa?success=disabled", http.StatusSeeOther)
+}
+
+// RecoveryCodesHandler replaces the user's recovery codes with new ones
+func (h *SettingsHandlers) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	enabled, err := h.authService.TwoFactorEnabled(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	if !enabled {
+		h.renderTwoFactor(w, r, "", "two-factor authentication is not enabled", nil)
+		return
+	}
+	if err := h.authService.Reauthenticate(userID, h.reauthentication(r, r.FormValue("password"))); err != nil {
+		h.renderTwoFactor(w, r, "", err.Error(), nil)
+		return
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	h.renderTwoFactor(w, r, "New recovery codes have been generated. Your old codes no longer work.", "", codes)
+}
+
+// reauthenticationReturns are the pages that send users without a password to
+// ReauthenticateHandler, and so the only places it sends them back to
+var reauthenticationReturns = map[string]bool{
+	"/settings":          true,
+	"/settings/2fa":      true,
+	"/settings/passkeys": true,
+}
+
+// ReauthenticateHandler lets a user without a password confirm it is them
+// before a sensitive change, with a provider they have logged in with or a
+// second factor code
+func (h *SettingsHandlers) ReauthenticateHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := auth.GetUserFromContext(r)
+
+	next := r.FormValue("next")
+	if !reauthenticationReturns[next] {
+		next = "/settings"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.renderReauthenticate(w, r, next, "")
+	case http.MethodPost:
+		if provider := r.FormValue("provider"); provider != "" {
+			state, authURL, err := h.authService.BeginOIDCReauthentication(r.Context(), userID, provider, next)
+			if err != nil {
+				h.renderReauthenticate(w, r, next, err.Error())
+				return
+			}
+			auth.SetOAuthStateCookie(w, state)
+			http.Redirect(w, r, authURL, http.StatusSeeOther)
+			return
+		}
+
+		if err := h.authService.ConfirmSecondFactor(userID, r.FormValue("code")); err != nil {
+			h.renderReauthenticate(w, r, next, err.Error())
+			return
+		}
+		if err := h.sessionService.MarkReauthenticated(r); err != nil {
+			h.errorHandler.Handle500(w, r, err)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// renderReauthenticate shows the ways the user can confirm it is them
+func (h *SettingsHandlers) renderReauthenticate(w http.ResponseWriter, r *http.Request, next, errorMsg string) {
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	// Users with a password confirm changes with it instead
+	if currentUser.HasPassword {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	providers, err := h.authService.LinkedOIDCProviders(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	twoFactor, err := h.authService.TwoFactorEnabled(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title     string
+		CSRFToken string
+		User      *auth.User
+		Providers []auth.OIDCProvider
+		TwoFactor bool
+		Next      string
+		Error     string
+	}{
+		Title:     "Confirm It Is You",
+		CSRFToken: auth.CSRFToken(r),
+		User:      currentUser,
+		Providers: providers,
+		TwoFactor: twoFactor,
+		Next:      next,
+		Error:     errorMsg,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "settings_reauthenticate.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// PasskeysHandler shows the user's passkeys
+func (h *SettingsHandlers) PasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	passkeys, err := h.authService.ListPasskeys(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title           string
+		CSRFToken       string
+		User            *auth.User
+		Reauthenticated bool
+		Passkeys        []auth.Passkey
+		Success         string
+	}{
+		Title:           "Passkeys",
+		CSRFToken:       auth.CSRFToken(r),
+		User:            currentUser,
+		Reauthenticated: h.sessionService.Reauthenticated(r),
+		Passkeys:        passkeys,
+	}
+
+	switch r.URL.Query().Get("success") {
+	case "added":
+		data.Success = "Your passkey has been added. You can now use it to log in."
+	case "deleted":
+		data.Success = "The passkey has been removed."
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "settings_passkeys.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// PasskeyRegisterBeginHandler checks it is the user and returns the
+// options for navigator.credentials.create()
+func (h *SettingsHandlers) PasskeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	// A stolen session must not be enough to plant a passkey on the account
+	if err := h.authService.Reauthenticate(userID, h.reauthentication(r, req.Password)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, options, err := h.authService.BeginPasskeyRegistration(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	auth.SetPasskeyCeremonyCookie(w, token)
+	writeJSON(w, http.StatusOK, options)
+}
+
+// PasskeyRegisterFinishHandler stores the passkey the browser created
+func (h *SettingsHandlers) PasskeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	var req struct {
+		Name              string             `json:"name"`
+		ClientDataJSON    webauthn.Base64URL `json:"clientDataJSON"`
+		AttestationObject webauthn.Base64URL `json:"attestationObject"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid passkey response")
+		return
+	}
+
+	err := h.authService.FinishPasskeyRegistration(userID, auth.PasskeyCeremonyToken(r), req.Name, req.ClientDataJSON, req.AttestationObject)
+	auth.ClearPasskeyCeremonyCookie(w)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/settings/passkeys?success=added"})
+}
+
+// DeletePasskeyHandler removes one of the user's passkeys
+func (h *SettingsHandlers) DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	passkeyID, err := strconv.ParseInt(r.FormValue("passkey_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid passkey ID")
+		return
+	}
+
+	if err := h.authService.DeletePasskey(userID, passkeyID); err != nil {
+		h.errorHandler.Handle400(w, r, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/settings/passkeys?success=deleted", http.StatusSeeOther)
+}
+
+// apiTokenLifetimes are the expiry choices offered for new API tokens
+var apiTokenLifetimes = map[string]time.Duration{
+	"7":     7 * 24 * time.Hour,
+	"30":    30 * 24 * time.Hour,
+	"90":    90 * 24 * time.Hour,
+	"365":   365 * 24 * time.Hour,
+	"never": 0,
+}
+
+// renderAPITokens shows the API tokens page. A newly created token is shown
+// once, right after it is created.
+func (h *SettingsHandlers) renderAPITokens(w http.ResponseWriter, r *http.Request, success, errorMsg, newToken string) {
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	tokens, err := h.sessionService.ListAPITokens(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title        string
+		CSRFToken    string
+		User         *auth.User
+		SingleSignOn bool
+		Tokens       []auth.APIToken
+		NewToken     string
+		Success      string
+		Error        string
+	}{
+		Title:        "API Tokens",
+		CSRFToken:    auth.CSRFToken(r),
+		User:         currentUser,
+		SingleSignOn: h.singleSignOn,
+		Tokens:       tokens,
+		NewToken:     newToken,
+		Success:      success,
+		Error:        errorMsg,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "settings_tokens.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// APITokensHandler shows the user's personal API tokens
+func (h *SettingsHandlers) APITokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var success string
+	if r.URL.Query().Get("success") == "revoked" {
+		success = "The token has been revoked."
+	}
+	h.renderAPITokens(w, r, success, "", "")
+}
+
+// CreateAPITokenHandler mints a new personal API token
+func (h *SettingsHandlers) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	lifetime, ok := apiTokenLifetimes[r.FormValue("expires")]
+	if !ok {
+		h.renderAPITokens(w, r, "", "Please choose when the token expires", "")
+		return
+	}
+
+	token, err := h.sessionService.CreateAPIToken(userID, r.FormValue("name"), r.Form["scope"], lifetime)
+	if err != nil {
+		h.renderAPITokens(w, r, "", err.Error(), "")
+		return
+	}
+
+	// Rendered rather than redirected so the token never ends up in a URL
+	h.renderAPITokens(w, r, "Your token has been created. Copy it now, it will not be shown again.", "", token)
+}
+
+// RevokeAPITokenHandler deletes one of the user's API tokens
+func (h *SettingsHandlers) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(r.FormValue("token_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid token ID")
+		return
+	}
+
+	if err := h.sessionService.RevokeAPIToken(userID, tokenID); err != nil {
+		h.errorHandler.Handle400(w, r, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/settings/tokens?success=revoked", http.StatusSeeOther)
+}
@@ -0,0 +1,517 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"forum/internal/auth"
+	"forum/internal/features"
+	"forum/internal/webhooks"
+)
+
+const (
+	// deliveryLogLimit is how many deliveries the webhook page shows
+	deliveryLogLimit = 50
+	// defaultIncomingRateLimit is the suggested hourly limit for new incoming webhooks
+	defaultIncomingRateLimit = 60
+	// incomingRotationGrace is how long a rotated incoming webhook token keeps
+	// working when the admin asks for a grace period
+	incomingRotationGrace = 24 * time.Hour
+)
+
+// WebhooksHandler lists the webhooks and shows the form for adding one
+func (h *AdminHandlers) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	hooks, err := h.webhooks.List(r.Context())
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	incoming, err := h.incoming.ListIncoming(r.Context())
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	categories, err := features.GetAllCategories(r.Context(), h.db)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title            string
+		CSRFToken        string
+		User             *auth.User
+		Webhooks         []webhooks.Webhook
+		Events           []webhooks.EventType
+		Incoming         []webhooks.IncomingWebhook
+		Categories       []features.Category
+		DefaultRateLimit int
+		MaxRateLimit     int
+		Success          string
+	}{
+		Title:            "Webhooks",
+		CSRFToken:        auth.CSRFToken(r),
+		User:             currentUser,
+		Webhooks:         hooks,
+		Events:           webhooks.Events,
+		Incoming:         incoming,
+		Categories:       categories,
+		DefaultRateLimit: defaultIncomingRateLimit,
+		MaxRateLimit:     webhooks.MaxIncomingRateLimit,
+	}
+
+	switch r.URL.Query().Get("deleted") {
+	case "true":
+		data.Success = "Webhook deleted."
+	case "incoming":
+		data.Success = "Incoming webhook deleted. The posts it created stay."
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "admin_webhooks.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+}
+
+// WebhookHandler shows one webhook with its secret and delivery log
+func (h *AdminHandlers) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	webhookID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle404(w, r)
+		return
+	}
+	hook, err := h.webhooks.Get(r.Context(), webhookID)
+	if err != nil {
+		if errors.Is(err, webhooks.ErrWebhookNotFound) {
+			h.errorHandler.Handle404(w, r)
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+	deliveries, err := h.webhooks.Deliveries(r.Context(), webhookID, deliveryLogLimit)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	type event struct {
+		webhooks.EventType
+		Subscribed bool
+	}
+	var events []event
+	for _, e := range webhooks.Events {
+		events = append(events, event{e, hook.Subscribes(e.Name)})
+	}
+
+	var success string
+	switch r.URL.Query().Get("success") {
+	case "created":
+		success = "Webhook added. Use the secret below to verify the signature of each delivery."
+	case "updated":
+		success = "Webhook saved."
+	case "test":
+		success = "Test event queued. It will appear in the delivery log below once it has been sent."
+	case "paused":
+		success = "Webhook paused. New events are not queued until it is resumed."
+	case "resumed":
+		success = "Webhook resumed."
+	case "retried":
+		success = "Delivery queued again."
+	}
+
+	data := struct {
+		Title      string
+		CSRFToken  string
+		User       *auth.User
+		Webhook    *webhooks.Webhook
+		Events     []event
+		Deliveries []webhooks.Delivery
+		Success    string
+	}{
+		Title:      "Webhook",
+		CSRFToken:  auth.CSRFToken(r),
+		User:       currentUser,
+		Webhook:    hook,
+		Events:     events,
+		Deliveries: deliveries,
+		Success:    success,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "admin_webhook.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+}
+
+// CreateWebhookHandler registers a webhook
+func (h *AdminHandlers) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	hook, err := h.webhooks.Create(r.Context(), r.FormValue("url"), r.FormValue("description"), r.Form["event"], userID)
+	if err != nil {
+		if webhooks.IsValidationError(err) {
+			h.errorHandler.Handle400(w, r, err.Error())
+			return
+		}
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, webhookPage(hook.ID, "created"), http.StatusSeeOther)
+}
+
+// UpdateWebhookHandler changes a webhook's URL, description and events
+func (h *AdminHandlers) UpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.webhooks.Update(r.Context(), webhookID, r.FormValue("url"), r.FormValue("description"), r.Form["event"])
+	if err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, webhookPage(webhookID, "updated"), http.StatusSeeOther)
+}
+
+// TestWebhookHandler sends a ping event to a webhook
+func (h *AdminHandlers) TestWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.webhooks.SendTest(r.Context(), webhookID); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, webhookPage(webhookID, "test"), http.StatusSeeOther)
+}
+
+// ToggleWebhookHandler pauses or resumes a webhook
+func (h *AdminHandlers) ToggleWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	active := r.FormValue("active") == "true"
+	if err := h.webhooks.SetActive(r.Context(), webhookID, active); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	success := "paused"
+	if active {
+		success = "resumed"
+	}
+	http.Redirect(w, r, webhookPage(webhookID, success), http.StatusSeeOther)
+}
+
+// RetryWebhookDeliveryHandler sends a failed delivery again
+func (h *AdminHandlers) RetryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := strconv.ParseInt(r.FormValue("delivery_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid delivery ID")
+		return
+	}
+	if err := h.webhooks.Retry(r.Context(), webhookID, deliveryID); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, webhookPage(webhookID, "retried"), http.StatusSeeOther)
+}
+
+// DeleteWebhookHandler removes a webhook and its delivery log
+func (h *AdminHandlers) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.webhooks.Delete(r.Context(), webhookID); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks?deleted=true", http.StatusSeeOther)
+}
+
+// webhookForm checks the method and reads the webhook ID of a webhook form
+func (h *AdminHandlers) webhookForm(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return 0, false
+	}
+
+	webhookID, err := strconv.ParseInt(r.FormValue("webhook_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid webhook ID")
+		return 0, false
+	}
+	return webhookID, true
+}
+
+// webhookFailure answers an error from the webhook service
+func (h *AdminHandlers) webhookFailure(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, webhooks.ErrWebhookNotFound):
+		h.errorHandler.Handle404(w, r)
+	case webhooks.IsValidationError(err):
+		h.errorHandler.Handle400(w, r, err.Error())
+	default:
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+func webhookPage(webhookID int64, success string) string {
+	return "/admin/webhooks/view?id=" + strconv.FormatInt(webhookID, 10) + "&success=" + success
+}
+
+// renderIncomingWebhook shows an incoming webhook. Its URL is only shown right
+// after the hook is created or its token rotated, since only a hash of the
+// token is stored.
+func (h *AdminHandlers) renderIncomingWebhook(w http.ResponseWriter, r *http.Request, webhookID int64, success, newURL string) {
+	userID, _ := auth.GetUserFromContext(r)
+	currentUser, err := h.authService.GetUserByID(userID)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	hook, err := h.incoming.GetIncoming(r.Context(), webhookID)
+	if err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+	categories, err := features.GetAllCategories(r.Context(), h.db)
+	if err != nil {
+		h.errorHandler.Handle500(w, r, err)
+		return
+	}
+
+	data := struct {
+		Title        string
+		CSRFToken    string
+		User         *auth.User
+		Webhook      *webhooks.IncomingWebhook
+		Categories   []features.Category
+		MaxRateLimit int
+		NewURL       string
+		Success      string
+	}{
+		Title:        "Incoming Webhook",
+		CSRFToken:    auth.CSRFToken(r),
+		User:         currentUser,
+		Webhook:      hook,
+		Categories:   categories,
+		MaxRateLimit: webhooks.MaxIncomingRateLimit,
+		NewURL:       newURL,
+		Success:      success,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "admin_incoming_webhook.html", data); err != nil {
+		h.errorHandler.Handle500(w, r, err)
+	}
+}
+
+// IncomingWebhookHandler shows one incoming webhook
+func (h *AdminHandlers) IncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	webhookID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle404(w, r)
+		return
+	}
+
+	var success string
+	switch r.URL.Query().Get("success") {
+	case "updated":
+		success = "Incoming webhook saved."
+	case "paused":
+		success = "Incoming webhook paused. Messages sent to it are refused until it is resumed."
+	case "resumed":
+		success = "Incoming webhook resumed."
+	}
+	h.renderIncomingWebhook(w, r, webhookID, success, "")
+}
+
+// CreateIncomingWebhookHandler registers an incoming webhook, creating its bot
+// account if needed, and shows its URL once
+func (h *AdminHandlers) CreateIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.errorHandler.Handle400(w, r, "Invalid form data")
+		return
+	}
+
+	categoryID, err := strconv.ParseInt(r.FormValue("category_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Please choose a category")
+		return
+	}
+	rateLimit, err := strconv.Atoi(r.FormValue("rate_limit"))
+	if err != nil {
+		h.errorHandler.Handle400(w, r, webhooks.ErrInvalidRateLimit.Error())
+		return
+	}
+	botUserID, err := h.authService.BotUser(r.FormValue("bot_username"))
+	if err != nil {
+		h.errorHandler.Handle400(w, r, err.Error())
+		return
+	}
+
+	userID, _ := auth.GetUserFromContext(r)
+	hook, token, err := h.incoming.CreateIncoming(r.Context(), r.FormValue("name"), botUserID, categoryID, rateLimit, userID)
+	if err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	h.renderIncomingWebhook(w, r, hook.ID, "Incoming webhook added. Copy its URL now; it will not be shown again.", h.incoming.URL(token))
+}
+
+// UpdateIncomingWebhookHandler changes an incoming webhook's name, category and rate limit
+func (h *AdminHandlers) UpdateIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	categoryID, err := strconv.ParseInt(r.FormValue("category_id"), 10, 64)
+	if err != nil {
+		h.errorHandler.Handle400(w, r, "Please choose a category")
+		return
+	}
+	rateLimit, err := strconv.Atoi(r.FormValue("rate_limit"))
+	if err != nil {
+		h.errorHandler.Handle400(w, r, webhooks.ErrInvalidRateLimit.Error())
+		return
+	}
+	if err := h.incoming.UpdateIncoming(r.Context(), webhookID, r.FormValue("name"), categoryID, rateLimit); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, incomingWebhookPage(webhookID, "updated"), http.StatusSeeOther)
+}
+
+// RotateIncomingWebhookHandler replaces an incoming webhook's token and shows
+// the new URL once
+func (h *AdminHandlers) RotateIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	var grace time.Duration
+	success := "Token rotated. The old URL no longer works."
+	if r.FormValue("grace") == "true" {
+		grace = incomingRotationGrace
+		success = "Token rotated. The old URL keeps working for 24 hours."
+	}
+	token, err := h.incoming.RotateIncoming(r.Context(), webhookID, grace)
+	if err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	h.renderIncomingWebhook(w, r, webhookID, success, h.incoming.URL(token))
+}
+
+// ToggleIncomingWebhookHandler pauses or resumes an incoming webhook
+func (h *AdminHandlers) ToggleIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	active := r.FormValue("active") == "true"
+	if err := h.incoming.SetIncomingActive(r.Context(), webhookID, active); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	success := "paused"
+	if active {
+		success = "resumed"
+	}
+	http.Redirect(w, r, incomingWebhookPage(webhookID, success), http.StatusSeeOther)
+}
+
+// DeleteIncomingWebhookHandler removes an incoming webhook
+func (h *AdminHandlers) DeleteIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, ok := h.webhookForm(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.incoming.DeleteIncoming(r.Context(), webhookID); err != nil {
+		h.webhookFailure(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks?deleted=incoming", http.StatusSeeOther)
+}
+
+func incomingWebhookPage(webhookID int64, success string) string {
+	return "/admin/webhooks/incoming?id=" + strconv.FormatInt(webhookID, 10) + "&success=" + success
+}
@@ -0,0 +1,146 @@
+// Package imaging decodes, cleans and resizes uploaded images using only the
+// standard library. It understands JPEG, PNG and GIF.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+)
+
+// MaxPixels limits the size of images that are decoded, since a small file
+// can describe a huge image
+const MaxPixels = 40_000_000
+
+var (
+	ErrTooLarge    = errors.New("image is too large")
+	ErrUnsupported = errors.New("unsupported image format")
+)
+
+// Decode decodes an image after checking that its dimensions are reasonable.
+// It returns the format name ("jpeg", "png" or "gif").
+func Decode(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrUnsupported
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrUnsupported
+	}
+	return img, format, nil
+}
+
+// Size returns an image's dimensions without decoding it
+func Size(data []byte) (width, height int, err error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, ErrUnsupported
+	}
+	return config.Width, config.Height, nil
+}
+
+// Fit returns the largest size with the image's aspect ratio that fits in a
+// limit by limit square. Images that already fit keep their size.
+func Fit(width, height, limit int) (int, int) {
+	if width <= limit && height <= limit {
+		return width, height
+	}
+	if width >= height {
+		return limit, max(1, height*limit/width)
+	}
+	return max(1, width*limit/height), limit
+}
+
+// Resize scales an image to width by height. Each output pixel is the average
+// of the source pixels it covers, which gives smooth thumbnails.
+func Resize(src image.Image, width, height int) *image.RGBA {
+	s := toRGBA(src)
+	sw, sh := s.Rect.Dx(), s.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// Source columns covered by each output column
+	x0s := make([]int, width)
+	x1s := make([]int, width)
+	for dx := 0; dx < width; dx++ {
+		x0s[dx], x1s[dx] = span(dx, width, sw)
+	}
+
+	for dy := 0; dy < height; dy++ {
+		y0, y1 := span(dy, height, sh)
+		for dx := 0; dx < width; dx++ {
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				row := s.Pix[y*s.Stride:]
+				for x := x0s[dx]; x < x1s[dx]; x++ {
+					p := row[x*4 : x*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			o := dst.Pix[dy*dst.Stride+dx*4:]
+			o[0], o[1], o[2], o[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// span returns the source range [start, end) covered by output index i when
+// n outputs are drawn from size inputs. The range is never empty, so images
+// can also be enlarged.
+func span(i, n, size int) (int, int) {
+	start := i * size / n
+	end := (i + 1) * size / n
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
+
+// Crop returns the part of an image inside r
+func Crop(src image.Image, r image.Rectangle) *image.RGBA {
+	r = r.Intersect(src.Bounds())
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Rect, src, r.Min, draw.Src)
+	return dst
+}
+
+// EncodeJPEG encodes an image as a JPEG of good quality
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodePNG encodes an image as a PNG, keeping transparency
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toRGBA converts an image to RGBA with its origin at 0,0
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, src, b.Min, draw.Src)
+	return dst
+}
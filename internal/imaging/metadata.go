@@ -0,0 +1,199 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+var errCorrupt = errors.New("corrupt image")
+
+// StripMetadata removes EXIF, XMP, IPTC and text metadata, which can contain
+// GPS positions and camera serial numbers, from JPEG and PNG files. A JPEG
+// whose EXIF data rotates it is turned upright first, since the rotation is
+// lost with the metadata. Other formats are returned unchanged.
+func StripMetadata(data []byte, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		cleaned, orientation, err := stripJPEG(data)
+		if err != nil {
+			return nil, err
+		}
+		if orientation <= 1 || orientation > 8 {
+			return cleaned, nil
+		}
+		img, _, err := Decode(cleaned)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeJPEG(orient(img, orientation))
+	case "image/png":
+		return stripPNG(data)
+	}
+	return data, nil
+}
+
+// stripJPEG drops application segments other than JFIF (APP0), ICC colour
+// profiles (APP2) and Adobe colour transforms (APP14), and all comments. It
+// returns the EXIF orientation found on the way.
+func stripJPEG(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	orientation := 1
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xFF {
+			return nil, 0, errCorrupt
+		}
+		// Markers may be padded with extra 0xFF bytes
+		for i+1 < len(data) && data[i+1] == 0xFF {
+			i++
+		}
+		if i+1 >= len(data) {
+			return nil, 0, errCorrupt
+		}
+		marker := data[i+1]
+
+		switch {
+		case marker == 0xDA, marker == 0xD9:
+			// Start of scan: the compressed image data follows to the end
+			out.Write(data[i:])
+			return out.Bytes(), orientation, nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01:
+			// Markers without a length
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, 0, errCorrupt
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, 0, errCorrupt
+		}
+		segment := data[i:end]
+		i = end
+
+		switch {
+		case marker == 0xE1:
+			if o := exifOrientation(segment[4:]); o > 0 {
+				orientation = o
+			}
+		case marker == 0xE0, marker == 0xE2, marker == 0xEE:
+			out.Write(segment)
+		case marker > 0xE0 && marker <= 0xEF, marker == 0xFE:
+			// Other application data and comments
+		default:
+			out.Write(segment)
+		}
+	}
+	return nil, 0, errCorrupt
+}
+
+// exifOrientation reads the orientation tag from the first directory of an
+// APP1 EXIF segment, or returns 0
+func exifOrientation(app1 []byte) int {
+	if !bytes.HasPrefix(app1, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := app1[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// pngMetadata are the PNG chunks that hold text, EXIF data and timestamps
+var pngMetadata = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// stripPNG drops metadata chunks and anything after the end of the image
+func stripPNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+
+	for i := len(signature); i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errCorrupt
+		}
+		kind := string(data[i+4 : i+8])
+		if !pngMetadata[kind] {
+			out.Write(data[i:end])
+		}
+		if kind == "IEND" {
+			return out.Bytes(), nil
+		}
+		i = end
+	}
+	return nil, errCorrupt
+}
+
+// orient applies an EXIF orientation (2 to 8) so the image is upright
+func orient(src image.Image, orientation int) *image.RGBA {
+	s := toRGBA(src)
+	w, h := s.Rect.Dx(), s.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-dx, dy
+			case 3: // Upside down
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // Mirrored upside down
+				sx, sy = dx, h-1-dy
+			case 5: // Mirrored and turned left
+				sx, sy = dy, dx
+			case 6: // Turned left, so rotate clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // Mirrored and turned right
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // Turned right, so rotate anticlockwise
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], s.Pix[sy*s.Stride+sx*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,204 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// gpsPosition is written into the EXIF data of test photos, so tests can check
+// that it does not survive
+const gpsPosition = "51.5007N 0.1246W"
+
+var (
+	red  = color.RGBA{R: 255, A: 255}
+	blue = color.RGBA{B: 255, A: 255}
+)
+
+// twoTone returns a 32x16 image whose left half is red and right half blue
+func twoTone() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			if x < 16 {
+				img.Set(x, y, red)
+			} else {
+				img.Set(x, y, blue)
+			}
+		}
+	}
+	return img
+}
+
+// exifSegment builds an APP1 segment with an orientation tag and a GPS
+// directory, laid out the way cameras write them
+func exifSegment(orientation uint16) []byte {
+	order := binary.LittleEndian
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+
+	// IFD0: orientation and a pointer to the GPS directory at offset 38
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3) // SHORT
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = order.AppendUint16(tiff, 0)
+	tiff = order.AppendUint16(tiff, 0x8825)
+	tiff = order.AppendUint16(tiff, 4) // LONG
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint32(tiff, 38)
+	tiff = order.AppendUint32(tiff, 0)
+
+	// GPS IFD: the latitude reference, with the position as trailing data
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0001)
+	tiff = order.AppendUint16(tiff, 2) // ASCII
+	tiff = order.AppendUint32(tiff, 2)
+	tiff = append(tiff, 'N', 0, 0, 0)
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, gpsPosition...)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// photo encodes the two-tone image as a JPEG with EXIF data and a comment
+func photo(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, twoTone(), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	const text = "Taken at the office"
+	comment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xFE}, uint16(len(text)+2))
+	comment = append(comment, text...)
+	data := append([]byte{}, encoded[:2]...)
+	data = append(data, exifSegment(orientation)...)
+	data = append(data, comment...)
+	return append(data, encoded[2:]...)
+}
+
+// isColor reports whether a decoded pixel is close to c, allowing for JPEG
+// compression
+func isColor(got color.Color, want color.RGBA) bool {
+	r, g, b, _ := got.RGBA()
+	near := func(v uint32, w uint8) bool {
+		d := int(v>>8) - int(w)
+		return d > -60 && d < 60
+	}
+	return near(r, want.R) && near(g, want.G) && near(b, want.B)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	tests := []struct {
+		name          string
+		orientation   uint16
+		width, height int
+		top, bottom   color.RGBA // Colours near the top left and bottom right
+	}{
+		{"upright", 1, 32, 16, red, blue},
+		{"upside down", 3, 32, 16, blue, red},
+		{"turned left", 6, 16, 32, red, blue},
+		{"turned right", 8, 16, 32, blue, red},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := photo(t, tt.orientation)
+			if !bytes.Contains(data, []byte(gpsPosition)) {
+				t.Fatal("test photo has no GPS position")
+			}
+
+			cleaned, err := StripMetadata(data, "image/jpeg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, leak := range []string{gpsPosition, "Exif\x00\x00", "Taken at the office"} {
+				if bytes.Contains(cleaned, []byte(leak)) {
+					t.Errorf("cleaned photo still contains %q", leak)
+				}
+			}
+
+			img, format, err := Decode(cleaned)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != "jpeg" {
+				t.Errorf("format = %q, want jpeg", format)
+			}
+			b := img.Bounds()
+			if b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			if got := img.At(b.Min.X+4, b.Min.Y+4); !isColor(got, tt.top) {
+				t.Errorf("top left = %v, want %v", got, tt.top)
+			}
+			if got := img.At(b.Max.X-5, b.Max.Y-5); !isColor(got, tt.bottom) {
+				t.Errorf("bottom right = %v, want %v", got, tt.bottom)
+			}
+		})
+	}
+}
+
+// pngChunk encodes a PNG chunk with its checksum
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, twoTone()); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// Text and EXIF chunks go after the header chunk, which is 33 bytes in
+	const afterHeader = 8 + 25
+	data := append([]byte{}, encoded[:afterHeader]...)
+	data = append(data, pngChunk("tEXt", []byte("Location\x00"+gpsPosition))...)
+	data = append(data, pngChunk("eXIf", exifSegment(1)[10:])...)
+	data = append(data, encoded[afterHeader:]...)
+	data = append(data, "trailing data"...)
+
+	cleaned, err := StripMetadata(data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{gpsPosition, "tEXt", "eXIf", "trailing data"} {
+		if bytes.Contains(cleaned, []byte(leak)) {
+			t.Errorf("cleaned image still contains %q", leak)
+		}
+	}
+	if !bytes.Equal(cleaned, encoded) {
+		t.Error("cleaned image differs from the original without metadata")
+	}
+}
+
+func TestStripCorruptImages(t *testing.T) {
+	photo := photo(t, 6)
+	tests := []struct {
+		name, contentType string
+		data              []byte
+	}{
+		{"not a JPEG", "image/jpeg", []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"/>")},
+		{"truncated JPEG", "image/jpeg", photo[:20]},
+		{"not a PNG", "image/png", []byte("<html><script>alert(1)</script>")},
+	}
+	for _, tt := range tests {
+		if _, err := StripMetadata(tt.data, tt.contentType); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
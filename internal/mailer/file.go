@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer writes every message to its own .eml file in a directory, so
+// emails can be read (or checked by scripts) without a mail server
+type FileMailer struct {
+	dir  string
+	from string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewFileMailer creates a mailer that stores messages in dir, creating it if needed
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file
+func (m *FileMailer) Send(msg Message) error {
+	m.mu.Lock()
+	m.seq++
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405"), m.seq)
+	m.mu.Unlock()
+
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, formatMessage(m.from, msg), 0o600); err != nil {
+		return fmt.Errorf("failed to write mail file: %w", err)
+	}
+	return nil
+}
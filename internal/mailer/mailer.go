@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an email sent to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string // Plain text
+	// HTML is an optional HTML version of Body. Mail clients show it instead
+	// of the plain text when they can.
+	HTML string
+	// Unsubscribe is an optional URL that unsubscribes the recipient with a
+	// single POST (RFC 8058), offered by mail clients next to the sender
+	Unsubscribe string
+}
+
+// Mailer delivers emails to users
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// formatMessage renders a message as an RFC 5322 email. Line breaks are removed
+// from header values so user-supplied text cannot inject extra headers.
+func formatMessage(from string, msg Message) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if msg.Unsubscribe != "" {
+		fmt.Fprintf(&b, "List-Unsubscribe: <%s>\r\n", header.Replace(msg.Unsubscribe))
+		b.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		b.WriteString("\r\n")
+		b.WriteString(crlf(msg.Body))
+		return []byte(b.String())
+	}
+
+	// Plain text first: clients show the last part they understand
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n", parts.Boundary())
+	b.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", msg.Body},
+		{"text/html; charset=UTF-8", msg.HTML},
+	} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		io.WriteString(w, crlf(part.body))
+	}
+	parts.Close()
+	return []byte(b.String())
+}
+
+// crlf converts line endings to the CRLF that email requires
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// LogMailer writes messages to a logger instead of sending them
+type LogMailer struct {
+	logger *log.Logger
+}
+
+// NewLogMailer creates a mailer that logs every message it is asked to send
+func NewLogMailer(logger *log.Logger) *LogMailer {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &LogMailer{logger: logger}
+}
+
+// Send logs the message
+func (m *LogMailer) Send(msg Message) error {
+	m.logger.Printf("To: %s | Subject: %s\n%s", msg.To, msg.Subject, strings.TrimSpace(msg.Body))
+	return nil
+}
@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTPConfig holds the connection settings of an SMTP server
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string // Optional; PLAIN auth is used when set
+	Password string
+	From     string
+}
+
+// SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	config SMTPConfig
+}
+
+// NewSMTPMailer creates a mailer that delivers messages over SMTP
+func NewSMTPMailer(config SMTPConfig) (*SMTPMailer, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("smtp host is required")
+	}
+	if config.From == "" {
+		return nil, fmt.Errorf("sender address is required")
+	}
+	if config.Port == 0 {
+		config.Port = 587
+	}
+	return &SMTPMailer{config: config}, nil
+}
+
+// Send delivers the message. net/smtp upgrades to TLS when the server supports
+// STARTTLS and refuses PLAIN auth over unencrypted non-local connections.
+func (m *SMTPMailer) Send(msg Message) error {
+	addr := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+	}
+
+	if err := smtp.SendMail(addr, auth, m.config.From, []string{msg.To}, formatMessage(m.config.From, msg)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
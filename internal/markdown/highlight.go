@@ -0,0 +1,214 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Classes of highlighted tokens. The stylesheet colours them; the sanitizer
+// allows exactly these on <span>.
+const (
+	keywordClass = "hl-k"
+	stringClass  = "hl-s"
+	commentClass = "hl-c"
+	numberClass  = "hl-n"
+	builtinClass = "hl-b"
+)
+
+// language describes enough of a language's lexical syntax to colour it
+type language struct {
+	keywords      []string
+	builtins      []string
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string // Characters that start a string
+	rawQuote      byte   // Quote of strings without escapes, such as Go's `
+}
+
+var (
+	cLike = language{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+	}
+	languages = map[string]language{
+		"go": withWords(language{lineComments: cLike.lineComments, blockComments: cLike.blockComments, quotes: `"'`, rawQuote: '`'},
+			"break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var",
+			"bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr any true false nil iota append cap close copy delete len make new panic print println recover min max clear"),
+		"javascript": withWords(language{lineComments: cLike.lineComments, blockComments: cLike.blockComments, quotes: `"'`, rawQuote: '`'},
+			"async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof let new of return static super switch this throw try typeof var void while with yield interface type enum implements private protected public readonly as",
+			"true false null undefined NaN Infinity console window document Promise Array Object String Number Boolean Map Set JSON Math Error string number boolean any unknown never void"),
+		"python": withWords(language{lineComments: []string{"#"}, quotes: `"'`},
+			"and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield match case",
+			"True False None self print len range list dict set tuple int str float bool open isinstance super object Exception"),
+		"sql": withWords(language{lineComments: []string{"--"}, blockComments: cLike.blockComments, quotes: `'"`},
+			"select from where and or not insert into values update set delete create table index view drop alter add column primary key foreign references on join left right inner outer cross group by order having limit offset as distinct union all exists in is null like between case when then else end begin commit rollback transaction if default unique check cascade with returning asc desc",
+			"count sum avg min max coalesce integer int text varchar char real boolean datetime timestamp date now current_timestamp"),
+		"bash": withWords(language{lineComments: []string{"#"}, quotes: `"'`},
+			"if then else elif fi for while until do done case esac function return in select local export readonly shift break continue exit",
+			"echo cd ls cat grep sed awk set unset source test read printf pwd mkdir rm cp mv chmod chown sudo curl git go docker kill"),
+		"json": withWords(language{quotes: `"`}, "", "true false null"),
+		"yaml": withWords(language{lineComments: []string{"#"}, quotes: `"'`}, "", "true false null yes no on off"),
+		"css": withWords(language{blockComments: cLike.blockComments, quotes: `"'`},
+			"@media @import @keyframes @font-face", ""),
+		"html": {blockComments: [][2]string{{"<!--", "-->"}}, quotes: `"`},
+		"rust": withWords(cLike,
+			"as async await break const continue crate dyn else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while",
+			"true false Some None Ok Err Option Result Vec String Box bool char i8 i16 i32 i64 i128 isize u8 u16 u32 u64 u128 usize f32 f64 str println format vec"),
+		"java": withWords(cLike,
+			"abstract assert break case catch class const continue default do else enum extends final finally for goto if implements import instanceof interface native new package private protected public return static strictfp super switch synchronized this throw throws transient try void volatile while var record",
+			"true false null boolean byte char double float int long short String Object Integer List Map System"),
+		"c": withWords(cLike,
+			"auto break case const continue default do else enum extern for goto if inline register restrict return sizeof static struct switch typedef union volatile while class namespace template typename public private protected virtual override new delete this using try catch throw nullptr #include #define #ifdef #ifndef #endif #if #else",
+			"void char short int long float double signed unsigned bool true false NULL size_t std string vector printf malloc free"),
+	}
+	// Other names for the languages above
+	languageAliases = map[string]string{
+		"golang": "go",
+		"js":     "javascript", "jsx": "javascript", "ts": "javascript", "tsx": "javascript", "typescript": "javascript",
+		"py": "python",
+		"sh": "bash", "shell": "bash", "zsh": "bash", "console": "bash",
+		"sqlite": "sql", "postgres": "sql", "postgresql": "sql", "mysql": "sql",
+		"yml": "yaml",
+		"xml": "html", "svg": "html",
+		"rs":     "rust",
+		"kotlin": "java", "kt": "java", "csharp": "java", "cs": "java",
+		"cpp": "c", "c++": "c", "h": "c", "hpp": "c",
+	}
+)
+
+// withWords returns a copy of a language with keyword and builtin lists
+func withWords(l language, keywords, builtins string) language {
+	l.keywords = strings.Fields(keywords)
+	l.builtins = strings.Fields(builtins)
+	return l
+}
+
+func lookupLanguage(name string) (language, bool) {
+	if alias, ok := languageAliases[name]; ok {
+		name = alias
+	}
+	l, ok := languages[name]
+	return l, ok
+}
+
+// highlight returns escaped code with tokens wrapped in classed spans. Code in
+// unknown languages is only escaped.
+func highlight(lang, code string) string {
+	l, ok := lookupLanguage(lang)
+	if !ok {
+		return escapeHTML(code)
+	}
+	caseless := lang == "sql" || languageAliases[lang] == "sql"
+
+	var sb strings.Builder
+	span := func(class, text string) {
+		sb.WriteString(`<span class="` + class + `">` + escapeHTML(text) + "</span>")
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+
+		if end := commentEnd(l, rest); end > 0 {
+			span(commentClass, rest[:end])
+			i += end
+			continue
+		}
+
+		c := code[i]
+		if strings.IndexByte(l.quotes, c) >= 0 || (l.rawQuote != 0 && c == l.rawQuote) {
+			n := stringEnd(rest, c, c != l.rawQuote)
+			span(stringClass, rest[:n])
+			i += n
+			continue
+		}
+
+		if c >= '0' && c <= '9' && (i == 0 || !isWordByte(code[i-1])) {
+			n := 1
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			span(numberClass, rest[:n])
+			i += n
+			continue
+		}
+
+		if isWordStart(c) {
+			n := 1
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '-' && lang == "css") {
+				n++
+			}
+			word := rest[:n]
+			switch {
+			case hasWord(l.keywords, word, caseless):
+				span(keywordClass, word)
+			case hasWord(l.builtins, word, caseless):
+				span(builtinClass, word)
+			default:
+				sb.WriteString(escapeHTML(word))
+			}
+			i += n
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(rest)
+		sb.WriteString(escapeHTML(rest[:size]))
+		i += size
+	}
+	return sb.String()
+}
+
+// commentEnd returns the length of a comment starting at the beginning of s, or 0
+func commentEnd(l language, s string) int {
+	for _, prefix := range l.lineComments {
+		if strings.HasPrefix(s, prefix) {
+			if end := strings.IndexByte(s, '\n'); end >= 0 {
+				return end
+			}
+			return len(s)
+		}
+	}
+	for _, pair := range l.blockComments {
+		if strings.HasPrefix(s, pair[0]) {
+			if end := strings.Index(s[len(pair[0]):], pair[1]); end >= 0 {
+				return len(pair[0]) + end + len(pair[1])
+			}
+			return len(s)
+		}
+	}
+	return 0
+}
+
+// stringEnd returns the length of a string literal starting at the beginning
+// of s. Escaped strings end at the end of the line if they are not closed.
+func stringEnd(s string, quote byte, escapes bool) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escapes && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			return i + 1
+		case escapes && s[i] == '\n':
+			return i
+		}
+	}
+	return len(s)
+}
+
+func hasWord(words []string, word string, caseless bool) bool {
+	for _, w := range words {
+		if w == word || caseless && strings.EqualFold(w, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c == '@' || c == '#' || c >= 0x80 || unicode.IsLetter(rune(c))
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
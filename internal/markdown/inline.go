@@ -0,0 +1,562 @@
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type inlineKind int
+
+const (
+	textInline      inlineKind = iota // Literal text, escaped when written
+	htmlInline                        // Finished markup
+	delimiterInline                   // Run of *, _ or ~ that may become emphasis
+	bracketInline                     // [ or ![ that may open a link or image
+	autolinkInline                    // Bare URL turned into a link, unless inside another link
+)
+
+type inlineNode struct {
+	kind inlineKind
+	text string // Text, markup, the delimiter character or the bracket
+
+	// Delimiter runs
+	count    int // Delimiters left unmatched
+	canOpen  bool
+	canClose bool
+	opens    []string // Tags opened by matched delimiters, innermost first
+	closes   []string // Tags closed by matched delimiters, innermost first
+
+	// Brackets, and the images made from them
+	image  bool
+	source int // Offset in the source just after the bracket
+
+	url string // Target of bare autolinks
+}
+
+var (
+	entityRef      = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	uriAutolink    = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*)>`)
+	emailAutolink  = regexp.MustCompile(`^<([A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*)>`)
+	bareURL        = regexp.MustCompile(`^(?:https?://|www\.)[^\s<]+`)
+	linkTitleQuote = regexp.MustCompile(`^(?:"((?:[^"\\]|\\.)*)"|'((?:[^'\\]|\\.)*)'|\(((?:[^()\\]|\\.)*)\))`)
+)
+
+// inline renders the inline content of a block
+func (p *parser) inline(src string) string {
+	var nodes []*inlineNode
+	var text strings.Builder
+	// Open brackets, and how many of them can no longer become links
+	var brackets []int
+	inactive := 0
+
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, &inlineNode{kind: textInline, text: text.String()})
+			text.Reset()
+		}
+	}
+	push := func(n *inlineNode) {
+		flush()
+		nodes = append(nodes, n)
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			push(&inlineNode{kind: htmlInline, text: "<br>\n"})
+			i += 2
+
+		case c == '\\' && i+1 < len(src) && isASCIIPunct(src[i+1]):
+			text.WriteByte(src[i+1])
+			i += 2
+
+		case c == '`':
+			run := countRun(src, i, '`')
+			end := findCodeSpanEnd(src, i+run, run)
+			if end < 0 {
+				text.WriteString(src[i : i+run])
+				i += run
+				continue
+			}
+			push(&inlineNode{kind: htmlInline, text: "<code>" + escapeHTML(codeSpanContent(src[i+run:end])) + "</code>"})
+			i = end + run
+
+		case c == '*' || c == '_' || c == '~':
+			run := countRun(src, i, c)
+			if c == '~' && run > 2 {
+				text.WriteString(src[i : i+run])
+				i += run
+				continue
+			}
+			open, close := flanking(src, i, run, c)
+			push(&inlineNode{kind: delimiterInline, text: string(c), count: run, canOpen: open, canClose: close})
+			i += run
+
+		case c == '!' && i+1 < len(src) && src[i+1] == '[':
+			push(&inlineNode{kind: bracketInline, text: "![", image: true, source: i + 2})
+			brackets = append(brackets, len(nodes)-1)
+			i += 2
+
+		case c == '[':
+			push(&inlineNode{kind: bracketInline, text: "[", source: i + 1})
+			brackets = append(brackets, len(nodes)-1)
+			i++
+
+		case c == ']':
+			flush()
+			if len(brackets) == 0 {
+				text.WriteByte(']')
+				i++
+				continue
+			}
+			top := len(brackets) - 1
+			opener := brackets[top]
+			brackets = brackets[:top]
+			// A link cannot contain another link
+			active := nodes[opener].image || top >= inactive
+			inactive = min(inactive, top)
+			if consumed, ok := p.closeBracket(&nodes, src, i, opener, active); ok {
+				if !nodes[len(nodes)-1].image {
+					inactive = len(brackets)
+				}
+				i = consumed
+				continue
+			}
+			nodes[opener].kind = textInline
+			text.WriteByte(']')
+			i++
+
+		case c == '<':
+			if m := uriAutolink.FindStringSubmatch(src[i:]); m != nil {
+				push(&inlineNode{kind: htmlInline, text: linkHTML(m[1], "", escapeHTML(m[1]))})
+				i += len(m[0])
+				continue
+			}
+			if m := emailAutolink.FindStringSubmatch(src[i:]); m != nil {
+				push(&inlineNode{kind: htmlInline, text: linkHTML("mailto:"+m[1], "", escapeHTML(m[1]))})
+				i += len(m[0])
+				continue
+			}
+			text.WriteByte('<')
+			i++
+
+		case c == '&':
+			if m := entityRef.FindString(src[i:]); m != "" {
+				text.WriteString(html.UnescapeString(m))
+				i += len(m)
+				continue
+			}
+			text.WriteByte('&')
+			i++
+
+		case c == '\n':
+			// Line breaks are kept; trailing spaces only mattered to CommonMark
+			s := strings.TrimRight(text.String(), " ")
+			text.Reset()
+			text.WriteString(s)
+			push(&inlineNode{kind: htmlInline, text: "<br>\n"})
+			i++
+			for i < len(src) && src[i] == ' ' {
+				i++
+			}
+
+		case (c == 'h' || c == 'w') && atWordStart(src, i):
+			if m := bareURL.FindString(src[i:]); m != "" {
+				m = trimURL(m)
+				target := m
+				if strings.HasPrefix(m, "www.") {
+					target = "http://" + m
+				}
+				push(&inlineNode{kind: autolinkInline, text: m, url: target})
+				i += len(m)
+				continue
+			}
+			text.WriteByte(c)
+			i++
+
+		default:
+			_, size := utf8.DecodeRuneInString(src[i:])
+			text.WriteString(src[i : i+size])
+			i += size
+		}
+	}
+	flush()
+
+	processEmphasis(nodes)
+	return renderInline(nodes, true)
+}
+
+// closeBracket turns the nodes after an open bracket into a link or image if
+// a destination follows the ]. It returns where parsing continues.
+func (p *parser) closeBracket(nodes *[]*inlineNode, src string, i, opener int, active bool) (int, bool) {
+	bracket := (*nodes)[opener]
+	if !active {
+		return 0, false
+	}
+	dest, title, next, ok := p.linkTarget(src, i+1, src[bracket.source:i])
+	if !ok {
+		return 0, false
+	}
+
+	inner := (*nodes)[opener+1:]
+	processEmphasis(inner)
+	var markup string
+	if bracket.image {
+		markup = `<img src="` + escapeHTML(normalizeURL(dest)) + `" alt="` + escapeHTML(plainText(inner)) + `"`
+		if title != "" {
+			markup += ` title="` + escapeHTML(title) + `"`
+		}
+		markup += ">"
+	} else {
+		markup = linkHTML(dest, title, renderInline(inner, false))
+	}
+	*nodes = append((*nodes)[:opener], &inlineNode{kind: htmlInline, text: markup, image: bracket.image})
+	return next, true
+}
+
+// maxLabelLength is the longest link label CommonMark allows
+const maxLabelLength = 999
+
+// linkTarget parses what follows the ] of a link: an inline (destination
+// "title"), a full [label] or collapsed [] reference, or a shortcut reference
+// using the link text as label
+func (p *parser) linkTarget(src string, i int, text string) (dest, title string, next int, ok bool) {
+	if i < len(src) && src[i] == '(' {
+		if dest, title, next, ok := inlineTarget(src, i+1); ok {
+			return dest, title, next, true
+		}
+	}
+
+	if len(p.refs) == 0 {
+		return "", "", 0, false
+	}
+	label := text
+	next = i
+	if i < len(src) && src[i] == '[' {
+		if end := strings.IndexByte(src[i+1:], ']'); end >= 0 {
+			if l := src[i+1 : i+1+end]; strings.TrimSpace(l) != "" {
+				label = l
+			}
+			next = i + end + 2
+		}
+	}
+	if len(label) > maxLabelLength {
+		return "", "", 0, false
+	}
+	ref, found := p.refs[normalizeLabel(label)]
+	if !found {
+		return "", "", 0, false
+	}
+	return ref.dest, ref.title, next, true
+}
+
+// inlineTarget parses the inside of (destination "title") starting after the (
+func inlineTarget(src string, i int) (dest, title string, next int, ok bool) {
+	i = skipSpace(src, i)
+	if i < len(src) && src[i] == '<' {
+		end := strings.IndexAny(src[i+1:], "<>\n")
+		if end < 0 || src[i+1+end] != '>' {
+			return "", "", 0, false
+		}
+		dest = src[i+1 : i+1+end]
+		i += end + 2
+	} else {
+		start, depth := i, 0
+		for i < len(src) && src[i] > ' ' {
+			if src[i] == '\\' && i+1 < len(src) {
+				i += 2
+				continue
+			}
+			if src[i] == '(' {
+				depth++
+			} else if src[i] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+			i++
+		}
+		dest = src[start:i]
+	}
+
+	j := skipSpace(src, i)
+	if j > i {
+		if m := linkTitleQuote.FindStringSubmatch(src[j:]); m != nil {
+			title = m[1] + m[2] + m[3]
+			j = skipSpace(src, j+len(m[0]))
+		}
+	}
+	if j >= len(src) || src[j] != ')' {
+		return "", "", 0, false
+	}
+	return unescapeBackslashes(dest), unescapeBackslashes(title), j + 1, true
+}
+
+// processEmphasis matches delimiter runs into <em>, <strong> and <del>,
+// following the CommonMark delimiter algorithm
+func processEmphasis(nodes []*inlineNode) {
+	var openers []*inlineNode
+	// bottoms remembers, per kind of closer, below which opener a search
+	// already failed, which keeps long runs of unmatched delimiters linear
+	bottoms := make(map[string]int)
+
+	for _, closer := range nodes {
+		if closer.kind != delimiterInline {
+			continue
+		}
+		for closer.canClose && closer.count > 0 {
+			key := closer.text + strconv.Itoa(closer.count%3) + strconv.FormatBool(closer.canOpen)
+			found := -1
+			for o := len(openers) - 1; o >= bottoms[key]; o-- {
+				if matches(openers[o], closer) {
+					found = o
+					break
+				}
+			}
+			if found < 0 {
+				bottoms[key] = len(openers)
+				break
+			}
+
+			opener := openers[found]
+			use, tag := 1, "em"
+			switch {
+			case closer.text == "~":
+				use, tag = closer.count, "del"
+			case opener.count >= 2 && closer.count >= 2:
+				use, tag = 2, "strong"
+			}
+			opener.count -= use
+			closer.count -= use
+			opener.opens = append(opener.opens, "<"+tag+">")
+			closer.closes = append(closer.closes, "</"+tag+">")
+
+			// Delimiters between the pair can no longer match anything
+			openers = openers[:found+1]
+			if opener.count == 0 {
+				openers = openers[:found]
+			}
+			for k, bottom := range bottoms {
+				bottoms[k] = min(bottom, len(openers))
+			}
+		}
+		if closer.canOpen && closer.count > 0 {
+			openers = append(openers, closer)
+		}
+	}
+}
+
+// matches reports whether an opening delimiter run can pair with a closing one
+func matches(opener, closer *inlineNode) bool {
+	if opener.text != closer.text || opener.count == 0 {
+		return false
+	}
+	if closer.text == "~" {
+		return opener.count == closer.count
+	}
+	// The "multiple of three" rule keeps *foo**bar* from pairing oddly
+	return !((opener.canClose || closer.canOpen) && (opener.count+closer.count)%3 == 0 &&
+		!(opener.count%3 == 0 && closer.count%3 == 0))
+}
+
+// renderInline writes nodes as HTML. Bare autolinks inside a link are
+// written as text, since links cannot nest.
+func renderInline(nodes []*inlineNode, links bool) string {
+	var sb strings.Builder
+	for _, n := range nodes {
+		switch n.kind {
+		case textInline, bracketInline:
+			sb.WriteString(escapeHTML(n.text))
+		case htmlInline:
+			sb.WriteString(n.text)
+		case autolinkInline:
+			if links {
+				sb.WriteString(linkHTML(n.url, "", escapeHTML(n.text)))
+			} else {
+				sb.WriteString(escapeHTML(n.text))
+			}
+		case delimiterInline:
+			// Closing tags come first, then the unmatched delimiters, then the
+			// tags this run opens, outermost first
+			for _, tag := range n.closes {
+				sb.WriteString(tag)
+			}
+			sb.WriteString(strings.Repeat(n.text, n.count))
+			for i := len(n.opens) - 1; i >= 0; i-- {
+				sb.WriteString(n.opens[i])
+			}
+		}
+	}
+	return sb.String()
+}
+
+// plainText is the text of nodes without markup, for image alt text
+func plainText(nodes []*inlineNode) string {
+	var sb strings.Builder
+	for _, n := range nodes {
+		switch n.kind {
+		case textInline, bracketInline, autolinkInline:
+			sb.WriteString(n.text)
+		case delimiterInline:
+			sb.WriteString(strings.Repeat(n.text, n.count))
+		case htmlInline:
+			sb.WriteString(html.UnescapeString(stripTags(n.text)))
+		}
+	}
+	return sb.String()
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func stripTags(s string) string {
+	return tagPattern.ReplaceAllString(s, "")
+}
+
+func linkHTML(dest, title, content string) string {
+	markup := `<a href="` + escapeHTML(normalizeURL(dest)) + `"`
+	if title != "" {
+		markup += ` title="` + escapeHTML(title) + `"`
+	}
+	return markup + ">" + content + "</a>"
+}
+
+// normalizeURL percent-encodes characters that may not appear in a URL while
+// keeping existing escapes
+func normalizeURL(dest string) string {
+	var sb strings.Builder
+	for i := 0; i < len(dest); i++ {
+		c := dest[i]
+		switch {
+		case c == '%' && i+2 < len(dest) && isHex(dest[i+1]) && isHex(dest[i+2]):
+			sb.WriteByte(c)
+		case c > ' ' && c < 0x7f && c != '"' && c != '<' && c != '>' && c != '\\' && c != '`' && c != '{' && c != '}' && c != '|' && c != '^' && c != '%':
+			sb.WriteByte(c)
+		default:
+			sb.WriteString(url.QueryEscape(string(c)))
+		}
+	}
+	return strings.ReplaceAll(sb.String(), "+", "%20")
+}
+
+// flanking decides whether a delimiter run can open or close emphasis
+func flanking(src string, i, run int, c byte) (canOpen, canClose bool) {
+	before, after := ' ', ' '
+	if i > 0 {
+		before, _ = utf8.DecodeLastRuneInString(src[:i])
+	}
+	if i+run < len(src) {
+		after, _ = utf8.DecodeRuneInString(src[i+run:])
+	}
+
+	left := !unicode.IsSpace(after) && (!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+	right := !unicode.IsSpace(before) && (!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+	if c == '_' {
+		// Underscores inside words, as in snake_case, are not emphasis
+		return left && (!right || isPunct(before)), right && (!left || isPunct(after))
+	}
+	return left, right
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func countRun(src string, i int, c byte) int {
+	n := 0
+	for i+n < len(src) && src[i+n] == c {
+		n++
+	}
+	return n
+}
+
+// findCodeSpanEnd returns the start of the backtick run closing a code span
+func findCodeSpanEnd(src string, i, run int) int {
+	for i < len(src) {
+		j := strings.IndexByte(src[i:], '`')
+		if j < 0 {
+			return -1
+		}
+		j += i
+		n := countRun(src, j, '`')
+		if n == run {
+			return j
+		}
+		i = j + n
+	}
+	return -1
+}
+
+func codeSpanContent(s string) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) >= 2 && s[0] == ' ' && s[len(s)-1] == ' ' && strings.Trim(s, " ") != "" {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+func skipSpace(src string, i int) int {
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t' || src[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// atWordStart reports whether a bare URL may start at i
+func atWordStart(src string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(src[:i])
+	return unicode.IsSpace(r) || r == '(' || r == '*' || r == '_' || r == '~'
+}
+
+// trimURL drops trailing punctuation that more likely ends the sentence than
+// the URL, and closing parentheses without a matching opening one
+func trimURL(u string) string {
+	for len(u) > 0 {
+		last := u[len(u)-1]
+		switch {
+		case strings.IndexByte("?!.,:*_~'\";", last) >= 0:
+			u = u[:len(u)-1]
+		case last == ')' && strings.Count(u, ")") > strings.Count(u, "("):
+			u = u[:len(u)-1]
+		default:
+			return u
+		}
+	}
+	return u
+}
+
+func unescapeBackslashes(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// escapeHTML escapes text for element content and quoted attribute values
+func escapeHTML(s string) string {
+	return html.EscapeString(s)
+}
@@ -0,0 +1,587 @@
+// Package markdown renders post and comment bodies from CommonMark with the
+// GitHub extensions people expect: fenced code with syntax highlighting,
+// tables, strikethrough and bare URL autolinks. Line breaks inside a
+// paragraph are kept, as in GitHub comments, so text written before Markdown
+// existed still looks the same.
+//
+// Raw HTML in the source is shown as text, and the rendered HTML is passed
+// through an allow-list sanitizer before it is returned, so a bug in the
+// parser cannot produce markup outside the allow-list.
+package markdown
+
+import (
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version changes whenever the output for the same source may change.
+// Rendered HTML cached with an older version is rendered again.
+const Version = 1
+
+// Render converts Markdown to sanitized HTML
+func Render(src string) template.HTML {
+	p := &parser{refs: make(map[string]linkRef)}
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\r", "\n"), "\n")
+	blocks := p.parseBlocks(lines)
+
+	var sb strings.Builder
+	p.renderBlocks(&sb, blocks, false)
+	return template.HTML(Sanitize(sb.String()))
+}
+
+type blockKind int
+
+const (
+	paragraphBlock blockKind = iota
+	headingBlock
+	codeBlock
+	quoteBlock
+	listBlock
+	itemBlock
+	ruleBlock
+	tableBlock
+)
+
+type block struct {
+	kind     blockKind
+	text     string   // Inline source of paragraphs, headings and table cells
+	level    int      // Heading level
+	lang     string   // Language of fenced code
+	lines    []string // Lines of code blocks
+	children []*block // Blocks inside quotes, lists and list items
+	ordered  bool
+	start    int  // First number of an ordered list
+	tight    bool // List items without blank lines render without <p>
+	align    []string
+	header   []string
+	rows     [][]string
+}
+
+// linkRef is a link reference definition: [label]: destination "title"
+type linkRef struct {
+	dest  string
+	title string
+}
+
+type parser struct {
+	refs  map[string]linkRef
+	depth int // Quotes and lists the parser is inside
+}
+
+// maxNesting limits how deeply quotes and lists nest. Deeper markers are
+// text, which keeps parsing time linear for hostile input.
+const maxNesting = 16
+
+var (
+	atxHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	thematicBreak = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceOpen     = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*)$")
+	setextLine    = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	listMarker    = regexp.MustCompile(`^( {0,3})([-*+]|[0-9]{1,9}[.)])([ \t]+|$)`)
+	tableDelim    = regexp.MustCompile(`^[ \t]*\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	refDefinition = regexp.MustCompile(`^ {0,3}\[((?:[^\[\]\\]|\\.){1,999})\]:[ \t]*(<[^<>\n]*>|\S+)(?:[ \t]+("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|\((?:[^()\\]|\\.)*\)))?[ \t]*$`)
+)
+
+// expandTabs replaces tabs in a line's indentation with spaces up to the next
+// multiple of four
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var sb strings.Builder
+	col := 0
+	for i, r := range line {
+		switch r {
+		case '\t':
+			n := 4 - col%4
+			sb.WriteString(strings.Repeat(" ", n))
+			col += n
+		case ' ':
+			sb.WriteByte(' ')
+			col++
+		default:
+			sb.WriteString(line[i:])
+			return sb.String()
+		}
+	}
+	return sb.String()
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// stripIndent removes up to n leading spaces
+func stripIndent(line string, n int) string {
+	i := 0
+	for i < n && i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return line[i:]
+}
+
+// startsBlock reports whether a line starts a block that interrupts a paragraph
+func startsBlock(line string) bool {
+	if atxHeading.MatchString(line) || thematicBreak.MatchString(line) || fenceOpen.MatchString(line) {
+		return true
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	if indentOf(line) < 4 && strings.HasPrefix(trimmed, ">") {
+		return true
+	}
+	if m := listMarker.FindStringSubmatch(line); m != nil && m[3] != "" {
+		// Only lists starting at 1 interrupt a paragraph, so "2019. was a
+		// good year" stays text
+		marker := m[2]
+		return !isOrdered(marker) || strings.TrimRight(marker, ".)") == "1"
+	}
+	return false
+}
+
+func isOrdered(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+// parseBlocks splits lines into blocks
+func (p *parser) parseBlocks(lines []string) []*block {
+	var blocks []*block
+	for i := 0; i < len(lines); {
+		line := expandTabs(lines[i])
+
+		switch {
+		case isBlank(line):
+			i++
+
+		case fenceOpen.MatchString(line):
+			b, next := p.fencedCode(lines, i)
+			blocks = append(blocks, b)
+			i = next
+
+		case indentOf(line) >= 4:
+			b, next := indentedCode(lines, i)
+			blocks = append(blocks, b)
+			i = next
+
+		case atxHeading.MatchString(line):
+			m := atxHeading.FindStringSubmatch(line)
+			blocks = append(blocks, &block{kind: headingBlock, level: len(m[1]), text: strings.TrimSpace(m[2])})
+			i++
+
+		case thematicBreak.MatchString(line):
+			blocks = append(blocks, &block{kind: ruleBlock})
+			i++
+
+		case p.depth < maxNesting && strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			b, next := p.blockquote(lines, i)
+			blocks = append(blocks, b)
+			i = next
+
+		case p.depth < maxNesting && listMarker.MatchString(line):
+			b, next := p.list(lines, i)
+			blocks = append(blocks, b)
+			i = next
+
+		case i+1 < len(lines) && strings.Contains(line, "|") && tableDelim.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-"):
+			b, next, ok := table(lines, i)
+			if ok {
+				blocks = append(blocks, b)
+				i = next
+				continue
+			}
+			fallthrough
+
+		default:
+			b, next := p.paragraph(lines, i)
+			if b != nil {
+				blocks = append(blocks, b)
+			}
+			i = next
+		}
+	}
+	return blocks
+}
+
+// nested parses the lines inside a quote or list item
+func (p *parser) nested(lines []string) []*block {
+	p.depth++
+	defer func() { p.depth-- }()
+	return p.parseBlocks(lines)
+}
+
+func (p *parser) fencedCode(lines []string, i int) (*block, int) {
+	m := fenceOpen.FindStringSubmatch(expandTabs(lines[i]))
+	indent, fence := len(m[1]), m[2]
+	var lang string
+	if fields := strings.Fields(m[3]); len(fields) > 0 {
+		lang = strings.ToLower(fields[0])
+	}
+
+	b := &block{kind: codeBlock, lang: lang}
+	for i++; i < len(lines); i++ {
+		line := expandTabs(lines[i])
+		trimmed := strings.TrimSpace(line)
+		if indentOf(line) < 4 && strings.HasPrefix(trimmed, fence[:1]) &&
+			len(trimmed) >= len(fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			return b, i + 1
+		}
+		b.lines = append(b.lines, stripIndent(line, indent))
+	}
+	// An unclosed fence runs to the end of the text
+	return b, i
+}
+
+func indentedCode(lines []string, i int) (*block, int) {
+	b := &block{kind: codeBlock}
+	for ; i < len(lines); i++ {
+		line := expandTabs(lines[i])
+		if !isBlank(line) && indentOf(line) < 4 {
+			break
+		}
+		b.lines = append(b.lines, stripIndent(line, 4))
+	}
+	for len(b.lines) > 0 && isBlank(b.lines[len(b.lines)-1]) {
+		b.lines = b.lines[:len(b.lines)-1]
+	}
+	return b, i
+}
+
+func (p *parser) blockquote(lines []string, i int) (*block, int) {
+	var inner []string
+	inParagraph := false
+	for ; i < len(lines); i++ {
+		line := expandTabs(lines[i])
+		trimmed := strings.TrimLeft(line, " ")
+		if indentOf(line) < 4 && strings.HasPrefix(trimmed, ">") {
+			content := strings.TrimPrefix(trimmed, ">")
+			content = strings.TrimPrefix(content, " ")
+			inner = append(inner, content)
+			inParagraph = !isBlank(content) && !startsBlock(content)
+			continue
+		}
+		// Lazy continuation of a paragraph inside the quote
+		if inParagraph && !isBlank(line) && !startsBlock(line) {
+			inner = append(inner, line)
+			continue
+		}
+		break
+	}
+	return &block{kind: quoteBlock, children: p.nested(inner)}, i
+}
+
+func (p *parser) list(lines []string, i int) (*block, int) {
+	first := listMarker.FindStringSubmatch(expandTabs(lines[i]))
+	list := &block{kind: listBlock, ordered: isOrdered(first[2]), tight: true}
+	if list.ordered {
+		list.start, _ = strconv.Atoi(strings.TrimRight(first[2], ".)"))
+	}
+	delimiter := first[2][len(first[2])-1:]
+
+	for i < len(lines) {
+		line := expandTabs(lines[i])
+		m := listMarker.FindStringSubmatch(line)
+		if m == nil || isOrdered(m[2]) != list.ordered || m[2][len(m[2])-1:] != delimiter {
+			break
+		}
+		if thematicBreak.MatchString(line) {
+			break
+		}
+
+		// Content starts after the marker and one to four spaces
+		width := len(m[1]) + len(m[2])
+		spaces := len(m[3])
+		if spaces == 0 || spaces > 4 || isBlank(line[len(m[0]):]) {
+			spaces = 1
+		}
+		contentIndent := width + spaces
+		var content []string
+		if len(line) > width {
+			content = append(content, stripIndent(line[width:], spaces))
+		} else {
+			content = append(content, "")
+		}
+
+		i++
+		inParagraph := !isBlank(content[0])
+		blankBefore := false
+		for i < len(lines) {
+			next := expandTabs(lines[i])
+			if isBlank(next) {
+				content = append(content, "")
+				blankBefore = true
+				inParagraph = false
+				i++
+				continue
+			}
+			if indentOf(next) >= contentIndent {
+				content = append(content, stripIndent(next, contentIndent))
+				inParagraph = !blankBefore || inParagraph
+				blankBefore = false
+				i++
+				continue
+			}
+			if listMarker.MatchString(next) {
+				// The next item, or a list the item cannot hold
+				break
+			}
+			if inParagraph && !blankBefore && !startsBlock(next) {
+				content = append(content, next)
+				i++
+				continue
+			}
+			break
+		}
+
+		// Trailing blank lines belong between items, not inside the last one
+		trailing := 0
+		for len(content) > 0 && isBlank(content[len(content)-1]) {
+			content = content[:len(content)-1]
+			trailing++
+		}
+		item := &block{kind: itemBlock, children: p.nested(content)}
+		if hasInnerBlank(content) && len(item.children) > 1 {
+			list.tight = false
+		}
+		list.children = append(list.children, item)
+
+		if trailing > 0 {
+			if i < len(lines) {
+				if m := listMarker.FindStringSubmatch(expandTabs(lines[i])); m != nil && isOrdered(m[2]) == list.ordered && m[2][len(m[2])-1:] == delimiter {
+					list.tight = false
+					continue
+				}
+			}
+			break
+		}
+	}
+	return list, i
+}
+
+// hasInnerBlank reports whether an item has a blank line between two of its
+// blocks, which makes the list loose
+func hasInnerBlank(content []string) bool {
+	inFence := false
+	for _, line := range content {
+		if fenceOpen.MatchString(line) {
+			inFence = !inFence
+		}
+		if !inFence && isBlank(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func table(lines []string, i int) (*block, int, bool) {
+	header := splitRow(lines[i])
+	delims := splitRow(lines[i+1])
+	if len(header) != len(delims) {
+		return nil, i, false
+	}
+
+	b := &block{kind: tableBlock, header: header}
+	for _, d := range delims {
+		d = strings.TrimSpace(d)
+		switch {
+		case strings.HasPrefix(d, ":") && strings.HasSuffix(d, ":"):
+			b.align = append(b.align, "center")
+		case strings.HasSuffix(d, ":"):
+			b.align = append(b.align, "right")
+		case strings.HasPrefix(d, ":"):
+			b.align = append(b.align, "left")
+		default:
+			b.align = append(b.align, "")
+		}
+	}
+
+	for i += 2; i < len(lines); i++ {
+		line := expandTabs(lines[i])
+		if isBlank(line) || startsBlock(line) {
+			break
+		}
+		row := splitRow(line)
+		// Rows are cut or padded to the header's width
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		b.rows = append(b.rows, row[:len(header)])
+	}
+	return b, i, true
+}
+
+// splitRow splits a table row on pipes that are not escaped
+func splitRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func (p *parser) paragraph(lines []string, i int) (*block, int) {
+	var text []string
+	for ; i < len(lines); i++ {
+		line := expandTabs(lines[i])
+		if isBlank(line) {
+			break
+		}
+		if len(text) > 0 {
+			if m := setextLine.FindStringSubmatch(line); m != nil {
+				level := 2
+				if m[1][0] == '=' {
+					level = 1
+				}
+				if body := p.stripDefinitions(text); len(body) > 0 {
+					return &block{kind: headingBlock, level: level, text: strings.Join(body, "\n")}, i + 1
+				}
+			}
+			if startsBlock(line) {
+				break
+			}
+		}
+		text = append(text, strings.TrimLeft(line, " "))
+	}
+
+	text = p.stripDefinitions(text)
+	if len(text) == 0 {
+		return nil, i
+	}
+	return &block{kind: paragraphBlock, text: strings.Join(text, "\n")}, i
+}
+
+// stripDefinitions records link reference definitions at the start of a
+// paragraph and returns the lines that remain
+func (p *parser) stripDefinitions(lines []string) []string {
+	for len(lines) > 0 {
+		m := refDefinition.FindStringSubmatch(lines[0])
+		if m == nil {
+			break
+		}
+		label := normalizeLabel(m[1])
+		if _, ok := p.refs[label]; !ok && label != "" {
+			dest := strings.TrimSuffix(strings.TrimPrefix(m[2], "<"), ">")
+			title := ""
+			if len(m[3]) >= 2 {
+				title = m[3][1 : len(m[3])-1]
+			}
+			p.refs[label] = linkRef{dest: unescapeBackslashes(dest), title: unescapeBackslashes(title)}
+		}
+		lines = lines[1:]
+	}
+	return lines
+}
+
+// normalizeLabel matches link labels case-insensitively and ignoring runs of whitespace
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+func (p *parser) renderBlocks(sb *strings.Builder, blocks []*block, tight bool) {
+	for i, b := range blocks {
+		switch b.kind {
+		case paragraphBlock:
+			if tight {
+				sb.WriteString(p.inline(b.text))
+				if i < len(blocks)-1 {
+					sb.WriteByte('\n')
+				}
+			} else {
+				sb.WriteString("<p>" + p.inline(b.text) + "</p>\n")
+			}
+
+		case headingBlock:
+			tag := "h" + strconv.Itoa(b.level)
+			sb.WriteString("<" + tag + ">" + p.inline(b.text) + "</" + tag + ">\n")
+
+		case ruleBlock:
+			sb.WriteString("<hr>\n")
+
+		case codeBlock:
+			code := strings.Join(b.lines, "\n")
+			if len(b.lines) > 0 {
+				code += "\n"
+			}
+			if b.lang != "" {
+				sb.WriteString(`<pre><code class="language-` + escapeHTML(b.lang) + `">`)
+			} else {
+				sb.WriteString("<pre><code>")
+			}
+			sb.WriteString(highlight(b.lang, code))
+			sb.WriteString("</code></pre>\n")
+
+		case quoteBlock:
+			sb.WriteString("<blockquote>\n")
+			p.renderBlocks(sb, b.children, false)
+			sb.WriteString("</blockquote>\n")
+
+		case listBlock:
+			switch {
+			case !b.ordered:
+				sb.WriteString("<ul>\n")
+			case b.start != 1:
+				sb.WriteString(`<ol start="` + strconv.Itoa(b.start) + `">` + "\n")
+			default:
+				sb.WriteString("<ol>\n")
+			}
+			for _, item := range b.children {
+				sb.WriteString("<li>")
+				p.renderBlocks(sb, item.children, b.tight)
+				sb.WriteString("</li>\n")
+			}
+			if b.ordered {
+				sb.WriteString("</ol>\n")
+			} else {
+				sb.WriteString("</ul>\n")
+			}
+
+		case tableBlock:
+			sb.WriteString("<table>\n<thead>\n<tr>\n")
+			for i, cell := range b.header {
+				sb.WriteString(cellTag("th", b.align[i]) + p.inline(cell) + "</th>\n")
+			}
+			sb.WriteString("</tr>\n</thead>\n")
+			if len(b.rows) > 0 {
+				sb.WriteString("<tbody>\n")
+				for _, row := range b.rows {
+					sb.WriteString("<tr>\n")
+					for i, cell := range row {
+						sb.WriteString(cellTag("td", b.align[i]) + p.inline(cell) + "</td>\n")
+					}
+					sb.WriteString("</tr>\n")
+				}
+				sb.WriteString("</tbody>\n")
+			}
+			sb.WriteString("</table>\n")
+		}
+	}
+}
+
+// cellTag opens a table cell. Alignment is a class rather than a style
+// attribute so the sanitizer never has to allow inline CSS.
+func cellTag(tag, align string) string {
+	if align == "" {
+		return "<" + tag + ">"
+	}
+	return "<" + tag + ` class="align-` + align + `">`
+}
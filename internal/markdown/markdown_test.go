@@ -0,0 +1,116 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment string
+		want     string
+	}{
+		// Schemes
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"mixed case scheme", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"whitespace in scheme", "<a href=\" java\tscript:alert(1)\">x</a>", `<a rel="nofollow ugc noopener">x</a>`},
+		{"entity encoded scheme", `<a href="&#106;avascript:alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"entity encoded colon", `<a href="javascript&colon;alert(1)">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"data link", `<a href="data:text/html,<script>alert(1)</script>">x</a>`, `<a rel="nofollow ugc noopener">x</a>`},
+		{"data image", `<img src="data:image/png;base64,AAAA" alt="x">`, ``},
+		{"mailto link", `<a href="mailto:a@example.com">m</a>`, `<a href="mailto:a@example.com" rel="nofollow ugc noopener">m</a>`},
+		{"mailto image", `<img src="mailto:a@example.com">`, ``},
+
+		// Attributes
+		{"event handlers and rel are replaced", `<a href="/relative?q=1#f" onclick="alert(1)" rel="opener" target="_blank">x</a>`, `<a href="/relative?q=1#f" rel="nofollow ugc noopener">x</a>`},
+		{"unquoted event handler", `<img src=x onerror=alert(1)>`, `<img src="x" loading="lazy">`},
+		{"quote breakout in title", `<a href="https://example.com" title="a&quot; onmouseover=&quot;alert(1)">x</a>`, `<a href="https://example.com" title="a&#34; onmouseover=&#34;alert(1)" rel="nofollow ugc noopener">x</a>`},
+		{"quote breakout in alt", `<img src="/a.png" alt='x" onerror="alert(1)'>`, `<img src="/a.png" alt="x&#34; onerror=&#34;alert(1)" loading="lazy">`},
+		{"classes", `<p class="evil">x</p><span class="hl-k">k</span><span class="hl-x">x</span>`, `<p>x</p><span class="hl-k">k</span><span>x</span>`},
+		{"list start", `<ol start="3" reversed><li>x</li></ol><ol start="-1"></ol>`, `<ol start="3"><li>x</li></ol><ol></ol>`},
+
+		// Structure
+		{"misnested tags", `<b><i>nested</b> after`, `<b><i>nested</i></b> after`},
+		{"unclosed tags", `<blockquote><p>unclosed`, `<blockquote><p>unclosed</p></blockquote>`},
+		{"stray end tags", `</div></p>stray`, `stray`},
+		{"unfinished tag", `<a href="x`, `&lt;a href=&#34;x`},
+		{"angle brackets in text", `a < b and c > d`, `a &lt; b and c &gt; d`},
+		{"comments", `<!-- comment -->x<!-- unterminated`, `x`},
+		{"unknown elements keep their text", `<div><u>kept text</u></div>`, `kept text`},
+
+		// Dropped elements
+		{"script", `<script>alert(1)</script>ok`, `ok`},
+		{"script in upper case", `<SCRIPT>alert(1)</SCRIPT >ok`, `ok`},
+		{"style", `<style>body{display:none}</style>ok`, `ok`},
+		{"svg", `<svg><script>alert(1)</script></svg>ok`, `ok`},
+		{"unclosed svg", `<svg onload=alert(1)>`, ``},
+		{"iframe", `<iframe src="https://evil"></iframe>ok`, `ok`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.fragment); got != tt.want {
+				t.Errorf("Sanitize(%q)\n got %q\nwant %q", tt.fragment, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"javascript link", "[x](javascript:alert(1))", `<p><a rel="nofollow ugc noopener">x</a></p>` + "\n"},
+		{"upper case javascript link", "[x](JAVASCRIPT:alert(1))", `<p><a rel="nofollow ugc noopener">x</a></p>` + "\n"},
+		{"entity in destination stays relative", "[x](&#106;avascript:alert(1))", `<p><a href="&amp;#106;avascript:alert(1)" rel="nofollow ugc noopener">x</a></p>` + "\n"},
+		{"javascript autolink", "<javascript:alert(1)>", `<p><a rel="nofollow ugc noopener">javascript:alert(1)</a></p>` + "\n"},
+		{"data image", "![x](data:image/png;base64,AAAA)", "<p></p>\n"},
+		{"quote breakout in title", `[x](https://example.com "t\" onclick=\"alert(1)")`, `<p><a href="https://example.com" title="t&#34; onclick=&#34;alert(1)" rel="nofollow ugc noopener">x</a></p>` + "\n"},
+		{"quote breakout in destination", `[x](https://example.com/a"onmouseover="alert(1))`, `<p><a href="https://example.com/a%22onmouseover=%22alert(1)" rel="nofollow ugc noopener">x</a></p>` + "\n"},
+		{"raw script is text", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"raw html is text", "<b>raw</b>", "<p>&lt;b&gt;raw&lt;/b&gt;</p>\n"},
+		{"bare url", "See https://example.com/path?q=1.", `<p>See <a href="https://example.com/path?q=1" rel="nofollow ugc noopener">https://example.com/path?q=1</a>.</p>` + "\n"},
+		{"email and url autolinks", "mail <a@example.com> or https://x.example", `<p>mail <a href="mailto:a@example.com" rel="nofollow ugc noopener">a@example.com</a> or <a href="https://x.example" rel="nofollow ugc noopener">https://x.example</a></p>` + "\n"},
+		{"reference link", "[ref]\n\n[ref]: https://example.com \"T\"", `<p><a href="https://example.com" title="T" rel="nofollow ugc noopener">ref</a></p>` + "\n"},
+		{"highlighted code", "```go\nfunc main() { return \"s\" } // c\n```", `<pre><code class="language-go"><span class="hl-k">func</span> main() { <span class="hl-k">return</span> <span class="hl-s">&#34;s&#34;</span> } <span class="hl-c">// c</span>` + "\n</code></pre>\n"},
+		{"html in code", "```\n<script>x</script>\n```", "<pre><code>&lt;script&gt;x&lt;/script&gt;\n</code></pre>\n"},
+		{"unknown language", "```nosuchlang\nif x\n```", "<pre><code class=\"language-nosuchlang\">if x\n</code></pre>\n"},
+		{"table", "| a | b |\n|:--|--:|\n| 1 | 2 |", "<table>\n<thead>\n<tr>\n<th class=\"align-left\">a</th>\n<th class=\"align-right\">b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td class=\"align-left\">1</td>\n<td class=\"align-right\">2</td>\n</tr>\n</tbody>\n</table>\n"},
+		{"inline styles", "~~gone~~ **bold** *em* `code`", "<p><del>gone</del> <strong>bold</strong> <em>em</em> <code>code</code></p>\n"},
+		{"line breaks are kept", "line one\nline two", "<p>line one<br>\nline two</p>\n"},
+		{"nested blocks", "> quote\n> - item", "<blockquote>\n<p>quote</p>\n<ul>\n<li>item</li>\n</ul>\n</blockquote>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Render(tt.src)); got != tt.want {
+				t.Errorf("Render(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderLinkRel(t *testing.T) {
+	src := strings.Join([]string{
+		"[inline](https://example.com) and [relative](/posts/1)",
+		"<https://autolink.example> and https://bare.example and <a@example.com>",
+		"[ref][r] and [bad](javascript:alert(1))",
+		"> [quoted](https://quoted.example)",
+		"| [cell](https://cell.example) |\n|---|",
+		`<a href="https://raw.example" rel="opener">raw</a>`,
+		"[r]: https://ref.example",
+	}, "\n\n")
+
+	html := string(Render(src))
+	anchors := regexp.MustCompile(`<a[\s>][^>]*>`).FindAllString(html, -1)
+	if len(anchors) != 9 {
+		t.Fatalf("got %d links, want 9:\n%s", len(anchors), html)
+	}
+	for _, a := range anchors {
+		if strings.Count(a, "rel=") != 1 || !strings.Contains(a, `rel="nofollow ugc noopener"`) {
+			t.Errorf("link %s does not have rel=%q", a, linkRel)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// linkRel is forced on every link, since links are written by members
+const linkRel = "nofollow ugc noopener"
+
+// allowedTags are the only elements Sanitize keeps
+var allowedTags = map[string]bool{
+	"p": true, "br": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"strong": true, "em": true, "del": true, "s": true, "b": true, "i": true,
+	"code": true, "pre": true, "kbd": true, "sup": true, "sub": true, "span": true,
+	"blockquote": true, "ul": true, "ol": true, "li": true,
+	"a": true, "img": true,
+	"table": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true,
+}
+
+// voidTags have no closing tag
+var voidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// droppedTags are removed together with everything inside them
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"textarea": true, "title": true, "noscript": true, "template": true,
+	"svg": true, "math": true, "select": true, "xmp": true, "noembed": true, "noframes": true,
+}
+
+// allowedClasses limits the class attribute to the classes the renderer writes
+var allowedClasses = map[string]*regexp.Regexp{
+	"code": regexp.MustCompile(`^language-[a-z0-9_+#.-]{1,30}$`),
+	"span": regexp.MustCompile(`^hl-[kscnb]$`),
+	"th":   regexp.MustCompile(`^align-(left|center|right)$`),
+	"td":   regexp.MustCompile(`^align-(left|center|right)$`),
+}
+
+var (
+	tagName       = regexp.MustCompile(`^<(/?)([A-Za-z][A-Za-z0-9]*)`)
+	attributeName = regexp.MustCompile(`^[^\s"'<>/=]+`)
+	digits        = regexp.MustCompile(`^[0-9]{1,9}$`)
+)
+
+type attribute struct {
+	name  string
+	value string // Unescaped
+}
+
+// Sanitize keeps only allow-listed elements and attributes of an HTML
+// fragment. Link and image URLs must be relative or use http or https (links
+// may also use mailto), every link gets rel="nofollow ugc noopener", and
+// unclosed elements are closed so a fragment cannot affect the page around it.
+func Sanitize(fragment string) string {
+	var sb strings.Builder
+	var open []string
+
+	for i := 0; i < len(fragment); {
+		if fragment[i] != '<' {
+			end := strings.IndexByte(fragment[i:], '<')
+			if end < 0 {
+				end = len(fragment) - i
+			}
+			sb.WriteString(escapeHTML(html.UnescapeString(fragment[i : i+end])))
+			i += end
+			continue
+		}
+
+		if strings.HasPrefix(fragment[i:], "<!--") {
+			end := strings.Index(fragment[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+
+		m := tagName.FindStringSubmatch(fragment[i:])
+		if m == nil {
+			sb.WriteString("&lt;")
+			i++
+			continue
+		}
+		closing, name := m[1] == "/", strings.ToLower(m[2])
+		attrs, next, ok := parseAttributes(fragment, i+len(m[0]))
+		if !ok {
+			// An unfinished tag is text
+			sb.WriteString("&lt;")
+			i++
+			continue
+		}
+		i = next
+
+		switch {
+		case droppedTags[name]:
+			if !closing {
+				i = skipElement(fragment, i, name)
+			}
+
+		case !allowedTags[name]:
+			// Unknown elements are removed but their text is kept
+
+		case closing:
+			for j := len(open) - 1; j >= 0; j-- {
+				if open[j] == name {
+					for k := len(open) - 1; k >= j; k-- {
+						sb.WriteString("</" + open[k] + ">")
+					}
+					open = open[:j]
+					break
+				}
+			}
+
+		default:
+			tag, keep := startTag(name, attrs)
+			if !keep {
+				continue
+			}
+			sb.WriteString(tag)
+			if !voidTags[name] {
+				open = append(open, name)
+			}
+		}
+	}
+
+	for j := len(open) - 1; j >= 0; j-- {
+		sb.WriteString("</" + open[j] + ">")
+	}
+	return sb.String()
+}
+
+// startTag writes an allowed element's start tag with only its allowed attributes
+func startTag(name string, attrs []attribute) (string, bool) {
+	var sb strings.Builder
+	sb.WriteString("<" + name)
+	write := func(attr, value string) {
+		sb.WriteString(" " + attr + `="` + escapeHTML(value) + `"`)
+	}
+
+	var hasSrc bool
+	for _, a := range attrs {
+		switch {
+		case name == "a" && a.name == "href" && safeURL(a.value, true):
+			write("href", a.value)
+		case name == "img" && a.name == "src" && safeURL(a.value, false):
+			write("src", a.value)
+			hasSrc = true
+		case (name == "a" || name == "img") && a.name == "title",
+			name == "img" && a.name == "alt":
+			write(a.name, a.value)
+		case name == "ol" && a.name == "start" && digits.MatchString(a.value):
+			write("start", a.value)
+		case a.name == "class" && allowedClasses[name] != nil && allowedClasses[name].MatchString(a.value):
+			write("class", a.value)
+		}
+	}
+
+	switch name {
+	case "a":
+		write("rel", linkRel)
+	case "img":
+		if !hasSrc {
+			return "", false
+		}
+		write("loading", "lazy")
+	}
+	sb.WriteString(">")
+	return sb.String(), true
+}
+
+// parseAttributes reads attributes up to the end of a tag. It returns false if
+// the tag is not closed.
+func parseAttributes(s string, i int) ([]attribute, int, bool) {
+	var attrs []attribute
+	seen := make(map[string]bool)
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '\f' || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, false
+		}
+		if s[i] == '>' {
+			return attrs, i + 1, true
+		}
+
+		name := attributeName.FindString(s[i:])
+		if name == "" {
+			// Stray quote or < inside a tag; skip it
+			i++
+			continue
+		}
+		i += len(name)
+
+		var value string
+		j := i
+		for j < len(s) && (s[j] == ' ' || s[j] == '\t' || s[j] == '\n') {
+			j++
+		}
+		if j < len(s) && s[j] == '=' {
+			j++
+			for j < len(s) && (s[j] == ' ' || s[j] == '\t' || s[j] == '\n') {
+				j++
+			}
+			if j < len(s) && (s[j] == '"' || s[j] == '\'') {
+				end := strings.IndexByte(s[j+1:], s[j])
+				if end < 0 {
+					return nil, 0, false
+				}
+				value = s[j+1 : j+1+end]
+				j += end + 2
+			} else {
+				start := j
+				for j < len(s) && s[j] > ' ' && s[j] != '>' {
+					j++
+				}
+				value = s[start:j]
+			}
+			i = j
+		}
+
+		// The first of repeated attributes wins, as in browsers
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			attrs = append(attrs, attribute{name: name, value: html.UnescapeString(value)})
+		}
+	}
+}
+
+// skipElement returns the position after the end tag of a dropped element
+func skipElement(s string, i int, name string) int {
+	end := strings.Index(strings.ToLower(s[i:]), "</"+name)
+	if end < 0 {
+		return len(s)
+	}
+	i += end
+	if close := strings.IndexByte(s[i:], '>'); close >= 0 {
+		return i + close + 1
+	}
+	return len(s)
+}
+
+// safeURL reports whether a URL is relative or uses an allowed scheme
+func safeURL(u string, link bool) bool {
+	// Browsers ignore whitespace and control characters in schemes
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	if cleaned == "" {
+		return false
+	}
+
+	colon := strings.IndexByte(cleaned, ':')
+	if colon < 0 || strings.IndexAny(cleaned[:colon], "/?#") >= 0 {
+		return true
+	}
+	switch strings.ToLower(cleaned[:colon]) {
+	case "http", "https":
+		return true
+	case "mailto":
+		return link
+	}
+	return false
+}
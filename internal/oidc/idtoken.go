@@ -0,0 +1,303 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the provider's clock may be off from ours
+const clockSkew = 2 * time.Minute
+
+// keysRefreshInterval limits how often an unknown key ID triggers a JWKS refetch
+const keysRefreshInterval = time.Minute
+
+// Claims are the verified ID token claims the forum uses
+type Claims struct {
+	Subject           string // Stable user ID at the provider
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// idTokenClaims is the ID token payload as sent by the provider
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            float64  `json:"exp"`
+	IssuedAt          float64  `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// audience is a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("invalid audience")
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// flexBool is a boolean some providers send as the string "true" or "false"
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = flexBool(value)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid boolean")
+	}
+	*b = flexBool(s == "true")
+	return nil
+}
+
+// jsonWebKey is a public key from the issuer's JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verifyIDToken checks an ID token's signature and claims (OpenID Connect
+// Core 3.1.3.7) and returns its claims
+func (p *Provider) verifyIDToken(ctx context.Context, token, nonce string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	// Only asymmetric algorithms; "none" and HMAC are never accepted
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+
+	key, err := p.signingKey(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature")
+	}
+	if err := verifySignature(key, header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != md.Issuer:
+		return nil, fmt.Errorf("ID token issuer mismatch")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("ID token has no subject")
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("ID token is for another client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("ID token is for another client")
+	case time.Unix(int64(claims.Expiry), 0).Before(now.Add(-clockSkew)):
+		return nil, fmt.Errorf("ID token has expired")
+	case time.Unix(int64(claims.IssuedAt), 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("ID token is issued in the future")
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("ID token nonce mismatch")
+	}
+
+	return &Claims{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     bool(claims.EmailVerified),
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// signingKey returns the issuer key with the given ID, refetching the JWKS
+// when the key is unknown since providers rotate their keys
+func (p *Provider) signingKey(ctx context.Context, kid, alg string) (*jsonWebKey, error) {
+	p.mu.Lock()
+	keys, fetchedAt := p.keys, p.keysAt
+	p.mu.Unlock()
+
+	if key := findKey(keys, kid, alg); key != nil {
+		return key, nil
+	}
+	if time.Since(fetchedAt) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+	}
+
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, md.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+
+	keys = make(map[string]*jsonWebKey, len(set.Keys))
+	for i := range set.Keys {
+		if set.Keys[i].Use == "" || set.Keys[i].Use == "sig" {
+			keys[set.Keys[i].Kid] = &set.Keys[i]
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.keysAt = keys, time.Now()
+	p.mu.Unlock()
+
+	if key := findKey(keys, kid, alg); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+}
+
+// findKey picks the key for a token. Tokens without a key ID are only
+// accepted when the issuer has a single suitable key.
+func findKey(keys map[string]*jsonWebKey, kid, alg string) *jsonWebKey {
+	kty := "RSA"
+	if alg == "ES256" {
+		kty = "EC"
+	}
+	suitable := func(k *jsonWebKey) bool {
+		return k.Kty == kty && (k.Alg == "" || k.Alg == alg)
+	}
+
+	if kid != "" {
+		if key, ok := keys[kid]; ok && suitable(key) {
+			return key
+		}
+		return nil
+	}
+
+	var found *jsonWebKey
+	for _, key := range keys {
+		if suitable(key) {
+			if found != nil {
+				return nil
+			}
+			found = key
+		}
+	}
+	return found
+}
+
+// verifySignature checks a JWS signature with an RSA or P-256 key
+func verifySignature(key *jsonWebKey, alg string, signingInput, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+
+	switch alg {
+	case "RS256":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil || len(n) < 256 {
+			return fmt.Errorf("invalid RSA signing key")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return fmt.Errorf("invalid RSA signing key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid ID token signature")
+		}
+		return nil
+
+	case "ES256":
+		if key.Crv != "P-256" {
+			return fmt.Errorf("invalid EC signing key")
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return fmt.Errorf("invalid EC signing key")
+		}
+		// crypto/ecdh rejects points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return fmt.Errorf("invalid EC signing key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+		// JWS ES256 signatures are r || s, not ASN.1
+		if len(signature) != 64 {
+			return fmt.Errorf("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return fmt.Errorf("invalid ID token signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+}
@@ -0,0 +1,222 @@
+// Package oidc implements the relying party side of OpenID Connect: issuer
+// discovery, the authorization code flow with PKCE and ID token verification.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScopes are requested when a provider does not configure its own
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// Config describes an OpenID Connect provider
+type Config struct {
+	Name         string // Short identifier used in URLs and the database, e.g. "google"
+	DisplayName  string // Shown on the login button, e.g. "Google"
+	Issuer       string // e.g. "https://accounts.google.com"
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string // The forum's callback URL registered with the provider
+}
+
+// Provider is a configured OpenID Connect provider. The issuer's metadata and
+// keys are fetched on first use and cached.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     map[string]*jsonWebKey
+	keysAt   time.Time
+}
+
+// metadata is the part of the discovery document the forum uses
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider creates a provider from its configuration
+func NewProvider(config Config) (*Provider, error) {
+	if config.Name == "" || config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc provider needs a name, issuer, client ID and redirect URL")
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = config.Name
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultScopes
+	}
+	config.Issuer = strings.TrimRight(config.Issuer, "/")
+
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name returns the provider's identifier
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// DisplayName returns the provider's human readable name
+func (p *Provider) DisplayName() string {
+	return p.config.DisplayName
+}
+
+// discover fetches and caches the issuer's discovery document
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var md metadata
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &md); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.config.Name, err)
+	}
+	// The issuer must be exactly the one configured (OpenID Connect Discovery 4.3)
+	if strings.TrimRight(md.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: configured %q, discovered %q", p.config.Issuer, md.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s is incomplete", p.config.Name)
+	}
+
+	p.metadata = &md
+	return p.metadata, nil
+}
+
+// getJSON fetches a JSON document
+func (p *Provider) getJSON(ctx context.Context, target string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// AuthRequest holds the secrets of one login attempt. They must be stored
+// server-side until the provider redirects back.
+type AuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// NewAuthRequest generates the state, nonce and PKCE verifier of a login attempt
+func NewAuthRequest() (AuthRequest, error) {
+	var req AuthRequest
+	for _, field := range []*string{&req.State, &req.Nonce, &req.CodeVerifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return AuthRequest{}, fmt.Errorf("failed to generate random value: %w", err)
+		}
+		*field = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return req, nil
+}
+
+// AuthCodeURL returns the provider URL the user is sent to for logging in
+func (p *Provider) AuthCodeURL(ctx context.Context, req AuthRequest) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return md.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// tokenResponse is the token endpoint's answer
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades the authorization code for an ID token and returns its
+// verified claims
+func (p *Provider) Exchange(ctx context.Context, code string, req AuthRequest) (*Claims, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {req.CodeVerifier},
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	// client_secret_basic (RFC 6749 2.3.1): both parts are form-encoded first
+	httpReq.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("token request rejected: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("token response has no ID token")
+	}
+
+	return p.verifyIDToken(ctx, token.IDToken, req.Nonce)
+}
@@ -0,0 +1,241 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"forum/internal/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T, issuer *oidctest.Issuer) *Provider {
+	t.Helper()
+	provider, err := NewProvider(Config{
+		Name:         "test",
+		Issuer:       issuer.URL,
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  issuer.RedirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// login runs the authorization code flow and returns the verified claims
+func login(t *testing.T, issuer *oidctest.Issuer, claims map[string]any) (*Claims, error) {
+	t.Helper()
+	ctx := context.Background()
+	provider := newTestProvider(t, issuer)
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.Authorize(t, authURL, claims)
+	return provider.Exchange(ctx, code, req)
+}
+
+func TestLogin(t *testing.T) {
+	issuer := oidctest.NewIssuer(t)
+	for _, alg := range []string{"ES256", "RS256"} {
+		t.Run(alg, func(t *testing.T) {
+			issuer.Token = issuer.SignES256
+			if alg == "RS256" {
+				issuer.Token = issuer.SignRS256
+			}
+			claims, err := login(t, issuer, map[string]any{
+				"email":              "alice@example.com",
+				"email_verified":     "true", // Some providers send a string
+				"name":               "Alice Example",
+				"preferred_username": "alice",
+			})
+			if err != nil {
+				t.Fatalf("Exchange() = %v", err)
+			}
+			want := Claims{
+				Subject:           "subject-1",
+				Email:             "alice@example.com",
+				EmailVerified:     true,
+				Name:              "Alice Example",
+				PreferredUsername: "alice",
+			}
+			if *claims != want {
+				t.Errorf("claims = %+v, want %+v", *claims, want)
+			}
+		})
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	issuer := oidctest.NewIssuer(t)
+	provider := newTestProvider(t, issuer)
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	if got, want := q.Get("code_challenge"), base64.RawURLEncoding.EncodeToString(challenge[:]); got != want {
+		t.Errorf("code_challenge = %q, want %q", got, want)
+	}
+	if strings.Contains(authURL, req.CodeVerifier) {
+		t.Error("the code verifier was sent to the authorization endpoint")
+	}
+	if q.Get("state") != req.State || q.Get("nonce") != req.Nonce {
+		t.Error("state or nonce missing from the authorization URL")
+	}
+	if q.Get("scope") != "openid email profile" {
+		t.Errorf("scope = %q", q.Get("scope"))
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	issuer := oidctest.NewIssuer(t)
+	ctx := context.Background()
+	provider := newTestProvider(t, issuer)
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.Authorize(t, authURL, nil)
+
+	// A stolen code is useless without the verifier kept on the server
+	stolen := req
+	stolen.CodeVerifier = "attacker-verifier"
+	if _, err := provider.Exchange(ctx, code, stolen); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Exchange() with the wrong verifier = %v, want invalid_grant", err)
+	}
+}
+
+func TestIDTokenRejected(t *testing.T) {
+	issuer := oidctest.NewIssuer(t)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name   string
+		token  func(claims map[string]any) string
+		claims map[string]any
+		want   string
+	}{
+		{"bad signature", func(claims map[string]any) string {
+			token := issuer.SignES256(claims)
+			parts := strings.Split(token, ".")
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			signature[0] ^= 0xff
+			return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+		}, nil, "invalid ID token signature"},
+		{"claims changed after signing", func(claims map[string]any) string {
+			original := strings.Split(issuer.SignES256(claims), ".")
+			claims["sub"] = "someone-else"
+			forged := strings.Split(issuer.SignES256(claims), ".")
+			return original[0] + "." + forged[1] + "." + original[2]
+		}, nil, "invalid ID token signature"},
+		{"RSA signature under the EC key", func(claims map[string]any) string {
+			parts := strings.Split(issuer.SignRS256(claims), ".")
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"` + oidctest.ECKeyID + `"}`))
+			return header + "." + parts[1] + "." + parts[2]
+		}, nil, "invalid ID token signature"},
+		{"alg none", func(claims map[string]any) string {
+			return oidctest.Unsigned(claims)
+		}, nil, `unsupported ID token algorithm "none"`},
+		{"HS256 with the client secret", func(claims map[string]any) string {
+			return oidctest.SignHS256([]byte(issuer.ClientSecret), "", claims)
+		}, nil, `unsupported ID token algorithm "HS256"`},
+		{"HS256 with the public key", func(claims map[string]any) string {
+			return oidctest.SignHS256(issuer.RSAKey.PublicKey.N.Bytes(), oidctest.RSAKeyID, claims)
+		}, nil, `unsupported ID token algorithm "HS256"`},
+		{"unknown key", func(claims map[string]any) string {
+			parts := strings.Split(issuer.SignES256(claims), ".")
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"rotated-away"}`))
+			return header + "." + parts[1] + "." + parts[2]
+		}, nil, "unknown ID token signing key"},
+		{"malformed", func(claims map[string]any) string {
+			return "not-a-jwt"
+		}, nil, "malformed ID token"},
+		{"wrong audience", nil, map[string]any{"aud": "another-client"}, "another client"},
+		{"several audiences without azp", nil, map[string]any{"aud": []string{issuer.ClientID, "another-client"}}, "another client"},
+		{"wrong azp", nil, map[string]any{"aud": []string{issuer.ClientID, "another-client"}, "azp": "another-client"}, "another client"},
+		{"wrong issuer", nil, map[string]any{"iss": "https://evil.example.com"}, "issuer mismatch"},
+		{"no subject", nil, map[string]any{"sub": nil}, "no subject"},
+		{"nonce mismatch", nil, map[string]any{"nonce": "replayed-nonce"}, "nonce mismatch"},
+		{"no nonce", nil, map[string]any{"nonce": nil}, "nonce mismatch"},
+		{"expired", nil, map[string]any{"exp": now - 600}, "expired"},
+		{"issued in the future", nil, map[string]any{"iat": now + 600}, "in the future"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer.Token = issuer.SignES256
+			if tt.token != nil {
+				issuer.Token = tt.token
+			}
+			_, err := login(t, issuer, tt.claims)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Exchange() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDTokenAccepted(t *testing.T) {
+	issuer := oidctest.NewIssuer(t)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+	}{
+		{"several audiences with azp", map[string]any{"aud": []string{issuer.ClientID, "another-client"}, "azp": issuer.ClientID}},
+		{"expired within the clock skew", map[string]any{"exp": now - 60}},
+		{"issued ahead within the clock skew", map[string]any{"iat": now + 60}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := login(t, issuer, tt.claims); err != nil {
+				t.Errorf("Exchange() = %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := oidctest.NewIssuer(t)
+	// The same server under another name announces an issuer that is not the configured one
+	provider, err := NewProvider(Config{
+		Name:        "test",
+		Issuer:      strings.Replace(issuer.URL, "127.0.0.1", "localhost", 1),
+		ClientID:    issuer.ClientID,
+		RedirectURL: issuer.RedirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.AuthCodeURL(context.Background(), req); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("AuthCodeURL() = %v, want an issuer mismatch", err)
+	}
+}
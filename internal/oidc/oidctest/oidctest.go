@@ -0,0 +1,272 @@
+// Package oidctest runs an OpenID Connect issuer for tests. It serves
+// discovery, a JWKS with one P-256 and one RSA key and a token endpoint that
+// checks PKCE, and lets tests decide what the ID tokens it returns contain.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Key IDs of the issuer's signing keys
+const (
+	ECKeyID  = "ec-1"
+	RSAKeyID = "rsa-1"
+)
+
+// Issuer is a running test issuer
+type Issuer struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	ECKey  *ecdsa.PrivateKey
+	RSAKey *rsa.PrivateKey
+
+	// Token turns the claims of a grant into the ID token the token endpoint
+	// returns. It defaults to SignES256.
+	Token func(claims map[string]any) string
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	nonce         string
+	codeChallenge string
+	redirectURL   string
+	claims        map[string]any
+}
+
+// NewIssuer starts an issuer that is shut down when the test ends
+func NewIssuer(t testing.TB) *Issuer {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Issuer{
+		ClientID:     "forum-client",
+		ClientSecret: "forum-secret",
+		RedirectURL:  "http://forum.test/login/oidc/test/callback",
+		ECKey:        ecKey,
+		RSAKey:       rsaKey,
+		grants:       make(map[string]grant),
+	}
+	i.Token = i.SignES256
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("GET /jwks", i.jwks)
+	mux.HandleFunc("POST /token", i.token)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	i.URL = server.URL
+	return i
+}
+
+// Authorize plays the user logging in at the issuer: it checks the
+// authorization URL the forum sent them to and returns the code the issuer
+// would redirect back with. The ID token for the code has the standard
+// claims, overridden by claims; a nil value removes a claim.
+func (i *Issuer) Authorize(t testing.TB, authURL string, claims map[string]any) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	switch {
+	case u.Scheme+"://"+u.Host != i.URL || u.Path != "/authorize":
+		t.Fatalf("authorization URL %q is not the issuer's", authURL)
+	case q.Get("response_type") != "code":
+		t.Fatalf("response_type = %q, want code", q.Get("response_type"))
+	case q.Get("client_id") != i.ClientID:
+		t.Fatalf("client_id = %q, want %q", q.Get("client_id"), i.ClientID)
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		t.Fatalf("authorization URL has no S256 code challenge")
+	case q.Get("state") == "" || q.Get("nonce") == "":
+		t.Fatalf("authorization URL has no state or nonce")
+	}
+
+	code := randomString(t)
+	i.mu.Lock()
+	i.grants[code] = grant{
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		redirectURL:   q.Get("redirect_uri"),
+		claims:        claims,
+	}
+	i.mu.Unlock()
+	return code
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	ec := i.ECKey.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]any{
+			{
+				"kty": "EC", "kid": ECKeyID, "use": "sig", "alg": "ES256", "crv": "P-256",
+				"x": encode(ec.X.FillBytes(make([]byte, 32))),
+				"y": encode(ec.Y.FillBytes(make([]byte, 32))),
+			},
+			{
+				"kty": "RSA", "kid": RSAKeyID, "use": "sig", "alg": "RS256",
+				"n": encode(i.RSAKey.N.Bytes()),
+				"e": encode(big.NewInt(int64(i.RSAKey.E)).Bytes()),
+			},
+		},
+	})
+}
+
+// token implements the authorization code grant with client_secret_basic
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+	}
+
+	user, password, ok := r.BasicAuth()
+	clientID, _ := url.QueryUnescape(user)
+	secret, _ := url.QueryUnescape(password)
+	if !ok || clientID != i.ClientID || secret != i.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		fail("unsupported_grant_type")
+		return
+	}
+
+	i.mu.Lock()
+	g, ok := i.grants[r.FormValue("code")]
+	delete(i.grants, r.FormValue("code")) // Codes work once
+	i.mu.Unlock()
+	if !ok || g.redirectURL != r.FormValue("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if encode(challenge[:]) != g.codeChallenge {
+		fail("invalid_grant")
+		return
+	}
+
+	now := time.Now().Unix()
+	claims := map[string]any{
+		"iss":   i.URL,
+		"sub":   "subject-1",
+		"aud":   i.ClientID,
+		"iat":   now,
+		"exp":   now + 300,
+		"nonce": g.nonce,
+	}
+	for name, value := range g.claims {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     i.Token(claims),
+	})
+}
+
+// SignES256 signs claims with the issuer's P-256 key
+func (i *Issuer) SignES256(claims map[string]any) string {
+	input := signingInput(map[string]any{"alg": "ES256", "kid": ECKeyID, "typ": "JWT"}, claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, i.ECKey, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + encode(signature)
+}
+
+// SignRS256 signs claims with the issuer's RSA key
+func (i *Issuer) SignRS256(claims map[string]any) string {
+	input := signingInput(map[string]any{"alg": "RS256", "kid": RSAKeyID, "typ": "JWT"}, claims)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.RSAKey, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return input + "." + encode(signature)
+}
+
+// SignHS256 signs claims with a shared secret, as an attacker who knows the
+// client secret or a public key might
+func SignHS256(key []byte, kid string, claims map[string]any) string {
+	input := signingInput(map[string]any{"alg": "HS256", "kid": kid, "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return input + "." + encode(mac.Sum(nil))
+}
+
+// Unsigned returns an "alg": "none" token
+func Unsigned(claims map[string]any) string {
+	return signingInput(map[string]any{"alg": "none", "typ": "JWT"}, claims) + "."
+}
+
+func signingInput(header, claims map[string]any) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		panic(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+	return encode(h) + "." + encode(c)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomString(t testing.TB) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return encode(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
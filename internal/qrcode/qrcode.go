@@ -0,0 +1,510 @@
+// Package qrcode encodes short byte strings (such as otpauth:// URIs) as QR
+// codes and renders them as SVG. It supports byte mode at error correction
+// level M for versions 1 to 10, which holds up to 213 bytes.
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// blockLayout describes the error correction blocks of a version at level M
+type blockLayout struct {
+	ecPerBlock int
+	groups     [][2]int // {number of blocks, data codewords per block}
+}
+
+// layouts holds the level M block structure of versions 1 to 10 (index = version)
+var layouts = []blockLayout{
+	{},
+	{10, [][2]int{{1, 16}}},
+	{16, [][2]int{{1, 28}}},
+	{26, [][2]int{{1, 44}}},
+	{18, [][2]int{{2, 32}}},
+	{24, [][2]int{{2, 43}}},
+	{16, [][2]int{{4, 27}}},
+	{18, [][2]int{{4, 31}}},
+	{22, [][2]int{{2, 38}, {2, 39}}},
+	{22, [][2]int{{3, 36}, {2, 37}}},
+	{26, [][2]int{{4, 43}, {1, 44}}},
+}
+
+// alignmentPositions holds the alignment pattern centers of each version
+var alignmentPositions = [][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// Code is an encoded QR code
+type Code struct {
+	Size    int      // Modules per side, without the quiet zone
+	modules [][]bool // [y][x], true = dark
+}
+
+// Dark reports whether the module at column x, row y is dark
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Encode encodes data as a QR code using the smallest version that fits
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v < len(layouts); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= dataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("data too long for a QR code: %d bytes", len(data))
+	}
+
+	q := newBuilder(version)
+	q.drawFunctionPatterns()
+	q.drawCodewords(addErrorCorrection(version, encodeData(version, data)))
+	q.applyBestMask()
+
+	return &Code{Size: q.size, modules: q.modules}, nil
+}
+
+// dataCodewords returns the number of data codewords of a version
+func dataCodewords(version int) int {
+	n := 0
+	for _, g := range layouts[version].groups {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+// bitBuffer collects bits most significant first
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 == 1)
+	}
+}
+
+// encodeData builds the data codewords: byte mode header, data, terminator and padding
+func encodeData(version int, data []byte) []byte {
+	capacity := dataCodewords(version) * 8
+
+	var bits bitBuffer
+	bits.append(0x4, 4) // Byte mode
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, c := range data {
+		bits.append(int(c), 8)
+	}
+
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	out := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			out[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return out
+}
+
+// addErrorCorrection splits data into blocks, appends Reed-Solomon codewords
+// to each and interleaves the result
+func addErrorCorrection(version int, data []byte) []byte {
+	layout := layouts[version]
+	divisor := rsDivisor(layout.ecPerBlock)
+
+	var dataBlocks, ecBlocks [][]byte
+	offset := 0
+	for _, g := range layout.groups {
+		for i := 0; i < g[0]; i++ {
+			block := data[offset : offset+g[1]]
+			offset += g[1]
+			dataBlocks = append(dataBlocks, block)
+			ecBlocks = append(ecBlocks, rsRemainder(block, divisor))
+		}
+	}
+
+	var out []byte
+	for i := 0; ; i++ {
+		added := false
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// gfMultiply multiplies two elements of GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree,
+// without its leading coefficient
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords of a block
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// builder lays out the modules of a code
+type builder struct {
+	version    int
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+func newBuilder(version int) *builder {
+	size := version*4 + 17
+	q := &builder{version: version, size: size}
+	q.modules = make([][]bool, size)
+	q.isFunction = make([][]bool, size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.isFunction[y] = make([]bool, size)
+	}
+	return q
+}
+
+func (q *builder) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+// drawFunctionPatterns draws finder, timing and alignment patterns and
+// reserves the format and version areas
+func (q *builder) drawFunctionPatterns() {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	pos := alignmentPositions[q.version]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			// Skip the three corners occupied by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			q.drawAlignment(pos[i], pos[j])
+		}
+	}
+
+	q.drawFormatBits(0) // Reserve the area; redrawn with the chosen mask
+	q.drawVersionBits()
+}
+
+func (q *builder) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.size || y < 0 || y >= q.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			q.setFunction(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *builder) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for level M and the given mask
+func (q *builder) drawFormatBits(mask int) {
+	data := 0<<3 | mask // Level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true) // Dark module
+}
+
+// drawVersionBits draws the version information of versions 7 and up
+func (q *builder) drawVersionBits() {
+	if q.version < 7 {
+		return
+	}
+	rem := q.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := q.version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a := q.size - 11 + i%3
+		b := i / 3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order of the standard
+func (q *builder) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // Upward column
+				}
+				if q.isFunction[y][x] || i >= len(data)*8 {
+					continue
+				}
+				q.modules[y][x] = (data[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// masked reports whether mask pattern m inverts the module at x, y
+func masked(m, x, y int) bool {
+	switch m {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask inverts the data modules selected by a mask; applying it twice undoes it
+func (q *builder) applyMask(m int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.isFunction[y][x] && masked(m, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty score
+func (q *builder) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for m := 0; m < 8; m++ {
+		q.applyMask(m)
+		q.drawFormatBits(m)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = m, p
+		}
+		q.applyMask(m)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+}
+
+// penalty scores how hard the current modules are to scan (lower is better)
+func (q *builder) penalty() int {
+	result := 0
+	line := make([]bool, q.size)
+
+	for horizontal := 0; horizontal < 2; horizontal++ {
+		for a := 0; a < q.size; a++ {
+			for b := 0; b < q.size; b++ {
+				if horizontal == 0 {
+					line[b] = q.modules[a][b]
+				} else {
+					line[b] = q.modules[b][a]
+				}
+			}
+			result += linePenalty(line)
+		}
+	}
+
+	// Rule 2: 2x2 blocks of one color
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+
+	// Rule 4: balance of dark and light modules
+	total := q.size * q.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	result += k * 10
+
+	return result
+}
+
+// finderLike is the 1:1:3:1:1 finder pattern with four light modules on one side
+var finderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// linePenalty applies rules 1 (runs) and 3 (finder-like patterns) to one row or column
+func linePenalty(line []bool) int {
+	result := 0
+
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += 3 + run - 5
+		}
+		run = 1
+	}
+
+	for _, pattern := range finderLike {
+		for i := 0; i+len(pattern) <= len(line); i++ {
+			match := true
+			for j, p := range pattern {
+				if line[i+j] != p {
+					match = false
+					break
+				}
+			}
+			if match {
+				result += 40
+			}
+		}
+	}
+
+	return result
+}
+
+// SVG renders the code as an SVG image with a four module quiet zone, each
+// module being scale pixels wide
+func (c *Code) SVG(scale int) string {
+	const quiet = 4
+	dim := c.Size + 2*quiet
+
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges">`+
+			`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		dim, dim, dim*scale, dim*scale, dim, dim, path.String(),
+	)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
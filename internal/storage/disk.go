@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DiskStore keeps blobs as files in a directory. Files are spread over
+// subdirectories named after the first two characters of their key.
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore creates a store in dir, creating the directory if needed
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	prefix := key
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return filepath.Join(s.dir, prefix, key), nil
+}
+
+// Put writes the blob to a temporary file and renames it into place, so
+// readers never see a partly written file
+func (s *DiskStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after the rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+	return nil
+}
+
+// diskBlob is an open blob file
+type diskBlob struct {
+	*os.File
+	size int64
+}
+
+func (b diskBlob) Size() int64 {
+	return b.size
+}
+
+func (s *DiskStore) Open(ctx context.Context, key string) (Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return diskBlob{File: f, size: info.Size()}, nil
+}
+
+func (s *DiskStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// Remove the subdirectory once it is empty; this fails while it is not
+	os.Remove(filepath.Dir(path))
+	return nil
+}
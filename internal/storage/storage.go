@@ -0,0 +1,47 @@
+// Package storage keeps uploaded files. Blobs are addressed by a key chosen by
+// the caller; only the local disk is supported for now, but handlers use the
+// Store interface so another backend can be dropped in.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned for keys that have no blob
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned for keys that are not safe to use as names
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Store saves and serves blobs
+type Store interface {
+	// Put stores data under key, replacing any blob already there
+	Put(ctx context.Context, key string, data []byte) error
+	// Open returns the blob stored under key
+	Open(ctx context.Context, key string) (Blob, error)
+	// Delete removes a blob. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Blob is an open stored file. Seeking lets http.ServeContent answer range
+// requests.
+type Blob interface {
+	io.ReadSeekCloser
+	Size() int64
+}
+
+// validKey reports whether a key only uses lowercase letters, digits, dots,
+// dashes and underscores and does not start with a dot
+func validKey(key string) bool {
+	if key == "" || len(key) > 128 || key[0] == '.' {
+		return false
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '.' && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// maxCBORDepth bounds nesting so hostile input cannot exhaust the stack
+const maxCBORDepth = 8
+
+// decodeCBOR decodes one CBOR data item (RFC 8949) and returns it along with
+// the bytes that follow it. Only what authenticators send is supported:
+// integers (int64), byte strings ([]byte), text strings (string), arrays
+// ([]any), maps (map[any]any) and the simple values false, true and null.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	rest := data[1:]
+
+	// Major type 7 holds the simple values, which are encoded in info itself
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	arg, rest, err := readArgument(info, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0: // Unsigned integer
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("cbor: integer overflow")
+		}
+		return int64(arg), rest, nil
+
+	case 1: // Negative integer, -1 - arg
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("cbor: integer overflow")
+		}
+		return -1 - int64(arg), rest, nil
+
+	case 2, 3: // Byte string, text string
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor: string longer than data")
+		}
+		value := rest[:arg]
+		if major == 3 {
+			return string(value), rest[arg:], nil
+		}
+		return append([]byte(nil), value...), rest[arg:], nil
+
+	case 4: // Array
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor: array longer than data")
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			item, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+
+	case 5: // Map
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor: map longer than data")
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value any
+			key, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			value, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+
+	default: // Tags (6) are not used by WebAuthn
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
+
+// readArgument reads the argument that follows an initial byte
+func readArgument(info byte, data []byte) (uint64, []byte, error) {
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		// 28-30 are reserved and 31 marks indefinite lengths, which
+		// authenticators must not use (CTAP2 canonical encoding)
+		return 0, nil, fmt.Errorf("cbor: unsupported length encoding %d", info)
+	}
+
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("cbor: unexpected end of data")
+	}
+	var value uint64
+	switch size {
+	case 1:
+		value = uint64(data[0])
+	case 2:
+		value = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		value = uint64(binary.BigEndian.Uint32(data))
+	case 8:
+		value = binary.BigEndian.Uint64(data)
+	}
+	return value, data[size:], nil
+}
@@ -0,0 +1,143 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) accepted for passkeys
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// SupportedAlgorithms lists the accepted algorithms, most preferred first
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters
+const (
+	coseKty    = 1
+	coseAlg    = 3
+	coseCrv    = -1 // EC2 and OKP curve
+	coseX      = -2 // EC2 and OKP x coordinate
+	coseY      = -3 // EC2 y coordinate
+	coseRSAN   = -1 // RSA modulus
+	coseRSAE   = -2 // RSA exponent
+	ktyOKP     = 1
+	ktyEC2     = 2
+	ktyRSA     = 3
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+// p256SPKIPrefix is the DER SubjectPublicKeyInfo header of an uncompressed
+// P-256 point; prefixing it lets crypto/x509 parse and validate the point
+var p256SPKIPrefix = []byte{
+	0x30, 0x59, 0x30, 0x13, 0x06, 0x07, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x02, 0x01,
+	0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07, 0x03, 0x42, 0x00, 0x04,
+}
+
+// publicKey verifies signatures made by a credential
+type publicKey interface {
+	verify(message, signature []byte) error
+}
+
+type ecdsaKey struct{ key *ecdsa.PublicKey }
+
+func (k ecdsaKey) verify(message, signature []byte) error {
+	digest := sha256.Sum256(message)
+	if !ecdsa.VerifyASN1(k.key, digest[:], signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+type ed25519Key struct{ key ed25519.PublicKey }
+
+func (k ed25519Key) verify(message, signature []byte) error {
+	if !ed25519.Verify(k.key, message, signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+type rsaKey struct{ key *rsa.PublicKey }
+
+func (k rsaKey) verify(message, signature []byte) error {
+	digest := sha256.Sum256(message)
+	if err := rsa.VerifyPKCS1v15(k.key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// parsePublicKey parses a COSE_Key as stored with a credential
+func parsePublicKey(cose []byte) (publicKey, error) {
+	item, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after public key")
+	}
+	return publicKeyFromMap(item)
+}
+
+func publicKeyFromMap(item any) (publicKey, error) {
+	m, ok := item.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("public key is not a map")
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == ktyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 key")
+		}
+		der := append(append(append([]byte(nil), p256SPKIPrefix...), x...), y...)
+		parsed, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid P-256 key: %w", err)
+		}
+		key, ok := parsed.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("invalid P-256 key")
+		}
+		return ecdsaKey{key}, nil
+
+	case kty == ktyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519Key{ed25519.PublicKey(x)}, nil
+
+	case kty == ktyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseRSAN)].([]byte)
+		e, _ := m[int64(coseRSAE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		if exponent < 3 || exponent%2 == 0 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return rsaKey{&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+	}
+}
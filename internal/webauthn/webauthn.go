@@ -0,0 +1,362 @@
+// Package webauthn implements the server side of WebAuthn (passkey)
+// registration and authentication ceremonies, following the verification
+// procedures of the W3C Web Authentication Level 2 specification.
+//
+// Registrations ask for "none" attestation, so the attestation statement is
+// not checked; the forum only needs to know the credential's public key.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Timeout is how long the browser and the server wait for a ceremony
+const Timeout = 5 * time.Minute
+
+// maxCredentialIDLength is the largest credential ID the spec allows
+const maxCredentialIDLength = 1023
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// Base64URL is binary data that travels as unpadded base64url in JSON, the
+// encoding the browser script converts to and from ArrayBuffers
+type Base64URL []byte
+
+// MarshalJSON encodes the bytes as a base64url string
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes a base64url string, with or without padding
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(trimPadding(s))
+	if err != nil {
+		return fmt.Errorf("invalid base64url data: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// RelyingParty identifies the site passkeys are registered with
+type RelyingParty struct {
+	ID     string // Domain the passkeys are bound to, e.g. "forum.example.com"
+	Name   string // Shown by the browser while creating a passkey
+	Origin string // Origin the ceremonies run on, e.g. "https://forum.example.com"
+}
+
+// User is the account a passkey is created for
+type User struct {
+	Handle      []byte // Opaque user ID stored on the authenticator
+	Name        string
+	DisplayName string
+}
+
+// Credential is a newly registered passkey
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key, as passed to VerifyAssertion later
+	SignCount uint32
+}
+
+// Assertion is the browser's response to an authentication ceremony
+type Assertion struct {
+	CredentialID      Base64URL `json:"id"`
+	ClientDataJSON    Base64URL `json:"clientDataJSON"`
+	AuthenticatorData Base64URL `json:"authenticatorData"`
+	Signature         Base64URL `json:"signature"`
+	UserHandle        Base64URL `json:"userHandle"`
+}
+
+// CredentialDescriptor refers to an existing credential
+type CredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+// RPEntity describes the relying party to the authenticator
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity describes the account to the authenticator
+type UserEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+// CredentialParameter is an accepted credential algorithm
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// AuthenticatorSelection states what kind of authenticator is wanted
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are passed to navigator.credentials.create()
+type CreationOptions struct {
+	Challenge              Base64URL              `json:"challenge"`
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get()
+type RequestOptions struct {
+	Challenge        Base64URL `json:"challenge"`
+	RPID             string    `json:"rpId"`
+	Timeout          int       `json:"timeout"`
+	UserVerification string    `json:"userVerification"`
+}
+
+// NewChallenge returns a random ceremony challenge
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// CreationOptions builds the options for registering a discoverable passkey.
+// Passkeys replace the password, so user verification is required.
+func (rp RelyingParty) CreationOptions(challenge []byte, user User, exclude [][]byte) CreationOptions {
+	params := make([]CredentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	excluded := make([]CredentialDescriptor, 0, len(exclude))
+	for _, id := range exclude {
+		excluded = append(excluded, CredentialDescriptor{Type: "public-key", ID: id})
+	}
+
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 RPEntity{ID: rp.ID, Name: rp.Name},
+		User:               UserEntity{ID: user.Handle, Name: user.Name, DisplayName: user.DisplayName},
+		PubKeyCredParams:   params,
+		Timeout:            int(Timeout.Milliseconds()),
+		ExcludeCredentials: excluded,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions builds the options for signing in with any discoverable
+// passkey of this site
+func (rp RelyingParty) RequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          int(Timeout.Milliseconds()),
+		UserVerification: "required",
+	}
+}
+
+// VerifyRegistration checks the browser's response to a registration
+// ceremony and returns the new credential
+func (rp RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	attestation, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("attestation object has no authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, fmt.Errorf("authenticator data has no credential")
+	}
+	if _, err := parsePublicKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks the browser's response to an authentication
+// ceremony against a stored credential and returns the new signature counter
+func (rp RelyingParty) VerifyAssertion(challenge []byte, credential Credential, assertion Assertion) (uint32, error) {
+	if !bytes.Equal(assertion.CredentialID, credential.ID) {
+		return 0, fmt.Errorf("assertion is for another credential")
+	}
+	if err := rp.checkClientData(assertion.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := parseAuthenticatorData(assertion.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthenticatorData(authData); err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(assertion.ClientDataJSON)
+	signed := append(append([]byte(nil), assertion.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.verify(signed, assertion.Signature); err != nil {
+		return 0, err
+	}
+
+	// A counter that does not go up means the authenticator may have been
+	// cloned. Authenticators that do not count always report zero.
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, fmt.Errorf("signature counter did not increase")
+	}
+
+	return authData.signCount, nil
+}
+
+// clientData is the part of CollectedClientData the server checks
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// checkClientData verifies the ceremony type, challenge and origin
+func (rp RelyingParty) checkClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("invalid client data: %w", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("unexpected ceremony type %q", data.Type)
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(trimPadding(data.Challenge))
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("challenge mismatch")
+	}
+	if data.Origin != rp.Origin {
+		return fmt.Errorf("unexpected origin %q", data.Origin)
+	}
+	if data.CrossOrigin {
+		return fmt.Errorf("cross-origin ceremonies are not allowed")
+	}
+	return nil
+}
+
+// authenticatorData is the parsed authenticator data structure
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte // Only present in registrations
+	publicKey    []byte // COSE_Key, only present in registrations
+}
+
+// parseAuthenticatorData parses rpIdHash, flags, signCount and, when the AT
+// flag is set, the attested credential data. Extensions are ignored.
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// aaguid (16 bytes), credentialIdLength (2 bytes), credentialId, credentialPublicKey
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || idLength > maxCredentialIDLength || idLength > len(rest) {
+		return nil, fmt.Errorf("invalid credential ID length")
+	}
+	ad.credentialID = append([]byte(nil), rest[:idLength]...)
+	rest = rest[idLength:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	ad.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+	return ad, nil
+}
+
+// checkAuthenticatorData verifies the RP ID hash and that the user was both
+// present and verified
+func (rp RelyingParty) checkAuthenticatorData(ad *authenticatorData) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(ad.rpIDHash, want[:]) != 1 {
+		return fmt.Errorf("credential belongs to another site")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return fmt.Errorf("user was not present")
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return fmt.Errorf("user was not verified")
+	}
+	return nil
+}
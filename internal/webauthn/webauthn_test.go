@@ -0,0 +1,443 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testRP = RelyingParty{ID: "forum.example.com", Name: "Forum", Origin: "https://forum.example.com"}
+
+// authenticator is a software ES256 authenticator that produces the same
+// responses a browser passes on from a real one
+type authenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+
+	// Knobs for the other cases
+	rpID      string
+	origin    string
+	flags     byte
+	noCounter bool // Always report a zero counter, as some authenticators do
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{
+		t:            t,
+		key:          key,
+		credentialID: id,
+		rpID:         testRP.ID,
+		origin:       testRP.Origin,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *authenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, err := json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+// authData builds authenticator data, with the attested credential when
+// attested is set
+func (a *authenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *authenticator) coseKey() []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	return encodeMap(
+		coseKty, ktyEC2,
+		coseAlg, AlgES256,
+		coseCrv, crvP256,
+		coseX, x,
+		coseY, y,
+	)
+}
+
+// register answers a registration ceremony with "none" attestation
+func (a *authenticator) register(challenge []byte) (clientDataJSON, attestationObject []byte) {
+	attestation := encodeMap(
+		"fmt", "none",
+		"attStmt", map[any]any{},
+		"authData", a.authData(true),
+	)
+	return a.clientData("webauthn.create", challenge), attestation
+}
+
+// assert answers an authentication ceremony, counting the signature
+func (a *authenticator) assert(challenge []byte) Assertion {
+	if !a.noCounter {
+		a.signCount++
+	}
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authData := a.authData(false)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return Assertion{
+		CredentialID:      a.credentialID,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authData,
+		Signature:         signature,
+	}
+}
+
+// encodeMap CBOR-encodes a map from alternating keys and values, keeping
+// their order
+func encodeMap(pairs ...any) []byte {
+	data := encodeHead(5, uint64(len(pairs)/2))
+	for _, item := range pairs {
+		data = append(data, encodeCBOR(item)...)
+	}
+	return data
+}
+
+func encodeCBOR(item any) []byte {
+	switch v := item.(type) {
+	case int:
+		if v < 0 {
+			return encodeHead(1, uint64(-1-v))
+		}
+		return encodeHead(0, uint64(v))
+	case []byte:
+		return append(encodeHead(2, uint64(len(v))), v...)
+	case string:
+		return append(encodeHead(3, uint64(len(v))), v...)
+	case map[any]any:
+		if len(v) != 0 {
+			panic("encodeCBOR: use encodeMap for non-empty maps")
+		}
+		return encodeHead(5, 0)
+	default:
+		panic("encodeCBOR: unsupported type")
+	}
+}
+
+func encodeHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+}
+
+func mustChallenge(t *testing.T) []byte {
+	t.Helper()
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// registered returns an authenticator and the credential it registered
+func registered(t *testing.T) (*authenticator, Credential) {
+	t.Helper()
+	a := newAuthenticator(t)
+	challenge := mustChallenge(t)
+	clientDataJSON, attestation := a.register(challenge)
+	credential, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestation)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+	return a, *credential
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	a, credential := registered(t)
+	if !bytes.Equal(credential.ID, a.credentialID) {
+		t.Errorf("credential ID = %x, want %x", credential.ID, a.credentialID)
+	}
+	if !bytes.Equal(credential.PublicKey, a.coseKey()) {
+		t.Errorf("public key was not kept as sent")
+	}
+
+	for i := 0; i < 2; i++ {
+		challenge := mustChallenge(t)
+		counter, err := testRP.VerifyAssertion(challenge, credential, a.assert(challenge))
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if counter != a.signCount {
+			t.Errorf("counter = %d, want %d", counter, a.signCount)
+		}
+		credential.SignCount = counter
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator, challenge []byte) (clientDataJSON, attestationObject []byte)
+		want   string
+	}{
+		{"wrong origin", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			a.origin = "https://evil.example.com"
+			return a.register(challenge)
+		}, "unexpected origin"},
+		{"wrong challenge", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			return a.register([]byte("some other challenge"))
+		}, "challenge mismatch"},
+		{"wrong ceremony", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			_, attestation := a.register(challenge)
+			return a.clientData("webauthn.get", challenge), attestation
+		}, "unexpected ceremony type"},
+		{"wrong rpIdHash", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			a.rpID = "evil.example.com"
+			return a.register(challenge)
+		}, "another site"},
+		{"user not present", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			a.flags = flagUserVerified
+			return a.register(challenge)
+		}, "not present"},
+		{"user not verified", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			a.flags = flagUserPresent
+			return a.register(challenge)
+		}, "not verified"},
+		{"truncated attestation object", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			clientDataJSON, attestation := a.register(challenge)
+			return clientDataJSON, attestation[:len(attestation)/2]
+		}, "invalid attestation object"},
+		{"trailing data after attestation object", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			clientDataJSON, attestation := a.register(challenge)
+			return clientDataJSON, append(attestation, 0)
+		}, "invalid attestation object"},
+		{"attestation object is not a map", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			clientDataJSON, _ := a.register(challenge)
+			return clientDataJSON, encodeCBOR("none")
+		}, "invalid attestation object"},
+		{"missing authenticator data", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			clientDataJSON, _ := a.register(challenge)
+			return clientDataJSON, encodeMap("fmt", "none", "attStmt", map[any]any{})
+		}, "no authenticator data"},
+		{"truncated public key", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			authData := a.authData(true)
+			attestation := encodeMap("fmt", "none", "attStmt", map[any]any{}, "authData", authData[:len(authData)-10])
+			return a.clientData("webauthn.create", challenge), attestation
+		}, "invalid credential public key"},
+		{"credential ID longer than the data", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			authData := a.authData(true)
+			binary.BigEndian.PutUint16(authData[37+16:], 0xffff)
+			attestation := encodeMap("fmt", "none", "attStmt", map[any]any{}, "authData", authData)
+			return a.clientData("webauthn.create", challenge), attestation
+		}, "invalid credential ID length"},
+		{"no attested credential", func(a *authenticator, challenge []byte) ([]byte, []byte) {
+			attestation := encodeMap("fmt", "none", "attStmt", map[any]any{}, "authData", a.authData(false))
+			return a.clientData("webauthn.create", challenge), attestation
+		}, "no credential"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t)
+			challenge := mustChallenge(t)
+			clientDataJSON, attestation := tt.modify(a, challenge)
+			_, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestation)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("VerifyRegistration() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator, credential *Credential, challenge []byte) Assertion
+		want   string
+	}{
+		{"wrong origin", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			a.origin = "https://evil.example.com"
+			return a.assert(challenge)
+		}, "unexpected origin"},
+		{"replayed assertion", func(a *authenticator, credential *Credential, challenge []byte) Assertion {
+			// An assertion for an earlier ceremony, verified once already
+			earlier := mustChallenge(a.t)
+			assertion := a.assert(earlier)
+			counter, err := testRP.VerifyAssertion(earlier, *credential, assertion)
+			if err != nil {
+				a.t.Fatalf("VerifyAssertion: %v", err)
+			}
+			credential.SignCount = counter
+			return assertion
+		}, "challenge mismatch"},
+		{"wrong challenge", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			return a.assert([]byte("some other challenge"))
+		}, "challenge mismatch"},
+		{"wrong ceremony", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			assertion := a.assert(challenge)
+			assertion.ClientDataJSON = a.clientData("webauthn.create", challenge)
+			return assertion
+		}, "unexpected ceremony type"},
+		{"wrong rpIdHash", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			a.rpID = "evil.example.com"
+			return a.assert(challenge)
+		}, "another site"},
+		{"user not verified", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			a.flags = flagUserPresent
+			return a.assert(challenge)
+		}, "not verified"},
+		{"counter went backwards", func(a *authenticator, credential *Credential, challenge []byte) Assertion {
+			credential.SignCount = 10
+			a.signCount = 4
+			return a.assert(challenge)
+		}, "counter did not increase"},
+		{"counter did not move", func(a *authenticator, credential *Credential, challenge []byte) Assertion {
+			credential.SignCount = a.signCount + 1
+			return a.assert(challenge)
+		}, "counter did not increase"},
+		{"bad signature", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			assertion := a.assert(challenge)
+			assertion.Signature[len(assertion.Signature)-1] ^= 0xff
+			return assertion
+		}, "invalid signature"},
+		{"tampered authenticator data", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			assertion := a.assert(challenge)
+			binary.BigEndian.PutUint32(assertion.AuthenticatorData[33:], 1000)
+			return assertion
+		}, "invalid signature"},
+		{"another credential", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			assertion := a.assert(challenge)
+			assertion.CredentialID = []byte("another credential")
+			return assertion
+		}, "another credential"},
+		{"truncated authenticator data", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			assertion := a.assert(challenge)
+			assertion.AuthenticatorData = assertion.AuthenticatorData[:36]
+			return assertion
+		}, "too short"},
+		{"malformed client data", func(a *authenticator, _ *Credential, challenge []byte) Assertion {
+			assertion := a.assert(challenge)
+			assertion.ClientDataJSON = assertion.ClientDataJSON[:10]
+			return assertion
+		}, "invalid client data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, credential := registered(t)
+			challenge := mustChallenge(t)
+			assertion := tt.modify(a, &credential, challenge)
+			_, err := testRP.VerifyAssertion(challenge, credential, assertion)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("VerifyAssertion() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionWithoutCounter(t *testing.T) {
+	a, credential := registered(t)
+	a.noCounter = true
+	for i := 0; i < 2; i++ {
+		challenge := mustChallenge(t)
+		counter, err := testRP.VerifyAssertion(challenge, credential, a.assert(challenge))
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if counter != 0 {
+			t.Errorf("counter = %d, want 0", counter)
+		}
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x81}, maxCBORDepth+2) // Arrays of one item
+	deep = append(deep, 0x00)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"byte string longer than data", []byte{0x45, 0x01, 0x02}},
+		{"text string longer than data", []byte{0x7a, 0xff, 0xff, 0xff, 0xff}},
+		{"array longer than data", []byte{0x9a, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"map longer than data", []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"map missing a value", []byte{0xa1, 0x01}},
+		{"byte string map key", []byte{0xa1, 0x41, 0x00, 0x01}},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"reserved length", []byte{0x1c}},
+		{"tag", []byte{0xc0, 0x00}},
+		{"unsupported simple value", []byte{0xf9, 0x00, 0x00}},
+		{"integer overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"nested too deeply", deep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if item, _, err := decodeCBOR(tt.data); err == nil {
+				t.Errorf("decodeCBOR(%x) = %v, want an error", tt.data, item)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyRejected(t *testing.T) {
+	a := newAuthenticator(t)
+	valid := a.coseKey()
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+
+	tests := []struct {
+		name string
+		key  []byte
+	}{
+		{"truncated", valid[:len(valid)-1]},
+		{"trailing data", append(append([]byte(nil), valid...), 0x00)},
+		{"not a map", encodeCBOR("key")},
+		{"point not on the curve", encodeMap(coseKty, ktyEC2, coseAlg, AlgES256, coseCrv, crvP256, coseX, x, coseY, x)},
+		{"short coordinate", encodeMap(coseKty, ktyEC2, coseAlg, AlgES256, coseCrv, crvP256, coseX, x[:31], coseY, x)},
+		{"unsupported algorithm", encodeMap(coseKty, ktyEC2, coseAlg, -35, coseCrv, crvP256, coseX, x, coseY, x)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePublicKey(tt.key); err == nil {
+				t.Error("parsePublicKey() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Retry schedule: the first retry waits retryDelay, each later one twice as
+// long as the one before. A delivery that still fails after maxAttempts is
+// given up.
+const (
+	retryDelay  = 30 * time.Second
+	maxAttempts = 8
+)
+
+// Worker settings
+const (
+	pollInterval     = 5 * time.Second
+	batchSize        = 20
+	responseBodySize = 1024 // Bytes of each response kept in the log
+)
+
+// Delivery is one event queued for, or sent to, a webhook
+type Delivery struct {
+	ID            int64
+	WebhookID     int64
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastAttemptAt *time.Time
+	ResponseCode  *int
+	ResponseBody  string
+	Error         string
+	CreatedAt     time.Time
+}
+
+// envelope is the JSON body of every delivery
+type envelope struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// Enqueue queues an event for every active webhook subscribed to it.
+// Ping events are only sent through SendTest.
+func (s *Service) Enqueue(ctx context.Context, event string, data any) error {
+	hooks, err := s.active(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	queued := false
+	for _, hook := range hooks {
+		if !hook.Subscribes(event) {
+			continue
+		}
+		if err := s.insert(ctx, hook.ID, event, data, now); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		s.notify()
+	}
+	return nil
+}
+
+// active returns the IDs and events of the active webhooks
+func (s *Service) active(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, events FROM webhooks WHERE active = 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var w Webhook
+		var events string
+		if err := rows.Scan(&w.ID, &events); err != nil {
+			return nil, err
+		}
+		w.Events = splitEvents(events)
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+// SendTest queues a ping event for one webhook, whether or not it is active
+func (s *Service) SendTest(ctx context.Context, id int64) error {
+	hook, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	data := map[string]any{
+		"webhook_id": hook.ID,
+		"message":    "This is a test event sent from the forum admin panel.",
+	}
+	if err := s.insert(ctx, hook.ID, EventPing, data, time.Now().UTC()); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// insert stores a delivery. Each delivery gets its own envelope ID so
+// receivers can tell retries of one delivery from separate events.
+func (s *Service) insert(ctx context.Context, webhookID int64, event string, data any, now time.Time) error {
+	payload, err := json.Marshal(envelope{ID: uuid.NewString(), Event: event, CreatedAt: now, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+		webhookID, event, string(payload), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// Deliveries returns the most recent deliveries of a webhook
+func (s *Service) Deliveries(ctx context.Context, webhookID int64, limit int) ([]Delivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, last_attempt_at,
+			response_code, response_body, error, created_at
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Retry queues a failed delivery to be sent again straight away
+func (s *Service) Retry(ctx context.Context, webhookID, deliveryID int64) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND webhook_id = ? AND status = 'failed'`,
+		time.Now().UTC(), deliveryID, webhookID)
+	if err != nil {
+		return fmt.Errorf("failed to retry delivery: %w", err)
+	}
+	if err := mustAffect(result); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// Run delivers queued events until the process exits. Deliveries are checked
+// every few seconds, and straight away when an event is queued.
+func (s *Service) Run() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.deliverDue(context.Background()); err != nil {
+			log.Printf("Webhook delivery failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// notify wakes the worker without blocking
+func (s *Service) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue sends every due delivery of an active webhook
+func (s *Service) deliverDue(ctx context.Context) error {
+	for {
+		due, err := s.due(ctx)
+		if err != nil {
+			return err
+		}
+		for _, d := range due {
+			if err := s.deliver(ctx, d); err != nil {
+				return err
+			}
+		}
+		if len(due) < batchSize {
+			return nil
+		}
+	}
+}
+
+// pendingDelivery is a due delivery with the webhook it goes to
+type pendingDelivery struct {
+	Delivery
+	url    string
+	secret string
+}
+
+func (s *Service) due(ctx context.Context) ([]pendingDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at, d.last_attempt_at,
+			d.response_code, d.response_body, d.error, d.created_at, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+		  AND (w.active = 1 OR d.event = ?)
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?`, time.Now().UTC(), EventPing, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []pendingDelivery
+	for rows.Next() {
+		var p pendingDelivery
+		if err := rows.Scan(&p.ID, &p.WebhookID, &p.Event, &p.Payload, &p.Status, &p.Attempts,
+			&p.NextAttemptAt, &p.LastAttemptAt, &p.ResponseCode, &p.ResponseBody, &p.Error, &p.CreatedAt,
+			&p.url, &p.secret); err != nil {
+			return nil, err
+		}
+		due = append(due, p)
+	}
+	return due, rows.Err()
+}
+
+// deliver posts one delivery and records the outcome. Only database errors
+// are returned; a failed request schedules a retry.
+func (s *Service) deliver(ctx context.Context, d pendingDelivery) error {
+	now := time.Now().UTC()
+	code, body, sendErr := s.send(ctx, d, now)
+
+	attempts := d.Attempts + 1
+	status := StatusDelivered
+	next := d.NextAttemptAt
+	errMsg := ""
+	if sendErr != nil {
+		errMsg = sendErr.Error()
+		if attempts >= maxAttempts {
+			status = StatusFailed
+		} else {
+			status = StatusPending
+			next = now.Add(retryDelay << (attempts - 1))
+		}
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?, response_code = ?, response_body = ?, error = ?
+		WHERE id = ?`,
+		status, attempts, next, now, code, body, errMsg, d.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// send posts a delivery and returns the response code (nil if there was no
+// response), the start of the response body and why it failed, if it did
+func (s *Service) send(ctx context.Context, d pendingDelivery, now time.Time) (*int, string, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Forum-Webhooks/1.0")
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(d.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, responseBodySize))
+	// Drain the rest so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	code := resp.StatusCode
+	if code < 200 || code > 299 {
+		return &code, string(respBody), fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return &code, string(respBody), nil
+}
+
+func scanDelivery(rows *sql.Rows) (*Delivery, error) {
+	var d Delivery
+	err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastAttemptAt, &d.ResponseCode, &d.ResponseBody, &d.Error, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
@@ -0,0 +1,325 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint that records what it is sent
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	method string
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+	rec := &receiver{status: http.StatusOK}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.requests = append(rec.requests, receivedRequest{r.Method, r.Header.Clone(), body})
+		w.WriteHeader(rec.status)
+		io.WriteString(w, "response "+strconv.Itoa(rec.status))
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *receiver) respond(status int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.status = status
+}
+
+// take returns the requests received since the last call
+func (rec *receiver) take() []receivedRequest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	requests := rec.requests
+	rec.requests = nil
+	return requests
+}
+
+// onlyDelivery returns the single delivery of a webhook
+func onlyDelivery(t *testing.T, s *Service, webhookID int64) Delivery {
+	t.Helper()
+	deliveries, err := s.Deliveries(context.Background(), webhookID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+// makeDue moves every pending delivery's next attempt into the past
+func makeDue(t *testing.T, db *sql.DB) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE webhook_deliveries SET next_attempt_at = ?", time.Now().UTC().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	ctx := context.Background()
+	s, _, adminID := newTestService(t)
+	rec := newReceiver(t)
+
+	hook, err := s.Create(ctx, rec.URL, "test", []string{EventPostCreated}, adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue(ctx, EventPostCreated, map[string]any{"post": map[string]any{"id": 7}}); err != nil {
+		t.Fatal(err)
+	}
+	// Not subscribed to, so not queued
+	if err := s.Enqueue(ctx, EventCommentCreated, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deliverDue(ctx); err != nil {
+		t.Fatalf("deliverDue() = %v", err)
+	}
+
+	requests := rec.take()
+	if len(requests) != 1 {
+		t.Fatalf("endpoint got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	delivery := onlyDelivery(t, s, hook.ID)
+
+	if req.method != http.MethodPost || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("request = %s with Content-Type %q", req.method, req.header.Get("Content-Type"))
+	}
+	if got := req.header.Get(HeaderEvent); got != EventPostCreated {
+		t.Errorf("%s = %q, want %q", HeaderEvent, got, EventPostCreated)
+	}
+	if got := req.header.Get(HeaderDelivery); got != strconv.FormatInt(delivery.ID, 10) {
+		t.Errorf("%s = %q, want %d", HeaderDelivery, got, delivery.ID)
+	}
+	if string(req.body) != delivery.Payload {
+		t.Errorf("body = %s, want the stored payload %s", req.body, delivery.Payload)
+	}
+
+	var body struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+		Data  struct {
+			Post struct {
+				ID int64 `json:"id"`
+			} `json:"post"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if body.ID == "" || body.Event != EventPostCreated || body.Data.Post.ID != 7 {
+		t.Errorf("body = %+v", body)
+	}
+
+	// The signature is Sign's HMAC over the timestamp and body
+	timestamp, err := strconv.ParseInt(req.header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatalf("%s = %q", HeaderTimestamp, req.header.Get(HeaderTimestamp))
+	}
+	if got := req.header.Get(HeaderSignature); got != Sign(hook.Secret, timestamp, req.body) {
+		t.Errorf("%s = %q, want %q", HeaderSignature, got, Sign(hook.Secret, timestamp, req.body))
+	}
+	if err := Verify(hook.Secret, req.header, req.body, 5*time.Minute); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+	if err := Verify("whsec_wrong", req.header, req.body, 5*time.Minute); err != ErrInvalidSignature {
+		t.Errorf("Verify() with another secret = %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := Verify(hook.Secret, req.header, append(req.body, ' '), 5*time.Minute); err != ErrInvalidSignature {
+		t.Errorf("Verify() of a changed body = %v, want %v", err, ErrInvalidSignature)
+	}
+	old := req.header.Clone()
+	old.Set(HeaderTimestamp, strconv.FormatInt(timestamp-600, 10))
+	old.Set(HeaderSignature, Sign(hook.Secret, timestamp-600, req.body))
+	if err := Verify(hook.Secret, old, req.body, 5*time.Minute); err != ErrInvalidSignature {
+		t.Errorf("Verify() of an old delivery = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	if delivery.Status != StatusDelivered || delivery.Attempts != 1 || delivery.ResponseCode == nil || *delivery.ResponseCode != 200 {
+		t.Errorf("delivery = %+v, want delivered on the first attempt", delivery)
+	}
+
+	// Delivered events are not sent again
+	if err := s.deliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if requests := rec.take(); len(requests) != 0 {
+		t.Errorf("endpoint got %d more requests", len(requests))
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	ctx := context.Background()
+	s, db, adminID := newTestService(t)
+	rec := newReceiver(t)
+	rec.respond(http.StatusInternalServerError)
+
+	hook, err := s.Create(ctx, rec.URL, "", []string{EventUserRegistered}, adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue(ctx, EventUserRegistered, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err := s.deliverDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if requests := rec.take(); len(requests) != 1 {
+			t.Fatalf("attempt %d: endpoint got %d requests, want 1", attempt, len(requests))
+		}
+
+		d := onlyDelivery(t, s, hook.ID)
+		if d.Attempts != attempt || d.ResponseCode == nil || *d.ResponseCode != 500 || d.ResponseBody != "response 500" || d.Error == "" {
+			t.Fatalf("attempt %d: delivery = %+v", attempt, d)
+		}
+		if attempt == maxAttempts {
+			if d.Status != StatusFailed {
+				t.Errorf("after %d attempts, status = %q, want %q", attempt, d.Status, StatusFailed)
+			}
+			break
+		}
+
+		if d.Status != StatusPending {
+			t.Fatalf("attempt %d: status = %q, want %q", attempt, d.Status, StatusPending)
+		}
+		wait := d.NextAttemptAt.Sub(*d.LastAttemptAt)
+		if want := retryDelay << (attempt - 1); wait != want {
+			t.Errorf("attempt %d: next attempt in %v, want %v", attempt, wait, want)
+		}
+
+		// Nothing is sent before the retry is due
+		if err := s.deliverDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if requests := rec.take(); len(requests) != 0 {
+			t.Fatalf("attempt %d: retried %d times before it was due", attempt, len(requests))
+		}
+		makeDue(t, db)
+	}
+
+	// A delivery that was given up is not sent again
+	makeDue(t, db)
+	if err := s.deliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if requests := rec.take(); len(requests) != 0 {
+		t.Errorf("failed delivery was sent %d more times", len(requests))
+	}
+
+	// Until an admin retries it
+	rec.respond(http.StatusNoContent)
+	failed := onlyDelivery(t, s, hook.ID)
+	if err := s.Retry(ctx, hook.ID+1, failed.ID); err != ErrWebhookNotFound {
+		t.Errorf("Retry() through another webhook = %v, want %v", err, ErrWebhookNotFound)
+	}
+	if err := s.Retry(ctx, hook.ID, failed.ID); err != nil {
+		t.Fatalf("Retry() = %v", err)
+	}
+	if d := onlyDelivery(t, s, hook.ID); d.Status != StatusPending || d.Attempts != 0 {
+		t.Errorf("after Retry(), delivery = %+v", d)
+	}
+	if err := s.deliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	requests := rec.take()
+	if len(requests) != 1 || string(requests[0].body) != failed.Payload {
+		t.Fatalf("after Retry(), endpoint got %d requests", len(requests))
+	}
+	if d := onlyDelivery(t, s, hook.ID); d.Status != StatusDelivered || d.Attempts != 1 {
+		t.Errorf("retried delivery = %+v", d)
+	}
+	if err := s.Retry(ctx, hook.ID, failed.ID); err != ErrWebhookNotFound {
+		t.Errorf("Retry() of a delivered event = %v, want %v", err, ErrWebhookNotFound)
+	}
+}
+
+func TestInactiveWebhooks(t *testing.T) {
+	ctx := context.Background()
+	s, _, adminID := newTestService(t)
+	rec := newReceiver(t)
+
+	hook, err := s.Create(ctx, rec.URL, "", []string{EventPostCreated}, adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue(ctx, EventPostCreated, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetActive(ctx, hook.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paused webhooks get no new events, and queued ones wait
+	if err := s.Enqueue(ctx, EventPostCreated, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue(ctx, EventPing, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendTest(ctx, hook.ID); err != nil {
+		t.Fatalf("SendTest() = %v", err)
+	}
+	if err := s.deliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := rec.take()
+	if len(requests) != 1 || requests[0].header.Get(HeaderEvent) != EventPing {
+		t.Fatalf("paused webhook got %d requests, want only the test ping", len(requests))
+	}
+	if err := Verify(hook.Secret, requests[0].header, requests[0].body, time.Minute); err != nil {
+		t.Errorf("Verify() of the ping = %v", err)
+	}
+
+	deliveries, err := s.Deliveries(ctx, hook.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, d := range deliveries {
+		statuses[d.Event] += d.Status + " "
+	}
+	if len(deliveries) != 2 || statuses[EventPing] != "delivered " || statuses[EventPostCreated] != "pending " {
+		t.Errorf("deliveries of the paused webhook = %v", statuses)
+	}
+
+	if err := s.SendTest(ctx, hook.ID+1); err != ErrWebhookNotFound {
+		t.Errorf("SendTest() of an unknown webhook = %v, want %v", err, ErrWebhookNotFound)
+	}
+
+	// Resuming sends what was queued before the pause
+	if err := s.SetActive(ctx, hook.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if requests := rec.take(); len(requests) != 1 || requests[0].header.Get(HeaderEvent) != EventPostCreated {
+		t.Errorf("resumed webhook got %d requests, want the queued event", len(requests))
+	}
+}
@@ -0,0 +1,258 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"forum/internal/features"
+)
+
+// Payload data of each event. The JSON field names are part of the public
+// webhook format; add fields rather than renaming them.
+
+// UserData identifies a user
+type UserData struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// PostData is a post in post events
+type PostData struct {
+	ID         int64      `json:"id"`
+	Title      string     `json:"title"`
+	Content    string     `json:"content"`
+	Author     UserData   `json:"author"`
+	Categories []string   `json:"categories"`
+	URL        string     `json:"url"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+}
+
+// CommentData is a comment in comment events
+type CommentData struct {
+	ID        int64     `json:"id"`
+	PostID    int64     `json:"post_id"`
+	Content   string    `json:"content"`
+	Author    UserData  `json:"author"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionData is the payload of reaction.changed
+type ReactionData struct {
+	Target   string   `json:"target"` // "post" or "comment"
+	ID       int64    `json:"id"`     // ID of the post or comment
+	PostID   int64    `json:"post_id"`
+	User     UserData `json:"user"`
+	Reaction string   `json:"reaction"` // "like", "dislike" or "none"
+	Likes    int      `json:"likes"`
+	Dislikes int      `json:"dislikes"`
+}
+
+// PostCreated queues post.created
+func (s *Service) PostCreated(ctx context.Context, postID int64) {
+	s.postEvent(ctx, EventPostCreated, postID)
+}
+
+// PostUpdated queues post.updated
+func (s *Service) PostUpdated(ctx context.Context, postID int64) {
+	s.postEvent(ctx, EventPostUpdated, postID)
+}
+
+func (s *Service) postEvent(ctx context.Context, event string, postID int64) {
+	if s == nil {
+		return
+	}
+	post, err := s.post(ctx, postID)
+	if err == nil {
+		err = s.Enqueue(ctx, event, map[string]any{"post": post})
+	}
+	if err != nil {
+		log.Printf("Failed to queue %s webhook for post %d: %v", event, postID, err)
+	}
+}
+
+// PostDeleted queues post.deleted. The post is gone by now, so only its ID
+// and the user who deleted it are sent.
+func (s *Service) PostDeleted(ctx context.Context, postID, userID int64) {
+	if s == nil {
+		return
+	}
+	user, err := s.user(ctx, userID)
+	if err == nil {
+		err = s.Enqueue(ctx, EventPostDeleted, map[string]any{
+			"post":       map[string]int64{"id": postID},
+			"deleted_by": user,
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to queue %s webhook for post %d: %v", EventPostDeleted, postID, err)
+	}
+}
+
+// CommentCreated queues comment.created
+func (s *Service) CommentCreated(ctx context.Context, commentID int64) {
+	if s == nil {
+		return
+	}
+	err := func() error {
+		comment, err := features.GetCommentByID(ctx, s.db, commentID)
+		if err != nil {
+			return err
+		}
+		author, err := s.user(ctx, comment.AuthorID)
+		if err != nil {
+			return err
+		}
+		post, err := s.post(ctx, comment.PostID)
+		if err != nil {
+			return err
+		}
+		return s.Enqueue(ctx, EventCommentCreated, map[string]any{
+			"comment": CommentData{
+				ID:        comment.ID,
+				PostID:    comment.PostID,
+				Content:   comment.Content,
+				Author:    author,
+				URL:       post.URL + "#comment-" + strconv.FormatInt(comment.ID, 10),
+				CreatedAt: comment.CreatedAt,
+			},
+			"post": post,
+		})
+	}()
+	if err != nil {
+		log.Printf("Failed to queue %s webhook for comment %d: %v", EventCommentCreated, commentID, err)
+	}
+}
+
+// PostReactionChanged queues reaction.changed for a post
+func (s *Service) PostReactionChanged(ctx context.Context, userID, postID int64) {
+	if s == nil {
+		return
+	}
+	err := func() error {
+		user, err := s.user(ctx, userID)
+		if err != nil {
+			return err
+		}
+		counts, err := features.CountPostReactions(ctx, s.db, postID)
+		if err != nil {
+			return err
+		}
+		reaction, err := s.reaction(ctx, "SELECT reaction FROM post_likes WHERE user_id = ? AND post_id = ?", userID, postID)
+		if err != nil {
+			return err
+		}
+		return s.Enqueue(ctx, EventReactionChanged, ReactionData{
+			Target: "post", ID: postID, PostID: postID, User: user,
+			Reaction: reaction, Likes: counts.Likes, Dislikes: counts.Dislikes,
+		})
+	}()
+	if err != nil {
+		log.Printf("Failed to queue %s webhook for post %d: %v", EventReactionChanged, postID, err)
+	}
+}
+
+// CommentReactionChanged queues reaction.changed for a comment
+func (s *Service) CommentReactionChanged(ctx context.Context, userID, commentID int64) {
+	if s == nil {
+		return
+	}
+	err := func() error {
+		comment, err := features.GetCommentByID(ctx, s.db, commentID)
+		if err != nil {
+			return err
+		}
+		user, err := s.user(ctx, userID)
+		if err != nil {
+			return err
+		}
+		counts, err := features.CountCommentReactions(ctx, s.db, commentID)
+		if err != nil {
+			return err
+		}
+		reaction, err := s.reaction(ctx, "SELECT reaction FROM comment_likes WHERE user_id = ? AND comment_id = ?", userID, commentID)
+		if err != nil {
+			return err
+		}
+		return s.Enqueue(ctx, EventReactionChanged, ReactionData{
+			Target: "comment", ID: commentID, PostID: comment.PostID, User: user,
+			Reaction: reaction, Likes: counts.Likes, Dislikes: counts.Dislikes,
+		})
+	}()
+	if err != nil {
+		log.Printf("Failed to queue %s webhook for comment %d: %v", EventReactionChanged, commentID, err)
+	}
+}
+
+// UserRegistered queues user.registered. method is how the account was
+// created: "password", "bot", or the name of the OIDC provider or auth proxy.
+func (s *Service) UserRegistered(userID int64, method string) {
+	if s == nil {
+		return
+	}
+	ctx := context.Background()
+	user, err := s.user(ctx, userID)
+	if err == nil {
+		err = s.Enqueue(ctx, EventUserRegistered, map[string]any{"user": user, "method": method})
+	}
+	if err != nil {
+		log.Printf("Failed to queue %s webhook for user %d: %v", EventUserRegistered, userID, err)
+	}
+}
+
+func (s *Service) post(ctx context.Context, postID int64) (*PostData, error) {
+	post, err := features.GetPostByID(ctx, s.db, postID)
+	if err != nil {
+		return nil, err
+	}
+	author, err := s.user(ctx, post.AuthorID)
+	if err != nil {
+		return nil, err
+	}
+	data := &PostData{
+		ID:         post.ID,
+		Title:      post.Title,
+		Content:    post.Content,
+		Author:     author,
+		Categories: post.Categories,
+		URL:        s.baseURL + "/post/" + strconv.FormatInt(post.ID, 10),
+		CreatedAt:  post.CreatedAt,
+	}
+	if data.Categories == nil {
+		data.Categories = []string{}
+	}
+	if !post.UpdatedAt.IsZero() {
+		data.UpdatedAt = &post.UpdatedAt
+	}
+	return data, nil
+}
+
+func (s *Service) user(ctx context.Context, userID int64) (UserData, error) {
+	u := UserData{ID: userID}
+	err := s.db.QueryRowContext(ctx, "SELECT username FROM users WHERE id = ?", userID).Scan(&u.Username)
+	return u, err
+}
+
+// reaction returns a user's current reaction as it is named in payloads
+func (s *Service) reaction(ctx context.Context, query string, args ...any) (string, error) {
+	var value int
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "none", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch value {
+	case 1:
+		return "like", nil
+	case -1:
+		return "dislike", nil
+	}
+	return "none", nil
+}
@@ -0,0 +1,380 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"forum/internal/features"
+)
+
+const (
+	// incomingTokenPrefix marks incoming webhook tokens so secret scanners can
+	// find leaked ones
+	incomingTokenPrefix = "forum_whin_"
+	// IncomingPath is where incoming webhooks are posted
+	IncomingPath = "/hooks/incoming"
+
+	maxIncomingNameLength = 50
+	// MaxIncomingRateLimit caps the requests per hour an incoming webhook may allow
+	MaxIncomingRateLimit = 10000
+)
+
+// Incoming webhook errors
+var (
+	ErrInvalidIncomingToken = errors.New("invalid incoming webhook token")
+	ErrIncomingPaused       = errors.New("this incoming webhook is paused")
+	ErrNameRequired         = errors.New("name cannot be empty")
+	ErrNameTooLong          = fmt.Errorf("name must be at most %d characters", maxIncomingNameLength)
+	ErrInvalidRateLimit     = fmt.Errorf("rate limit must be between 1 and %d requests per hour", MaxIncomingRateLimit)
+	ErrUnknownCategory      = errors.New("unknown category")
+)
+
+// IncomingWebhook lets an external system create posts and comments as a bot
+// account in one category
+type IncomingWebhook struct {
+	ID           int64
+	Name         string
+	BotUserID    int64
+	BotName      string
+	CategoryID   int64
+	CategoryName string
+	RateLimit    int // Requests per hour
+	Active       bool
+	CreatedAt    time.Time
+	LastUsedAt   time.Time // Zero if never used
+	// PreviousExpiresAt is when the token replaced by the last rotation stops
+	// working; zero if there is none
+	PreviousExpiresAt time.Time
+	Posts             int // Posts created for a message key, filled in by ListIncoming
+}
+
+// IncomingService manages incoming webhooks and turns their messages into
+// posts and comments
+type IncomingService struct {
+	db      *sql.DB
+	baseURL string
+
+	mu   sync.Mutex
+	hits map[int64][]time.Time // Recent requests of each hook, oldest first
+}
+
+// NewIncomingService creates the incoming webhook service
+func NewIncomingService(db *sql.DB) *IncomingService {
+	return &IncomingService{
+		db:      db,
+		baseURL: "http://localhost:8080",
+		hits:    map[int64][]time.Time{},
+	}
+}
+
+// SetBaseURL sets the public URL of the forum used in hook URLs
+func (s *IncomingService) SetBaseURL(baseURL string) {
+	s.baseURL = strings.TrimRight(baseURL, "/")
+}
+
+// URL returns the address an external system posts to with the given token
+func (s *IncomingService) URL(token string) string {
+	return s.baseURL + IncomingPath + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// CreateIncoming registers an incoming webhook and returns it with its token.
+// Only a hash of the token is stored, so it cannot be shown again.
+func (s *IncomingService) CreateIncoming(ctx context.Context, name string, botUserID, categoryID int64, rateLimit int, createdBy int64) (*IncomingWebhook, string, error) {
+	name = strings.TrimSpace(name)
+	if err := s.validateIncoming(ctx, name, categoryID, rateLimit); err != nil {
+		return nil, "", err
+	}
+	token, err := newIncomingToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO incoming_webhooks (name, token_hash, bot_user_id, category_id, rate_limit, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		name, hashIncomingToken(token), botUserID, categoryID, rateLimit, createdBy, time.Now().UTC())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create incoming webhook: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create incoming webhook: %w", err)
+	}
+	hook, err := s.GetIncoming(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	return hook, token, nil
+}
+
+// UpdateIncoming changes an incoming webhook's name, category and rate limit
+func (s *IncomingService) UpdateIncoming(ctx context.Context, id int64, name string, categoryID int64, rateLimit int) error {
+	name = strings.TrimSpace(name)
+	if err := s.validateIncoming(ctx, name, categoryID, rateLimit); err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, "UPDATE incoming_webhooks SET name = ?, category_id = ?, rate_limit = ? WHERE id = ?",
+		name, categoryID, rateLimit, id)
+	if err != nil {
+		return fmt.Errorf("failed to update incoming webhook: %w", err)
+	}
+	return mustAffect(result)
+}
+
+// RotateIncoming gives an incoming webhook a new token and returns it. The old
+// token keeps working for grace, so senders can switch over without losing
+// messages; a zero grace revokes it at once.
+func (s *IncomingService) RotateIncoming(ctx context.Context, id int64, grace time.Duration) (string, error) {
+	token, err := newIncomingToken()
+	if err != nil {
+		return "", err
+	}
+
+	var previousExpiresAt sql.NullTime
+	if grace > 0 {
+		previousExpiresAt = sql.NullTime{Time: time.Now().UTC().Add(grace), Valid: true}
+	}
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE incoming_webhooks
+		SET previous_token_hash = CASE WHEN ? THEN token_hash END, previous_expires_at = ?, token_hash = ?
+		WHERE id = ?`,
+		grace > 0, previousExpiresAt, hashIncomingToken(token), id)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate token: %w", err)
+	}
+	if err := mustAffect(result); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SetIncomingActive pauses or resumes an incoming webhook
+func (s *IncomingService) SetIncomingActive(ctx context.Context, id int64, active bool) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE incoming_webhooks SET active = ? WHERE id = ?", active, id)
+	if err != nil {
+		return fmt.Errorf("failed to update incoming webhook: %w", err)
+	}
+	return mustAffect(result)
+}
+
+// DeleteIncoming removes an incoming webhook. The posts it created stay.
+func (s *IncomingService) DeleteIncoming(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM incoming_webhooks WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete incoming webhook: %w", err)
+	}
+	if err := mustAffect(result); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.hits, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// incomingColumns are the columns scanned by scanIncoming
+const incomingColumns = `
+	h.id, h.name, h.bot_user_id, u.username, h.category_id, c.name, h.rate_limit, h.active,
+	h.created_at, h.last_used_at, h.previous_expires_at,
+	(SELECT COUNT(*) FROM incoming_webhook_posts p WHERE p.webhook_id = h.id)
+	FROM incoming_webhooks h
+	JOIN users u ON u.id = h.bot_user_id
+	JOIN categories c ON c.id = h.category_id`
+
+// GetIncoming returns an incoming webhook
+func (s *IncomingService) GetIncoming(ctx context.Context, id int64) (*IncomingWebhook, error) {
+	hook, err := scanIncoming(s.db.QueryRowContext(ctx, "SELECT"+incomingColumns+" WHERE h.id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	return hook, err
+}
+
+// ListIncoming returns all incoming webhooks
+func (s *IncomingService) ListIncoming(ctx context.Context) ([]IncomingWebhook, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT"+incomingColumns+" ORDER BY h.created_at, h.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []IncomingWebhook
+	for rows.Next() {
+		hook, err := scanIncoming(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+	return hooks, rows.Err()
+}
+
+// Authenticate returns the incoming webhook a token belongs to
+func (s *IncomingService) Authenticate(ctx context.Context, token string) (*IncomingWebhook, error) {
+	if !strings.HasPrefix(token, incomingTokenPrefix) {
+		return nil, ErrInvalidIncomingToken
+	}
+	hash := hashIncomingToken(token)
+	hook, err := scanIncoming(s.db.QueryRowContext(ctx, "SELECT"+incomingColumns+`
+		WHERE h.token_hash = ? OR (h.previous_token_hash = ? AND h.previous_expires_at > ?)`,
+		hash, hash, time.Now().UTC()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidIncomingToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hook.Active {
+		return nil, ErrIncomingPaused
+	}
+	return hook, nil
+}
+
+// Allow records a request to a hook and reports whether it is within the
+// hook's hourly rate limit. If it is not, it also returns how long until the
+// next request will be allowed. Counts are kept in memory, so a restart
+// resets them.
+func (s *IncomingService) Allow(hook *IncomingWebhook) (bool, time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hits := s.hits[hook.ID]
+	for len(hits) > 0 && now.Sub(hits[0]) >= time.Hour {
+		hits = hits[1:]
+	}
+	if len(hits) >= hook.RateLimit {
+		s.hits[hook.ID] = hits
+		return false, time.Hour - now.Sub(hits[0])
+	}
+	s.hits[hook.ID] = append(hits, now)
+	return true, 0
+}
+
+// IncomingResult is what a message posted to an incoming webhook created
+type IncomingResult struct {
+	PostID    int64
+	CommentID int64 // Zero if the message created a post
+	URL       string
+}
+
+// Publish creates a post from a message in the hook's category, or a comment
+// if a post was already created for the message's key
+func (s *IncomingService) Publish(ctx context.Context, hook *IncomingWebhook, msg IncomingMessage) (*IncomingResult, error) {
+	if msg.Content == "" {
+		return nil, fmt.Errorf("%w: the message has no text", ErrInvalidMessage)
+	}
+
+	if msg.Key != "" {
+		var postID int64
+		err := s.db.QueryRowContext(ctx, "SELECT post_id FROM incoming_webhook_posts WHERE webhook_id = ? AND external_key = ?",
+			hook.ID, msg.Key).Scan(&postID)
+		if err == nil {
+			commentID, err := features.CreateComment(ctx, s.db, postID, hook.BotUserID, msg.Content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create comment: %w", err)
+			}
+			s.used(ctx, hook.ID)
+			return &IncomingResult{
+				PostID:    postID,
+				CommentID: commentID,
+				URL:       s.postURL(postID) + "#comment-" + strconv.FormatInt(commentID, 10),
+			}, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if msg.Title == "" {
+		return nil, fmt.Errorf("%w: a new post needs a title", ErrInvalidMessage)
+	}
+	postID, err := features.CreatePost(ctx, s.db, hook.BotUserID, msg.Title, msg.Content, []string{hook.CategoryName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create post: %w", err)
+	}
+	if msg.Key != "" {
+		if _, err := s.db.ExecContext(ctx, `
+			INSERT OR IGNORE INTO incoming_webhook_posts (webhook_id, external_key, post_id, created_at) VALUES (?, ?, ?, ?)`,
+			hook.ID, msg.Key, postID, time.Now().UTC()); err != nil {
+			return nil, fmt.Errorf("failed to record post key: %w", err)
+		}
+	}
+	s.used(ctx, hook.ID)
+	return &IncomingResult{PostID: postID, URL: s.postURL(postID)}, nil
+}
+
+// used records when a hook was last used. Failures only affect the admin page.
+func (s *IncomingService) used(ctx context.Context, id int64) {
+	s.db.ExecContext(ctx, "UPDATE incoming_webhooks SET last_used_at = ? WHERE id = ?", time.Now().UTC(), id)
+}
+
+func (s *IncomingService) postURL(postID int64) string {
+	return s.baseURL + "/post/" + strconv.FormatInt(postID, 10)
+}
+
+func (s *IncomingService) validateIncoming(ctx context.Context, name string, categoryID int64, rateLimit int) error {
+	if name == "" {
+		return ErrNameRequired
+	}
+	if utf8.RuneCountInString(name) > maxIncomingNameLength {
+		return ErrNameTooLong
+	}
+	if rateLimit < 1 || rateLimit > MaxIncomingRateLimit {
+		return ErrInvalidRateLimit
+	}
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE id = ?)", categoryID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownCategory
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanIncoming(row rowScanner) (*IncomingWebhook, error) {
+	var hook IncomingWebhook
+	var lastUsedAt, previousExpiresAt sql.NullTime
+	err := row.Scan(&hook.ID, &hook.Name, &hook.BotUserID, &hook.BotName, &hook.CategoryID, &hook.CategoryName,
+		&hook.RateLimit, &hook.Active, &hook.CreatedAt, &lastUsedAt, &previousExpiresAt, &hook.Posts)
+	if err != nil {
+		return nil, err
+	}
+	if lastUsedAt.Valid {
+		hook.LastUsedAt = lastUsedAt.Time
+	}
+	if previousExpiresAt.Valid && previousExpiresAt.Time.After(time.Now()) {
+		hook.PreviousExpiresAt = previousExpiresAt.Time
+	}
+	return &hook, nil
+}
+
+func newIncomingToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return incomingTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashIncomingToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
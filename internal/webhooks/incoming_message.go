@@ -0,0 +1,174 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxTitleLength matches the title field of the create post form
+const maxTitleLength = 200
+
+// ErrInvalidMessage is returned for messages that cannot become a post or comment
+var ErrInvalidMessage = errors.New("invalid message")
+
+// IncomingMessage is a message posted to an incoming webhook
+type IncomingMessage struct {
+	Title   string
+	Content string
+	// Key identifies the post in the sender's system. The first message with
+	// a key creates a post; later ones with the same key comment on it.
+	Key string
+}
+
+// incomingPayload accepts the forum's own format and the subset of the Slack
+// incoming webhook format that makes sense for posts
+type incomingPayload struct {
+	// Forum format
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	Key     string `json:"key"`
+
+	// Slack format
+	Text        string            `json:"text"`
+	ThreadTS    string            `json:"thread_ts"`
+	Blocks      []slackBlock      `json:"blocks"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackText struct {
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text"`
+	Fields []slackText `json:"fields"`
+}
+
+type slackAttachment struct {
+	Title    string `json:"title"`
+	Pretext  string `json:"pretext"`
+	Text     string `json:"text"`
+	Fallback string `json:"fallback"`
+}
+
+// ParseIncomingMessage reads a message from a request body. JSON bodies may use
+// the forum format ({"title", "content", "key"}) or the Slack format
+// ({"text", "blocks", "attachments", "thread_ts"}); form bodies carry the JSON
+// in a "payload" field, as older Slack clients send it.
+func ParseIncomingMessage(contentType string, body []byte) (IncomingMessage, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil || form.Get("payload") == "" {
+			return IncomingMessage{}, fmt.Errorf("%w: form bodies need a payload field", ErrInvalidMessage)
+		}
+		body = []byte(form.Get("payload"))
+	}
+
+	var p incomingPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return IncomingMessage{}, fmt.Errorf("%w: the body is not a JSON object", ErrInvalidMessage)
+	}
+
+	msg := IncomingMessage{
+		Title:   strings.TrimSpace(p.Title),
+		Content: strings.TrimSpace(p.Content),
+		Key:     strings.TrimSpace(p.Key),
+	}
+	if msg.Key == "" {
+		msg.Key = strings.TrimSpace(p.ThreadTS)
+	}
+	if msg.Content == "" {
+		msg.Title, msg.Content = p.slackMessage(msg.Title)
+	}
+	if utf8.RuneCountInString(msg.Title) > maxTitleLength {
+		msg.Title = string([]rune(msg.Title)[:maxTitleLength-1]) + "…"
+	}
+	return msg, nil
+}
+
+// slackMessage builds a title and content from the Slack fields. Without an
+// explicit title, a header block, the first attachment title or the first
+// line of the text is used.
+func (p incomingPayload) slackMessage(title string) (string, string) {
+	var parts []string
+	add := func(text string) {
+		if text = strings.TrimSpace(slackToPlain(text)); text != "" {
+			parts = append(parts, text)
+		}
+	}
+
+	add(p.Text)
+	for _, block := range p.Blocks {
+		switch {
+		case block.Type == "header" && block.Text != nil:
+			if title == "" {
+				title = slackToPlain(block.Text.Text)
+			} else {
+				add(block.Text.Text)
+			}
+		case block.Type == "section":
+			if block.Text != nil {
+				add(block.Text.Text)
+			}
+			for _, field := range block.Fields {
+				add(field.Text)
+			}
+		}
+	}
+	for _, a := range p.Attachments {
+		if title == "" && a.Title != "" {
+			title = slackToPlain(a.Title)
+		} else {
+			add(a.Title)
+		}
+		add(a.Pretext)
+		if a.Text != "" {
+			add(a.Text)
+		} else {
+			add(a.Fallback)
+		}
+	}
+
+	content := strings.Join(parts, "\n\n")
+	if title == "" && content != "" {
+		// A one-line message is both the title and the post
+		first, rest, _ := strings.Cut(content, "\n")
+		title = strings.Trim(strings.TrimSpace(first), "*_~")
+		if rest = strings.TrimSpace(rest); rest != "" {
+			content = rest
+		}
+	}
+	return strings.TrimSpace(title), content
+}
+
+// slackLink matches Slack's <url|label> and <url> link markup
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]+))?>`)
+
+// slackToPlain turns Slack links into plain text and undoes Slack's escaping
+func slackToPlain(text string) string {
+	text = slackLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := slackLink.FindStringSubmatch(m)
+		target, label := parts[1], parts[2]
+		if strings.HasPrefix(target, "@") || strings.HasPrefix(target, "#") || strings.HasPrefix(target, "!") {
+			// User, channel and special mentions mean nothing here
+			if label != "" {
+				return label
+			}
+			return ""
+		}
+		target = strings.TrimPrefix(target, "mailto:")
+		if label == "" || label == target {
+			return target
+		}
+		return label + " (" + target + ")"
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+}
@@ -0,0 +1,172 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newIncomingTest returns an IncomingService with one incoming webhook posting
+// to General as a bot, and the hook's token
+func newIncomingTest(t *testing.T, rateLimit int) (*IncomingService, *sql.DB, *IncomingWebhook, string) {
+	t.Helper()
+	_, db, adminID := newTestService(t)
+
+	var botID, categoryID int64
+	err := db.QueryRow(
+		"INSERT INTO users (username, email, password_hash) VALUES ('ci-bot', 'ci-bot@bots.invalid', '*') RETURNING id",
+	).Scan(&botID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT id FROM categories WHERE name = 'General'").Scan(&categoryID); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewIncomingService(db)
+	hook, token, err := s.CreateIncoming(context.Background(), "CI", botID, categoryID, rateLimit, adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, db, hook, token
+}
+
+func TestIncomingTokenRotation(t *testing.T) {
+	ctx := context.Background()
+	s, db, hook, oldToken := newIncomingTest(t, 100)
+
+	if got, err := s.Authenticate(ctx, oldToken); err != nil || got.ID != hook.ID {
+		t.Fatalf("Authenticate() = %v, %v", got, err)
+	}
+	for _, token := range []string{"", "forum_whin_not-a-token", oldToken[len(incomingTokenPrefix):]} {
+		if _, err := s.Authenticate(ctx, token); err != ErrInvalidIncomingToken {
+			t.Errorf("Authenticate(%q) = %v, want %v", token, err, ErrInvalidIncomingToken)
+		}
+	}
+
+	// Both tokens work during the grace period
+	newToken, err := s.RotateIncoming(ctx, hook.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if got, err := s.Authenticate(ctx, token); err != nil || got.ID != hook.ID {
+			t.Errorf("Authenticate() during the grace period = %v, %v", got, err)
+		}
+	}
+	if got, err := s.GetIncoming(ctx, hook.ID); err != nil || got.PreviousExpiresAt.IsZero() {
+		t.Errorf("GetIncoming() = %+v, %v, want the old token's expiry", got, err)
+	}
+
+	// Only the new one afterwards
+	if _, err := db.Exec("UPDATE incoming_webhooks SET previous_expires_at = ?", time.Now().UTC().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, oldToken); err != ErrInvalidIncomingToken {
+		t.Errorf("Authenticate(old token) after the grace period = %v, want %v", err, ErrInvalidIncomingToken)
+	}
+	if _, err := s.Authenticate(ctx, newToken); err != nil {
+		t.Errorf("Authenticate(new token) = %v", err)
+	}
+
+	// Without a grace period the old token stops working at once
+	newestToken, err := s.RotateIncoming(ctx, hook.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, newToken); err != ErrInvalidIncomingToken {
+		t.Errorf("Authenticate(revoked token) = %v, want %v", err, ErrInvalidIncomingToken)
+	}
+
+	if err := s.SetIncomingActive(ctx, hook.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, newestToken); err != ErrIncomingPaused {
+		t.Errorf("Authenticate() of a paused hook = %v, want %v", err, ErrIncomingPaused)
+	}
+}
+
+func TestIncomingRateLimit(t *testing.T) {
+	s, _, hook, _ := newIncomingTest(t, 2)
+
+	for i := 0; i < hook.RateLimit; i++ {
+		if ok, _ := s.Allow(hook); !ok {
+			t.Fatalf("request %d was refused", i+1)
+		}
+	}
+	ok, wait := s.Allow(hook)
+	if ok || wait <= 0 || wait > time.Hour {
+		t.Errorf("Allow() over the limit = %v, %v, want a refusal with a wait of up to an hour", ok, wait)
+	}
+
+	// Requests count for an hour
+	s.mu.Lock()
+	s.hits[hook.ID][0] = time.Now().Add(-time.Hour)
+	s.mu.Unlock()
+	if ok, _ := s.Allow(hook); !ok {
+		t.Error("Allow() refused a request after the oldest one was an hour old")
+	}
+	if ok, _ := s.Allow(hook); ok {
+		t.Error("Allow() went over the limit")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	s, db, hook, _ := newIncomingTest(t, 100)
+
+	first, err := s.Publish(ctx, hook, IncomingMessage{Title: "Build #1 failed", Content: "Details", Key: "build-1"})
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if first.PostID == 0 || first.CommentID != 0 {
+		t.Fatalf("first message = %+v, want a post", *first)
+	}
+
+	// The same key comments on that post; no title is needed
+	second, err := s.Publish(ctx, hook, IncomingMessage{Content: "Fixed", Key: "build-1"})
+	if err != nil {
+		t.Fatalf("Publish() with the same key = %v", err)
+	}
+	if second.PostID != first.PostID || second.CommentID == 0 {
+		t.Fatalf("second message = %+v, want a comment on post %d", *second, first.PostID)
+	}
+	var commentPost, commentAuthor int64
+	var content string
+	err = db.QueryRow("SELECT post_id, author_id, content FROM comments WHERE id = ?", second.CommentID).Scan(&commentPost, &commentAuthor, &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commentPost != first.PostID || commentAuthor != hook.BotUserID || content != "Fixed" {
+		t.Errorf("comment = post %d, author %d, %q", commentPost, commentAuthor, content)
+	}
+
+	// Other keys and messages without one start new posts
+	other, err := s.Publish(ctx, hook, IncomingMessage{Title: "Build #2 failed", Content: "Details", Key: "build-2"})
+	if err != nil || other.CommentID != 0 || other.PostID == first.PostID {
+		t.Errorf("message with another key = %+v, %v, want a new post", other, err)
+	}
+	unkeyed, err := s.Publish(ctx, hook, IncomingMessage{Title: "Deploy done", Content: "All good"})
+	if err != nil || unkeyed.CommentID != 0 || unkeyed.PostID == first.PostID || unkeyed.PostID == other.PostID {
+		t.Errorf("message without a key = %+v, %v, want a new post", unkeyed, err)
+	}
+
+	var posts int
+	var category string
+	db.QueryRow("SELECT COUNT(*) FROM posts WHERE author_id = ?", hook.BotUserID).Scan(&posts)
+	db.QueryRow(`SELECT c.name FROM post_categories pc JOIN categories c ON c.id = pc.category_id WHERE pc.post_id = ?`, first.PostID).Scan(&category)
+	if posts != 3 || category != hook.CategoryName {
+		t.Errorf("bot has %d posts, first in %q; want 3, in %q", posts, category, hook.CategoryName)
+	}
+
+	for _, msg := range []IncomingMessage{
+		{Title: "No content", Key: "build-1"},
+		{Content: "A new key needs a title", Key: "build-3"},
+	} {
+		if _, err := s.Publish(ctx, hook, msg); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("Publish(%+v) = %v, want %v", msg, err, ErrInvalidMessage)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Package webhooks sends forum events to endpoints registered by admins.
+// Every event is stored in a delivery queue first and posted as signed JSON
+// by a background worker, which retries failed deliveries with exponential
+// backoff and keeps a log of the responses. Incoming webhooks work the other
+// way round: they turn messages from other services into posts by a bot user.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types
+const (
+	EventPostCreated     = "post.created"
+	EventPostUpdated     = "post.updated"
+	EventPostDeleted     = "post.deleted"
+	EventCommentCreated  = "comment.created"
+	EventReactionChanged = "reaction.changed"
+	EventUserRegistered  = "user.registered"
+	// EventPing is sent by the "send test event" button. Every webhook gets it.
+	EventPing = "ping"
+)
+
+// EventType describes an event webhooks can subscribe to
+type EventType struct {
+	Name        string
+	Description string
+}
+
+// Events lists the events webhooks can subscribe to
+var Events = []EventType{
+	{EventPostCreated, "A post was created"},
+	{EventPostUpdated, "A post was edited"},
+	{EventPostDeleted, "A post was deleted"},
+	{EventCommentCreated, "A comment was added"},
+	{EventReactionChanged, "A post or comment was liked, disliked or unliked"},
+	{EventUserRegistered, "A new account was created"},
+}
+
+// Signature headers sent with every delivery
+const (
+	HeaderEvent     = "X-Forum-Event"
+	HeaderDelivery  = "X-Forum-Delivery"
+	HeaderTimestamp = "X-Forum-Timestamp"
+	HeaderSignature = "X-Forum-Signature"
+)
+
+// Errors
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrInvalidURL       = errors.New("webhook URL must be an http or https URL")
+	ErrUnknownEvent     = errors.New("unknown event")
+	ErrNoEvents         = errors.New("choose at least one event")
+)
+
+// Webhook is an endpoint that receives events
+type Webhook struct {
+	ID          int64
+	URL         string
+	Description string
+	Secret      string
+	Events      []string
+	Active      bool
+	CreatedAt   time.Time
+	// Delivery counts, filled in by List
+	Pending   int
+	Delivered int
+	Failed    int
+}
+
+// Subscribes reports whether the webhook wants an event
+func (w *Webhook) Subscribes(event string) bool {
+	if event == EventPing {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Service manages webhooks and delivers their events. All event methods are
+// no-ops on a nil *Service, so webhooks can be turned off by passing nil.
+type Service struct {
+	db      *sql.DB
+	client  *http.Client
+	baseURL string
+	wake    chan struct{}
+}
+
+// NewService creates the webhook service
+func NewService(db *sql.DB) *Service {
+	return &Service{
+		db:      db,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		baseURL: "http://localhost:8080",
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// SetBaseURL sets the public URL of the forum used in payload links
+func (s *Service) SetBaseURL(baseURL string) {
+	s.baseURL = strings.TrimRight(baseURL, "/")
+}
+
+// SetHTTPClient replaces the client used for deliveries
+func (s *Service) SetHTTPClient(client *http.Client) {
+	s.client = client
+}
+
+// IsValidationError reports whether err is about the webhook settings given
+// rather than a failure of the service
+func IsValidationError(err error) bool {
+	for _, target := range []error{
+		ErrInvalidURL, ErrUnknownEvent, ErrNoEvents,
+		ErrNameRequired, ErrNameTooLong, ErrInvalidRateLimit, ErrUnknownCategory,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create registers a webhook and returns it with its new signing secret
+func (s *Service) Create(ctx context.Context, rawURL, description string, events []string, createdBy int64) (*Webhook, error) {
+	if err := validateURL(rawURL); err != nil {
+		return nil, err
+	}
+	events, err := validateEvents(events)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhooks (url, description, secret, events, created_by) VALUES (?, ?, ?, ?, ?)`,
+		rawURL, strings.TrimSpace(description), "whsec_"+hex.EncodeToString(secret), strings.Join(events, ","), createdBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	return s.Get(ctx, id)
+}
+
+// Update changes a webhook's URL, description and events
+func (s *Service) Update(ctx context.Context, id int64, rawURL, description string, events []string) error {
+	if err := validateURL(rawURL); err != nil {
+		return err
+	}
+	events, err := validateEvents(events)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, "UPDATE webhooks SET url = ?, description = ?, events = ? WHERE id = ?",
+		rawURL, strings.TrimSpace(description), strings.Join(events, ","), id)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	return mustAffect(result)
+}
+
+// SetActive pauses or resumes a webhook. Paused webhooks get no new events;
+// events already queued wait until it is resumed.
+func (s *Service) SetActive(ctx context.Context, id int64, active bool) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE webhooks SET active = ? WHERE id = ?", active, id)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	if err := mustAffect(result); err != nil {
+		return err
+	}
+	if active {
+		s.notify()
+	}
+	return nil
+}
+
+// Delete removes a webhook and its delivery log
+func (s *Service) Delete(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return mustAffect(result)
+}
+
+// Get returns a webhook
+func (s *Service) Get(ctx context.Context, id int64) (*Webhook, error) {
+	var w Webhook
+	var events string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, url, description, secret, events, active, created_at FROM webhooks WHERE id = ?`, id).
+		Scan(&w.ID, &w.URL, &w.Description, &w.Secret, &events, &w.Active, &w.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.Events = splitEvents(events)
+	return &w, nil
+}
+
+// List returns all webhooks with their delivery counts
+func (s *Service) List(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT w.id, w.url, w.description, w.secret, w.events, w.active, w.created_at,
+			COUNT(CASE WHEN d.status = 'pending' THEN 1 END),
+			COUNT(CASE WHEN d.status = 'delivered' THEN 1 END),
+			COUNT(CASE WHEN d.status = 'failed' THEN 1 END)
+		FROM webhooks w
+		LEFT JOIN webhook_deliveries d ON d.webhook_id = w.id
+		GROUP BY w.id
+		ORDER BY w.created_at, w.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Webhook
+	for rows.Next() {
+		var w Webhook
+		var events string
+		if err := rows.Scan(&w.ID, &w.URL, &w.Description, &w.Secret, &events, &w.Active, &w.CreatedAt,
+			&w.Pending, &w.Delivered, &w.Failed); err != nil {
+			return nil, err
+		}
+		w.Events = splitEvents(events)
+		list = append(list, w)
+	}
+	return list, rows.Err()
+}
+
+// Sign returns the signature of a payload: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret, prefixed with "sha256="
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of a delivery, for receivers written in
+// Go. Deliveries older than maxAge are rejected to stop replays.
+func Verify(secret string, header http.Header, body []byte, maxAge time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(header.Get(HeaderSignature)), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// validateEvents checks the event names and returns them in the order of Events
+func validateEvents(events []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, e := range events {
+		wanted[e] = true
+	}
+	var valid []string
+	for _, e := range Events {
+		if wanted[e.Name] {
+			valid = append(valid, e.Name)
+			delete(wanted, e.Name)
+		}
+	}
+	for e := range wanted {
+		return nil, fmt.Errorf("%w %q", ErrUnknownEvent, e)
+	}
+	if len(valid) == 0 {
+		return nil, ErrNoEvents
+	}
+	return valid, nil
+}
+
+func splitEvents(events string) []string {
+	if events == "" {
+		return nil
+	}
+	return strings.Split(events, ",")
+}
+
+func mustAffect(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
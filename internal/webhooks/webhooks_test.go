@@ -0,0 +1,48 @@
+package webhooks
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"forum/internal/database"
+)
+
+// newTestService returns a Service on a fresh database with one admin, and
+// that admin's ID
+func newTestService(t *testing.T) (*Service, *sql.DB, int64) {
+	t.Helper()
+
+	// InitializeDatabase reads the migrations relative to the repository root
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("..", "..")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := database.NewDB(&database.Config{
+		DSN:          filepath.Join(t.TempDir(), "forum.db"),
+		MaxOpenConns: 1,
+		MaxIdleConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	var adminID int64
+	err = db.QueryRow(
+		"INSERT INTO users (username, email, password_hash, role) VALUES ('admin', 'admin@example.com', '!', 'admin') RETURNING id",
+	).Scan(&adminID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(db.DB), db.DB, adminID
+}
@@ -0,0 +1,225 @@
+// Live updates and in-place reactions.
+// Like and dislike forms are sent in the background and update their buttons.
+// Pages with a data-live element subscribe to its Server-Sent Events stream
+// and apply new comments, edits, deletions and counts as they happen. The
+// browser reconnects by itself and resumes from the last event it saw.
+(function () {
+    'use strict';
+
+    // Reactions
+
+    function setCounts(root, counts) {
+        ['likes', 'dislikes', 'comments'].forEach(function (name) {
+            if (counts[name] === undefined) {
+                return;
+            }
+            root.querySelectorAll('[data-count="' + name + '"]').forEach(function (el) {
+                // Post counts must not touch the counts of its comments
+                if (el.closest('.comment') === root.closest('.comment')) {
+                    el.textContent = counts[name];
+                }
+            });
+        });
+    }
+
+    document.addEventListener('submit', function (event) {
+        var form = event.target;
+        if (!form.classList.contains('like-form') || form.dataset.plain || !window.fetch) {
+            return;
+        }
+        event.preventDefault();
+
+        var submitter = event.submitter;
+        var body = new FormData(form);
+        if (submitter && submitter.name) {
+            body.append(submitter.name, submitter.value);
+        }
+
+        fetch(form.action, {
+            method: 'POST',
+            body: body,
+            credentials: 'same-origin',
+            headers: { 'Accept': 'application/json' }
+        }).then(function (response) {
+            if (!response.ok || response.headers.get('Content-Type').indexOf('application/json') !== 0) {
+                throw new Error('reaction failed');
+            }
+            return response.json();
+        }).then(function (state) {
+            setCounts(form, state);
+            form.querySelector('.like-btn').classList.toggle('liked', state.reaction === 'like');
+            form.querySelector('.dislike-btn').classList.toggle('disliked', state.reaction === 'dislike');
+        }).catch(function () {
+            // Fall back to a normal submission, which shows what went wrong
+            form.dataset.plain = '1';
+            if (form.requestSubmit) {
+                form.requestSubmit(submitter);
+            } else {
+                form.submit();
+            }
+        });
+    });
+
+    // Live stream
+
+    var root = document.querySelector('[data-live]');
+    if (!root || !window.EventSource) {
+        return;
+    }
+    var notice = document.querySelector('.live-notice');
+    var userID = root.dataset.userId;
+    var newPosts = 0;
+
+    function showNotice(text) {
+        if (!notice) {
+            return;
+        }
+        notice.textContent = text + ' ';
+        var link = document.createElement('a');
+        link.href = window.location.href.split('#')[0];
+        link.textContent = 'Reload';
+        notice.appendChild(link);
+        notice.hidden = false;
+    }
+
+    function posts(id) {
+        return document.querySelectorAll('[data-post="' + id + '"]');
+    }
+
+    function setField(container, name, value) {
+        var el = container.querySelector('[data-field="' + name + '"]');
+        if (el) {
+            el.textContent = value;
+        }
+    }
+
+    // setContent shows rendered Markdown. The server sanitizes it, so unlike
+    // the other fields it is inserted as markup.
+    function setContent(container, html) {
+        var el = container.querySelector('[data-field="content"]');
+        if (el) {
+            el.innerHTML = html;
+        }
+    }
+
+    function setCategories(container, categories) {
+        var el = container.querySelector('[data-field="categories"]');
+        if (!el) {
+            return;
+        }
+        el.textContent = '';
+        (categories || []).forEach(function (name) {
+            var tag = document.createElement('span');
+            tag.className = 'category-tag';
+            tag.textContent = name;
+            el.appendChild(tag);
+        });
+    }
+
+    function addComment(comment) {
+        var list = document.querySelector('.comments-list');
+        var template = document.getElementById('comment-template');
+        if (!list || !template || document.getElementById('comment-' + comment.id)) {
+            return;
+        }
+
+        var el = template.content.firstElementChild.cloneNode(true);
+        el.id = 'comment-' + comment.id;
+        var author = el.querySelector('.comment-author');
+        author.querySelector('span').textContent = comment.author;
+        author.querySelector('.avatar').src = comment.avatar_url;
+        author.href = '/user/' + encodeURIComponent(comment.author);
+        setContent(el, comment.content_html);
+        el.querySelectorAll('input[name="comment_id"]').forEach(function (input) {
+            input.value = comment.id;
+        });
+        el.querySelectorAll('input[name="anchor"]').forEach(function (input) {
+            input.value = 'comment-' + comment.id;
+        });
+        if (String(comment.author_id) !== userID) {
+            el.querySelectorAll('[data-own-only]').forEach(function (own) {
+                own.remove();
+            });
+        }
+
+        var empty = list.querySelector('.no-comments');
+        if (empty) {
+            empty.remove();
+        }
+        list.appendChild(el);
+    }
+
+    var source = new EventSource(root.dataset.live);
+
+    function on(type, handle) {
+        source.addEventListener(type, function (event) {
+            handle(JSON.parse(event.data));
+        });
+    }
+
+    on('reset', function () {
+        showNotice('You missed some updates while offline.');
+    });
+
+    on('post.created', function () {
+        newPosts++;
+        showNotice(newPosts === 1 ? 'There is a new post.' : 'There are ' + newPosts + ' new posts.');
+    });
+
+    on('post.updated', function (post) {
+        posts(post.id).forEach(function (el) {
+            setField(el, 'title', post.title);
+            setContent(el, post.content_html);
+            setCategories(el, post.categories);
+        });
+        if (document.querySelector('.post-detail[data-post="' + post.id + '"]')) {
+            document.title = post.title + ' - Forum';
+        }
+    });
+
+    on('post.deleted', function (post) {
+        var detail = document.querySelector('.post-detail[data-post="' + post.id + '"]');
+        if (detail) {
+            source.close();
+            showNotice('This post has been deleted.');
+            document.querySelectorAll('.post-detail-container form').forEach(function (form) {
+                form.querySelectorAll('button, textarea').forEach(function (control) {
+                    control.disabled = true;
+                });
+            });
+            return;
+        }
+        posts(post.id).forEach(function (el) {
+            el.remove();
+        });
+    });
+
+    on('post.counts', function (counts) {
+        posts(counts.id).forEach(function (el) {
+            setCounts(el, counts);
+        });
+    });
+
+    on('comment.created', addComment);
+
+    on('comment.updated', function (comment) {
+        var el = document.getElementById('comment-' + comment.id);
+        if (el) {
+            setContent(el, comment.content_html);
+        }
+    });
+
+    on('comment.deleted', function (comment) {
+        var el = document.getElementById('comment-' + comment.id);
+        if (el) {
+            el.remove();
+        }
+    });
+
+    on('comment.counts', function (counts) {
+        var el = document.getElementById('comment-' + counts.id);
+        if (el) {
+            setCounts(el, counts);
+        }
+    });
+})();
@@ -0,0 +1,143 @@
+// Passkey (WebAuthn) login and registration.
+// The server sends binary fields as unpadded base64url strings; they are
+// converted to ArrayBuffers for the browser API and back for the response.
+(function () {
+    'use strict';
+
+    if (!window.PublicKeyCredential || !navigator.credentials) {
+        return;
+    }
+
+    function toBuffer(value) {
+        var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        while (base64.length % 4) {
+            base64 += '=';
+        }
+        var binary = atob(base64);
+        var bytes = new Uint8Array(binary.length);
+        for (var i = 0; i < binary.length; i++) {
+            bytes[i] = binary.charCodeAt(i);
+        }
+        return bytes.buffer;
+    }
+
+    function toBase64URL(buffer) {
+        var bytes = new Uint8Array(buffer);
+        var binary = '';
+        for (var i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
+        }
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function csrfToken(root) {
+        var field = root.querySelector('input[name="csrf_token"]') ||
+            document.querySelector('input[name="csrf_token"]');
+        return field ? field.value : '';
+    }
+
+    function postJSON(url, body, token) {
+        return fetch(url, {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': token
+            },
+            body: JSON.stringify(body || {})
+        }).then(function (response) {
+            return response.json().catch(function () {
+                return {};
+            }).then(function (data) {
+                if (!response.ok) {
+                    throw new Error(data.error || 'Something went wrong, please try again');
+                }
+                return data;
+            });
+        });
+    }
+
+    function showError(box, error) {
+        // Cancelling the browser dialog is not worth an error message
+        if (error && error.name === 'NotAllowedError') {
+            box.hidden = true;
+            return;
+        }
+        box.textContent = (error && error.message) || 'Something went wrong, please try again';
+        box.hidden = false;
+    }
+
+    // Login page: sign in with any passkey registered for this site
+    document.querySelectorAll('[data-passkey-login]').forEach(function (section) {
+        var button = section.querySelector('button');
+        var errorBox = section.querySelector('.passkey-error');
+        section.hidden = false;
+
+        button.addEventListener('click', function () {
+            var token = csrfToken(document);
+            var remember = document.querySelector('input[name="remember"]');
+            errorBox.hidden = true;
+            button.disabled = true;
+
+            postJSON('/login/passkey/begin', {}, token).then(function (options) {
+                options.challenge = toBuffer(options.challenge);
+                return navigator.credentials.get({ publicKey: options });
+            }).then(function (credential) {
+                var response = credential.response;
+                return postJSON('/login/passkey/finish', {
+                    id: toBase64URL(credential.rawId),
+                    clientDataJSON: toBase64URL(response.clientDataJSON),
+                    authenticatorData: toBase64URL(response.authenticatorData),
+                    signature: toBase64URL(response.signature),
+                    userHandle: response.userHandle ? toBase64URL(response.userHandle) : '',
+                    remember: !!(remember && remember.checked)
+                }, token);
+            }).then(function (result) {
+                window.location.href = result.redirect;
+            }).catch(function (error) {
+                showError(errorBox, error);
+                button.disabled = false;
+            });
+        });
+    });
+
+    // Settings page: add a passkey to the account
+    document.querySelectorAll('[data-passkey-register]').forEach(function (form) {
+        var button = form.querySelector('button');
+        var errorBox = form.querySelector('.passkey-error');
+        form.hidden = false;
+
+        form.addEventListener('submit', function (event) {
+            event.preventDefault();
+            var token = csrfToken(form);
+            errorBox.hidden = true;
+            button.disabled = true;
+
+            postJSON('/settings/passkeys/begin', {
+                password: form.elements.password ? form.elements.password.value : ''
+            }, token).then(function (options) {
+                options.challenge = toBuffer(options.challenge);
+                options.user.id = toBuffer(options.user.id);
+                options.excludeCredentials.forEach(function (descriptor) {
+                    descriptor.id = toBuffer(descriptor.id);
+                });
+                return navigator.credentials.create({ publicKey: options });
+            }).then(function (credential) {
+                return postJSON('/settings/passkeys/finish', {
+                    name: form.elements.name.value,
+                    clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                    attestationObject: toBase64URL(credential.response.attestationObject)
+                }, token);
+            }).then(function (result) {
+                window.location.href = result.redirect;
+            }).catch(function (error) {
+                showError(errorBox, error);
+                button.disabled = false;
+            });
+        });
+    });
+
+    document.querySelectorAll('.passkey-unsupported').forEach(function (note) {
+        note.hidden = true;
+    });
+})();
@@ -0,0 +1,62 @@
+// Markdown preview for the post form. The server renders and sanitizes the
+// text, so the preview looks exactly like the published post.
+(function () {
+    'use strict';
+
+    if (!window.fetch) {
+        return;
+    }
+
+    document.querySelectorAll('[data-preview-toggle]').forEach(function (button) {
+        var textarea = document.getElementById(button.dataset.previewToggle);
+        var preview = document.querySelector('[data-preview-for="' + button.dataset.previewToggle + '"]');
+        var form = button.form;
+        if (!textarea || !preview || !form) {
+            return;
+        }
+        button.hidden = false;
+
+        var timer = null;
+
+        function render() {
+            var body = new FormData();
+            body.append('csrf_token', form.querySelector('input[name="csrf_token"]').value);
+            body.append('content', textarea.value);
+
+            fetch('/preview', {
+                method: 'POST',
+                body: body,
+                credentials: 'same-origin',
+                headers: { 'Accept': 'application/json' }
+            }).then(function (response) {
+                return response.json().then(function (data) {
+                    if (!response.ok) {
+                        throw new Error(data.error || 'Preview failed, please try again');
+                    }
+                    return data;
+                });
+            }).then(function (data) {
+                preview.innerHTML = data.html || '<p class="preview-empty">Nothing to preview</p>';
+            }).catch(function (error) {
+                preview.textContent = error.message;
+            });
+        }
+
+        button.addEventListener('click', function () {
+            preview.hidden = !preview.hidden;
+            button.textContent = preview.hidden ? 'Preview' : 'Hide preview';
+            if (!preview.hidden) {
+                render();
+            }
+        });
+
+        // Keep an open preview up to date while typing
+        textarea.addEventListener('input', function () {
+            if (preview.hidden) {
+                return;
+            }
+            clearTimeout(timer);
+            timer = setTimeout(render, 400);
+        });
+    });
+})();